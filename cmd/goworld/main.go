@@ -27,6 +27,7 @@ func main() {
 		showMsg("no command to execute")
 		flag.Usage()
 		fmt.Fprintf(os.Stderr, "\tgoworld <build|start|stop|kill|reload|status> [server-id]\n")
+		fmt.Fprintf(os.Stderr, "\tgoworld migrate <server-id> <entity-type>\n")
 		os.Exit(1)
 	}
 
@@ -35,6 +36,10 @@ func main() {
 		if len(args) != 2 {
 			showMsgAndQuit("server id is not given")
 		}
+	} else if cmd == "migrate" {
+		if len(args) != 3 {
+			showMsgAndQuit("server id and entity type should be given")
+		}
 	}
 	detectGoWorldPath(args[1])
 
@@ -57,6 +62,8 @@ func main() {
 		reload(ServerID(args[1]))
 	} else if cmd == "kill" {
 		kill(ServerID(args[1]))
+	} else if cmd == "migrate" {
+		migrate(ServerID(args[1]), args[2])
 	} else if cmd == "status" {
 		status()
 	} else {
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+
+	"github.com/sagacao/goworld/engine/config"
+)
+
+// migrate upgrades all stored entities of the type to the current schema version using the game binary
+//
+// Schema upgraders are registered by game logic, so the game binary is executed with -upgradeschema to do the upgrade.
+func migrate(sid ServerID, typeName string) {
+	err := os.Chdir(env.GoWorldRoot)
+	checkErrorOrQuit(err, "chdir to goworld directory failed")
+
+	ss := detectServerStatus()
+	if ss.NumGamesRunning > 0 {
+		showMsgAndQuit("games are running, stop the server before migrating stored entities")
+	}
+
+	gameid := uint16(1)
+	showMsg("migrate stored entities of type %s using game %d ...", typeName, gameid)
+	gameExePath := filepath.Join(sid.Path(), sid.Name()+BinaryExtension)
+	cmd := exec.Command(gameExePath, "-gid", strconv.Itoa(int(gameid)), "-upgradeschema", typeName)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	checkErrorOrQuit(err, "migrate failed, see "+config.GetGame(gameid).LogFile+" for error")
+	showMsg("migrate stored entities of type %s finished", typeName)
+}
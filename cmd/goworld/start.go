@@ -47,6 +47,13 @@ func startDispatcher(dispid uint16) {
 	cmd := exec.Command(env.GetDispatcherBinary(), args...)
 	err := runCmdUntilTag(cmd, cfg.LogFile, consts.DISPATCHER_STARTED_TAG, time.Second*10)
 	checkErrorOrQuit(err, "start dispatcher failed, see dispatcher.log for error")
+
+	if cfg.HasStandby() {
+		showMsg("start standby dispatcher %d ...", dispid)
+		cmd := exec.Command(env.GetDispatcherBinary(), append(args, "-standby")...)
+		err := runCmdUntilTag(cmd, cfg.StandbyLogFile(), consts.DISPATCHER_STARTED_TAG, time.Second*10)
+		checkErrorOrQuit(err, "start standby dispatcher failed, see standby dispatcher log for error")
+	}
 }
 
 func startGames(sid ServerID, isRestore bool) {
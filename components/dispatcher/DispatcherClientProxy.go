@@ -4,6 +4,7 @@ import (
 	"net"
 
 	"fmt"
+	"sort"
 
 	"github.com/sagacao/goworld/engine/consts"
 	"github.com/sagacao/goworld/engine/gwioutil"
@@ -15,9 +16,37 @@ import (
 
 type dispatcherClientProxy struct {
 	*proto.GoWorldConnection
-	owner  *DispatcherService
-	gameid uint16
-	gateid uint16
+	owner     *DispatcherService
+	gameid    uint16
+	gateid    uint16
+	isStandby bool // connection from the standby dispatcher
+
+	epoch         uint64              // epoch of packet sequence numbers of the game or gate
+	recvSeq       uint64              // sequence number of the last packet received from the game or gate
+	replicatedSeq uint64              // delivered sequence number that is replicated to standby dispatcher
+	ackedSeq      uint64              // sequence number of the last packet acknowledged to the game or gate
+	skipPackets   uint64              // number of resent packets to skip, which are already processed before reconnecting
+	undelivered   []undeliveredPacket // received packets of which forwarded packets are not delivered yet, ordered by seq
+	sentSeq       uint64              // number of packets sent on the connection
+	deliveries    []pendingDelivery   // packets sent to the game or gate which are not acknowledged yet, ordered by seq
+}
+
+// undeliveredPacket is a packet received from the game or gate, of which the forwarded packets are not delivered yet
+type undeliveredPacket struct {
+	seq        uint64
+	deliveries int // number of forwarded packets not delivered yet
+}
+
+// deliverySource is the received packet that packets are forwarded for
+type deliverySource struct {
+	dcp *dispatcherClientProxy
+	seq uint64
+}
+
+// pendingDelivery is a packet sent to the game or gate which is not acknowledged yet
+type pendingDelivery struct {
+	seq    uint64 // sequence number of the packet on the connection
+	source deliverySource
 }
 
 func newDispatcherClientProxy(owner *DispatcherService, _conn net.Conn) *dispatcherClientProxy {
@@ -29,6 +58,10 @@ func newDispatcherClientProxy(owner *DispatcherService, _conn net.Conn) *dispatc
 		owner:             owner,
 	}
 	dcp.SetAutoFlush(consts.DISPATCHER_CLIENT_PROXY_WRITE_FLUSH_INTERVAL)
+	if owner.config.HasStandby() {
+		// all packets sent on the connection are counted, so that they can be matched with acknowledgements
+		dcp.SetSendPacketHook(dcp.sendTrackedPacket)
+	}
 	return dcp
 }
 
@@ -70,8 +103,108 @@ func (dcp *dispatcherClientProxy) serve() {
 	}
 }
 
+func (dcp *dispatcherClientProxy) clientID() dispatcherClientID {
+	if dcp.gateid > 0 {
+		return dispatcherClientID{isGate: true, id: dcp.gateid}
+	}
+	return dispatcherClientID{isGate: false, id: dcp.gameid}
+}
+
+// countRecvPacket counts the packet received from the game or gate, returns false if the packet should be skipped
+func (dcp *dispatcherClientProxy) countRecvPacket() bool {
+	if dcp.gameid == 0 && dcp.gateid == 0 {
+		// packets before MT_SET_GAME_ID or MT_SET_GATE_ID are not sequenced
+		return true
+	}
+
+	if dcp.skipPackets > 0 {
+		dcp.skipPackets -= 1
+		return false
+	}
+	dcp.recvSeq += 1
+	return true
+}
+
+// deliveredSeq returns the sequence number of the last packet from the game or gate, of which all packets forwarded
+// for it and all packets before it are delivered
+func (dcp *dispatcherClientProxy) deliveredSeq() uint64 {
+	if len(dcp.undelivered) > 0 {
+		return dcp.undelivered[0].seq - 1
+	}
+	return dcp.recvSeq
+}
+
+func (dcp *dispatcherClientProxy) addUndelivered(seq uint64) {
+	i := sort.Search(len(dcp.undelivered), func(i int) bool {
+		return dcp.undelivered[i].seq >= seq
+	})
+	if i < len(dcp.undelivered) && dcp.undelivered[i].seq == seq {
+		dcp.undelivered[i].deliveries += 1
+		return
+	}
+
+	dcp.undelivered = append(dcp.undelivered, undeliveredPacket{})
+	copy(dcp.undelivered[i+1:], dcp.undelivered[i:])
+	dcp.undelivered[i] = undeliveredPacket{seq: seq, deliveries: 1}
+}
+
+func (dcp *dispatcherClientProxy) removeUndelivered(seq uint64) {
+	i := sort.Search(len(dcp.undelivered), func(i int) bool {
+		return dcp.undelivered[i].seq >= seq
+	})
+	if i == len(dcp.undelivered) || dcp.undelivered[i].seq != seq {
+		gwlog.Errorf("%s: packet %d is not waiting for delivery", dcp, seq)
+		return
+	}
+
+	dcp.undelivered[i].deliveries -= 1
+	n := 0
+	for n < len(dcp.undelivered) && dcp.undelivered[n].deliveries == 0 {
+		n += 1
+	}
+	dcp.undelivered = dcp.undelivered[n:]
+}
+
+// sendTrackedPacket is the send packet hook of connections if standby dispatcher is configured. It counts packets sent
+// to the game or gate, and keeps track of packets forwarded for other packets until they are acknowledged.
+func (dcp *dispatcherClientProxy) sendTrackedPacket(packet *netutil.Packet) error {
+	dcp.sentSeq += 1
+	if source := dcp.owner.delivering; source.dcp != nil && (dcp.gameid > 0 || dcp.gateid > 0) {
+		source.dcp.addUndelivered(source.seq)
+		dcp.deliveries = append(dcp.deliveries, pendingDelivery{dcp.sentSeq, source})
+	}
+	return dcp.SendPacketNoHook(packet)
+}
+
+// handleClientAck releases packets delivered to the game or gate, seq is the number of packets it received
+func (dcp *dispatcherClientProxy) handleClientAck(seq uint64) {
+	n := 0
+	for n < len(dcp.deliveries) && dcp.deliveries[n].seq <= seq {
+		dcp.deliveries[n].source.delivered()
+		n += 1
+	}
+	dcp.deliveries = dcp.deliveries[n:]
+}
+
+// releaseDeliveries is called when the connection is down, packets sent to it will never be acknowledged
+func (dcp *dispatcherClientProxy) releaseDeliveries() {
+	for _, delivery := range dcp.deliveries {
+		delivery.source.delivered()
+	}
+	dcp.deliveries = nil
+}
+
+// delivered is called when a packet forwarded for the source packet is delivered or dropped
+func (source deliverySource) delivered() {
+	if source.dcp != nil {
+		source.dcp.removeUndelivered(source.seq)
+	}
+}
+
 func (dcp *dispatcherClientProxy) String() string {
-	if dcp.gameid > 0 {
+	if dcp.isStandby {
+		return fmt.Sprintf("dispatcherClientProxy<standby|%s>", dcp.RemoteAddr())
+	} else if dcp.gameid > 0 {
 		return fmt.Sprintf("dispatcherClientProxy<game%d|%s>", dcp.gameid, dcp.RemoteAddr())
 	} else if dcp.gateid > 0 {
 		return fmt.Sprintf("dispatcherClientProxy<gate%d|%s>", dcp.gateid, dcp.RemoteAddr())
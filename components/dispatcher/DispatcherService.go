@@ -11,8 +11,6 @@ import (
 
 	"math/rand"
 
-	"container/heap"
-
 	"github.com/pkg/errors"
 	"github.com/sagacao/goworld/engine/binutil"
 	"github.com/sagacao/goworld/engine/common"
@@ -23,12 +21,19 @@ import (
 	"github.com/sagacao/goworld/engine/netutil"
 	"github.com/sagacao/goworld/engine/post"
 	"github.com/sagacao/goworld/engine/proto"
+	"github.com/xiaonanln/go-xnsyncutil/xnsyncutil"
 )
 
+// pendingPacket is a packet waiting for the entity or game to be unblocked
+type pendingPacket struct {
+	packet *netutil.Packet
+	source deliverySource // the received packet that the packet is forwarded for
+}
+
 type entityDispatchInfo struct {
 	gameid             uint16
 	blockUntilTime     time.Time
-	pendingPacketQueue []*netutil.Packet
+	pendingPacketQueue []pendingPacket
 }
 
 func (edi *entityDispatchInfo) blockRPC(d time.Duration) {
@@ -50,11 +55,11 @@ func (edi *entityDispatchInfo) dispatchPacket(pkt *netutil.Packet) error {
 		// keep blocking, just put the call to wait
 		if len(edi.pendingPacketQueue) < consts.ENTITY_PENDING_PACKET_QUEUE_MAX_LEN {
 			pkt.AddRefCount(1)
-			edi.pendingPacketQueue = append(edi.pendingPacketQueue, pkt)
+			edi.pendingPacketQueue = append(edi.pendingPacketQueue, pendingPacket{pkt, dispatcherService.queueDelivery()})
 			return nil
 		} else {
 			gwlog.Errorf("%s.dispatchPacket: packet queue too long, packet dropped", edi)
-			return errors.Errorf("%s: packet of entity %s is dropped", dispatcherService)
+			return errors.Errorf("%s: packet to entity on game%d is dropped", dispatcherService, edi.gameid)
 		}
 	} else {
 		// time to unblock
@@ -70,23 +75,36 @@ func (info *entityDispatchInfo) unblock() {
 
 		targetGame := info.gameid
 		// send the cached calls to target game
-		var pendingPackets []*netutil.Packet
+		var pendingPackets []pendingPacket
 		pendingPackets, info.pendingPacketQueue = info.pendingPacketQueue, nil
-		for _, pkt := range pendingPackets {
-			dispatcherService.dispatchPacketToGame(targetGame, pkt)
-			pkt.Release()
+		for _, pp := range pendingPackets {
+			dispatcherService.redeliver(pp.source, func() {
+				dispatcherService.dispatchPacketToGame(targetGame, pp.packet)
+			})
+			pp.packet.Release()
 		}
 	}
 }
 
+func (edi *entityDispatchInfo) clearPendingPackets() {
+	var pendingPackets []pendingPacket
+	pendingPackets, edi.pendingPacketQueue = edi.pendingPacketQueue, nil
+	for _, pp := range pendingPackets {
+		pp.source.delivered()
+		pp.packet.Release()
+	}
+}
+
 type gameDispatchInfo struct {
 	gameid             uint16
 	clientProxy        *dispatcherClientProxy
 	isBlocked          bool
 	blockUntilTime     time.Time // game can be blocked
-	pendingPacketQueue []*netutil.Packet
+	pendingPacketQueue []pendingPacket
 	isBanBootEntity    bool
-	lbcheapentry       *lbcheapentry
+	lbcinfo            proto.GameLBCInfo // load info reported by the game
+	lbcChosen          int               // number of times the game is chosen since the last report of load info
+	lbcUpdateTime      time.Time         // last time of receiving load info
 }
 
 func (gdi *gameDispatchInfo) setClientProxy(clientProxy *dispatcherClientProxy) {
@@ -127,7 +145,7 @@ func (gdi *gameDispatchInfo) dispatchPacket(pkt *netutil.Packet) error {
 		return gdi.clientProxy.SendPacket(pkt)
 	} else {
 		if len(gdi.pendingPacketQueue) < consts.GAME_PENDING_PACKET_QUEUE_MAX_LEN {
-			gdi.pendingPacketQueue = append(gdi.pendingPacketQueue, pkt)
+			gdi.pendingPacketQueue = append(gdi.pendingPacketQueue, pendingPacket{pkt, dispatcherService.queueDelivery()})
 			pkt.AddRefCount(1)
 
 			if len(gdi.pendingPacketQueue)%1 == 0 {
@@ -152,19 +170,22 @@ func (gdi *gameDispatchInfo) unblock() {
 
 func (gdi *gameDispatchInfo) sendPendingPackets() {
 	// send the cached calls to target game
-	var pendingPackets []*netutil.Packet
+	var pendingPackets []pendingPacket
 	pendingPackets, gdi.pendingPacketQueue = gdi.pendingPacketQueue, nil
-	for _, pkt := range pendingPackets {
-		gdi.clientProxy.SendPacket(pkt)
-		pkt.Release()
+	for _, pp := range pendingPackets {
+		dispatcherService.redeliver(pp.source, func() {
+			gdi.clientProxy.SendPacket(pp.packet)
+		})
+		pp.packet.Release()
 	}
 }
 
 func (gdi *gameDispatchInfo) clearPendingPackets() {
-	var pendingPackets []*netutil.Packet
+	var pendingPackets []pendingPacket
 	pendingPackets, gdi.pendingPacketQueue = gdi.pendingPacketQueue, nil
-	for _, pkt := range pendingPackets {
-		pkt.Release()
+	for _, pp := range pendingPackets {
+		pp.source.delivered()
+		pp.packet.Release()
 	}
 }
 
@@ -185,27 +206,50 @@ type DispatcherService struct {
 	srvdisRegisterMap     map[string]string
 	entitySyncInfosToGame map[uint16]*netutil.Packet // cache entity sync infos to gates
 	ticker                <-chan time.Time
-	lbcheap               lbcheap // heap for game load balancing
-	chooseGameIdx         int     // choose game in a round robin way
-	isDeploymentReady     bool    // whether or not the deployment is ready
-}
-
-func newDispatcherService(dispid uint16) *DispatcherService {
+	lbcGames              []*gameDispatchInfo // games for load balancing
+	lbcStrategy           lbcStrategy         // strategy for choosing games to create entities anywhere
+	bootEntityLBCStrategy lbcStrategy         // strategy for choosing games to create boot entities
+	isDeploymentReady     bool                // whether or not the deployment is ready
+	lastRebalanceTime     time.Time           // last time of rebalancing entities between games
+	crontabSingletons     map[string]int64    // last granted fire times of singleton crontab jobs
+
+	isStandbyNode            bool                               // whether or not the dispatcher is started as standby
+	isActive                 xnsyncutil.AtomicBool              // dispatcher with standby configured is not active until promoted
+	epoch                    uint64                             // increased on every promotion, dispatchers of older epochs are fenced
+	standby                  *dispatcherClientProxy             // the standby dispatcher replicating states of this dispatcher
+	hasStandby               xnsyncutil.AtomicBool              // whether or not the standby dispatcher is connected
+	pendingReplicationPacket *netutil.Packet                    // replication operations to be sent to standby
+	lastReplicationTime      time.Time                          // last time of sending replication packet to standby
+	recvSeqs                 map[dispatcherClientID]recvSeqInfo // receive sequence numbers of games and gates
+	disconnectedGates        map[uint16]time.Time               // disconnected gates and the deadlines for them to reconnect
+	delivering               deliverySource                     // the received packet being handled, if standby dispatcher is configured
+}
+
+func newDispatcherService(dispid uint16, isStandbyNode bool) *DispatcherService {
 	cfg := config.GetDispatcher(dispid)
 	ds := &DispatcherService{
 		dispid:                dispid,
 		config:                cfg,
+		isStandbyNode:         isStandbyNode,
+		recvSeqs:              map[dispatcherClientID]recvSeqInfo{},
+		disconnectedGates:     map[uint16]time.Time{},
 		messageQueue:          make(chan dispatcherMessage, consts.DISPATCHER_SERVICE_PACKET_QUEUE_SIZE),
 		games:                 map[uint16]*gameDispatchInfo{},
 		gates:                 map[uint16]*dispatcherClientProxy{},
 		entityDispatchInfos:   map[common.EntityID]*entityDispatchInfo{},
 		srvdisRegisterMap:     map[string]string{},
+		crontabSingletons:     map[string]int64{},
 		entitySyncInfosToGame: map[uint16]*netutil.Packet{},
 		ticker:                time.Tick(consts.DISPATCHER_SERVICE_TICK_INTERVAL),
-		lbcheap:               nil,
+		lbcStrategy:           newLBCStrategy(cfg.LBCStrategy, cfg.LBCScoreWeights),
+		bootEntityLBCStrategy: newLBCStrategy(cfg.BootEntityLBCStrategy, cfg.LBCScoreWeights),
 		isDeploymentReady:     false,
 	}
 
+	if !cfg.HasStandby() {
+		ds.isActive.Store(true)
+		ds.epoch = 1
+	}
 	ds.recalcBootGames()
 
 	return ds
@@ -218,6 +262,27 @@ func (service *DispatcherService) messageLoop() {
 			dcp := msg.dcp
 			msgtype := msg.MsgType
 			pkt := msg.Packet
+			if dcp != nil && !service.isActive.Load() && msgtype != proto.MT_SET_STANDBY_DISPATCHER {
+				// games and gates should connect to the active dispatcher
+				if !dcp.IsClosed() {
+					gwlog.Warnf("%s: standby dispatcher is not active, reject %s", service, dcp)
+					dcp.Close()
+				}
+				pkt.Release()
+				break
+			}
+			if dcp != nil && msgtype == proto.MT_DISPATCHER_CLIENT_ACK {
+				// acknowledgements are not sequenced
+				dcp.handleClientAck(pkt.ReadUint64())
+				pkt.Release()
+				break
+			}
+			if dcp != nil && !dcp.countRecvPacket() {
+				pkt.Release()
+				break
+			}
+			service.delivering = service.deliverySourceOf(dcp)
+
 			if msgtype >= proto.MT_REDIRECT_TO_GATEPROXY_MSG_TYPE_START && msgtype <= proto.MT_REDIRECT_TO_GATEPROXY_MSG_TYPE_STOP {
 				service.handleDoSomethingOnSpecifiedClient(dcp, pkt)
 			} else {
@@ -226,7 +291,8 @@ func (service *DispatcherService) messageLoop() {
 					service.handleSyncPositionYawFromClient(dcp, pkt)
 				case proto.MT_SYNC_POSITION_YAW_ON_CLIENTS:
 					service.handleSyncPositionYawOnClients(dcp, pkt)
-				case proto.MT_CALL_ENTITY_METHOD:
+				case proto.MT_CALL_ENTITY_METHOD, proto.MT_CALL_ENTITY_METHOD_WITH_REPLY, proto.MT_CALL_ENTITY_METHOD_REPLY,
+					proto.MT_CALL_ENTITY_METHOD_RELIABLE, proto.MT_RELIABLE_CALL_ACK:
 					service.handleCallEntityMethod(dcp, pkt)
 				case proto.MT_CALL_ENTITY_METHOD_FROM_CLIENT:
 					service.handleCallEntityMethodFromClient(dcp, pkt)
@@ -242,6 +308,8 @@ func (service *DispatcherService) messageLoop() {
 					service.handleNotifyClientConnected(dcp, pkt)
 				case proto.MT_NOTIFY_CLIENT_DISCONNECTED:
 					service.handleNotifyClientDisconnected(dcp, pkt)
+				case proto.MT_RESUME_CLIENT:
+					service.handleResumeClient(dcp, pkt)
 				case proto.MT_LOAD_ENTITY_SOMEWHERE:
 					service.handleLoadEntitySomewhere(dcp, pkt)
 				case proto.MT_NOTIFY_CREATE_ENTITY:
@@ -258,6 +326,8 @@ func (service *DispatcherService) messageLoop() {
 					service.handleCallNilSpaces(dcp, pkt)
 				case proto.MT_CANCEL_MIGRATE:
 					service.handleCancelMigrate(dcp, pkt)
+				case proto.MT_CLAIM_CRONTAB_SINGLETON:
+					service.handleClaimCrontabSingleton(dcp, pkt)
 				case proto.MT_SRVDIS_REGISTER:
 					service.handleSrvdisRegister(dcp, pkt)
 				case proto.MT_SET_GAME_ID:
@@ -269,6 +339,10 @@ func (service *DispatcherService) messageLoop() {
 				case proto.MT_START_FREEZE_GAME:
 					// freeze the game
 					service.handleStartFreezeGame(dcp, pkt)
+				case proto.MT_SET_STANDBY_DISPATCHER:
+					service.handleSetStandbyDispatcher(dcp, pkt)
+				case proto.MT_REPLICATE_DISPATCHER_STATE:
+					service.handleReplicateDispatcherState(dcp, pkt)
 				default:
 					gwlog.TraceError("unknown msgtype %d from %s", msgtype, dcp)
 				}
@@ -277,8 +351,12 @@ func (service *DispatcherService) messageLoop() {
 			pkt.Release()
 			break
 		case <-service.ticker:
+			service.delivering = deliverySource{}
 			post.Tick()
 			service.sendEntitySyncInfosToGames()
+			service.replicateAndAck()
+			service.checkDisconnectedGates()
+			service.checkRebalance(time.Now())
 			break
 		}
 	}
@@ -290,6 +368,9 @@ func (service *DispatcherService) terminate() {
 }
 
 func (service *DispatcherService) delEntityDispatchInfo(entityID common.EntityID) {
+	if edi := service.entityDispatchInfos[entityID]; edi != nil {
+		edi.clearPendingPackets()
+	}
 	delete(service.entityDispatchInfos, entityID)
 }
 
@@ -304,6 +385,20 @@ func (service *DispatcherService) setEntityDispatcherInfoForWrite(entityID commo
 	return
 }
 
+// blockEntity blocks RPCs of the entity and replicates the blocking state
+func (service *DispatcherService) blockEntity(entityID common.EntityID, edi *entityDispatchInfo, d time.Duration) {
+	edi.blockRPC(d)
+	service.replicateEntityBlock(entityID, edi)
+}
+
+// unblockEntity unblocks RPCs of the entity and replicates the blocking state
+func (service *DispatcherService) unblockEntity(entityID common.EntityID, edi *entityDispatchInfo) {
+	if !edi.blockUntilTime.IsZero() {
+		edi.unblock()
+		service.replicateEntityBlock(entityID, edi)
+	}
+}
+
 func (service *DispatcherService) String() string {
 	return fmt.Sprintf("DispatcherService<%d>", dispid)
 }
@@ -311,7 +406,10 @@ func (service *DispatcherService) String() string {
 func (service *DispatcherService) run() {
 	binutil.PrintSupervisorTag(consts.DISPATCHER_STARTED_TAG)
 	go gwutils.RepeatUntilPanicless(service.messageLoop)
-	netutil.ServeTCPForever(service.config.ListenAddr, service)
+	if service.config.HasStandby() {
+		go gwutils.RepeatUntilPanicless(service.replicateFromPeer)
+	}
+	netutil.ServeTCPForever(service.listenAddr(), service)
 }
 
 // ServeTCPConnection handles dispatcher client connections to dispatcher
@@ -334,11 +432,22 @@ func (service *DispatcherService) handleSetGameID(dcp *dispatcherClientProxy, pk
 	//	eid := pkt.ReadEntityID()
 	//}
 
+	eids := make([]common.EntityID, numEntities)
+	for i := range eids {
+		eids[i] = pkt.ReadEntityID()
+	}
+	epoch := pkt.ReadUint64()
+	firstSeq := pkt.ReadUint64()
+	dispatcherEpoch := pkt.ReadUint64()
+
 	gwlog.Infof("%s: connection %s set gameid=%d, isReconnect=%v, isRestore=%v, isBanBootEntity=%v, numEntities=%d", service, dcp, gameid, isReconnect, isRestore, isBanBootEntity, numEntities)
 
 	if gameid <= 0 {
 		gwlog.Panicf("invalid gameid: %d", gameid)
 	}
+	if service.checkFenced(dcp, dispatcherEpoch) {
+		return
+	}
 	if dcp.gameid > 0 || dcp.gateid > 0 {
 		gwlog.Panicf("already set gameid=%d, gateid=%d", dcp.gameid, dcp.gateid)
 	}
@@ -348,48 +457,37 @@ func (service *DispatcherService) handleSetGameID(dcp *dispatcherClientProxy, pk
 		gwlog.Debugf("%s.handleSetGameID: dcp=%s, gameid=%d, isReconnect=%v", service, dcp, gameid, isReconnect)
 	}
 
-	gdi := service.games[gameid]
-	if gdi == nil {
-		// new game connected, create dispatch info for the game
-		lbcheapentry := &lbcheapentry{gameid, len(service.lbcheap), 0, 0}
-		gdi = &gameDispatchInfo{gameid: gameid, isBanBootEntity: isBanBootEntity, lbcheapentry: lbcheapentry}
-		service.games[gameid] = gdi
-		heap.Push(&service.lbcheap, lbcheapentry)
-		service.lbcheap.validateHeapIndexes()
-
-		if !isBanBootEntity {
-			service.bootGames = append(service.bootGames, gameid)
-		}
-	} else if gdi.clientProxy != nil {
+	if gdi := service.games[gameid]; gdi != nil && gdi.clientProxy != nil {
 		gdi.clientProxy.Close()
 		service.handleGameDisconnected(gdi.clientProxy)
 	}
 
-	oldIsBanBootEntity := gdi.isBanBootEntity
-	gdi.isBanBootEntity = isBanBootEntity
+	gdi := service.setGameDispatchInfo(gameid, isBanBootEntity)
+	service.replicateGame(gameid, isBanBootEntity)
 	gdi.setClientProxy(dcp) // should be nil, unless reconnect
-	gdi.unblock()           // unlock game dispatch info if new game is connected
-	if oldIsBanBootEntity != isBanBootEntity {
-		service.recalcBootGames() // recalc if necessary
+	if !gdi.blockUntilTime.IsZero() {
+		gdi.unblock() // unlock game dispatch info if new game is connected
+		service.replicateGameBlock(gameid, gdi)
 	}
 
 	// restore all entities for the game from the packet
 	var rejectEntities []common.EntityID
-	for i := uint32(0); i < numEntities; i++ {
-		eid := pkt.ReadEntityID()
+	for _, eid := range eids {
 		edi := service.setEntityDispatcherInfoForWrite(eid)
 		if edi.gameid == gameid {
 			// the current game for the entity is not changed
-			edi.unblock()
+			service.unblockEntity(eid, edi)
 		} else if edi.gameid == 0 {
 			// the entity has no game yet, set to this game
 			edi.gameid = gameid
-			edi.unblock()
+			service.replicateEntity(eid, gameid)
+			service.unblockEntity(eid, edi)
 		} else {
 			// the entity is on other game ... need to tell the game to destroy his version of entity
 			rejectEntities = append(rejectEntities, eid)
 		}
 	}
+	service.startRecvSeq(dcp, epoch, firstSeq)
 
 	gwlog.Infof("%s: %s set gameid = %d, numEntities = %d, rejectEntites = %d, services = %v", service, dcp, gameid, numEntities, len(rejectEntities), service.srvdisRegisterMap)
 	// reuse the packet to send SET_GAMEID_ACK with all connected gameids
@@ -401,6 +499,25 @@ func (service *DispatcherService) handleSetGameID(dcp *dispatcherClientProxy, pk
 	return
 }
 
+// setGameDispatchInfo creates or updates the dispatch info of the game
+func (service *DispatcherService) setGameDispatchInfo(gameid uint16, isBanBootEntity bool) *gameDispatchInfo {
+	gdi := service.games[gameid]
+	if gdi == nil {
+		// new game connected, create dispatch info for the game
+		gdi = &gameDispatchInfo{gameid: gameid, isBanBootEntity: isBanBootEntity}
+		service.games[gameid] = gdi
+		service.lbcGames = append(service.lbcGames, gdi)
+
+		if !isBanBootEntity {
+			service.bootGames = append(service.bootGames, gameid)
+		}
+	} else if gdi.isBanBootEntity != isBanBootEntity {
+		gdi.isBanBootEntity = isBanBootEntity
+		service.recalcBootGames() // recalc if necessary
+	}
+	return gdi
+}
+
 func (service *DispatcherService) getConnectedGameIDs() (gameids []uint16) {
 	for _, gdi := range service.games {
 		if gdi.clientProxy != nil {
@@ -422,12 +539,18 @@ func (service *DispatcherService) sendNotifyGameConnected(gameid uint16) {
 
 func (service *DispatcherService) handleSetGateID(dcp *dispatcherClientProxy, pkt *netutil.Packet) {
 	gateid := pkt.ReadUint16()
+	epoch := pkt.ReadUint64()
+	firstSeq := pkt.ReadUint64()
+	dispatcherEpoch := pkt.ReadUint64()
 	if gateid <= 0 {
 		gwlog.Panicf("invalid gateid: %d", gateid)
 	}
 	if dcp.gameid > 0 || dcp.gateid > 0 {
 		gwlog.Panicf("already set gameid=%d, gateid=%d", dcp.gameid, dcp.gateid)
 	}
+	if service.checkFenced(dcp, dispatcherEpoch) {
+		return
+	}
 
 	dcp.gateid = gateid
 	gwlog.Infof("Gate %d is connected: %s", gateid, dcp)
@@ -439,7 +562,16 @@ func (service *DispatcherService) handleSetGateID(dcp *dispatcherClientProxy, pk
 		service.handleGateDisconnected(olddcp)
 	}
 
+	if _, ok := service.disconnectedGates[gateid]; ok {
+		delete(service.disconnectedGates, gateid)
+		if known, ok := service.recvSeqs[dcp.clientID()]; !ok || known.epoch != epoch {
+			// gate is restarted, clients of the old gate are gone
+			service.notifyGateDisconnected(gateid)
+		}
+	}
+
 	service.gates[gateid] = dcp
+	service.startRecvSeq(dcp, epoch, firstSeq)
 	service.checkDeploymentReady()
 }
 
@@ -469,6 +601,7 @@ func (service *DispatcherService) checkDeploymentReady() {
 
 	// now deployment is ready
 	service.isDeploymentReady = true
+	service.replicateDeploymentReady()
 	// now the deployment is ready for only once
 	// broadcast deployment ready to all games
 	pkt := proto.MakeNotifyDeploymentReadyPacket()
@@ -485,6 +618,7 @@ func (service *DispatcherService) handleStartFreezeGame(dcp *dispatcherClientPro
 	}
 
 	gdi.block(consts.DISPATCHER_FREEZE_GAME_TIMEOUT)
+	service.replicateGameBlock(gameid, gdi)
 
 	// tell the game to start real freeze, re-using the packet
 	pkt.ClearPayload()
@@ -527,33 +661,29 @@ func (service *DispatcherService) dispatcherClientOfGate(gateid uint16) *dispatc
 
 // Choose a dispatcher client for sending Anywhere packets
 func (service *DispatcherService) chooseGame() *gameDispatchInfo {
-	if len(service.lbcheap) == 0 {
+	gdi := service.lbcStrategy.choose(service.lbcGames)
+	if gdi == nil {
 		return nil
 	}
 
-	top := service.lbcheap[0]
-	gwlog.Infof("%s: choose game by lbc: gameid=%d", service, top.gameid)
-	gdi := service.games[top.gameid]
-
-	// after game is chosen, udpate CPU percent by a bit
-	service.lbcheap.chosen(0)
-	service.lbcheap.validateHeapIndexes()
+	gwlog.Infof("%s: choose game by lbc %s: gameid=%d", service, service.config.LBCStrategy, gdi.gameid)
+	gdi.lbcChosen += 1 // the game is loaded a bit more after chosen
 	return gdi
 }
 
-// Choose a dispatcher client for sending Anywhere packets
+// Choose a game for creating the boot entity of new client
 func (service *DispatcherService) chooseGameForBootEntity() *gameDispatchInfo {
+	candidates := make([]*gameDispatchInfo, 0, len(service.bootGames))
+	for _, gameid := range service.bootGames {
+		candidates = append(candidates, service.games[gameid])
+	}
 
-	if len(service.bootGames) > 0 {
-		gameid := service.bootGames[service.chooseGameIdx%len(service.bootGames)]
-		service.chooseGameIdx += 1
-		return service.games[gameid]
-	} else {
+	gdi := service.bootEntityLBCStrategy.choose(candidates)
+	if gdi == nil {
 		gwlog.Errorf("%s chooseGameForBootEntity: no game", service)
 		return nil
 	}
-	gameid := service.bootGames[rand.Intn(len(service.bootGames))]
-	gdi := service.games[gameid]
+	gdi.lbcChosen += 1
 	return gdi
 }
 
@@ -565,7 +695,15 @@ func (service *DispatcherService) handleDispatcherClientDisconnect(dcp *dispatch
 		}
 	}()
 	gwlog.Warnf("%s disconnected", dcp)
-	if dcp.gateid > 0 {
+	dcp.releaseDeliveries()
+	if dcp.isStandby {
+		if service.standby == dcp {
+			service.standby = nil
+			service.hasStandby.Store(false)
+		}
+	} else if !service.isActive.Load() {
+		// states of games and gates are reset when the dispatcher is demoted
+	} else if dcp.gateid > 0 {
 		// gate disconnected, notify all clients disconnected
 		service.handleGateDisconnected(dcp)
 	} else if dcp.gameid > 0 {
@@ -584,7 +722,33 @@ func (service *DispatcherService) handleGateDisconnected(dcp *dispatcherClientPr
 	}
 
 	// should always goes here
+	service.saveRecvSeq(dcp)
 	delete(service.gates, gateid)
+	if service.config.HasStandby() {
+		// gate keeps running when disconnected from dispatcher with standby, wait for it to reconnect
+		service.disconnectedGates[gateid] = time.Now().Add(consts.DISPATCHER_GATE_RECONNECT_TIMEOUT)
+		return
+	}
+	service.notifyGateDisconnected(gateid)
+}
+
+// checkDisconnectedGates notifies games of disconnected gates which are not reconnected in time
+func (service *DispatcherService) checkDisconnectedGates() {
+	if !service.isActive.Load() {
+		return
+	}
+
+	now := time.Now()
+	for gateid, deadline := range service.disconnectedGates {
+		if now.After(deadline) {
+			gwlog.Warnf("%s: gate %d is not reconnected in %s, clients of the gate are disconnected", service, gateid, consts.DISPATCHER_GATE_RECONNECT_TIMEOUT)
+			delete(service.disconnectedGates, gateid)
+			service.notifyGateDisconnected(gateid)
+		}
+	}
+}
+
+func (service *DispatcherService) notifyGateDisconnected(gateid uint16) {
 	// notify all games of gate down
 	pkt := netutil.NewPacket()
 	pkt.AppendUint16(proto.MT_NOTIFY_GATE_DISCONNECTED)
@@ -607,6 +771,7 @@ func (service *DispatcherService) handleGameDisconnected(dcp *dispatcherClientPr
 		return
 	}
 
+	service.saveRecvSeq(dcp)
 	gdi.clientProxy = nil // connection down, set clientProxy = nil
 	if !gdi.isBlocked {
 		// game is down, we need to clear all
@@ -649,7 +814,8 @@ func (service *DispatcherService) handleNotifyCreateEntity(dcp *dispatcherClient
 	}
 	entityDispatchInfo := service.setEntityDispatcherInfoForWrite(entityID)
 	entityDispatchInfo.gameid = dcp.gameid
-	entityDispatchInfo.unblock()
+	service.replicateEntity(entityID, dcp.gameid)
+	service.unblockEntity(entityID, entityDispatchInfo)
 }
 
 func (service *DispatcherService) handleNotifyDestroyEntity(dcp *dispatcherClientProxy, pkt *netutil.Packet, entityID common.EntityID) {
@@ -661,6 +827,7 @@ func (service *DispatcherService) handleNotifyDestroyEntity(dcp *dispatcherClien
 
 func (service *DispatcherService) cleanupEntityInfo(entityID common.EntityID) {
 	service.delEntityDispatchInfo(entityID)
+	service.replicateEntity(entityID, 0)
 }
 
 func (service *DispatcherService) handleNotifyClientConnected(dcp *dispatcherClientProxy, pkt *netutil.Packet) {
@@ -679,6 +846,20 @@ func (service *DispatcherService) handleNotifyClientDisconnected(dcp *dispatcher
 	}
 }
 
+func (service *DispatcherService) handleResumeClient(dcp *dispatcherClientProxy, pkt *netutil.Packet) {
+	ownerEntityID := pkt.ReadEntityID()
+	edi := service.entityDispatchInfos[ownerEntityID]
+	if edi != nil {
+		pkt.AppendUint16(dcp.gateid)
+		edi.dispatchPacket(pkt)
+	} else {
+		// owner entity is already destroyed, so the client can not be resumed
+		clientid := pkt.ReadClientID()
+		gwlog.Warnf("%s: client %s resume failed: owner entity %s not found", service, clientid, ownerEntityID)
+		dcp.SendNotifyClientResumedOnClient(dcp.gateid, clientid, ownerEntityID, false)
+	}
+}
+
 func (service *DispatcherService) handleLoadEntitySomewhere(dcp *dispatcherClientProxy, pkt *netutil.Packet) {
 	//typeName := pkt.ReadVarStr()
 	//eid := pkt.ReadEntityID()
@@ -700,7 +881,8 @@ func (service *DispatcherService) handleLoadEntitySomewhere(dcp *dispatcherClien
 
 		if gdi != nil {
 			entityDispatchInfo.gameid = gdi.gameid
-			entityDispatchInfo.blockRPC(consts.DISPATCHER_LOAD_TIMEOUT)
+			service.replicateEntity(eid, gdi.gameid)
+			service.blockEntity(eid, entityDispatchInfo, consts.DISPATCHER_LOAD_TIMEOUT)
 			gdi.dispatchPacket(pkt)
 		} else {
 			gwlog.Errorf("%s: handleLoadEntitySomewhere: no game", service)
@@ -728,6 +910,7 @@ func (service *DispatcherService) handleCreateEntitySomewhere(dcp *dispatcherCli
 	if gdi != nil {
 		entityDispatchInfo := service.setEntityDispatcherInfoForWrite(entityid)
 		entityDispatchInfo.gameid = gdi.gameid // setup gameid of entity
+		service.replicateEntity(entityid, gdi.gameid)
 		gdi.dispatchPacket(pkt)
 	} else {
 		gwlog.Errorf("%s handleCreateEntitySomewhere: no game", service)
@@ -743,6 +926,7 @@ func (service *DispatcherService) handleSrvdisRegister(dcp *dispatcherClientProx
 
 	if force || curinfo == "" {
 		service.srvdisRegisterMap[srvid] = srvinfo
+		service.replicateSrvdisRegister(srvid, srvinfo)
 		service.broadcastToGames(pkt)
 		gwlog.Infof("%s: srvdis register %s = %s, force %v, register ok", service, srvid, srvinfo, force)
 	} else {
@@ -866,6 +1050,22 @@ func (service *DispatcherService) handleQuerySpaceGameIDForMigrate(dcp *dispatch
 	dcp.SendPacket(pkt)
 }
 
+// handleClaimCrontabSingleton grants the first claim of each run of a singleton crontab job, so the job runs on one game only
+func (service *DispatcherService) handleClaimCrontabSingleton(dcp *dispatcherClientProxy, pkt *netutil.Packet) {
+	name := pkt.ReadVarStr()
+	fireTime := int64(pkt.ReadUint64())
+
+	granted := fireTime > service.crontabSingletons[name]
+	if granted {
+		service.crontabSingletons[name] = fireTime
+		service.replicateCrontabSingleton(name, fireTime)
+		gwlog.Infof("%s: singleton crontab %s at %d is granted to %s", service, name, fireTime, dcp)
+	}
+	pkt.AppendBool(granted)
+	// send the packet back
+	dcp.SendPacket(pkt)
+}
+
 func (service *DispatcherService) handleMigrateRequest(dcp *dispatcherClientProxy, pkt *netutil.Packet) {
 	entityID := pkt.ReadEntityID()
 	spaceID := pkt.ReadEntityID()
@@ -876,7 +1076,7 @@ func (service *DispatcherService) handleMigrateRequest(dcp *dispatcherClientProx
 	}
 
 	entityDispatchInfo := service.setEntityDispatcherInfoForWrite(entityID)
-	entityDispatchInfo.blockRPC(consts.DISPATCHER_MIGRATE_TIMEOUT)
+	service.blockEntity(entityID, entityDispatchInfo, consts.DISPATCHER_MIGRATE_TIMEOUT)
 	dcp.SendPacket(pkt)
 }
 
@@ -889,7 +1089,7 @@ func (service *DispatcherService) handleCancelMigrate(dcp *dispatcherClientProxy
 
 	entityDispatchInfo := service.entityDispatchInfos[entityid]
 	if entityDispatchInfo != nil {
-		entityDispatchInfo.unblock()
+		service.unblockEntity(entityid, entityDispatchInfo)
 	}
 }
 
@@ -903,10 +1103,11 @@ func (service *DispatcherService) handleRealMigrate(dcp *dispatcherClientProxy,
 	entityDispatchInfo := service.setEntityDispatcherInfoForWrite(eid)
 
 	entityDispatchInfo.gameid = targetGame
+	service.replicateEntity(eid, targetGame)
 
 	service.dispatchPacketToGame(targetGame, pkt)
 	// send the cached calls to target game
-	entityDispatchInfo.unblock()
+	service.unblockEntity(eid, entityDispatchInfo)
 }
 
 func (service *DispatcherService) broadcastToGames(pkt *netutil.Packet) {
@@ -954,7 +1155,7 @@ func (service *DispatcherService) handleGameLBCInfo(dcp *dispatcherClientProxy,
 	gwlog.Debugf("Game %d Load Balancing Info: %+v", dcp.gameid, lbcinfo)
 	lbcinfo.CPUPercent *= 1 + (rand.Float64() * 0.1) // multiply CPUPercent by a random factor 1.0 ~ 1.1
 	gdi := service.games[dcp.gameid]
-	gdi.lbcheapentry.update(lbcinfo)
-	heap.Fix(&service.lbcheap, gdi.lbcheapentry.heapidx)
-	service.lbcheap.validateHeapIndexes()
+	gdi.lbcinfo = lbcinfo
+	gdi.lbcChosen = 0
+	gdi.lbcUpdateTime = time.Now()
 }
@@ -16,6 +16,7 @@ import (
 	"github.com/sagacao/goworld/engine/config"
 	"github.com/sagacao/goworld/engine/consts"
 	"github.com/sagacao/goworld/engine/gwlog"
+	"github.com/sagacao/goworld/engine/metrics"
 	"github.com/sagacao/goworld/engine/post"
 )
 
@@ -25,6 +26,7 @@ var (
 	configFile        = ""
 	logLevel          string
 	runInDaemonMode   bool
+	runAsStandby      bool
 	sigChan           = make(chan os.Signal, 1)
 	dispatcherService *DispatcherService
 )
@@ -34,6 +36,7 @@ func parseArgs() {
 	flag.StringVar(&configFile, "configfile", "", "set config file path")
 	flag.StringVar(&logLevel, "log", "", "set log level, will override log level in config")
 	flag.BoolVar(&runInDaemonMode, "d", false, "run in daemon mode")
+	flag.BoolVar(&runAsStandby, "standby", false, "run as the standby dispatcher of the dispatcher ID")
 	flag.Parse()
 	dispid = uint16(dispidArg)
 }
@@ -65,10 +68,23 @@ func main() {
 	if logLevel == "" {
 		logLevel = dispatcherConfig.LogLevel
 	}
-	binutil.SetupGWLog("dispatcherService", logLevel, dispatcherConfig.LogFile, dispatcherConfig.LogStderr)
-	binutil.SetupHTTPServer(dispatcherConfig.HTTPAddr, nil)
+	logFile, httpAddr := dispatcherConfig.LogFile, dispatcherConfig.HTTPAddr
+	if runAsStandby {
+		if !dispatcherConfig.HasStandby() {
+			gwlog.Fatalf("standby dispatcher is not configured for dispatcher%d, set standby_advertise_addr in config", dispid)
+		}
+		logFile = dispatcherConfig.StandbyLogFile()
+		httpAddr = dispatcherConfig.StandbyHTTPAddr
+	}
+	binutil.SetupGWLog("dispatcherService", logLevel, logFile, dispatcherConfig.LogStderr)
+	if httpAddr != "" {
+		binutil.SetupHTTPServer(httpAddr, nil)
+	}
 
-	dispatcherService = newDispatcherService(dispid)
+	dispatcherService = newDispatcherService(dispid, runAsStandby)
+	metrics.NewGaugeFunc("goworld_dispatcher_packet_queue_length", "Number of packets from games and gates waiting in queue", func() float64 {
+		return float64(len(dispatcherService.messageQueue))
+	})
 	setupSignals() // call setupSignals to avoid data race on `dispatcherService`
 	dispatcherService.run()
 }
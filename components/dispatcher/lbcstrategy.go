@@ -0,0 +1,132 @@
+package main
+
+import (
+	"math"
+
+	"github.com/sagacao/goworld/engine/config"
+	"github.com/sagacao/goworld/engine/gwlog"
+)
+
+// lbcStrategy chooses a game from candidate games for creating entities by loads of games
+type lbcStrategy interface {
+	choose(games []*gameDispatchInfo) *gameDispatchInfo
+}
+
+func newLBCStrategy(name string, scoreWeights map[string]float64) lbcStrategy {
+	switch name {
+	case config.LBCStrategyCPU:
+		return &leastLoadStrategy{load: cpuLoad}
+	case config.LBCStrategyEntities:
+		return &leastLoadStrategy{load: entityLoad}
+	case config.LBCStrategyClients:
+		return &leastLoadStrategy{load: clientLoad}
+	case config.LBCStrategyRoundRobin:
+		return &roundRobinStrategy{currentWeights: map[uint16]int{}}
+	case config.LBCStrategyComposite:
+		return &compositeStrategy{weights: scoreWeights}
+	default:
+		gwlog.Panicf("unknown lbc strategy: %s", name)
+		return nil
+	}
+}
+
+// loads of games which also count games chosen since the last report of load info
+func cpuLoad(gdi *gameDispatchInfo) float64 {
+	// increase CPU percent by a bit for each choice, but not too much
+	return gdi.lbcinfo.CPUPercent + math.Min(float64(gdi.lbcChosen)*0.1, 10)
+}
+
+func entityLoad(gdi *gameDispatchInfo) float64 {
+	return float64(gdi.lbcinfo.EntityCount + gdi.lbcChosen)
+}
+
+func clientLoad(gdi *gameDispatchInfo) float64 {
+	return float64(gdi.lbcinfo.ClientCount + gdi.lbcChosen)
+}
+
+func memoryLoad(gdi *gameDispatchInfo) float64 {
+	return float64(gdi.lbcinfo.MemoryBytes)
+}
+
+// leastLoadStrategy chooses the game with least load
+type leastLoadStrategy struct {
+	load func(gdi *gameDispatchInfo) float64
+}
+
+func (s *leastLoadStrategy) choose(games []*gameDispatchInfo) *gameDispatchInfo {
+	var chosen *gameDispatchInfo
+	var minLoad float64
+	for _, gdi := range games {
+		if load := s.load(gdi); chosen == nil || load < minLoad {
+			chosen, minLoad = gdi, load
+		}
+	}
+	return chosen
+}
+
+// roundRobinStrategy chooses games in a smooth weighted round robin way using weights reported by games
+type roundRobinStrategy struct {
+	currentWeights map[uint16]int
+}
+
+func (s *roundRobinStrategy) choose(games []*gameDispatchInfo) *gameDispatchInfo {
+	var chosen *gameDispatchInfo
+	totalWeight := 0
+	for _, gdi := range games {
+		weight := gdi.lbcinfo.Weight
+		if weight <= 0 { // load info is not reported yet
+			weight = 1
+		}
+		s.currentWeights[gdi.gameid] += weight
+		totalWeight += weight
+		if chosen == nil || s.currentWeights[gdi.gameid] > s.currentWeights[chosen.gameid] {
+			chosen = gdi
+		}
+	}
+	if chosen != nil {
+		s.currentWeights[chosen.gameid] -= totalWeight
+	}
+	return chosen
+}
+
+// compositeStrategy chooses the game with least score, which is the weighted sum of loads normalized by max loads
+type compositeStrategy struct {
+	weights map[string]float64
+}
+
+var compositeLoads = map[string]func(gdi *gameDispatchInfo) float64{
+	"cpu":      cpuLoad,
+	"entities": entityLoad,
+	"clients":  clientLoad,
+	"memory":   memoryLoad,
+}
+
+func (s *compositeStrategy) choose(games []*gameDispatchInfo) *gameDispatchInfo {
+	scores := make([]float64, len(games))
+	for metric, weight := range s.weights {
+		load := compositeLoads[metric]
+		if weight == 0 || load == nil {
+			continue
+		}
+
+		maxLoad := 0.0
+		for _, gdi := range games {
+			maxLoad = math.Max(maxLoad, load(gdi))
+		}
+		if maxLoad == 0 {
+			continue
+		}
+		for i, gdi := range games {
+			scores[i] += weight * load(gdi) / maxLoad
+		}
+	}
+
+	var chosen *gameDispatchInfo
+	var minScore float64
+	for i, gdi := range games {
+		if chosen == nil || scores[i] < minScore {
+			chosen, minScore = gdi, scores[i]
+		}
+	}
+	return chosen
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/sagacao/goworld/engine/config"
+	"github.com/sagacao/goworld/engine/proto"
+)
+
+func makeLBCGames(infos ...proto.GameLBCInfo) []*gameDispatchInfo {
+	games := make([]*gameDispatchInfo, len(infos))
+	for i, info := range infos {
+		games[i] = &gameDispatchInfo{gameid: uint16(i + 1), lbcinfo: info}
+	}
+	return games
+}
+
+func chooseN(s lbcStrategy, games []*gameDispatchInfo, n int) []uint16 {
+	var gameids []uint16
+	for i := 0; i < n; i++ {
+		gdi := s.choose(games)
+		gdi.lbcChosen += 1
+		gameids = append(gameids, gdi.gameid)
+	}
+	return gameids
+}
+
+func TestLeastLoadStrategies(t *testing.T) {
+	games := makeLBCGames(
+		proto.GameLBCInfo{CPUPercent: 50, EntityCount: 10, ClientCount: 3},
+		proto.GameLBCInfo{CPUPercent: 20, EntityCount: 12, ClientCount: 1},
+	)
+	if gdi := newLBCStrategy(config.LBCStrategyCPU, nil).choose(games); gdi.gameid != 2 {
+		t.Errorf("cpu strategy chose game%d", gdi.gameid)
+	}
+	if gdi := newLBCStrategy(config.LBCStrategyEntities, nil).choose(games); gdi.gameid != 1 {
+		t.Errorf("entities strategy chose game%d", gdi.gameid)
+	}
+	if gdi := newLBCStrategy(config.LBCStrategyClients, nil).choose(games); gdi.gameid != 2 {
+		t.Errorf("clients strategy chose game%d", gdi.gameid)
+	}
+
+	// chosen games are counted as loaded before the next report
+	gameids := chooseN(newLBCStrategy(config.LBCStrategyEntities, nil), games, 4)
+	if gameids[0] != 1 || gameids[1] != 1 || gameids[2] != 1 {
+		t.Errorf("entities strategy chose %v", gameids)
+	}
+
+	if newLBCStrategy(config.LBCStrategyCPU, nil).choose(nil) != nil {
+		t.Errorf("no game should be chosen")
+	}
+}
+
+func TestRoundRobinStrategy(t *testing.T) {
+	games := makeLBCGames(proto.GameLBCInfo{Weight: 2}, proto.GameLBCInfo{Weight: 1}, proto.GameLBCInfo{})
+	counts := map[uint16]int{}
+	for _, gameid := range chooseN(newLBCStrategy(config.LBCStrategyRoundRobin, nil), games, 8) {
+		counts[gameid] += 1
+	}
+	if counts[1] != 4 || counts[2] != 2 || counts[3] != 2 {
+		t.Errorf("round robin strategy chose %v", counts)
+	}
+}
+
+func TestCompositeStrategy(t *testing.T) {
+	games := makeLBCGames(
+		proto.GameLBCInfo{CPUPercent: 10, EntityCount: 1000, MemoryBytes: 100},
+		proto.GameLBCInfo{CPUPercent: 40, EntityCount: 100, MemoryBytes: 100},
+	)
+	s := newLBCStrategy(config.LBCStrategyComposite, map[string]float64{"cpu": 1, "entities": 1, "memory": 1})
+	if gdi := s.choose(games); gdi.gameid != 2 {
+		t.Errorf("composite strategy chose game%d", gdi.gameid)
+	}
+	s = newLBCStrategy(config.LBCStrategyComposite, map[string]float64{"cpu": 1})
+	if gdi := s.choose(games); gdi.gameid != 1 {
+		t.Errorf("composite strategy chose game%d", gdi.gameid)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	"github.com/sagacao/goworld/engine/config"
+	"github.com/sagacao/goworld/engine/gwlog"
+	"github.com/sagacao/goworld/engine/metrics"
+)
+
+const (
+	// games which do not report load info in time are not rebalanced
+	_REBALANCE_LBC_INFO_TIMEOUT = time.Second * 5
+	// only one dispatcher rebalances entities, so that games are not rebalanced by multiple dispatchers
+	_REBALANCE_DISPID = 1
+)
+
+var rebalanceEntityCountMetric = metrics.NewCounter("goworld_dispatcher_rebalance_entities_total", "Number of entities requested to migrate by rebalancing")
+
+// checkRebalance checks loads of games and migrates entities from the hottest game to the coolest game if necessary
+func (service *DispatcherService) checkRebalance(now time.Time) {
+	cfg := service.config
+	if cfg.RebalanceInterval <= 0 || service.dispid != _REBALANCE_DISPID || !service.isActive.Load() || !service.isDeploymentReady {
+		return
+	}
+
+	if now.Sub(service.lastRebalanceTime) < cfg.RebalanceInterval {
+		return
+	}
+	service.lastRebalanceTime = now
+
+	hot, cool := selectRebalanceGames(service.lbcGames, now)
+	if hot == nil {
+		return
+	}
+
+	count := rebalanceEntityCount(hot, cool, cfg)
+	if count <= 0 {
+		return
+	}
+
+	gwlog.Infof("%s: rebalance %d entities from game%d (cpu %.1f%%, %d entities) to game%d (cpu %.1f%%, %d entities), dry run = %v",
+		service, count, hot.gameid, hot.lbcinfo.CPUPercent, hot.lbcinfo.EntityCount, cool.gameid, cool.lbcinfo.CPUPercent, cool.lbcinfo.EntityCount, cfg.RebalanceDryRun)
+	if err := hot.clientProxy.SendRebalanceEntities(cool.gameid, count, cfg.RebalanceDryRun); err != nil {
+		gwlog.Errorf("%s: send rebalance entities to game%d failed: %s", service, hot.gameid, err)
+		return
+	}
+	if !cfg.RebalanceDryRun {
+		rebalanceEntityCountMetric.Add(uint64(count))
+	}
+}
+
+// selectRebalanceGames selects the hottest and the coolest games which are connected and report load info in time
+func selectRebalanceGames(games []*gameDispatchInfo, now time.Time) (hot *gameDispatchInfo, cool *gameDispatchInfo) {
+	for _, gdi := range games {
+		if gdi.clientProxy == nil || gdi.isBlocked || now.Sub(gdi.lbcUpdateTime) > _REBALANCE_LBC_INFO_TIMEOUT {
+			continue
+		}
+		if hot == nil || gdi.lbcinfo.CPUPercent > hot.lbcinfo.CPUPercent {
+			hot = gdi
+		}
+		if cool == nil || gdi.lbcinfo.CPUPercent < cool.lbcinfo.CPUPercent {
+			cool = gdi
+		}
+	}
+
+	if hot == cool {
+		return nil, nil
+	}
+	return
+}
+
+// rebalanceEntityCount returns the number of entities to be migrated from the hot game to the cool game, so that CPU
+// percents of both games are close
+func rebalanceEntityCount(hot *gameDispatchInfo, cool *gameDispatchInfo, cfg *config.DispatcherConfig) int {
+	diff := hot.lbcinfo.CPUPercent - cool.lbcinfo.CPUPercent
+	if diff < cfg.RebalanceThreshold || hot.lbcinfo.CPUPercent <= 0 {
+		return 0
+	}
+
+	// assume that entities on the hot game consume CPU evenly, so migrate entities of half the difference
+	count := int(math.Ceil(float64(hot.lbcinfo.EntityCount) * diff / 2 / hot.lbcinfo.CPUPercent))
+	if count > cfg.RebalanceMaxEntities {
+		count = cfg.RebalanceMaxEntities
+	}
+	return count
+}
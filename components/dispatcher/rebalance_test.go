@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sagacao/goworld/engine/config"
+	"github.com/sagacao/goworld/engine/proto"
+)
+
+func TestRebalance(t *testing.T) {
+	now := time.Now()
+	games := makeLBCGames(
+		proto.GameLBCInfo{CPUPercent: 90, EntityCount: 1000},
+		proto.GameLBCInfo{CPUPercent: 30, EntityCount: 300},
+		proto.GameLBCInfo{CPUPercent: 10, EntityCount: 100},
+		proto.GameLBCInfo{CPUPercent: 0},
+	)
+	for _, gdi := range games[:3] {
+		gdi.clientProxy = &dispatcherClientProxy{}
+		gdi.lbcUpdateTime = now
+	}
+	// game4 is not connected, and game3 does not report load info in time
+	games[2].lbcUpdateTime = now.Add(-time.Minute)
+
+	hot, cool := selectRebalanceGames(games, now)
+	if hot != games[0] || cool != games[1] {
+		t.Fatalf("wrong games selected for rebalancing: %v, %v", hot, cool)
+	}
+
+	cfg := &config.DispatcherConfig{RebalanceThreshold: 20, RebalanceMaxEntities: 1000}
+	if count := rebalanceEntityCount(hot, cool, cfg); count != 334 {
+		t.Errorf("should rebalance 334 entities, but %d", count)
+	}
+	cfg.RebalanceMaxEntities = 10
+	if count := rebalanceEntityCount(hot, cool, cfg); count != 10 {
+		t.Errorf("should rebalance 10 entities, but %d", count)
+	}
+	cfg.RebalanceThreshold = 70
+	if count := rebalanceEntityCount(hot, cool, cfg); count != 0 {
+		t.Errorf("should not rebalance, but %d", count)
+	}
+
+	if hot, cool := selectRebalanceGames(games[:1], now); hot != nil || cool != nil {
+		t.Errorf("should not rebalance with only one game")
+	}
+}
@@ -0,0 +1,590 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/sagacao/goworld/engine/common"
+	"github.com/sagacao/goworld/engine/consts"
+	"github.com/sagacao/goworld/engine/gwlog"
+	"github.com/sagacao/goworld/engine/netutil"
+	"github.com/sagacao/goworld/engine/proto"
+)
+
+// Each dispatcher slot can have a standby dispatcher. The active dispatcher streams its routing tables (entity -> game),
+// blocking states of entities (loading and migrating) and games (freezing), games, srvdis data and the number of
+// delivered packets from each game and gate to the standby. When the active dispatcher is down, the standby is
+// promoted and games & gates reconnect to it. Games & gates keep the packets sent to dispatcher until they are
+// acknowledged, and resend them after reconnecting, while the dispatcher skips the resent packets that were already
+// delivered according to the replicated receive sequence numbers.
+//
+// A packet from a game or gate is delivered when all packets forwarded for it (including packets waiting for blocked
+// entities or games) are acknowledged by the target games or gates, which acknowledge received packets every
+// DISPATCHER_CLIENT_ACK_INTERVAL. Packets are acknowledged one tick after they are delivered and the receive sequence
+// numbers are replicated, so packets are not lost as long as the replication stream reaches the standby within one
+// tick. Games and gates block senders if too many packets are not acknowledged.
+//
+// Delivery after failover is at-least-once: packets processed by the failed dispatcher after its last replicated
+// receive sequence numbers are resent and processed again by the promoted dispatcher, so targets may receive packets
+// forwarded for them twice.
+//
+// The primary dispatcher is preferred: it is promoted when the peer is not active, while the standby dispatcher is only
+// promoted after no states are replicated for DISPATCHER_STANDBY_PROMOTE_TIMEOUT. Every promotion increases the epoch
+// of the dispatcher slot. Games and gates remember the latest epoch acknowledged by dispatchers, and an active
+// dispatcher of an older epoch (e.g. the primary dispatcher after a network partition) is fenced: it is demoted when
+// it meets a game, gate or peer dispatcher of a newer epoch, and replicates states from the peer dispatcher then.
+// States changed on the fenced dispatcher since the promotion of the peer are lost.
+
+// Replication operations in MT_REPLICATE_DISPATCHER_STATE packets
+const (
+	replOpReset            byte = iota + 1 // clear replicated states before applying a snapshot
+	replOpSetEntity                        // entity ID, gameid (0 for deleting)
+	replOpSetGame                          // gameid, isBanBootEntity
+	replOpSrvdisRegister                   // srvid, srvinfo
+	replOpDeploymentReady                  //
+	replOpRecvSeq                          // dispatcher client ID, epoch, receive sequence number
+	replOpPromote                          // only queued by the dispatcher itself when the peer dispatcher is not active
+	replOpCrontabSingleton                 // job name, last granted fire time
+	replOpEpoch                            // epoch of the active dispatcher
+	replOpBlockEntity                      // entity ID, block until time (0 for unblocked)
+	replOpBlockGame                        // gameid, isBlocked, block until time (0 for unblocked)
+)
+
+const (
+	_REPLICATION_PACKET_PAYLOAD_LIMIT = 1024 * 1024
+	_REPLICATION_RETRY_INTERVAL       = time.Second
+	_REPLICATION_HEARTBEAT_INTERVAL   = time.Second // empty replication packets are sent to standby as heartbeats
+)
+
+// dispatcherClientID identifies a game or gate across connections
+type dispatcherClientID struct {
+	isGate bool
+	id     uint16
+}
+
+// recvSeqInfo is the sequence number of the last delivered packet from a game or gate
+//
+// Epoch changes when the game or gate restarts, and sequence numbers of different epochs are not comparable
+type recvSeqInfo struct {
+	epoch        uint64
+	seq          uint64
+	processedSeq uint64 // sequence number of the last packet processed by this dispatcher, which is not replicated
+}
+
+func (service *DispatcherService) listenAddr() string {
+	if service.isStandbyNode {
+		if service.config.StandbyListenAddr != "" {
+			return service.config.StandbyListenAddr
+		}
+		return service.config.StandbyAdvertiseAddr
+	}
+	return service.config.ListenAddr
+}
+
+// peerAddr returns the address of the other dispatcher in the same slot
+func (service *DispatcherService) peerAddr() string {
+	if service.isStandbyNode {
+		return service.config.AdvertiseAddr
+	}
+	return service.config.StandbyAdvertiseAddr
+}
+
+// replicateFromPeer replicates states from the peer dispatcher when the dispatcher is not active, and promotes the
+// dispatcher if the peer is not active either
+//
+// The primary dispatcher is promoted as soon as no states can be replicated from the peer. The standby dispatcher
+// keeps retrying, and is promoted if no states are replicated for DISPATCHER_STANDBY_PROMOTE_TIMEOUT. The active
+// dispatcher also connects to the peer if no standby is connected, so that one of them is demoted if both are active.
+func (service *DispatcherService) replicateFromPeer() {
+	peerAddr := service.peerAddr()
+	lastReplicateTime := time.Now()
+	for {
+		if service.isActive.Load() && service.hasStandby.Load() {
+			lastReplicateTime = time.Now()
+			time.Sleep(_REPLICATION_RETRY_INTERVAL)
+			continue
+		}
+
+		replicated := false
+		conn, err := netutil.ConnectTCP(peerAddr)
+		if err == nil {
+			gwlog.Debugf("%s: connected to peer dispatcher %s", service, peerAddr)
+			replicated = service.recvReplication(conn)
+		} else if !service.isActive.Load() {
+			gwlog.Warnf("%s: connect to peer dispatcher %s failed: %s", service, peerAddr, err)
+		}
+		if replicated {
+			lastReplicateTime = time.Now()
+		}
+
+		if !service.isActive.Load() && (!service.isStandbyNode && !replicated || time.Since(lastReplicateTime) >= consts.DISPATCHER_STANDBY_PROMOTE_TIMEOUT) {
+			gwlog.Warnf("%s: no states replicated from peer dispatcher %s, promoting ...", service, peerAddr)
+			// queue the promotion after all replicated states
+			pkt := netutil.NewPacket()
+			pkt.AppendByte(replOpPromote)
+			service.messageQueue <- dispatcherMessage{nil, proto.Message{proto.MT_REPLICATE_DISPATCHER_STATE, pkt}}
+			lastReplicateTime = time.Now()
+		}
+		time.Sleep(_REPLICATION_RETRY_INTERVAL)
+	}
+}
+
+// recvReplication receives replicated states from the peer dispatcher until the connection is down, returns if any
+// states are replicated
+func (service *DispatcherService) recvReplication(conn net.Conn) (replicated bool) {
+	gwc := proto.NewGoWorldConnection(netutil.NewBufferedConnection(netutil.NetConnection{conn}), false, "")
+	defer gwc.Close()
+
+	gwc.SendSetStandbyDispatcher(service.dispid, service.isActive.Load(), atomic.LoadUint64(&service.epoch))
+	if err := gwc.Flush("SetStandbyDispatcher"); err != nil {
+		return
+	}
+
+	for {
+		var msgtype proto.MsgType
+		gwc.SetRecvDeadline(time.Now().Add(consts.DISPATCHER_STANDBY_PROMOTE_TIMEOUT))
+		pkt, err := gwc.Recv(&msgtype)
+		if err != nil {
+			gwlog.Warnf("%s: replication from peer dispatcher is down: %s", service, err)
+			return
+		}
+
+		if msgtype != proto.MT_REPLICATE_DISPATCHER_STATE {
+			gwlog.Errorf("%s: unexpected msgtype %d from peer dispatcher", service, msgtype)
+			pkt.Release()
+			continue
+		}
+		if !replicated {
+			gwlog.Infof("%s: replicating from peer dispatcher %s as standby ...", service, conn.RemoteAddr())
+			replicated = true
+		}
+		service.messageQueue <- dispatcherMessage{nil, proto.Message{msgtype, pkt}}
+	}
+}
+
+func (service *DispatcherService) promote() {
+	if service.isActive.Load() {
+		return
+	}
+
+	atomic.StoreUint64(&service.epoch, service.epoch+1)
+	service.isActive.Store(true)
+	// gates connected to the failed dispatcher keep running, wait for them to reconnect
+	for clientID := range service.recvSeqs {
+		if clientID.isGate {
+			service.disconnectedGates[clientID.id] = time.Now().Add(consts.DISPATCHER_GATE_RECONNECT_TIMEOUT)
+		}
+	}
+	gwlog.Infof("%s: promoted to active dispatcher of epoch %d with %d games, %d entities, %d srvdis registers", service, service.epoch, len(service.games), len(service.entityDispatchInfos), len(service.srvdisRegisterMap))
+}
+
+// demote is called when an active dispatcher of newer epoch is found, and states are replicated from it later
+func (service *DispatcherService) demote() {
+	if !service.isActive.Load() {
+		return
+	}
+
+	gwlog.Warnf("%s: fenced by active dispatcher of newer epoch, demoted from epoch %d", service, service.epoch)
+	service.isActive.Store(false)
+	for _, gdi := range service.games {
+		if gdi.clientProxy != nil {
+			gdi.clientProxy.Close()
+		}
+	}
+	for _, dcp := range service.gates {
+		dcp.Close()
+	}
+	if service.standby != nil {
+		service.standby.Close()
+		service.standby = nil
+		service.hasStandby.Store(false)
+	}
+}
+
+// isFencedBy returns if the dispatcher should give way to an active dispatcher of the epoch
+//
+// The primary dispatcher wins if both dispatchers are of the same epoch.
+func (service *DispatcherService) isFencedBy(epoch uint64) bool {
+	return epoch > service.epoch || epoch == service.epoch && service.isStandbyNode
+}
+
+// checkFenced demotes the dispatcher if the game or gate has seen an active dispatcher of newer epoch
+func (service *DispatcherService) checkFenced(dcp *dispatcherClientProxy, dispatcherEpoch uint64) bool {
+	if dispatcherEpoch <= service.epoch {
+		return false
+	}
+
+	gwlog.Warnf("%s: %s has seen dispatcher epoch %d, which is newer than %d", service, dcp, dispatcherEpoch, service.epoch)
+	service.demote()
+	dcp.Close()
+	return true
+}
+
+func (service *DispatcherService) handleSetStandbyDispatcher(dcp *dispatcherClientProxy, pkt *netutil.Packet) {
+	standbyDispid := pkt.ReadUint16()
+	peerIsActive := pkt.ReadBool()
+	peerEpoch := pkt.ReadUint64()
+	if standbyDispid != service.dispid {
+		gwlog.Warnf("%s: reject standby dispatcher%d from %s", service, standbyDispid, dcp)
+		dcp.Close()
+		return
+	}
+
+	if peerIsActive {
+		if service.isActive.Load() && service.isFencedBy(peerEpoch) {
+			service.demote()
+		}
+		if !service.isActive.Load() {
+			// the peer keeps active, and this dispatcher replicates from it
+			dcp.Close()
+			return
+		}
+	} else if !service.isActive.Load() {
+		if service.isStandbyNode {
+			// the primary dispatcher is preferred when both are not active
+			dcp.Close()
+			return
+		}
+		service.promote()
+	}
+
+	if service.standby != nil {
+		gwlog.Warnf("%s: standby dispatcher %s is replaced by %s", service, service.standby, dcp)
+		service.standby.Close()
+	}
+
+	dcp.isStandby = true
+	service.standby = dcp
+	service.hasStandby.Store(true)
+	service.sendReplicationSnapshot()
+	gwlog.Infof("%s: standby dispatcher connected: %s", service, dcp)
+}
+
+// sendReplicationSnapshot sends all replicated states to the standby dispatcher
+func (service *DispatcherService) sendReplicationSnapshot() {
+	service.flushReplicationPacket() // pending operations are included in the snapshot, but keep them in order anyway
+
+	service.replicationPacket().AppendByte(replOpReset)
+	service.replicateEpoch()
+	for gameid, gdi := range service.games {
+		service.replicateGame(gameid, gdi.isBanBootEntity)
+	}
+	for gameid, gdi := range service.games {
+		if gdi.isBlocked || !gdi.blockUntilTime.IsZero() {
+			service.replicateGameBlock(gameid, gdi)
+		}
+	}
+	for eid, edi := range service.entityDispatchInfos {
+		if edi.gameid != 0 {
+			service.replicateEntity(eid, edi.gameid)
+		}
+		if !edi.blockUntilTime.IsZero() {
+			service.replicateEntityBlock(eid, edi)
+		}
+	}
+	for srvid, srvinfo := range service.srvdisRegisterMap {
+		service.replicateSrvdisRegister(srvid, srvinfo)
+	}
+	if service.isDeploymentReady {
+		service.replicateDeploymentReady()
+	}
+	for clientID, info := range service.recvSeqs {
+		service.replicateRecvSeq(clientID, info)
+	}
+	for name, fireTime := range service.crontabSingletons {
+		service.replicateCrontabSingleton(name, fireTime)
+	}
+	service.flushReplicationPacket()
+}
+
+// replicationPacket returns the packet for appending replication operations, or nil if there is no standby
+func (service *DispatcherService) replicationPacket() *netutil.Packet {
+	if service.standby == nil {
+		return nil
+	}
+
+	pkt := service.pendingReplicationPacket
+	if pkt != nil && pkt.GetPayloadLen() >= _REPLICATION_PACKET_PAYLOAD_LIMIT {
+		service.flushReplicationPacket()
+		pkt = nil
+	}
+
+	if pkt == nil {
+		pkt = netutil.NewPacket()
+		pkt.AppendUint16(proto.MT_REPLICATE_DISPATCHER_STATE)
+		service.pendingReplicationPacket = pkt
+	}
+	return pkt
+}
+
+func (service *DispatcherService) flushReplicationPacket() {
+	pkt := service.pendingReplicationPacket
+	if pkt == nil {
+		return
+	}
+
+	service.pendingReplicationPacket = nil
+	if service.standby != nil {
+		service.standby.SendPacket(pkt)
+		service.lastReplicationTime = time.Now()
+	}
+	pkt.Release()
+}
+
+func (service *DispatcherService) replicateEntity(eid common.EntityID, gameid uint16) {
+	if pkt := service.replicationPacket(); pkt != nil {
+		pkt.AppendByte(replOpSetEntity)
+		pkt.AppendEntityID(eid)
+		pkt.AppendUint16(gameid)
+	}
+}
+
+func (service *DispatcherService) replicateEntityBlock(eid common.EntityID, edi *entityDispatchInfo) {
+	if pkt := service.replicationPacket(); pkt != nil {
+		pkt.AppendByte(replOpBlockEntity)
+		pkt.AppendEntityID(eid)
+		pkt.AppendUint64(uint64(unixNano(edi.blockUntilTime)))
+	}
+}
+
+func (service *DispatcherService) replicateGameBlock(gameid uint16, gdi *gameDispatchInfo) {
+	if pkt := service.replicationPacket(); pkt != nil {
+		pkt.AppendByte(replOpBlockGame)
+		pkt.AppendUint16(gameid)
+		pkt.AppendBool(gdi.isBlocked)
+		pkt.AppendUint64(uint64(unixNano(gdi.blockUntilTime)))
+	}
+}
+
+// unixNano returns 0 for the zero time
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// timeFromUnixNano returns the zero time for 0
+func timeFromUnixNano(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+func (service *DispatcherService) replicateGame(gameid uint16, isBanBootEntity bool) {
+	if pkt := service.replicationPacket(); pkt != nil {
+		pkt.AppendByte(replOpSetGame)
+		pkt.AppendUint16(gameid)
+		pkt.AppendBool(isBanBootEntity)
+	}
+}
+
+func (service *DispatcherService) replicateSrvdisRegister(srvid string, srvinfo string) {
+	if pkt := service.replicationPacket(); pkt != nil {
+		pkt.AppendByte(replOpSrvdisRegister)
+		pkt.AppendVarStr(srvid)
+		pkt.AppendVarStr(srvinfo)
+	}
+}
+
+func (service *DispatcherService) replicateDeploymentReady() {
+	if pkt := service.replicationPacket(); pkt != nil {
+		pkt.AppendByte(replOpDeploymentReady)
+	}
+}
+
+func (service *DispatcherService) replicateRecvSeq(clientID dispatcherClientID, info recvSeqInfo) {
+	if pkt := service.replicationPacket(); pkt != nil {
+		pkt.AppendByte(replOpRecvSeq)
+		pkt.AppendBool(clientID.isGate)
+		pkt.AppendUint16(clientID.id)
+		pkt.AppendUint64(info.epoch)
+		pkt.AppendUint64(info.seq)
+	}
+}
+
+func (service *DispatcherService) replicateEpoch() {
+	if pkt := service.replicationPacket(); pkt != nil {
+		pkt.AppendByte(replOpEpoch)
+		pkt.AppendUint64(service.epoch)
+	}
+}
+
+func (service *DispatcherService) replicateCrontabSingleton(name string, fireTime int64) {
+	if pkt := service.replicationPacket(); pkt != nil {
+		pkt.AppendByte(replOpCrontabSingleton)
+		pkt.AppendVarStr(name)
+		pkt.AppendUint64(uint64(fireTime))
+	}
+}
+
+func (service *DispatcherService) handleReplicateDispatcherState(dcp *dispatcherClientProxy, pkt *netutil.Packet) {
+	if dcp != nil {
+		// replicated states are only received from the replication connection
+		gwlog.Errorf("%s: unexpected replication from %s", service, dcp)
+		return
+	}
+
+	for pkt.HasUnreadPayload() {
+		op := pkt.ReadOneByte()
+		switch op {
+		case replOpReset:
+			// a snapshot is only sent by an active dispatcher which fenced this one
+			service.demote()
+			service.games = map[uint16]*gameDispatchInfo{}
+			service.lbcGames = nil
+			service.bootGames = nil
+			service.gates = map[uint16]*dispatcherClientProxy{}
+			service.disconnectedGates = map[uint16]time.Time{}
+			service.isDeploymentReady = false
+			service.entityDispatchInfos = map[common.EntityID]*entityDispatchInfo{}
+			service.srvdisRegisterMap = map[string]string{}
+			service.recvSeqs = map[dispatcherClientID]recvSeqInfo{}
+			service.crontabSingletons = map[string]int64{}
+		case replOpSetEntity:
+			eid := pkt.ReadEntityID()
+			gameid := pkt.ReadUint16()
+			if gameid == 0 {
+				service.delEntityDispatchInfo(eid)
+			} else {
+				service.setEntityDispatcherInfoForWrite(eid).gameid = gameid
+			}
+		case replOpSetGame:
+			gameid := pkt.ReadUint16()
+			isBanBootEntity := pkt.ReadBool()
+			service.setGameDispatchInfo(gameid, isBanBootEntity)
+		case replOpSrvdisRegister:
+			srvid := pkt.ReadVarStr()
+			service.srvdisRegisterMap[srvid] = pkt.ReadVarStr()
+		case replOpDeploymentReady:
+			service.isDeploymentReady = true
+		case replOpRecvSeq:
+			var clientID dispatcherClientID
+			clientID.isGate = pkt.ReadBool()
+			clientID.id = pkt.ReadUint16()
+			var info recvSeqInfo
+			info.epoch = pkt.ReadUint64()
+			info.seq = pkt.ReadUint64()
+			info.processedSeq = info.seq
+			service.recvSeqs[clientID] = info
+		case replOpPromote:
+			service.promote()
+		case replOpCrontabSingleton:
+			name := pkt.ReadVarStr()
+			service.crontabSingletons[name] = int64(pkt.ReadUint64())
+		case replOpEpoch:
+			atomic.StoreUint64(&service.epoch, pkt.ReadUint64())
+		case replOpBlockEntity:
+			eid := pkt.ReadEntityID()
+			service.setEntityDispatcherInfoForWrite(eid).blockUntilTime = timeFromUnixNano(int64(pkt.ReadUint64()))
+		case replOpBlockGame:
+			gameid := pkt.ReadUint16()
+			isBlocked := pkt.ReadBool()
+			blockUntilTime := timeFromUnixNano(int64(pkt.ReadUint64()))
+			if gdi := service.games[gameid]; gdi != nil {
+				gdi.isBlocked = isBlocked
+				gdi.blockUntilTime = blockUntilTime
+			}
+		default:
+			gwlog.Panicf("%s: invalid replication operation: %d", service, op)
+		}
+	}
+}
+
+// startRecvSeq is called when a game or gate connects, firstSeq is the sequence number of the first packet it will send
+func (service *DispatcherService) startRecvSeq(dcp *dispatcherClientProxy, epoch uint64, firstSeq uint64) {
+	dcp.epoch = epoch
+	known, ok := service.recvSeqs[dcp.clientID()]
+	if !service.config.HasStandby() {
+		// packets are not resent if standby dispatcher is not configured
+		dcp.recvSeq = firstSeq - 1
+	} else if ok && known.epoch == epoch && known.processedSeq >= firstSeq {
+		// packets till known.processedSeq are already processed before reconnecting, skip them
+		dcp.skipPackets = known.processedSeq - firstSeq + 1
+		dcp.recvSeq = known.processedSeq
+	} else {
+		dcp.recvSeq = firstSeq - 1
+	}
+	dcp.replicatedSeq = dcp.recvSeq
+	dcp.ackedSeq = dcp.recvSeq
+	if dcp.skipPackets > 0 {
+		gwlog.Infof("%s: %s reconnected from seq %d, skipping %d packets that are already processed", service, dcp, firstSeq, dcp.skipPackets)
+	}
+	if service.config.HasStandby() {
+		// let the game or gate know the epoch of this dispatcher
+		dcp.SendDispatcherAck(service.epoch, dcp.ackedSeq)
+	}
+}
+
+// replicateAndAck is called every tick to replicate delivered sequence numbers to standby, and acknowledge packets of
+// which delivered sequence numbers were replicated in last tick
+func (service *DispatcherService) replicateAndAck() {
+	if !service.config.HasStandby() {
+		return
+	}
+
+	for _, gdi := range service.games {
+		if gdi.clientProxy != nil {
+			service.replicateAndAckClient(gdi.clientProxy)
+		}
+	}
+	for _, dcp := range service.gates {
+		service.replicateAndAckClient(dcp)
+	}
+
+	if service.standby != nil && service.pendingReplicationPacket == nil && time.Since(service.lastReplicationTime) >= _REPLICATION_HEARTBEAT_INTERVAL {
+		service.replicationPacket() // send an empty replication packet as heartbeat
+	}
+	service.flushReplicationPacket()
+}
+
+func (service *DispatcherService) replicateAndAckClient(dcp *dispatcherClientProxy) {
+	if dcp.ackedSeq != dcp.replicatedSeq {
+		dcp.SendDispatcherAck(service.epoch, dcp.replicatedSeq)
+		dcp.ackedSeq = dcp.replicatedSeq
+	}
+
+	if dcp.replicatedSeq != dcp.deliveredSeq() {
+		service.saveRecvSeq(dcp)
+	}
+}
+
+// saveRecvSeq saves the receive sequence number of the current connection of the game or gate, and replicates the
+// delivered sequence number
+func (service *DispatcherService) saveRecvSeq(dcp *dispatcherClientProxy) {
+	clientID := dcp.clientID()
+	info := recvSeqInfo{dcp.epoch, dcp.deliveredSeq(), dcp.recvSeq}
+	service.recvSeqs[clientID] = info
+	service.replicateRecvSeq(clientID, info)
+	dcp.replicatedSeq = info.seq
+}
+
+// deliverySourceOf returns the delivery source of the packet being received from the game or gate, packets are only
+// tracked for delivery if standby dispatcher is configured
+func (service *DispatcherService) deliverySourceOf(dcp *dispatcherClientProxy) deliverySource {
+	if dcp == nil || !service.config.HasStandby() || dcp.gameid == 0 && dcp.gateid == 0 {
+		return deliverySource{}
+	}
+	return deliverySource{dcp, dcp.recvSeq}
+}
+
+// queueDelivery is called when a packet forwarded for the received packet is queued for a blocked entity or game
+func (service *DispatcherService) queueDelivery() deliverySource {
+	source := service.delivering
+	if source.dcp != nil {
+		source.dcp.addUndelivered(source.seq)
+	}
+	return source
+}
+
+// redeliver sends a queued packet on behalf of the packet it is forwarded for
+func (service *DispatcherService) redeliver(source deliverySource, send func()) {
+	delivering := service.delivering
+	service.delivering = source
+	send()
+	service.delivering = delivering
+	// the queued packet is sent (or queued again), which is tracked by its own
+	source.delivered()
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sagacao/goworld/engine/common"
+	"github.com/sagacao/goworld/engine/config"
+	"github.com/sagacao/goworld/engine/dispatchercluster/dispatcherclient"
+	"github.com/sagacao/goworld/engine/netutil"
+	"github.com/sagacao/goworld/engine/proto"
+)
+
+// _TEST_DISPATCHER_ARGS_ENV makes the test binary run as a dispatcher with the arguments in it
+const _TEST_DISPATCHER_ARGS_ENV = "GOWORLD_TEST_DISPATCHER_ARGS"
+
+func TestMain(m *testing.M) {
+	if args := os.Getenv(_TEST_DISPATCHER_ARGS_ENV); args != "" {
+		os.Args = append([]string{os.Args[0]}, strings.Fields(args)...)
+		main()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+type testGameDelegate struct {
+	sync.Mutex
+	eids      []common.EntityID
+	connected bool
+	calls     map[string]int // number of times each method is called
+	resume    chan struct{}  // handling calls is paused until closed
+}
+
+func newTestGameDelegate(eids ...common.EntityID) *testGameDelegate {
+	resume := make(chan struct{})
+	close(resume)
+	return &testGameDelegate{eids: eids, calls: map[string]int{}, resume: resume}
+}
+
+func (delegate *testGameDelegate) HandleDispatcherClientPacket(msgtype proto.MsgType, packet *netutil.Packet) {
+	delegate.Lock()
+	if msgtype == proto.MT_SET_GAME_ID_ACK {
+		delegate.connected = true
+	} else if msgtype == proto.MT_CALL_ENTITY_METHOD {
+		packet.ReadEntityID()
+		delegate.calls[packet.ReadVarStr()] += 1
+	}
+	resume := delegate.resume
+	delegate.Unlock()
+	packet.Release()
+
+	if msgtype == proto.MT_CALL_ENTITY_METHOD {
+		<-resume
+	}
+}
+
+func (delegate *testGameDelegate) HandleDispatcherClientDisconnect() {
+}
+
+func (delegate *testGameDelegate) GetEntityIDsForDispatcher(dispid uint16) []common.EntityID {
+	return delegate.eids
+}
+
+func (delegate *testGameDelegate) isConnected() bool {
+	delegate.Lock()
+	defer delegate.Unlock()
+	return delegate.connected
+}
+
+// missingCalls returns methods from 0 to n-1 which are not called
+func (delegate *testGameDelegate) missingCalls(n int) (missing []int) {
+	delegate.Lock()
+	defer delegate.Unlock()
+	for i := 0; i < n; i++ {
+		if delegate.calls[strconv.Itoa(i)] == 0 {
+			missing = append(missing, i)
+		}
+	}
+	return
+}
+
+func freeTCPAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func startTestDispatcher(t *testing.T, configFile string, standby bool) *exec.Cmd {
+	args := fmt.Sprintf("-dispid 1 -configfile %s", configFile)
+	if standby {
+		args += " -standby"
+	}
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), _TEST_DISPATCHER_ARGS_ENV+"="+args)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return cmd
+}
+
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDispatcherFailover(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping dispatcher failover test in short mode")
+	}
+
+	dir, err := ioutil.TempDir("", "goworld_dispatcher_failover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configFile := filepath.Join(dir, "goworld.ini")
+	configContent := fmt.Sprintf(`[deployment]
+desired_dispatchers=1
+desired_games=2
+desired_gates=1
+
+[dispatcher1]
+listen_addr=%s
+advertise_addr=%[1]s
+standby_advertise_addr=%s
+log_file=%s
+log_level=info
+`, freeTCPAddr(t), freeTCPAddr(t), filepath.Join(dir, "dispatcher.log"))
+	if err := ioutil.WriteFile(configFile, []byte(configContent), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config.SetConfigFile(configFile)
+
+	primary := startTestDispatcher(t, configFile, false)
+	defer primary.Process.Kill()
+	standby := startTestDispatcher(t, configFile, true)
+	defer standby.Process.Kill()
+
+	eid := common.GenEntityID()
+	game1 := newTestGameDelegate()
+	game2 := newTestGameDelegate(eid)
+	dcm2 := dispatcherclient.NewDispatcherConnMgr(2, dispatcherclient.GameDispatcherClientType, 1, false, false, game2)
+	dcm2.Connect()
+	waitFor(t, 10*time.Second, "game2 connected", game2.isConnected)
+	dcm1 := dispatcherclient.NewDispatcherConnMgr(1, dispatcherclient.GameDispatcherClientType, 1, false, false, game1)
+	dcm1.Connect()
+	waitFor(t, 10*time.Second, "game1 connected", game1.isConnected)
+
+	// game1 creates the entity on game2, and then calls it continuously. game2 stops receiving calls after the first
+	// one, so that calls are kept in buffers of the active dispatcher when it is killed.
+	const numCalls = 3000
+	arg := strings.Repeat("x", 4096)
+	game2.Lock()
+	resume := make(chan struct{})
+	game2.resume = resume
+	game2.Unlock()
+	dcm1.GetDispatcherClientForSend().SendCreateEntitySomewhere(2, eid, "Test", map[string]interface{}{})
+	halfSent := make(chan struct{})
+	sendDone := make(chan struct{})
+	go func() {
+		for i := 0; i < numCalls; i++ {
+			if i == numCalls/2 {
+				close(halfSent)
+			}
+			dcm1.GetDispatcherClientForSend().SendCallEntityMethod(eid, strconv.Itoa(i), []interface{}{arg})
+		}
+		close(sendDone)
+	}()
+
+	<-halfSent
+	time.Sleep(100 * time.Millisecond)
+	// kill the active dispatcher mid-stream, the standby dispatcher should take over
+	primary.Process.Kill()
+	primary.Wait()
+	close(resume)
+
+	<-sendDone
+	deadline := time.Now().Add(30 * time.Second)
+	for missing := game2.missingCalls(numCalls); len(missing) > 0; missing = game2.missingCalls(numCalls) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d calls are lost after failover, the first is %d", len(missing), missing[0])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
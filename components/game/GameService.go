@@ -12,6 +12,7 @@ import (
 	"github.com/sagacao/goworld/engine/common"
 	"github.com/sagacao/goworld/engine/config"
 	"github.com/sagacao/goworld/engine/consts"
+	"github.com/sagacao/goworld/engine/crontab"
 	"github.com/sagacao/goworld/engine/dispatchercluster"
 	"github.com/sagacao/goworld/engine/entity"
 	"github.com/sagacao/goworld/engine/gwlog"
@@ -104,6 +105,31 @@ func (gs *GameService) serveRoutine() {
 				method := pkt.ReadVarStr()
 				args := pkt.ReadArgs()
 				gs.HandleCallEntityMethod(eid, method, args, "")
+			case proto.MT_CALL_ENTITY_METHOD_WITH_REPLY:
+				eid := pkt.ReadEntityID()
+				method := pkt.ReadVarStr()
+				args := pkt.ReadArgs()
+				callerID := pkt.ReadEntityID()
+				replyID := pkt.ReadUint32()
+				gs.HandleCallEntityMethodWithReply(eid, method, args, callerID, replyID)
+			case proto.MT_CALL_ENTITY_METHOD_REPLY:
+				callerID := pkt.ReadEntityID()
+				replyID := pkt.ReadUint32()
+				errmsg := pkt.ReadVarStr()
+				results := pkt.ReadArgs()
+				gs.HandleCallEntityMethodReply(callerID, replyID, errmsg, results)
+			case proto.MT_CALL_ENTITY_METHOD_RELIABLE:
+				eid := pkt.ReadEntityID()
+				method := pkt.ReadVarStr()
+				args := pkt.ReadArgs()
+				callerID := pkt.ReadEntityID()
+				seq := pkt.ReadUint64()
+				gs.HandleCallEntityMethodReliable(eid, method, args, callerID, seq)
+			case proto.MT_RELIABLE_CALL_ACK:
+				callerID := pkt.ReadEntityID()
+				calleeID := pkt.ReadEntityID()
+				seq := pkt.ReadUint64()
+				gs.HandleReliableCallAck(callerID, calleeID, seq)
 			case proto.MT_QUERY_SPACE_GAMEID_FOR_MIGRATE_ACK:
 				gs.HandleQuerySpaceGameIDForMigrateAck(pkt)
 			case proto.MT_MIGRATE_REQUEST_ACK:
@@ -113,12 +139,31 @@ func (gs *GameService) serveRoutine() {
 			case proto.MT_NOTIFY_CLIENT_CONNECTED:
 				clientid := pkt.ReadClientID()
 				eid := pkt.ReadEntityID()
+				resumeToken := pkt.ReadVarStr()
 				gid := pkt.ReadUint16()
-				gs.HandleNotifyClientConnected(clientid, eid, gid)
+				gs.HandleNotifyClientConnected(clientid, eid, resumeToken, gid)
 			case proto.MT_NOTIFY_CLIENT_DISCONNECTED:
 				eid := pkt.ReadEntityID()
 				clientid := pkt.ReadClientID()
-				gs.HandleNotifyClientDisconnected(eid, clientid)
+				resumable := pkt.ReadBool()
+				gs.HandleNotifyClientDisconnected(eid, clientid, resumable)
+			case proto.MT_RESUME_CLIENT:
+				eid := pkt.ReadEntityID()
+				clientid := pkt.ReadClientID()
+				resumeToken := pkt.ReadVarStr()
+				newResumeToken := pkt.ReadVarStr()
+				gid := pkt.ReadUint16()
+				gs.HandleResumeClient(eid, clientid, gid, resumeToken, newResumeToken)
+			case proto.MT_CLAIM_CRONTAB_SINGLETON_ACK:
+				name := pkt.ReadVarStr()
+				fireTime := int64(pkt.ReadUint64())
+				granted := pkt.ReadBool()
+				crontab.OnSingletonClaimed(name, fireTime, granted)
+			case proto.MT_REBALANCE_ENTITIES:
+				targetGameID := pkt.ReadUint16()
+				count := pkt.ReadUint32()
+				dryRun := pkt.ReadBool()
+				gs.HandleRebalanceEntities(targetGameID, int(count), dryRun)
 			case proto.MT_LOAD_ENTITY_SOMEWHERE:
 				_ = pkt.ReadUint16()
 				eid := pkt.ReadEntityID()
@@ -184,6 +229,7 @@ func (gs *GameService) serveRoutine() {
 		// after handling packets or firing timers, check the posted functions
 		post.Tick()
 		if isTick {
+			entity.FlushClientAttrChanges()
 			now := time.Now()
 			if !gs.nextCollectEntitySyncInfosTime.After(now) {
 				gs.nextCollectEntitySyncInfosTime = now.Add(gs.positionSyncInterval)
@@ -339,6 +385,7 @@ func (gs *GameService) handleNotifyGameDisconnected(pkt *netutil.Packet) {
 
 	gs.onlineGames.Remove(gameid)
 	gwlog.Infof("%s notify game disconnected: %d online games left", gs, len(gs.onlineGames))
+	service.OnGameDisconnected(gameid)
 }
 
 func (gs *GameService) handleNotifyDeploymentReady(pkt *netutil.Packet) {
@@ -417,8 +464,37 @@ func (gs *GameService) HandleCallEntityMethod(entityID common.EntityID, method s
 	entity.OnCall(entityID, method, args, clientid)
 }
 
-func (gs *GameService) HandleNotifyClientConnected(clientid common.ClientID, bootEid common.EntityID, gateid uint16) {
+func (gs *GameService) HandleCallEntityMethodWithReply(entityID common.EntityID, method string, args [][]byte, callerID common.EntityID, replyID uint32) {
+	if consts.DEBUG_PACKETS {
+		gwlog.Debugf("%s.HandleCallEntityMethodWithReply: %s.%s(%v), caller=%s, replyID=%d", gs, entityID, method, args, callerID, replyID)
+	}
+	entity.OnCallWithReply(entityID, method, args, callerID, replyID)
+}
+
+func (gs *GameService) HandleCallEntityMethodReply(callerID common.EntityID, replyID uint32, errmsg string, results [][]byte) {
+	if consts.DEBUG_PACKETS {
+		gwlog.Debugf("%s.HandleCallEntityMethodReply: caller=%s, replyID=%d, err=%q, results=%v", gs, callerID, replyID, errmsg, results)
+	}
+	entity.OnCallReply(callerID, replyID, errmsg, results)
+}
+
+func (gs *GameService) HandleCallEntityMethodReliable(entityID common.EntityID, method string, args [][]byte, callerID common.EntityID, seq uint64) {
+	if consts.DEBUG_PACKETS {
+		gwlog.Debugf("%s.HandleCallEntityMethodReliable: %s.%s(%v), caller=%s, seq=%d", gs, entityID, method, args, callerID, seq)
+	}
+	entity.OnCallReliable(entityID, method, args, callerID, seq)
+}
+
+func (gs *GameService) HandleReliableCallAck(callerID common.EntityID, calleeID common.EntityID, seq uint64) {
+	if consts.DEBUG_PACKETS {
+		gwlog.Debugf("%s.HandleReliableCallAck: caller=%s, callee=%s, seq=%d", gs, callerID, calleeID, seq)
+	}
+	entity.OnReliableCallAck(callerID, calleeID, seq)
+}
+
+func (gs *GameService) HandleNotifyClientConnected(clientid common.ClientID, bootEid common.EntityID, resumeToken string, gateid uint16) {
 	client := entity.MakeGameClient(clientid, gateid)
+	client.SetResumeToken(resumeToken)
 	if consts.DEBUG_PACKETS {
 		gwlog.Debugf("%s.handleNotifyClientConnected: %s", gs, client)
 	}
@@ -437,12 +513,27 @@ func (gs *GameService) HandleCallNilSpaces(method string, args [][]byte) {
 	entity.OnCallNilSpaces(method, args)
 }
 
-func (gs *GameService) HandleNotifyClientDisconnected(ownerID common.EntityID, clientid common.ClientID) {
+func (gs *GameService) HandleNotifyClientDisconnected(ownerID common.EntityID, clientid common.ClientID, resumable bool) {
 	if consts.DEBUG_CLIENTS {
-		gwlog.Debugf("%s.handleNotifyClientDisconnected: %s.%s", gs, ownerID, clientid)
+		gwlog.Debugf("%s.handleNotifyClientDisconnected: %s.%s, resumable=%v", gs, ownerID, clientid, resumable)
 	}
 	// find the owner of the client, and notify lose client
-	entity.OnClientDisconnected(ownerID, clientid)
+	entity.OnClientDisconnected(ownerID, clientid, resumable)
+}
+
+func (gs *GameService) HandleResumeClient(ownerID common.EntityID, clientid common.ClientID, gateid uint16, resumeToken string, newResumeToken string) {
+	if consts.DEBUG_CLIENTS {
+		gwlog.Debugf("%s.HandleResumeClient: %s.%s@%d", gs, ownerID, clientid, gateid)
+	}
+	entity.OnClientResume(ownerID, clientid, gateid, resumeToken, newResumeToken)
+}
+
+func (gs *GameService) HandleRebalanceEntities(targetGameID uint16, count int, dryRun bool) {
+	if !gs.onlineGames.Contains(targetGameID) {
+		gwlog.Warnf("%s: rebalance entities to game%d, but the game is not online", gs, targetGameID)
+		return
+	}
+	entity.OnRebalanceEntities(targetGameID, count, dryRun)
 }
 
 func (gs *GameService) HandleQuerySpaceGameIDForMigrateAck(pkt *netutil.Packet) {
@@ -31,6 +31,7 @@ import (
 	"github.com/sagacao/goworld/engine/entity"
 	"github.com/sagacao/goworld/engine/gwlog"
 	"github.com/sagacao/goworld/engine/kvdb"
+	"github.com/sagacao/goworld/engine/metrics"
 	"github.com/sagacao/goworld/engine/netutil"
 	"github.com/sagacao/goworld/engine/post"
 	"github.com/sagacao/goworld/engine/proto"
@@ -44,6 +45,7 @@ var (
 	logLevel        string
 	restore         bool
 	runInDaemonMode bool
+	upgradeSchema   string
 	gameService     *GameService
 	signalChan      = make(chan os.Signal, 1)
 	gameCtx         = context.Background()
@@ -56,6 +58,7 @@ func parseArgs() {
 	flag.StringVar(&logLevel, "log", "", "set log level, will override log level in config")
 	flag.BoolVar(&restore, "restore", false, "restore from freezed state")
 	flag.BoolVar(&runInDaemonMode, "d", false, "run in daemon mode")
+	flag.StringVar(&upgradeSchema, "upgradeschema", "", "upgrade stored entities of specified type to the current schema version and quit")
 	flag.Parse()
 	gameid = uint16(gameidArg)
 }
@@ -98,6 +101,10 @@ func Run() {
 
 	gwlog.Infof("Initializing storage ...")
 	storage.Initialize()
+	if upgradeSchema != "" {
+		upgradeStoredEntities(upgradeSchema)
+		return
+	}
 	gwlog.Infof("Initializing KVDB ...")
 	kvdb.Initialize()
 	gwlog.Infof("Initializing crontab ...")
@@ -107,9 +114,13 @@ func Run() {
 	binutil.SetupHTTPServer(gameConfig.HTTPAddr, nil)
 
 	entity.SetSaveInterval(gameConfig.SaveInterval)
+	entity.SetClientResumeGracePeriod(gameConfig.ClientResumeGracePeriod)
 
 	gwlog.Infof("Start game service ...")
 	gameService = newGameService(gameid)
+	metrics.NewGaugeFunc("goworld_game_packet_queue_length", "Number of packets from dispatchers waiting in queue", func() float64 {
+		return float64(len(gameService.packetQueue))
+	})
 
 	if !restore {
 		gwlog.Infof("Creating nil space ...")
@@ -126,11 +137,11 @@ func Run() {
 	gwlog.Infof("Start dispatchercluster ...")
 	dispatchercluster.Initialize(gameid, dispatcherclient.GameDispatcherClientType, restore, gameConfig.BanBootEntity, &_GameDispatcherClientDelegate{})
 
-	gamelbc.Initialize(gameCtx, time.Second*1)
+	gamelbc.Initialize(gameCtx, time.Second*1, gameConfig.LBCWeight)
 
 	setupSignals()
 
-	service.Setup(gameid)
+	service.Setup(gameid, GetOnlineGames)
 	gwlog.Infof("Game service start running ...")
 	gameService.run()
 }
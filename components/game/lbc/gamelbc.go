@@ -9,12 +9,15 @@ import (
 
 	"github.com/shirou/gopsutil/process"
 	"github.com/sagacao/goworld/engine/dispatchercluster"
+	"github.com/sagacao/goworld/engine/entity"
 	"github.com/sagacao/goworld/engine/gwlog"
 	"github.com/sagacao/goworld/engine/gwutils"
 	"github.com/sagacao/goworld/engine/proto"
 )
 
-func Initialize(ctx context.Context, collectInterval time.Duration) {
+// Initialize starts collecting loads of the game process and reporting to dispatchers, weight is the weight of the
+// game for the weighted round robin strategy
+func Initialize(ctx context.Context, collectInterval time.Duration, weight int) {
 	pid := os.Getpid()
 	p, err := process.NewProcess(int32(pid))
 	if err != nil {
@@ -30,10 +33,20 @@ func Initialize(ctx context.Context, collectInterval time.Duration) {
 				gwlog.Panicf("gamelbc: get process cpu percent failed: %s", err)
 			}
 
-			gwlog.Debugf("gamelbc: cpu percent is %.3f%%", pcnt)
-			dispatchercluster.SendGameLBCInfo(proto.GameLBCInfo{
-				CPUPercent: pcnt,
-			})
+			meminfo, err := p.MemoryInfoWithContext(ctx)
+			if err != nil {
+				gwlog.Panicf("gamelbc: get process memory info failed: %s", err)
+			}
+
+			lbcinfo := proto.GameLBCInfo{
+				CPUPercent:  pcnt,
+				EntityCount: entity.GetEntityCount(),
+				ClientCount: entity.GetClientCount(),
+				MemoryBytes: meminfo.RSS,
+				Weight:      weight,
+			}
+			gwlog.Debugf("gamelbc: %+v", lbcinfo)
+			dispatchercluster.SendGameLBCInfo(lbcinfo)
 		}
 	})
 }
@@ -0,0 +1,35 @@
+package game
+
+import (
+	"os"
+	"time"
+
+	"github.com/sagacao/goworld/engine/entity"
+	"github.com/sagacao/goworld/engine/gwlog"
+	"github.com/sagacao/goworld/engine/post"
+)
+
+// upgradeStoredEntities upgrades all stored entities of the type to the current schema version, and then quit
+func upgradeStoredEntities(typeName string) {
+	gwlog.Infof("Upgrading stored entities of type %s ...", typeName)
+	finished := false
+	failed := false
+	entity.UpgradeStoredEntities(typeName, func(total int, upgraded int, err error) {
+		if err != nil {
+			gwlog.Errorf("Upgrade stored entities of type %s failed: %+v", typeName, err)
+			failed = true
+		}
+		gwlog.Infof("Upgraded %d of %d stored entities of type %s", upgraded, total, typeName)
+		finished = true
+	})
+
+	for !finished {
+		post.Tick()
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	waitEntityStorageFinish()
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 
 	"github.com/xiaonanln/goTimer"
@@ -36,6 +38,11 @@ type ClientProxy struct {
 	heartbeatTime  time.Time
 	ownerEntityID  common.EntityID // owner entity's ID
 	heartTimer     *timer.Timer
+	resumeToken    string          // token for resuming the session of this client on a new connection
+	bootEntityID   common.EntityID // boot entity created for this connection
+	resumed        bool            // the session of a disconnected client is resumed on this connection
+	limiter        *clientLimiter
+	limitAction    string
 }
 
 func newClientProxy(conn netutil.Connection, cfg *config.GateConfig) *ClientProxy {
@@ -45,9 +52,21 @@ func newClientProxy(conn netutil.Connection, cfg *config.GateConfig) *ClientProx
 		clientid:          common.GenClientID(), // each client has its unique clientid
 		filterProps:       map[string]string{},
 		heartbeatTime:     time.Now(),
+		resumeToken:       genResumeToken(),
+		limiter:           newClientLimiter(cfg),
+		limitAction:       cfg.ClientLimitAction,
 	}
 }
 
+// genResumeToken generates a random token which can not be guessed by other clients
+func genResumeToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		gwlog.Panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
 func (cp *ClientProxy) String() string {
 	return fmt.Sprintf("ClientProxy<%s@%s>", cp.clientid, cp.RemoteAddr())
 }
@@ -105,12 +124,20 @@ func (cp *ClientProxy) serve() {
 	}()
 
 	cp.SetAutoFlush(consts.CLIENT_PROXY_WRITE_FLUSH_INTERVAL)
-	//cp.SendSetClientClientID(cp.cp) // set the cp on the client side
+	cp.SendSetClientClientID(cp.clientid, cp.resumeToken) // set the clientid on the client side
 
 	for {
 		var msgtype proto.MsgType
 		pkt, err := cp.Recv(&msgtype)
 		if pkt != nil {
+			if !cp.checkLimits(msgtype, pkt) {
+				pkt.Release()
+				if cp.limitAction == config.LimitActionDisconnect {
+					limitDisconnectCountMetric.Inc()
+					break
+				}
+				continue
+			}
 			gateService.clientPacketQueue <- clientProxyMessage{cp, proto.Message{msgtype, pkt}}
 		} else if err != nil && !gwioutil.IsTimeoutError(err) {
 			if netutil.IsConnectionError(err) {
@@ -121,3 +148,29 @@ func (cp *ClientProxy) serve() {
 		}
 	}
 }
+
+// checkLimits checks the message against client limits, returns false if the message should be dropped
+func (cp *ClientProxy) checkLimits(msgtype proto.MsgType, pkt *netutil.Packet) bool {
+	now := time.Now()
+	reason := cp.limiter.check(msgtype, pkt, now)
+	if reason == "" {
+		return true
+	}
+
+	limitViolationCountMetric.Inc(reason)
+	switch cp.limitAction {
+	case config.LimitActionWarn:
+		if cp.limiter.shouldWarn(now) {
+			gwlog.Warnf("%s: message %d exceeds limit: %s", cp, msgtype, reason)
+		}
+		return true
+	case config.LimitActionDisconnect:
+		gwlog.Warnf("%s: message %d exceeds limit: %s, disconnecting ...", cp, msgtype, reason)
+		return false
+	default:
+		if cp.limiter.shouldWarn(now) {
+			gwlog.Warnf("%s: message %d exceeds limit: %s, dropped", cp, msgtype, reason)
+		}
+		return false
+	}
+}
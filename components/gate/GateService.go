@@ -18,6 +18,7 @@ import (
 	"github.com/sagacao/goworld/engine/dispatchercluster"
 	"github.com/sagacao/goworld/engine/gwlog"
 	"github.com/sagacao/goworld/engine/gwutils"
+	"github.com/sagacao/goworld/engine/metrics"
 	"github.com/sagacao/goworld/engine/netutil"
 	"github.com/sagacao/goworld/engine/opmon"
 	"github.com/sagacao/goworld/engine/post"
@@ -26,6 +27,8 @@ import (
 	"github.com/xtaci/kcp-go"
 )
 
+var clientCountMetric = metrics.NewGauge("goworld_gate_clients", "Number of clients connected to the gate")
+
 type clientProxyMessage struct {
 	cp  *ClientProxy
 	msg proto.Message
@@ -225,13 +228,16 @@ func (gs *GateService) checkClientHeartbeats() {
 
 func (gs *GateService) onNewClientProxy(cp *ClientProxy) {
 	gs.clientProxies[cp.clientid] = cp
+	clientCountMetric.Inc()
 	bootEntityID := common.GenEntityID() // generate boot entity ID in the gate
 	cp.ownerEntityID = bootEntityID
-	dispatchercluster.SelectByEntityID(bootEntityID).SendNotifyClientConnected(cp.clientid, bootEntityID)
+	cp.bootEntityID = bootEntityID
+	dispatchercluster.SelectByEntityID(bootEntityID).SendNotifyClientConnected(cp.clientid, bootEntityID, cp.resumeToken)
 }
 
 func (gs *GateService) onClientProxyClose(cp *ClientProxy) {
 	delete(gs.clientProxies, cp.clientid)
+	clientCountMetric.Dec()
 
 	for key, val := range cp.filterProps {
 		ft := gs.filterTrees[key]
@@ -243,7 +249,8 @@ func (gs *GateService) onClientProxyClose(cp *ClientProxy) {
 		}
 	}
 
-	dispatchercluster.SelectByEntityID(cp.ownerEntityID).SendNotifyClientDisconnected(cp.clientid, cp.ownerEntityID)
+	// the owner entity can keep the client for resuming on a new connection
+	dispatchercluster.SelectByEntityID(cp.ownerEntityID).SendNotifyClientDisconnected(cp.clientid, cp.ownerEntityID, true)
 	// if consts.DEBUG_CLIENTS {
 	gwlog.Infof("%s.onClientProxyClose: client %s disconnected", gs, cp)
 	// }
@@ -261,6 +268,8 @@ func (gs *GateService) handleClientProxyPacket(cp *ClientProxy, msgtype proto.Ms
 		dispatchercluster.SelectByEntityID(eid).SendPacket(pkt)
 	case proto.MT_HEARTBEAT_FROM_CLIENT:
 		// kcp connected from client, need to do nothing here
+	case proto.MT_RESUME_CLIENT_FROM_CLIENT:
+		gs.handleResumeClientFromClient(cp, pkt)
 	default:
 		gwlog.Panicf("unknown message type from client: %d", msgtype)
 	}
@@ -283,15 +292,21 @@ func (gs *GateService) handleDispatcherClientPacket(msgtype proto.MsgType, packe
 			isPlayer := packet.ReadBool()
 			if isPlayer {
 				entityID := packet.ReadEntityID() // this is the owner entity
-				if clientproxy != nil {
+				if clientproxy != nil && clientproxy.resumed && entityID == clientproxy.bootEntityID {
+					// boot entity is created after the session is resumed, it should not own the client any more
+					dispatchercluster.SelectByEntityID(entityID).SendNotifyClientDisconnected(clientid, entityID, false)
+					return
+				} else if clientproxy != nil {
 					clientproxy.ownerEntityID = entityID
 					//gwlog.Warnf("%s: owner entity changed to %s", clientproxy, entityID)
 				} else {
 					// client already disconnected, but the game service seems not knowing it, so tell the owner entity
-					dispatchercluster.SelectByEntityID(entityID).SendNotifyClientDisconnected(clientid, entityID)
+					dispatchercluster.SelectByEntityID(entityID).SendNotifyClientDisconnected(clientid, entityID, false)
 					gwlog.Warnf("clientproxy not found for owner entity %s", entityID)
 				}
 			}
+		} else if msgtype == proto.MT_NOTIFY_CLIENT_RESUMED_ON_CLIENT {
+			gs.handleNotifyClientResumed(clientproxy, clientid, packet)
 		}
 
 		if clientproxy != nil {
@@ -314,6 +329,36 @@ func (gs *GateService) handleDispatcherClientPacket(msgtype proto.MsgType, packe
 	}
 }
 
+func (gs *GateService) handleResumeClientFromClient(cp *ClientProxy, packet *netutil.Packet) {
+	ownerEntityID := packet.ReadEntityID()
+	resumeToken := packet.ReadVarStr()
+	gwlog.Infof("%s: client %s is resuming the session of owner entity %s", gs, cp, ownerEntityID)
+	// the new token is used for resuming the session later
+	dispatchercluster.SelectByEntityID(ownerEntityID).SendResumeClient(ownerEntityID, cp.clientid, resumeToken, cp.resumeToken)
+}
+
+func (gs *GateService) handleNotifyClientResumed(clientproxy *ClientProxy, clientid common.ClientID, packet *netutil.Packet) {
+	ownerEntityID := packet.ReadEntityID()
+	resumed := packet.ReadBool()
+	if !resumed {
+		return
+	}
+
+	if clientproxy == nil {
+		// client disconnected again, the owner entity can wait for resuming again
+		dispatchercluster.SelectByEntityID(ownerEntityID).SendNotifyClientDisconnected(clientid, ownerEntityID, true)
+		return
+	}
+
+	oldOwnerEntityID := clientproxy.ownerEntityID
+	clientproxy.ownerEntityID = ownerEntityID
+	clientproxy.resumed = true
+	if oldOwnerEntityID != ownerEntityID {
+		// the boot entity (or other owner entity) of this connection should lose the client
+		dispatchercluster.SelectByEntityID(oldOwnerEntityID).SendNotifyClientDisconnected(clientid, oldOwnerEntityID, false)
+	}
+}
+
 func (gs *GateService) handleSetClientFilterProp(clientproxy *ClientProxy, packet *netutil.Packet) {
 	// gwlog.Debugf("%s.handleSetClientFilterProp: clientproxy=%s", gs, clientproxy)
 	key := packet.ReadVarStr()
@@ -26,6 +26,7 @@ import (
 	"github.com/sagacao/goworld/engine/dispatchercluster"
 	"github.com/sagacao/goworld/engine/dispatchercluster/dispatcherclient"
 	"github.com/sagacao/goworld/engine/gwlog"
+	"github.com/sagacao/goworld/engine/metrics"
 	"github.com/sagacao/goworld/engine/netutil"
 	"github.com/sagacao/goworld/engine/post"
 	"github.com/sagacao/goworld/engine/proto"
@@ -85,6 +86,12 @@ func main() {
 	binutil.SetupGWLog(fmt.Sprintf("gate%d", args.gateid), logLevel, gateConfig.LogFile, gateConfig.LogStderr)
 
 	gateService = newGateService()
+	metrics.NewGaugeFunc("goworld_gate_dispatcher_packet_queue_length", "Number of packets from dispatchers waiting in queue", func() float64 {
+		return float64(len(gateService.dispatcherClientPacketQueue))
+	})
+	metrics.NewGaugeFunc("goworld_gate_client_packet_queue_length", "Number of packets from clients waiting in queue", func() float64 {
+		return float64(len(gateService.clientPacketQueue))
+	})
 	if gateConfig.EncryptConnection {
 		cfgdir := config.GetConfigDir()
 		rsaCert := path.Join(cfgdir, gateConfig.RSACertificate)
@@ -136,12 +143,26 @@ func (delegate *gateDispatcherClientDelegate) HandleDispatcherClientPacket(msgty
 }
 
 func (delegate *gateDispatcherClientDelegate) HandleDispatcherClientDisconnect() {
-	//gwlog.Errorf("Disconnected from dispatcher, try reconnecting ...")
+	if isAllDispatchersStandbyConfigured() {
+		// the standby dispatcher will take over, and sent packets are resent after reconnecting
+		gwlog.Errorf("Disconnected from dispatcher, try reconnecting ...")
+		return
+	}
+
 	// if gate is disconnected from dispatcher, we just quit
 	gwlog.Infof("Disconnected from dispatcher, gate has to quit.")
 	signalChan <- syscall.SIGTERM // let gate quit
 }
 
+func isAllDispatchersStandbyConfigured() bool {
+	for _, dispid := range config.GetDispatcherIDs() {
+		if !config.GetDispatcher(dispid).HasStandby() {
+			return false
+		}
+	}
+	return true
+}
+
 func (deleget *gateDispatcherClientDelegate) GetEntityIDsForDispatcher(dispid uint16) []common.EntityID {
 	return nil
 }
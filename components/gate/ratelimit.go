@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/sagacao/goworld/engine/common"
+	"github.com/sagacao/goworld/engine/config"
+	"github.com/sagacao/goworld/engine/metrics"
+	"github.com/sagacao/goworld/engine/netutil"
+	"github.com/sagacao/goworld/engine/proto"
+)
+
+const (
+	// max number of methods tracked for each client, so that clients can not exhaust memory by calling random methods
+	_MAX_LIMITED_METHODS_PER_CLIENT = 256
+	// min interval of warnings for each client
+	_LIMIT_WARN_INTERVAL = time.Second
+)
+
+// reasons of limit violations
+const (
+	violationPacketSize     = "packet_size"
+	violationCallArgs       = "call_args"
+	violationCallRate       = "call_rate"
+	violationMethodRate     = "method_rate"
+	violationSyncRate       = "sync_rate"
+	violationMalformed      = "malformed"
+	violationTooManyMethods = "too_many_methods"
+)
+
+var (
+	limitViolationCountMetric  = metrics.NewCounterVec("goworld_gate_client_limit_violations_total", "Number of messages from clients exceeding limits by reason", "reason")
+	limitDisconnectCountMetric = metrics.NewCounter("goworld_gate_client_limit_disconnects_total", "Number of clients disconnected for exceeding limits")
+)
+
+// tokenBucket limits the rate of messages, a message is allowed if a token is available
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit config.RateLimit, now time.Time) *tokenBucket {
+	if limit.Rate <= 0 {
+		return nil
+	}
+	burst := float64(limit.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   limit.Rate,
+		burst:  burst,
+		tokens: burst,
+		last:   now,
+	}
+}
+
+// take takes a token from the bucket, returns false if no token is available
+func (b *tokenBucket) take(now time.Time) bool {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens -= 1
+	return true
+}
+
+// clientLimiter checks messages from a client against limits in gate config
+//
+// clientLimiter is only used by the serving goroutine of the client, so it is not locked
+type clientLimiter struct {
+	cfg           *config.GateConfig
+	callBucket    *tokenBucket
+	syncBucket    *tokenBucket
+	methodBuckets map[string]*tokenBucket
+	lastWarnTime  time.Time
+}
+
+func newClientLimiter(cfg *config.GateConfig) *clientLimiter {
+	now := time.Now()
+	return &clientLimiter{
+		cfg:           cfg,
+		callBucket:    newTokenBucket(cfg.ClientCallRateLimit, now),
+		syncBucket:    newTokenBucket(cfg.ClientSyncRateLimit, now),
+		methodBuckets: map[string]*tokenBucket{},
+	}
+}
+
+// check checks the message from client, returns the reason of violation, or empty string if the message is allowed
+func (l *clientLimiter) check(msgtype proto.MsgType, pkt *netutil.Packet, now time.Time) string {
+	payload := pkt.UnreadPayload()
+	if l.cfg.ClientMaxPacketSize > 0 && len(payload) > l.cfg.ClientMaxPacketSize {
+		return violationPacketSize
+	}
+
+	switch msgtype {
+	case proto.MT_SYNC_POSITION_YAW_FROM_CLIENT:
+		if l.syncBucket != nil && !l.syncBucket.take(now) {
+			return violationSyncRate
+		}
+	case proto.MT_CALL_ENTITY_METHOD_FROM_CLIENT:
+		return l.checkCall(payload, now)
+	}
+	return ""
+}
+
+func (l *clientLimiter) checkCall(payload []byte, now time.Time) string {
+	if l.callBucket != nil && !l.callBucket.take(now) {
+		return violationCallRate
+	}
+
+	if l.cfg.ClientMaxCallArgs <= 0 && l.cfg.ClientMethodRateLimit.Rate <= 0 && len(l.cfg.ClientMethodRateLimits) == 0 {
+		return ""
+	}
+
+	method, argCount, ok := parseCallFromClient(payload)
+	if !ok {
+		return violationMalformed
+	}
+
+	if l.cfg.ClientMaxCallArgs > 0 && argCount > l.cfg.ClientMaxCallArgs {
+		return violationCallArgs
+	}
+
+	bucket, ok := l.methodBuckets[method]
+	if !ok {
+		limit, ok := l.cfg.ClientMethodRateLimits[method]
+		if !ok {
+			limit = l.cfg.ClientMethodRateLimit
+		}
+		if limit.Rate > 0 && len(l.methodBuckets) >= _MAX_LIMITED_METHODS_PER_CLIENT {
+			return violationTooManyMethods
+		}
+		bucket = newTokenBucket(limit, now)
+		if bucket != nil {
+			l.methodBuckets[method] = bucket
+		}
+	}
+	if bucket != nil && !bucket.take(now) {
+		return violationMethodRate
+	}
+	return ""
+}
+
+// shouldWarn returns if the violation should be logged, warnings are throttled for each client
+func (l *clientLimiter) shouldWarn(now time.Time) bool {
+	if now.Sub(l.lastWarnTime) < _LIMIT_WARN_INTERVAL {
+		return false
+	}
+	l.lastWarnTime = now
+	return true
+}
+
+// parseCallFromClient parses method name and number of arguments from payload of MT_CALL_ENTITY_METHOD_FROM_CLIENT
+// without moving the read cursor of packet
+func parseCallFromClient(payload []byte) (method string, argCount int, ok bool) {
+	pos := common.ENTITYID_LENGTH
+	if len(payload) < pos+4 {
+		return
+	}
+	methodLen := int(binary.LittleEndian.Uint32(payload[pos:]))
+	pos += 4
+	if methodLen > len(payload)-pos {
+		return
+	}
+	method = string(payload[pos : pos+methodLen])
+	pos += methodLen
+	if len(payload) < pos+2 {
+		return
+	}
+	argCount = int(binary.LittleEndian.Uint16(payload[pos:]))
+	ok = true
+	return
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sagacao/goworld/engine/common"
+	"github.com/sagacao/goworld/engine/config"
+	"github.com/sagacao/goworld/engine/netutil"
+	"github.com/sagacao/goworld/engine/proto"
+)
+
+func makeCallFromClient(method string, argCount int) *netutil.Packet {
+	pkt := netutil.NewPacket()
+	pkt.AppendEntityID(common.GenEntityID())
+	pkt.AppendVarStr(method)
+	args := make([]interface{}, argCount)
+	for i := range args {
+		args[i] = i
+	}
+	pkt.AppendArgs(args)
+	return pkt
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(config.RateLimit{Rate: 10, Burst: 2}, now)
+	if !b.take(now) || !b.take(now) {
+		t.Fatalf("burst should be allowed")
+	}
+	if b.take(now) {
+		t.Fatalf("should be limited after burst")
+	}
+	now = now.Add(time.Millisecond * 100)
+	if !b.take(now) {
+		t.Fatalf("token should be refilled")
+	}
+	if b.take(now) {
+		t.Fatalf("should be limited")
+	}
+	now = now.Add(time.Hour)
+	if !b.take(now) || !b.take(now) || b.take(now) {
+		t.Fatalf("tokens should not exceed burst")
+	}
+
+	if newTokenBucket(config.RateLimit{}, now) != nil {
+		t.Fatalf("bucket should be nil if not limited")
+	}
+}
+
+func TestClientLimiter(t *testing.T) {
+	cfg := &config.GateConfig{
+		ClientMethodRateLimit:  config.RateLimit{Rate: 1, Burst: 2},
+		ClientMethodRateLimits: map[string]config.RateLimit{"Chat_Client": {Rate: 1, Burst: 1}},
+		ClientSyncRateLimit:    config.RateLimit{Rate: 1, Burst: 1},
+		ClientMaxPacketSize:    1024,
+		ClientMaxCallArgs:      3,
+	}
+	l := newClientLimiter(cfg)
+	now := time.Now()
+
+	check := func(msgtype proto.MsgType, pkt *netutil.Packet, expected string) {
+		if reason := l.check(msgtype, pkt, now); reason != expected {
+			t.Errorf("check %d: expected %q, but got %q", msgtype, expected, reason)
+		}
+		pkt.Release()
+	}
+
+	check(proto.MT_CALL_ENTITY_METHOD_FROM_CLIENT, makeCallFromClient("Chat_Client", 1), "")
+	check(proto.MT_CALL_ENTITY_METHOD_FROM_CLIENT, makeCallFromClient("Chat_Client", 1), violationMethodRate)
+	check(proto.MT_CALL_ENTITY_METHOD_FROM_CLIENT, makeCallFromClient("Move_Client", 3), "")
+	check(proto.MT_CALL_ENTITY_METHOD_FROM_CLIENT, makeCallFromClient("Move_Client", 3), "")
+	check(proto.MT_CALL_ENTITY_METHOD_FROM_CLIENT, makeCallFromClient("Move_Client", 3), violationMethodRate)
+	check(proto.MT_CALL_ENTITY_METHOD_FROM_CLIENT, makeCallFromClient("Other_Client", 4), violationCallArgs)
+
+	pkt := netutil.NewPacket()
+	pkt.AppendEntityID(common.GenEntityID())
+	pkt.AppendUint32(100) // method name longer than payload
+	check(proto.MT_CALL_ENTITY_METHOD_FROM_CLIENT, pkt, violationMalformed)
+
+	pkt = netutil.NewPacket()
+	pkt.AppendBytes(make([]byte, 1025))
+	check(proto.MT_HEARTBEAT_FROM_CLIENT, pkt, violationPacketSize)
+
+	check(proto.MT_SYNC_POSITION_YAW_FROM_CLIENT, netutil.NewPacket(), "")
+	check(proto.MT_SYNC_POSITION_YAW_FROM_CLIENT, netutil.NewPacket(), violationSyncRate)
+
+	now = now.Add(time.Second)
+	check(proto.MT_CALL_ENTITY_METHOD_FROM_CLIENT, makeCallFromClient("Chat_Client", 1), "")
+	check(proto.MT_SYNC_POSITION_YAW_FROM_CLIENT, netutil.NewPacket(), "")
+}
+
+func TestClientLimiterTooManyMethods(t *testing.T) {
+	cfg := &config.GateConfig{
+		ClientCallRateLimit:   config.RateLimit{Rate: 1000000, Burst: 1000000},
+		ClientMethodRateLimit: config.RateLimit{Rate: 1, Burst: 1},
+	}
+	l := newClientLimiter(cfg)
+	now := time.Now()
+	for i := 0; i < _MAX_LIMITED_METHODS_PER_CLIENT; i++ {
+		pkt := makeCallFromClient(string(rune('A'+i%26))+string(rune('a'+i/26)), 0)
+		if reason := l.check(proto.MT_CALL_ENTITY_METHOD_FROM_CLIENT, pkt, now); reason != "" {
+			t.Fatalf("method %d should be allowed, but got %q", i, reason)
+		}
+		pkt.Release()
+	}
+	pkt := makeCallFromClient("OneMore", 0)
+	if reason := l.check(proto.MT_CALL_ENTITY_METHOD_FROM_CLIENT, pkt, now); reason != violationTooManyMethods {
+		t.Fatalf("expected %q, but got %q", violationTooManyMethods, reason)
+	}
+	pkt.Release()
+}
@@ -29,7 +29,7 @@ like bellow:
 		goworld.RegisterSpace(&MySpace{}) // Register a custom Space type
 		// Register service entity types
 		goworld.RegisterService("OnlineService", &OnlineService{})
-		goworld.RegisterService("SpaceService", &SpaceService{})
+		goworld.RegisterService("SpaceService", &SpaceService{}).SetShardCount(4)
 		// Register Account entity type
 		goworld.RegisterEntity("Account", &Account{})
 		// Register Monster entity type
@@ -42,6 +42,12 @@ like bellow:
 
 Basically, you need to register space type, service types and entity types and then start the endless loop of game logic.
 
+Services
+
+Each service has one or more shards, and each shard is a service entity created automatically on some game. If the game
+of a shard is down, the shard is re-created on another game. Use goworld.CallService to call shards in round-robin, or
+goworld.CallServiceShardKey to always call the same shard for the same key (e.g. an entity ID).
+
 Creating Spaces
 
 Use goworld.CreateSpace* functions to create spaces.
@@ -66,7 +72,7 @@ just like bellow.
 	func (a *Avatar) DescribeEntityType(desc *entity.EntityTypeDesc) {
 		desc.SetPersistent(true).SetUseAOI(true, 100)
 		desc.DefineAttr("name", "AllClients", "Persistent")
-		desc.DefineAttr("exp", "Client", "Persistent")
+		desc.DefineAttr("exp", "Client", "Persistent", "int", "default=0", "min=0")
 		desc.DefineAttr("lastMailID", "Persistent")
 		desc.DefineAttr("testListField", "AllClients")
 		desc.DefineAttr("enteringNilSpace")
@@ -79,6 +85,9 @@ Entities use attributes to store related data. Attributes can be synchronized to
 An entity's "AllClient" attributes will be synchronized to all clients of entities where this entity is
 in its AOI range. "Client" attributes wil be synchronized to own clients of entities. "Persistent" attributes will be
 saved on entity storage when entities are saved periodically.
+Attributes can also declare types (int, float, bool, str, map, list, map<T>, list<T>) with default=V, min=V and max=V.
+Setting an attribute with a value violating its type declaration panics, and invalid values in loaded data are reported
+and dropped (or clamped for out of range numbers).
 When entity is migrated from one game process to another, all attributes are marshalled and sent to the target game where
 the entity will be reconstructed using attribute data.
 
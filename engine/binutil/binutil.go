@@ -5,6 +5,7 @@ import (
 	"syscall"
 
 	"github.com/sagacao/goworld/engine/gwlog"
+	"github.com/sagacao/goworld/engine/metrics"
 	"golang.org/x/net/websocket"
 )
 
@@ -13,12 +14,12 @@ const (
 	FreezeSignal = syscall.SIGHUP
 )
 
-// SetupHTTPServer starts the HTTP server for go tool pprof and websockets
+// SetupHTTPServer starts the HTTP server for go tool pprof, metrics and websockets
 func SetupHTTPServer(listenAddr string, wsHandler func(ws *websocket.Conn)) {
 	setupHTTPServer(listenAddr, wsHandler, "", "")
 }
 
-// SetupHTTPServerTLS starts the HTTPs server for go tool pprof and websockets
+// SetupHTTPServerTLS starts the HTTPs server for go tool pprof, metrics and websockets
 func SetupHTTPServerTLS(listenAddr string, wsHandler func(ws *websocket.Conn), certFile string, keyFile string) {
 	setupHTTPServer(listenAddr, wsHandler, certFile, keyFile)
 }
@@ -28,11 +29,13 @@ func setupHTTPServer(listenAddr string, wsHandler func(ws *websocket.Conn), cert
 	gwlog.Infof("pprof http://%s/debug/pprof/ ... available commands: ", listenAddr)
 	gwlog.Infof("    go tool pprof http://%s/debug/pprof/heap", listenAddr)
 	gwlog.Infof("    go tool pprof http://%s/debug/pprof/profile", listenAddr)
+	gwlog.Infof("metrics http://%s/metrics", listenAddr)
 	if keyFile != "" || certFile != "" {
 		gwlog.Infof("TLS is enabled on http: key=%s, cert=%s", keyFile, certFile)
 	}
 
 	//http.Handle("/", http.FileServer(http.Dir(".")))
+	http.Handle("/metrics", metrics.Handler())
 	if wsHandler != nil {
 		gwlog.Infof("WebSocket is enabled on %s", listenAddr)
 		http.Handle("/ws", websocket.Handler(wsHandler))
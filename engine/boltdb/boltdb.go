@@ -0,0 +1,117 @@
+package boltdb
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.etcd.io/bbolt"
+)
+
+const (
+	// DefaultPath is the default file path of bolt database
+	DefaultPath = "_goworld.db"
+
+	_LOCK_TIMEOUT = 10 * time.Second
+)
+
+var (
+	locksLock sync.Mutex
+	locks     = map[string]*sync.RWMutex{}
+)
+
+// DB is an embedded single-file database based on bbolt, used by storage, KVDB and rank backends for development and tests
+//
+// The file is opened for each transaction and closed after it, so that multiple processes of a local cluster (e.g. games)
+// can share the same file. Transactions in the same process are serialized by a lock of the file, and transactions in
+// different processes are serialized by the file lock of bbolt.
+type DB struct {
+	path string
+	lock *sync.RWMutex
+}
+
+// Open opens the bolt database file, the file is created if not exists
+func Open(path string) (*DB, error) {
+	if path == "" {
+		path = DefaultPath
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	locksLock.Lock()
+	lock := locks[path]
+	if lock == nil {
+		lock = &sync.RWMutex{}
+		locks[path] = lock
+	}
+	locksLock.Unlock()
+
+	db := &DB{path: path, lock: lock}
+	// make sure the file is created and valid
+	if err := db.Update(func(tx *bbolt.Tx) error { return nil }); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Path returns the absolute file path of the database
+func (db *DB) Path() string {
+	return db.path
+}
+
+// Update executes fn in a read-write transaction, changes are committed if fn returns nil
+func (db *DB) Update(fn func(tx *bbolt.Tx) error) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	bdb, err := bbolt.Open(db.path, 0644, &bbolt.Options{Timeout: _LOCK_TIMEOUT})
+	if err != nil {
+		return errors.Wrapf(err, "open %s failed", db.path)
+	}
+	defer bdb.Close()
+	return bdb.Update(fn)
+}
+
+// View executes fn in a read-only transaction
+func (db *DB) View(fn func(tx *bbolt.Tx) error) error {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	bdb, err := bbolt.Open(db.path, 0644, &bbolt.Options{Timeout: _LOCK_TIMEOUT, ReadOnly: true})
+	if err != nil {
+		return errors.Wrapf(err, "open %s failed", db.path)
+	}
+	defer bdb.Close()
+	return bdb.View(fn)
+}
+
+// Bucket returns the bucket of the path of names in read-write transaction, buckets are created if not exist
+func Bucket(tx *bbolt.Tx, names ...string) (*bbolt.Bucket, error) {
+	b, err := tx.CreateBucketIfNotExists([]byte(names[0]))
+	for _, name := range names[1:] {
+		if err != nil {
+			break
+		}
+		b, err = b.CreateBucketIfNotExists([]byte(name))
+	}
+	return b, err
+}
+
+// LookupBucket returns the bucket of the path of names, or nil if not exists
+func LookupBucket(tx *bbolt.Tx, names ...string) *bbolt.Bucket {
+	b := tx.Bucket([]byte(names[0]))
+	for _, name := range names[1:] {
+		if b == nil {
+			break
+		}
+		b = b.Bucket([]byte(name))
+	}
+	return b
+}
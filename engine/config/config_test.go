@@ -78,3 +78,19 @@ func TestGetGate(t *testing.T) {
 func TestSetConfigFile(t *testing.T) {
 	SetConfigFile("../../goworld.ini")
 }
+
+func TestParseRateLimit(t *testing.T) {
+	limit, err := parseRateLimit("2.5")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, RateLimit{Rate: 2.5, Burst: 3}, limit)
+
+	limit, err = parseRateLimit(" 10 : 20 ")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, RateLimit{Rate: 10, Burst: 20}, limit)
+
+	for _, s := range []string{"", "x", "-1", "10:0", "10:x"} {
+		if _, err := parseRateLimit(s); err == nil {
+			t.Errorf("rate limit %q should be invalid", s)
+		}
+	}
+}
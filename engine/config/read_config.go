@@ -17,6 +17,8 @@ import (
 
 	"path"
 
+	"math"
+
 	"github.com/go-ini/ini"
 	"github.com/pkg/errors"
 	"github.com/sagacao/goworld/engine/common"
@@ -30,6 +32,16 @@ const (
 	_DEFAULT_STORAGE_DB    = "goworld"
 )
 
+// defaultStorageWorkers are the default numbers of read and write workers of storage backends, each worker has its own connection
+var defaultStorageWorkers = map[string][2]int{
+	"filesystem":    {2, 2},
+	"mongodb":       {4, 4},
+	"redis":         {2, 2},
+	"redis_cluster": {4, 4},
+	"sql":           {4, 4},
+	"bolt":          {1, 1}, // transactions on the database file are serialized anyway
+}
+
 var (
 	configFilePath = _DEFAULT_CONFIG_FILE
 	goWorldConfig  *GoWorldConfig
@@ -54,6 +66,10 @@ type GameConfig struct {
 	GoMaxProcs             int
 	PositionSyncIntervalMS int
 	BanBootEntity          bool
+	// Period during which the owner entity keeps the disconnected client for resuming the session, 0 to disable
+	ClientResumeGracePeriod time.Duration
+	// Weight of the game for the weighted round robin load balancing strategy of dispatchers
+	LBCWeight int
 }
 
 // GateConfig defines fields of gate config
@@ -71,8 +87,32 @@ type GateConfig struct {
 	RSACertificate         string
 	HeartbeatCheckInterval int
 	PositionSyncIntervalMS int
+
+	// Limits of messages from each client connection, limits are disabled if not set
+	ClientCallRateLimit    RateLimit            // limit of all entity calls
+	ClientMethodRateLimit  RateLimit            // default limit of entity calls to each method
+	ClientMethodRateLimits map[string]RateLimit // limits of entity calls to specified methods
+	ClientSyncRateLimit    RateLimit            // limit of position syncs
+	ClientMaxPacketSize    int                  // max payload size of packets
+	ClientMaxCallArgs      int                  // max number of arguments of entity calls
+	ClientLimitAction      string               // action when limits are exceeded: drop, warn or disconnect
+}
+
+// RateLimit is the token bucket limit of messages, Rate is 0 if not limited
+type RateLimit struct {
+	Rate  float64 // messages per second
+	Burst int     // max number of messages in burst
 }
 
+const (
+	// LimitActionDrop drops the message which exceeds limits
+	LimitActionDrop = "drop"
+	// LimitActionWarn logs the message which exceeds limits, but still handles it
+	LimitActionWarn = "warn"
+	// LimitActionDisconnect drops the message and disconnects the client
+	LimitActionDisconnect = "disconnect"
+)
+
 // DispatcherConfig defines fields of dispatcher config
 type DispatcherConfig struct {
 	ListenAddr    string
@@ -81,6 +121,63 @@ type DispatcherConfig struct {
 	LogFile       string
 	LogStderr     bool
 	LogLevel      string
+
+	// Standby dispatcher of the same dispatcher slot, which replicates states of the active dispatcher and takes over when
+	// the active dispatcher is down
+	StandbyListenAddr    string
+	StandbyAdvertiseAddr string
+	StandbyHTTPAddr      string
+
+	// Load balancing strategies for choosing games to create entities anywhere and to create boot entities
+	LBCStrategy           string
+	BootEntityLBCStrategy string
+	// Weights of load metrics (cpu, entities, clients, memory) for the composite load balancing strategy
+	LBCScoreWeights map[string]float64
+
+	// Automatic rebalancing of entities from overloaded games to cooler games, which only runs on dispatcher 1
+	RebalanceInterval    time.Duration // interval of checking loads of games, 0 to disable rebalancing
+	RebalanceThreshold   float64       // min difference of CPU percents between the hottest and the coolest games
+	RebalanceMaxEntities int           // max number of entities migrated in each rebalancing
+	RebalanceDryRun      bool          // only log entities to be migrated, but do not migrate them
+}
+
+const (
+	// LBCStrategyCPU chooses the game with least CPU usage
+	LBCStrategyCPU = "cpu"
+	// LBCStrategyEntities chooses the game with least entities
+	LBCStrategyEntities = "entities"
+	// LBCStrategyClients chooses the game with least clients
+	LBCStrategyClients = "clients"
+	// LBCStrategyRoundRobin chooses games in a weighted round robin way
+	LBCStrategyRoundRobin = "round_robin"
+	// LBCStrategyComposite chooses the game with least composite score of weighted load metrics
+	LBCStrategyComposite = "composite"
+)
+
+var lbcStrategies = common.StringSet{}
+var lbcScoreMetrics = common.StringSet{}
+
+func init() {
+	lbcStrategies.Add(LBCStrategyCPU)
+	lbcStrategies.Add(LBCStrategyEntities)
+	lbcStrategies.Add(LBCStrategyClients)
+	lbcStrategies.Add(LBCStrategyRoundRobin)
+	lbcStrategies.Add(LBCStrategyComposite)
+
+	lbcScoreMetrics.Add("cpu")
+	lbcScoreMetrics.Add("entities")
+	lbcScoreMetrics.Add("clients")
+	lbcScoreMetrics.Add("memory")
+}
+
+// HasStandby returns if the dispatcher has a standby dispatcher configured
+func (dc *DispatcherConfig) HasStandby() bool {
+	return dc.StandbyAdvertiseAddr != ""
+}
+
+// StandbyLogFile returns the log file of the standby dispatcher
+func (dc *DispatcherConfig) StandbyLogFile() string {
+	return strings.TrimSuffix(dc.LogFile, ".log") + "_standby.log"
 }
 
 // GoWorldConfig defines the total GoWorld config file structure
@@ -100,18 +197,24 @@ type GoWorldConfig struct {
 
 // StorageConfig defines fields of storage config
 type StorageConfig struct {
-	Type       string // Type of storage (filesystem, mongodb, redis, mysql)
+	Type       string // Type of storage (filesystem, mongodb, redis, mysql, bolt)
 	Directory  string // Directory of filesystem storage (filesystem)
-	Url        string // Connection URL (mongodb, redis, mysql)
+	Url        string // Connection URL (mongodb, redis, mysql), or database file path (bolt)
 	DB         string // Database name (mongodb, redis)
 	Driver     string // SQL Driver name (mysql)
 	StartNodes common.StringSet
+	// ReadWorkers and WriteWorkers are numbers of concurrent loads and saves, default values depend on the storage type
+	ReadWorkers  int
+	WriteWorkers int
+	CacheSize    int // Number of entities of which pending saves are cached for loading, 0 (default) to disable
+	// SoftDeleteRetention is the duration for which deleted entities are kept before purged, 0 to delete immediately
+	SoftDeleteRetention time.Duration
 }
 
 // KVDBConfig defines fields of KVDB config
 type KVDBConfig struct {
 	Type       string
-	Url        string // MongoDB
+	Url        string // MongoDB, or database file path of bolt
 	DB         string // MongoDB
 	Collection string // MongoDB & Redis Prefix
 	Driver     string // SQL Driver: e.x. mysql
@@ -122,7 +225,7 @@ type KVDBConfig struct {
 // RankConfig defines fields of KVDB config
 type RankConfig struct {
 	Type       string
-	Url        string // Redis Prefix
+	Url        string // Redis, or database file path of bolt
 	DB         string // Redis
 	Prefix     string // Redis
 	Auth       string // Redis
@@ -353,6 +456,7 @@ func readGameCommonConfig(section *ini.Section, scc *GameConfig) {
 	scc.HTTPAddr = "127.0.0.1:25000"
 	scc.GoMaxProcs = 0
 	scc.PositionSyncIntervalMS = 100 // sync positions per 100ms by default
+	scc.LBCWeight = 1
 
 	_readGameConfig(section, scc)
 }
@@ -388,6 +492,13 @@ func _readGameConfig(sec *ini.Section, sc *GameConfig) {
 			sc.PositionSyncIntervalMS = key.MustInt(sc.PositionSyncIntervalMS)
 		} else if name == "ban_boot_entity" {
 			sc.BanBootEntity = key.MustBool(sc.BanBootEntity)
+		} else if name == "client_resume_grace_period" {
+			sc.ClientResumeGracePeriod = time.Second * time.Duration(key.MustInt(int(sc.ClientResumeGracePeriod/time.Second)))
+		} else if name == "lbc_weight" {
+			sc.LBCWeight = key.MustInt(sc.LBCWeight)
+			if sc.LBCWeight <= 0 {
+				gwlog.Fatalf("%s: lbc_weight must be positive", sec.Name())
+			}
 		} else {
 			gwlog.Fatalf("section %s has unknown key: %s", sec.Name(), key.Name())
 		}
@@ -407,6 +518,7 @@ func readGateCommonConfig(section *ini.Section, gcc *GateConfig) {
 	gcc.RSACertificate = "rsa.crt"
 	gcc.HeartbeatCheckInterval = 0
 	gcc.PositionSyncIntervalMS = 100
+	gcc.ClientLimitAction = LimitActionDrop
 
 	_readGateConfig(section, gcc)
 }
@@ -456,12 +568,64 @@ func _readGateConfig(sec *ini.Section, sc *GateConfig) {
 			sc.HeartbeatCheckInterval = key.MustInt(sc.HeartbeatCheckInterval)
 		} else if name == "position_sync_interval_ms" {
 			sc.PositionSyncIntervalMS = key.MustInt(sc.PositionSyncIntervalMS)
+		} else if name == "client_call_rate_limit" {
+			sc.ClientCallRateLimit = mustParseRateLimit(key.Name(), key.String())
+		} else if name == "client_method_rate_limit" {
+			sc.ClientMethodRateLimit = mustParseRateLimit(key.Name(), key.String())
+		} else if name == "client_method_rate_limits" {
+			sc.ClientMethodRateLimits = map[string]RateLimit{}
+			for _, item := range key.Strings(",") {
+				parts := strings.SplitN(item, "=", 2)
+				if len(parts) != 2 {
+					gwlog.Fatalf("%s: invalid method rate limit: %s", key.Name(), item)
+				}
+				sc.ClientMethodRateLimits[strings.TrimSpace(parts[0])] = mustParseRateLimit(key.Name(), parts[1])
+			}
+		} else if name == "client_sync_rate_limit" {
+			sc.ClientSyncRateLimit = mustParseRateLimit(key.Name(), key.String())
+		} else if name == "client_max_packet_size" {
+			sc.ClientMaxPacketSize = key.MustInt(sc.ClientMaxPacketSize)
+		} else if name == "client_max_call_args" {
+			sc.ClientMaxCallArgs = key.MustInt(sc.ClientMaxCallArgs)
+		} else if name == "client_limit_action" {
+			sc.ClientLimitAction = strings.ToLower(key.MustString(sc.ClientLimitAction))
+			if sc.ClientLimitAction != LimitActionDrop && sc.ClientLimitAction != LimitActionWarn && sc.ClientLimitAction != LimitActionDisconnect {
+				gwlog.Fatalf("%s: invalid action: %s", key.Name(), sc.ClientLimitAction)
+			}
 		} else {
 			gwlog.Fatalf("section %s has unknown key: %s", sec.Name(), key.Name())
 		}
 	}
 }
 
+// parseRateLimit parses rate limit in format of <rate>[:<burst>], burst is the same as rate if not set
+func parseRateLimit(s string) (RateLimit, error) {
+	var limit RateLimit
+	parts := strings.SplitN(strings.TrimSpace(s), ":", 2)
+	rate, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil || rate < 0 {
+		return limit, errors.Errorf("invalid rate: %s", parts[0])
+	}
+	limit.Rate = rate
+	limit.Burst = int(math.Ceil(rate))
+	if len(parts) == 2 {
+		burst, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || burst < 1 {
+			return limit, errors.Errorf("invalid burst: %s", parts[1])
+		}
+		limit.Burst = burst
+	}
+	return limit, nil
+}
+
+func mustParseRateLimit(keyName string, s string) RateLimit {
+	limit, err := parseRateLimit(s)
+	if err != nil {
+		gwlog.Fatalf("%s: %s", keyName, err)
+	}
+	return limit
+}
+
 func readDispatcherCommonConfig(section *ini.Section, dc *DispatcherConfig) {
 	dc.ListenAddr = "127.0.0.1:13000"
 	dc.AdvertiseAddr = "127.0.0.1:13000"
@@ -469,6 +633,11 @@ func readDispatcherCommonConfig(section *ini.Section, dc *DispatcherConfig) {
 	dc.LogFile = "dispatcher.log"
 	dc.LogStderr = true
 	dc.LogLevel = _DEFAULT_LOG_LEVEL
+	dc.LBCStrategy = LBCStrategyCPU
+	dc.BootEntityLBCStrategy = LBCStrategyRoundRobin
+	dc.LBCScoreWeights = map[string]float64{"cpu": 1, "entities": 1, "clients": 1, "memory": 1}
+	dc.RebalanceThreshold = 20
+	dc.RebalanceMaxEntities = 10
 
 	_readDispatcherConfig(section, dc)
 }
@@ -477,6 +646,9 @@ func readDispatcherConfig(sec *ini.Section, dispatcherCommonConfig *DispatcherCo
 	dc := *dispatcherCommonConfig // copy from game_common
 	_readDispatcherConfig(sec, &dc)
 	// validate dispatcher config
+	if dc.StandbyListenAddr != "" && dc.StandbyAdvertiseAddr == "" {
+		gwlog.Fatalf("section %s: standby_advertise_addr must be set if standby_listen_addr is set", sec.Name())
+	}
 	return &dc
 }
 
@@ -495,6 +667,37 @@ func _readDispatcherConfig(sec *ini.Section, config *DispatcherConfig) {
 			config.HTTPAddr = key.MustString(config.HTTPAddr)
 		} else if name == "log_level" {
 			config.LogLevel = key.MustString(config.LogLevel)
+		} else if name == "standby_listen_addr" {
+			config.StandbyListenAddr = key.MustString(config.StandbyListenAddr)
+		} else if name == "standby_advertise_addr" {
+			config.StandbyAdvertiseAddr = key.MustString(config.StandbyAdvertiseAddr)
+		} else if name == "standby_http_addr" {
+			config.StandbyHTTPAddr = key.MustString(config.StandbyHTTPAddr)
+		} else if name == "lbc_strategy" {
+			config.LBCStrategy = mustReadLBCStrategy(sec, key)
+		} else if name == "boot_entity_lbc_strategy" {
+			config.BootEntityLBCStrategy = mustReadLBCStrategy(sec, key)
+		} else if name == "rebalance_interval" {
+			config.RebalanceInterval = time.Second * time.Duration(key.MustInt(int(config.RebalanceInterval/time.Second)))
+		} else if name == "rebalance_threshold" {
+			config.RebalanceThreshold = key.MustFloat64(config.RebalanceThreshold)
+		} else if name == "rebalance_max_entities" {
+			config.RebalanceMaxEntities = key.MustInt(config.RebalanceMaxEntities)
+		} else if name == "rebalance_dry_run" {
+			config.RebalanceDryRun = key.MustBool(config.RebalanceDryRun)
+		} else if name == "lbc_score_weights" {
+			config.LBCScoreWeights = map[string]float64{}
+			for _, item := range key.Strings(",") {
+				parts := strings.SplitN(item, "=", 2)
+				if len(parts) != 2 || !lbcScoreMetrics.Contains(strings.TrimSpace(parts[0])) {
+					gwlog.Fatalf("section %s: invalid lbc score weight: %s", sec.Name(), item)
+				}
+				weight, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+				if err != nil || weight < 0 {
+					gwlog.Fatalf("section %s: invalid lbc score weight: %s", sec.Name(), item)
+				}
+				config.LBCScoreWeights[strings.TrimSpace(parts[0])] = weight
+			}
 		} else {
 			gwlog.Fatalf("section %s has unknown key: %s", sec.Name(), key.Name())
 		}
@@ -502,6 +705,14 @@ func _readDispatcherConfig(sec *ini.Section, config *DispatcherConfig) {
 	return
 }
 
+func mustReadLBCStrategy(sec *ini.Section, key *ini.Key) string {
+	strategy := strings.ToLower(key.String())
+	if !lbcStrategies.Contains(strategy) {
+		gwlog.Fatalf("section %s: invalid %s: %s, should be one of %v", sec.Name(), key.Name(), strategy, lbcStrategies.ToList())
+	}
+	return strategy
+}
+
 func readStorageConfig(sec *ini.Section, config *StorageConfig) {
 	// setup default values
 	config.Type = "filesystem"
@@ -510,11 +721,23 @@ func readStorageConfig(sec *ini.Section, config *StorageConfig) {
 	config.Url = ""
 	config.Driver = ""
 	config.StartNodes = common.StringSet{}
+	config.ReadWorkers = 0
+	config.WriteWorkers = 0
+	config.CacheSize = 0
+	config.SoftDeleteRetention = 0
 
 	for _, key := range sec.Keys() {
 		name := strings.ToLower(key.Name())
 		if name == "type" {
 			config.Type = key.MustString(config.Type)
+		} else if name == "read_workers" {
+			config.ReadWorkers = key.MustInt(config.ReadWorkers)
+		} else if name == "write_workers" {
+			config.WriteWorkers = key.MustInt(config.WriteWorkers)
+		} else if name == "cache_size" {
+			config.CacheSize = key.MustInt(config.CacheSize)
+		} else if name == "soft_delete_retention" {
+			config.SoftDeleteRetention = time.Second * time.Duration(key.MustInt(int(config.SoftDeleteRetention/time.Second)))
 		} else if name == "directory" {
 			config.Directory = key.MustString(config.Directory)
 		} else if name == "url" {
@@ -535,6 +758,12 @@ func readStorageConfig(sec *ini.Section, config *StorageConfig) {
 			config.DB = "0"
 		}
 	}
+	if config.ReadWorkers <= 0 {
+		config.ReadWorkers = defaultStorageWorkers[config.Type][0]
+	}
+	if config.WriteWorkers <= 0 {
+		config.WriteWorkers = defaultStorageWorkers[config.Type][1]
+	}
 
 	validateStorageConfig(config)
 }
@@ -603,6 +832,8 @@ func validateKVDBConfig(config *KVDBConfig) {
 		if config.Url == "" {
 			gwlog.Fatalf("invalid %s KVDB config:\n%s", config.Type, DumpPretty(config))
 		}
+	} else if config.Type == "bolt" {
+		// url is the database file path, default file is used if not set
 	} else {
 		gwlog.Fatalf("unknown storage type: %s", config.Type)
 	}
@@ -658,6 +889,8 @@ func validateRankConfig(config *RankConfig) {
 				gwlog.Fatalf("start_nodes must not be empty")
 			}
 		}
+	} else if config.Type == "bolt" {
+		// url is the database file path, default file is used if not set
 	} else {
 		gwlog.Fatalf("unknown rank type: %s", config.Type)
 	}
@@ -723,6 +956,8 @@ func validateStorageConfig(config *StorageConfig) {
 		if config.Url == "" {
 			gwlog.Fatalf("db url is not set")
 		}
+	} else if config.Type == "bolt" {
+		// url is the database file path, default file is used if not set
 	} else {
 		gwlog.Fatalf("unknown storage type: %s", config.Type)
 	}
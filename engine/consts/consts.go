@@ -38,12 +38,28 @@ const (
 	DISPATCHER_CLIENT_PROXY_WRITE_FLUSH_INTERVAL = 5 * time.Millisecond
 	// DISPATCHER_CLIENT_FLUSH_INTERVAL is the flush interval for dispatcher clients (game -> dispatcher)
 	DISPATCHER_CLIENT_FLUSH_INTERVAL = 5 * time.Millisecond
+	// DISPATCHER_CLIENT_MAX_UNACKED_BYTES is the max total size of packets kept by dispatcher clients for resending after reconnecting to a standby dispatcher, senders are blocked if exceeded
+	DISPATCHER_CLIENT_MAX_UNACKED_BYTES = 64 * 1024 * 1024
+	// DISPATCHER_CLIENT_ACK_INTERVAL is the interval for dispatcher clients to acknowledge packets received from dispatcher, if standby dispatcher is configured
+	DISPATCHER_CLIENT_ACK_INTERVAL = 5 * time.Millisecond
+	// DISPATCHER_STANDBY_PROMOTE_TIMEOUT is the time for standby dispatcher to be promoted after the active dispatcher is down
+	DISPATCHER_STANDBY_PROMOTE_TIMEOUT = time.Second * 3
+	// DISPATCHER_GATE_RECONNECT_TIMEOUT is the time for gate to reconnect before its clients are considered disconnected, if standby dispatcher is configured
+	DISPATCHER_GATE_RECONNECT_TIMEOUT = time.Second * 30
 
 	// For Game Service
 	// GAME_SERVICE_PACKET_QUEUE_SIZE is the max packet queue length for game service
 	GAME_SERVICE_PACKET_QUEUE_SIZE = 10000 // packet queue size
 	// GAME_SERVICE_TICK_INTERVAL is the tick interval to tick timers in game service
 	GAME_SERVICE_TICK_INTERVAL = time.Millisecond * 5 // server tick interval => affect timer resolution
+	// ATTR_CHANGES_PACKET_PAYLOAD_LIMIT is the payload size to start a new packet when sending batched attribute changes to one client
+	ATTR_CHANGES_PACKET_PAYLOAD_LIMIT = 64 * 1024
+	// RELIABLE_CALL_RESEND_INTERVAL is the interval to resend reliable calls which are not acknowledged by callees
+	RELIABLE_CALL_RESEND_INTERVAL = time.Second * 5
+	// RELIABLE_CALL_MAX_PENDING is the max number of reliable calls received out of order and kept by the callee for one caller
+	RELIABLE_CALL_MAX_PENDING = 1000
+	// CLIENT_RESUME_BUFFER_LIMIT is the max size of messages buffered for a suspended client, the client can not be resumed if exceeded
+	CLIENT_RESUME_BUFFER_LIMIT = 4 * 1024 * 1024
 
 	// DISPATCHER_CLIENT_WRITE_BUFFER_SIZE is the writer buffer size for gates/games' connections to dispatcher
 	DISPATCHER_CLIENT_WRITE_BUFFER_SIZE = 1024 * 1024
@@ -3,85 +3,37 @@ package crontab
 import (
 	"time"
 
-	"github.com/xiaonanln/goTimer"
+	"github.com/pkg/errors"
+	"github.com/sagacao/goworld/engine/dispatchercluster"
 	"github.com/sagacao/goworld/engine/gwlog"
 	"github.com/sagacao/goworld/engine/gwutils"
+	"github.com/xiaonanln/goTimer"
 )
 
 const (
-	_CRONTAB_TIME_OFFSET = time.Second * 2
+	_CHECK_INTERVAL  = time.Second / 2
+	_MAX_CHECK_DELAY = time.Minute // callbacks are skipped if checking is delayed too long, e.g. the game was frozen
 )
 
 var (
 	cancelledHandles = []Handle{}
 	entries          = map[Handle]*entry{}
 	nextHandle       = Handle(1)
+	lastCheckTime    time.Time
+
+	// claimSingleton claims the run of the singleton job at the time from the dispatcher
+	claimSingleton = func(name string, fireTime int64) {
+		dispatchercluster.SendClaimCrontabSingleton(name, fireTime)
+	}
 )
 
 // Handle is the type of return value of Register, can be used to cancel the register
 type Handle int
 
 type entry struct {
-	minute, hour, day, month, dayofweek int
-	cb                                  func()
-}
-
-func (entry *entry) match(minute int, hour int, day int, month time.Month, weekday time.Weekday) bool {
-	if entry.minute >= 0 {
-		if entry.minute != minute {
-			return false
-		}
-	} else { // minute < 0
-		if minute%-entry.minute != 0 {
-			return false
-		}
-	}
-
-	if entry.hour >= 0 {
-		if entry.hour != hour {
-			return false
-		}
-	} else { // hour < 0
-		if hour%-entry.hour != 0 {
-			return false
-		}
-	}
-
-	if entry.day >= 0 {
-		if entry.day != day {
-			return false
-		}
-	} else {
-		if day%-entry.day != 0 {
-			return false
-		}
-	}
-
-	if entry.month >= 0 {
-		if entry.month != int(month) {
-			return false
-		}
-	} else {
-		if int(month)%-entry.month != 0 {
-			return false
-		}
-	}
-
-	if entry.dayofweek >= 0 {
-		if entry.dayofweek >= 1 && entry.dayofweek <= 6 {
-			if entry.dayofweek != int(weekday) {
-				return false
-			}
-		} else if entry.dayofweek == 0 || entry.dayofweek == 7 {
-			if weekday != time.Sunday {
-				return false
-			}
-		} else { // invalid dayofweek, never happen
-			return false
-		}
-	} // else dayofweek == -1
-
-	return true
+	schedule  *Schedule
+	singleton string // name of the singleton job, empty if the entry runs on every game
+	cb        func()
 }
 
 // Register a callack which will be executed when time condition is satisfied
@@ -95,18 +47,55 @@ func (entry *entry) match(minute int, hour int, day int, month time.Month, weekd
 func Register(minute, hour, day, month, dayofweek int, cb func()) Handle {
 	validateTime(minute, hour, day, month, dayofweek)
 
+	return RegisterSchedule(legacySchedule(minute, hour, day, month, dayofweek), cb)
+}
+
+// RegisterSpec registers a callback which will be executed when the time matches the cron spec
+//
+// See ParseSchedule for the format of spec
+func RegisterSpec(spec string, cb func()) (Handle, error) {
+	schedule, err := ParseSchedule(spec)
+	if err != nil {
+		return 0, err
+	}
+	return RegisterSchedule(schedule, cb), nil
+}
+
+// RegisterSchedule registers a callback which will be executed when the time matches the schedule
+func RegisterSchedule(schedule *Schedule, cb func()) Handle {
 	h := genNextHandle()
 	entries[h] = &entry{
-		minute:    minute,
-		hour:      hour,
-		day:       day,
-		month:     month,
-		dayofweek: dayofweek,
-		cb:        cb,
+		schedule: schedule,
+		cb:       cb,
 	}
 	return h
 }
 
+// RegisterSingleton registers a job which is executed on only one game of the cluster each time the cron spec matches
+//
+// All games should register the job with the same name and spec. When the time matches, each game claims the run from
+// the dispatcher selected by the name, and only the first claim is granted, so the job runs exactly once across games.
+func RegisterSingleton(name string, spec string, cb func()) (Handle, error) {
+	schedule, err := ParseSchedule(spec)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, entry := range entries {
+		if entry.singleton == name {
+			return 0, errors.Errorf("singleton crontab %s is already registered", name)
+		}
+	}
+
+	h := genNextHandle()
+	entries[h] = &entry{
+		schedule:  schedule,
+		singleton: name,
+		cb:        cb,
+	}
+	return h, nil
+}
+
 func validateTime(minute, hour, day, month, dayofweek int) {
 	if minute > 59 || minute < -60 {
 		gwlog.Panicf("invalid minute = %d", minute)
@@ -141,42 +130,67 @@ func unregisterCancelledHandles() {
 
 // Initialize crontab module, called by engine
 func Initialize() {
-	now := time.Now()
-	sec := now.Second()
-	var d time.Duration
-	if time.Second*time.Duration(sec) < _CRONTAB_TIME_OFFSET {
-		d = _CRONTAB_TIME_OFFSET - time.Second*time.Duration(sec)
-	} else {
-		d = time.Second*time.Duration(60-sec) + _CRONTAB_TIME_OFFSET
-	}
-
-	d -= time.Nanosecond * time.Duration(now.Nanosecond())
-	gwlog.Debugf("current time is %s, will setup repeat time after %s", now, d)
-	timer.AddCallback(d, func() {
-		setupRepeatTimer()
-		check()
-	})
+	lastCheckTime = time.Now().Truncate(time.Second)
+	timer.AddTimer(_CHECK_INTERVAL, check)
 }
 
 func check() {
+	checkUntil(time.Now())
+}
+
+// checkUntil executes callbacks of entries matching any second since last check until now
+func checkUntil(now time.Time) {
 	unregisterCancelledHandles()
 
-	now := time.Now()
-	gwlog.Debugf("Crontab: checking %d callbacks ...", len(entries))
-	dayofweek, month, day, hour, minute := now.Weekday(), now.Month(), now.Day(), now.Hour(), now.Minute()
+	now = now.Truncate(time.Second)
+	if now.Sub(lastCheckTime) > _MAX_CHECK_DELAY {
+		gwlog.Warnf("Crontab: checking is delayed for %s, missed callbacks are skipped", now.Sub(lastCheckTime))
+		lastCheckTime = now.Add(-_MAX_CHECK_DELAY)
+	}
+
+	for t := lastCheckTime.Add(time.Second); !t.After(now); t = t.Add(time.Second) {
+		for _, entry := range entries {
+			if !entry.schedule.Match(t) {
+				continue
+			}
 
-	for _, entry := range entries {
-		if entry.match(minute, hour, day, month, dayofweek) {
-			gwutils.RunPanicless(entry.cb)
+			if entry.singleton == "" {
+				gwutils.RunPanicless(entry.cb)
+			} else {
+				claimSingleton(entry.singleton, t.Unix())
+			}
 		}
+		unregisterCancelledHandles()
 	}
 
-	unregisterCancelledHandles()
+	if now.After(lastCheckTime) {
+		lastCheckTime = now
+	}
+}
+
+// OnSingletonClaimed is called by engine when the dispatcher replies the claim of singleton job
+func OnSingletonClaimed(name string, fireTime int64, granted bool) {
+	if !granted {
+		gwlog.Debugf("Crontab: singleton %s at %s is run by other game", name, time.Unix(fireTime, 0))
+		return
+	}
+
+	for h, entry := range entries {
+		if entry.singleton == name && !isCancelled(h) {
+			gwlog.Infof("Crontab: running singleton %s at %s", name, time.Unix(fireTime, 0))
+			gwutils.RunPanicless(entry.cb)
+			return
+		}
+	}
 }
 
-func setupRepeatTimer() {
-	gwlog.Debugf("Crontab: setup repeat timer at time %s", time.Now())
-	timer.AddTimer(time.Minute, check)
+func isCancelled(h Handle) bool {
+	for _, ch := range cancelledHandles {
+		if ch == h {
+			return true
+		}
+	}
+	return false
 }
 
 func genNextHandle() (h Handle) {
@@ -1,6 +1,9 @@
 package crontab
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 var (
 	quit int64
@@ -35,6 +38,126 @@ func TestUnregister(t *testing.T) {
 	check()
 }
 
+func TestParseSchedule(t *testing.T) {
+	loc := time.UTC
+	at := func(s string) time.Time {
+		tm, err := time.ParseInLocation("2006-01-02 15:04:05", s, loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+
+	for _, c := range []struct {
+		spec    string
+		time    string
+		matched bool
+	}{
+		{"*/5 9-18 * * 1-5", "2024-01-01 09:05:00", true}, // Monday
+		{"*/5 9-18 * * 1-5", "2024-01-01 09:05:01", false},
+		{"*/5 9-18 * * 1-5", "2024-01-01 09:06:00", false},
+		{"*/5 9-18 * * 1-5", "2024-01-01 19:00:00", false},
+		{"*/5 9-18 * * 1-5", "2024-01-06 10:00:00", false}, // Saturday
+		{"30 */10 0 * * *", "2024-01-06 00:20:30", true},
+		{"30 */10 0 * * *", "2024-01-06 00:20:00", false},
+		{"0 4 1,15 * *", "2024-03-15 04:00:00", true},
+		{"0 4 1,15 * *", "2024-03-14 04:00:00", false},
+		{"0 4 1 * mon", "2024-01-08 04:00:00", true}, // day of month or day of week
+		{"0 4 1 * mon", "2024-02-01 04:00:00", true},
+		{"0 4 1 * mon", "2024-02-02 04:00:00", false},
+		{"0 0 * * 7", "2024-01-07 00:00:00", true}, // 7 is Sunday
+		{"0 0 * jan-mar/2 *", "2024-03-02 00:00:00", true},
+		{"0 0 * jan-mar/2 *", "2024-02-02 00:00:00", false},
+		{"10/20 * * * *", "2024-02-02 00:50:00", true},
+		{"10/20 * * * *", "2024-02-02 00:20:00", false},
+		{"@daily", "2024-02-02 00:00:00", true},
+		{"@daily", "2024-02-02 01:00:00", false},
+		{"@hourly", "2024-02-02 01:00:00", true},
+	} {
+		s, err := ParseSchedule(c.spec)
+		if err != nil {
+			t.Fatalf("parse %q failed: %v", c.spec, err)
+		}
+		s.Location = loc
+		if matched := s.Match(at(c.time)); matched != c.matched {
+			t.Errorf("%q should match %s: %v, but got %v", c.spec, c.time, c.matched, matched)
+		}
+	}
+
+	for _, spec := range []string{"", "* * * *", "* * * * * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *",
+		"* * * * 8", "5-1 * * * *", "*/0 * * * *", "x * * * *", "@never", "CRON_TZ=Invalid/Zone 0 4 * * *"} {
+		if _, err := ParseSchedule(spec); err == nil {
+			t.Errorf("parse %q should fail", spec)
+		}
+	}
+}
+
+func TestScheduleLocation(t *testing.T) {
+	s := MustParseSchedule("CRON_TZ=Asia/Shanghai 0 4 * * *")
+	if s.Location == nil || s.Location.String() != "Asia/Shanghai" {
+		t.Fatalf("wrong location: %v", s.Location)
+	}
+	if !s.Match(time.Date(2024, 1, 1, 20, 0, 0, 0, time.UTC)) { // 04:00 of the next day in Shanghai
+		t.Errorf("schedule should match in its time zone")
+	}
+	if s.Match(time.Date(2024, 1, 1, 4, 0, 0, 0, time.UTC)) {
+		t.Errorf("schedule should not match in UTC")
+	}
+}
+
+func TestLegacySchedule(t *testing.T) {
+	s := legacySchedule(-15, 3, -1, -1, 0)
+	if !s.Match(time.Date(2024, 1, 7, 3, 45, 0, 0, time.Local)) { // Sunday
+		t.Errorf("legacy schedule should match")
+	}
+	if s.Match(time.Date(2024, 1, 7, 3, 40, 0, 0, time.Local)) || s.Match(time.Date(2024, 1, 8, 3, 45, 0, 0, time.Local)) {
+		t.Errorf("legacy schedule should not match")
+	}
+}
+
+func TestCheckSingleton(t *testing.T) {
+	oldClaimSingleton, oldLastCheckTime := claimSingleton, lastCheckTime
+	defer func() {
+		claimSingleton, lastCheckTime = oldClaimSingleton, oldLastCheckTime
+	}()
+
+	var claims []int64
+	claimSingleton = func(name string, fireTime int64) {
+		if name != "daily_reset" {
+			t.Errorf("wrong singleton name: %s", name)
+		}
+		claims = append(claims, fireTime)
+	}
+
+	runs := 0
+	h, err := RegisterSingleton("daily_reset", "* * * * * *", func() {
+		runs += 1
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Unregister()
+	if _, err := RegisterSingleton("daily_reset", "* * * * *", func() {}); err == nil {
+		t.Errorf("duplicate singleton should fail")
+	}
+
+	now := time.Now().Truncate(time.Second)
+	lastCheckTime = now.Add(-time.Second * 3)
+	checkUntil(now)
+	if len(claims) != 3 || claims[2] != now.Unix() {
+		t.Fatalf("should claim for each second, but got %v", claims)
+	}
+	if runs != 0 {
+		t.Fatalf("singleton should not run before claimed")
+	}
+
+	OnSingletonClaimed("daily_reset", now.Unix(), false)
+	OnSingletonClaimed("daily_reset", now.Unix(), true)
+	if runs != 1 {
+		t.Fatalf("singleton should run once, but got %d", runs)
+	}
+}
+
 //
 //func timerLoop() {
 //	for quit == 0 {
@@ -0,0 +1,243 @@
+package crontab
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sagacao/goworld/engine/gwlog"
+)
+
+// Schedule is a parsed cron schedule, which matches times by second, minute, hour, day of month, month and day of week
+type Schedule struct {
+	second, minute, hour, dom, month, dow uint64 // bit sets of values matched by each field
+
+	// if both day of month and day of week are restricted, a time matches if either of them matches, as standard cron does
+	domOrDow bool
+
+	// Location is the time zone of the schedule, time.Local is used if nil
+	Location *time.Location
+}
+
+type fieldBounds struct {
+	name     string
+	min, max int
+	names    map[string]int
+}
+
+var (
+	secondBounds = fieldBounds{"second", 0, 59, nil}
+	minuteBounds = fieldBounds{"minute", 0, 59, nil}
+	hourBounds   = fieldBounds{"hour", 0, 23, nil}
+	domBounds    = fieldBounds{"day of month", 1, 31, nil}
+	monthBounds  = fieldBounds{"month", 1, 12, map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	dowBounds = fieldBounds{"day of week", 0, 7, map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+var descriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// ParseSchedule parses a standard cron spec
+//
+// The spec has five fields (minute, hour, day of month, month and day of week), or six fields with a leading second field.
+// Each field can be *, a value, a range (1-5), a step (*/5, 10-30/5) or a comma separated list of them. Months and days of
+// week can also be specified by names (jan-dec, sun-sat), and both 0 and 7 are Sunday. Descriptors like @daily and
+// @hourly are also supported. The time zone can be specified by a CRON_TZ= or TZ= prefix, e.g. "CRON_TZ=Asia/Shanghai 0 4 * * *".
+func ParseSchedule(spec string) (*Schedule, error) {
+	s := &Schedule{}
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "CRON_TZ=") || strings.HasPrefix(spec, "TZ=") {
+		i := strings.IndexAny(spec, " \t")
+		if i < 0 {
+			return nil, errors.Errorf("invalid cron spec %q: missing fields", spec)
+		}
+		tz := spec[strings.Index(spec, "=")+1 : i]
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid time zone %q", tz)
+		}
+		s.Location = loc
+		spec = strings.TrimSpace(spec[i:])
+	}
+
+	if strings.HasPrefix(spec, "@") {
+		expanded, ok := descriptors[strings.ToLower(spec)]
+		if !ok {
+			return nil, errors.Errorf("unknown cron descriptor %q", spec)
+		}
+		spec = expanded
+	}
+
+	fields := strings.Fields(spec)
+	switch len(fields) {
+	case 5:
+		fields = append([]string{"0"}, fields...)
+	case 6:
+	default:
+		return nil, errors.Errorf("invalid cron spec %q: expect 5 or 6 fields, but got %d", spec, len(fields))
+	}
+
+	var err error
+	if s.second, err = parseField(fields[0], secondBounds); err != nil {
+		return nil, err
+	}
+	if s.minute, err = parseField(fields[1], minuteBounds); err != nil {
+		return nil, err
+	}
+	if s.hour, err = parseField(fields[2], hourBounds); err != nil {
+		return nil, err
+	}
+	if s.dom, err = parseField(fields[3], domBounds); err != nil {
+		return nil, err
+	}
+	if s.month, err = parseField(fields[4], monthBounds); err != nil {
+		return nil, err
+	}
+	if s.dow, err = parseField(fields[5], dowBounds); err != nil {
+		return nil, err
+	}
+	if s.dow&(1<<7) != 0 { // 7 is also Sunday
+		s.dow |= 1
+	}
+	s.domOrDow = isRestricted(fields[3]) && isRestricted(fields[5])
+	return s, nil
+}
+
+// MustParseSchedule is like ParseSchedule but panics if the spec is invalid
+func MustParseSchedule(spec string) *Schedule {
+	s, err := ParseSchedule(spec)
+	if err != nil {
+		gwlog.Panic(err)
+	}
+	return s
+}
+
+func isWildcard(field string) bool {
+	return field == "*" || field == "?"
+}
+
+// isRestricted checks if the field restricts values, fields starting with * (e.g. */2) are not restricted like standard cron
+func isRestricted(field string) bool {
+	return field != "?" && !strings.HasPrefix(field, "*")
+}
+
+// parseField parses a comma separated list of ranges into a bit set
+func parseField(field string, bounds fieldBounds) (uint64, error) {
+	var bits uint64
+	for _, item := range strings.Split(field, ",") {
+		rangeExpr, step := item, 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			var err error
+			rangeExpr = item[:i]
+			if step, err = strconv.Atoi(item[i+1:]); err != nil || step <= 0 {
+				return 0, errors.Errorf("invalid step in %s field %q", bounds.name, item)
+			}
+		}
+
+		var low, high int
+		if isWildcard(rangeExpr) {
+			low, high = bounds.min, bounds.max
+		} else {
+			parts := strings.SplitN(rangeExpr, "-", 2)
+			var err error
+			if low, err = parseValue(parts[0], bounds); err != nil {
+				return 0, err
+			}
+			high = low
+			if len(parts) == 2 {
+				if high, err = parseValue(parts[1], bounds); err != nil {
+					return 0, err
+				}
+			} else if step > 1 {
+				high = bounds.max // a/n means from a to the max value every n
+			}
+			if high < low {
+				return 0, errors.Errorf("invalid range in %s field %q", bounds.name, item)
+			}
+		}
+
+		for v := low; v <= high; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func parseValue(s string, bounds fieldBounds) (int, error) {
+	if v, ok := bounds.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, errors.Errorf("invalid %s %q", bounds.name, s)
+	}
+	if v < bounds.min || v > bounds.max {
+		return 0, errors.Errorf("%s %d out of range [%d, %d]", bounds.name, v, bounds.min, bounds.max)
+	}
+	return v, nil
+}
+
+// Match checks if the time matches the schedule, at the precision of seconds
+func (s *Schedule) Match(t time.Time) bool {
+	if s.Location != nil {
+		t = t.In(s.Location)
+	} else {
+		t = t.Local()
+	}
+
+	if s.second&(1<<uint(t.Second())) == 0 || s.minute&(1<<uint(t.Minute())) == 0 ||
+		s.hour&(1<<uint(t.Hour())) == 0 || s.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domOrDow {
+		return domMatch || dowMatch
+	}
+	return domMatch && dowMatch
+}
+
+// legacySchedule converts time conditions of Register to schedule
+func legacySchedule(minute, hour, day, month, dayofweek int) *Schedule {
+	s := &Schedule{
+		second: 1,
+		minute: legacyFieldBits(minute, minuteBounds),
+		hour:   legacyFieldBits(hour, hourBounds),
+		dom:    legacyFieldBits(day, domBounds),
+		month:  legacyFieldBits(month, monthBounds),
+	}
+	if dayofweek < 0 {
+		s.dow = legacyFieldBits(-1, dowBounds)
+	} else {
+		s.dow = 1 << uint(dayofweek%7)
+	}
+	return s
+}
+
+// legacyFieldBits returns bits of the value, or values divisible by -v if v is negative
+func legacyFieldBits(v int, bounds fieldBounds) uint64 {
+	if v >= 0 {
+		return 1 << uint(v)
+	}
+	var bits uint64
+	for i := bounds.min; i <= bounds.max; i++ {
+		if i%-v == 0 {
+			bits |= 1 << uint(i)
+		}
+	}
+	return bits
+}
@@ -7,6 +7,7 @@ import (
 
 	"fmt"
 
+	"sync"
 	"sync/atomic"
 	"unsafe"
 
@@ -32,6 +33,15 @@ type DispatcherConnMgr struct {
 	_dispatcherClient                           *DispatcherClient
 	isReconnect, isRestoreGame, isBanBootEntity bool // more properties for Game
 	delegate                                    IDispatcherClientDelegate
+	useStandby                                  bool // connect to the standby dispatcher instead of the primary one
+
+	sendLock        sync.Mutex
+	sendCond        *sync.Cond      // signaled when sent packets are acknowledged
+	epoch           uint64          // epoch of sequence numbers of sent packets
+	sentPackets     sentPacketQueue // packets not acknowledged by dispatcher yet
+	dispatcherEpoch uint64          // the latest epoch of active dispatchers, older dispatchers are fenced
+	recvSeq         uint64          // number of packets received on the current connection (atomic)
+	ackedRecvSeq    uint64          // recvSeq acknowledged to dispatcher
 }
 
 var (
@@ -39,14 +49,17 @@ var (
 )
 
 func NewDispatcherConnMgr(gid uint16, dctype DispatcherClientType, dispid uint16, isRestoreGame, isBanBootEntity bool, delegate IDispatcherClientDelegate) *DispatcherConnMgr {
-	return &DispatcherConnMgr{
+	dcm := &DispatcherConnMgr{
 		gid:             gid,
 		dctype:          dctype,
 		dispid:          dispid,
 		isRestoreGame:   isRestoreGame,
 		isBanBootEntity: isBanBootEntity,
 		delegate:        delegate,
+		epoch:           uint64(time.Now().UnixNano()),
 	}
+	dcm.sendCond = sync.NewCond(&dcm.sendLock)
+	return dcm
 }
 
 func (dcm *DispatcherConnMgr) getDispatcherClient() *DispatcherClient { // atomic
@@ -71,15 +84,11 @@ func (dcm *DispatcherConnMgr) assureConnected() *DispatcherClient {
 		dc, err = dcm.connectDispatchClient()
 		if err != nil {
 			gwlog.Errorf("Connect to dispatcher%d failed: %s", dcm.dispid, err.Error())
+			dcm.switchDispatcher()
 			time.Sleep(_LOOP_DELAY_ON_DISPATCHER_CLIENT_ERROR)
 			continue
 		}
-		dcm.setDispatcherClient(dc)
-		if dcm.dctype == GameDispatcherClientType {
-			dc.SendSetGameID(dcm.gid, dcm.isReconnect, dcm.isRestoreGame, dcm.isBanBootEntity, dcm.delegate.GetEntityIDsForDispatcher(dcm.dispid))
-		} else {
-			dc.SendSetGateID(dcm.gid)
-		}
+		dcm.setupDispatcherClient(dc)
 		dcm.isReconnect = true
 
 		gwlog.Infof("dispatcher_client: connected to dispatcher: %s", dc)
@@ -87,9 +96,118 @@ func (dcm *DispatcherConnMgr) assureConnected() *DispatcherClient {
 	return dc
 }
 
+// setupDispatcherClient sets gameid or gateid on the new connection, resends packets which are not acknowledged yet,
+// and then uses the connection for sending
+//
+// Packets are only kept for resending if standby dispatcher is configured.
+func (dcm *DispatcherConnMgr) setupDispatcherClient(dc *DispatcherClient) {
+	dcm.sendLock.Lock()
+	defer dcm.sendLock.Unlock()
+
+	// packets received from dispatcher are counted on each connection
+	atomic.StoreUint64(&dcm.recvSeq, 0)
+	dcm.ackedRecvSeq = 0
+
+	firstSeq := dcm.sentPackets.firstSeq()
+	if dcm.dctype == GameDispatcherClientType {
+		dc.SendSetGameID(dcm.gid, dcm.isReconnect, dcm.isRestoreGame, dcm.isBanBootEntity, dcm.delegate.GetEntityIDsForDispatcher(dcm.dispid), dcm.epoch, firstSeq, dcm.dispatcherEpoch)
+	} else {
+		dc.SendSetGateID(dcm.gid, dcm.epoch, firstSeq, dcm.dispatcherEpoch)
+	}
+
+	if !config.GetDispatcher(dcm.dispid).HasStandby() {
+		dcm.setDispatcherClient(dc)
+		return
+	}
+
+	if len(dcm.sentPackets.packets) > 0 {
+		gwlog.Infof("%s: resending %d packets from seq %d", dcm, len(dcm.sentPackets.packets), firstSeq)
+	}
+	for _, packet := range dcm.sentPackets.packets {
+		dc.SendPacketNoHook(packet)
+	}
+
+	// all packets sent by old and new dispatcher clients are sent using the connection manager
+	dc.SetSendPacketHook(dcm.sendPacket)
+	dcm.setDispatcherClient(dc)
+}
+
+// sendPacket sends the packet to the current dispatcher client, and keeps the packet until it is acknowledged
+//
+// The sender is blocked if too many packets are not acknowledged by dispatcher yet.
+func (dcm *DispatcherConnMgr) sendPacket(packet *netutil.Packet) error {
+	dcm.sendLock.Lock()
+	defer dcm.sendLock.Unlock()
+
+	size := int(packet.GetPayloadLen())
+	if dcm.sentPackets.isFull(size) {
+		gwlog.Warnf("%s: %d packets (%d bytes) are not acknowledged by dispatcher, waiting ...", dcm, len(dcm.sentPackets.packets), dcm.sentPackets.bytes)
+		for dcm.sentPackets.isFull(size) {
+			dcm.sendCond.Wait()
+		}
+	}
+
+	dcm.sentPackets.push(packet)
+	dc := dcm.getDispatcherClient()
+	if dc.IsClosed() {
+		// the packet will be resent after reconnected
+		return nil
+	}
+	return dc.SendPacketNoHook(packet)
+}
+
+// handleDispatcherAck releases acknowledged packets, returns false if the dispatcher is fenced by a newer active dispatcher
+func (dcm *DispatcherConnMgr) handleDispatcherAck(dispatcherEpoch uint64, seq uint64) bool {
+	dcm.sendLock.Lock()
+	defer dcm.sendLock.Unlock()
+
+	if dispatcherEpoch < dcm.dispatcherEpoch {
+		gwlog.Warnf("%s: dispatcher epoch %d is older than %d, switching dispatcher ...", dcm, dispatcherEpoch, dcm.dispatcherEpoch)
+		return false
+	}
+	dcm.dispatcherEpoch = dispatcherEpoch
+	dcm.sentPackets.ack(seq)
+	dcm.sendCond.Broadcast()
+	return true
+}
+
+// ackRoutine acknowledges packets received from dispatcher periodically, dispatcher does not acknowledge packets
+// forwarded to this game or gate until then
+func (dcm *DispatcherConnMgr) ackRoutine() {
+	ticker := time.Tick(consts.DISPATCHER_CLIENT_ACK_INTERVAL)
+	for range ticker {
+		dcm.sendDispatcherClientAck()
+	}
+}
+
+func (dcm *DispatcherConnMgr) sendDispatcherClientAck() {
+	dcm.sendLock.Lock()
+	defer dcm.sendLock.Unlock()
+
+	recvSeq := atomic.LoadUint64(&dcm.recvSeq)
+	dc := dcm.getDispatcherClient()
+	if recvSeq == dcm.ackedRecvSeq || dc == nil || dc.IsClosed() {
+		return
+	}
+	if err := dc.SendDispatcherClientAck(recvSeq); err == nil {
+		dcm.ackedRecvSeq = recvSeq
+	}
+}
+
+// switchDispatcher switches between the primary and standby dispatcher if standby dispatcher is configured
+func (dcm *DispatcherConnMgr) switchDispatcher() {
+	if config.GetDispatcher(dcm.dispid).HasStandby() {
+		dcm.useStandby = !dcm.useStandby
+	}
+}
+
 func (dcm *DispatcherConnMgr) connectDispatchClient() (*DispatcherClient, error) {
 	dispatcherConfig := config.GetDispatcher(dcm.dispid)
-	conn, err := netutil.ConnectTCP(dispatcherConfig.AdvertiseAddr)
+	addr := dispatcherConfig.AdvertiseAddr
+	if dcm.useStandby {
+		addr = dispatcherConfig.StandbyAdvertiseAddr
+	}
+	conn, err := netutil.ConnectTCP(addr)
 	if err != nil {
 		return nil, err
 	}
@@ -111,6 +229,9 @@ type IDispatcherClientDelegate interface {
 func (dcm *DispatcherConnMgr) Connect() {
 	dcm.assureConnected()
 	go gwutils.RepeatUntilPanicless(dcm.serveDispatcherClient) // start the recv routine
+	if config.GetDispatcher(dcm.dispid).HasStandby() {
+		go gwutils.RepeatUntilPanicless(dcm.ackRoutine)
+	}
 }
 
 // GetDispatcherClientForSend returns the current dispatcher client for sending messages
@@ -134,6 +255,7 @@ func (dcm *DispatcherConnMgr) serveDispatcherClient() {
 
 			gwlog.TraceError("serveDispatcherClient: RecvMsgPacket error: %s", err.Error())
 			dc.Close()
+			dcm.switchDispatcher()
 			dcm.delegate.HandleDispatcherClientDisconnect()
 			time.Sleep(_LOOP_DELAY_ON_DISPATCHER_CLIENT_ERROR)
 			continue
@@ -142,6 +264,16 @@ func (dcm *DispatcherConnMgr) serveDispatcherClient() {
 		if consts.DEBUG_PACKETS {
 			gwlog.Debugf("%s.RecvPacket: msgtype=%v, payload=%v", dc, msgtype, pkt.Payload())
 		}
+		// all packets sent by dispatcher are counted, including acks
+		atomic.AddUint64(&dcm.recvSeq, 1)
+		if msgtype == proto.MT_DISPATCHER_ACK {
+			dispatcherEpoch := pkt.ReadUint64()
+			if !dcm.handleDispatcherAck(dispatcherEpoch, pkt.ReadUint64()) {
+				dc.Close() // reconnect to the other dispatcher
+			}
+			pkt.Release()
+			continue
+		}
 		dcm.delegate.HandleDispatcherClientPacket(msgtype, pkt)
 	}
 }
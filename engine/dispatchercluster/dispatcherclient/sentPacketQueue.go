@@ -0,0 +1,60 @@
+package dispatcherclient
+
+import (
+	"github.com/sagacao/goworld/engine/consts"
+	"github.com/sagacao/goworld/engine/gwlog"
+	"github.com/sagacao/goworld/engine/netutil"
+)
+
+// sentPacketQueue keeps packets sent to dispatcher until they are acknowledged, so that they can be resent after
+// reconnecting to dispatcher (or the standby dispatcher)
+//
+// Packets are numbered from 1 in the order of sending, and packets[i] is the packet of sequence number ackedSeq+1+i.
+type sentPacketQueue struct {
+	ackedSeq uint64
+	packets  []*netutil.Packet
+	bytes    int // total payload size of packets
+}
+
+// firstSeq returns the sequence number of the first packet which is not acknowledged yet
+func (q *sentPacketQueue) firstSeq() uint64 {
+	return q.ackedSeq + 1
+}
+
+// isFull returns if the packet of the size can not be kept until more packets are acknowledged
+//
+// A packet larger than DISPATCHER_CLIENT_MAX_UNACKED_BYTES can be kept if all packets are acknowledged.
+func (q *sentPacketQueue) isFull(size int) bool {
+	return len(q.packets) > 0 && q.bytes+size > consts.DISPATCHER_CLIENT_MAX_UNACKED_BYTES
+}
+
+// push keeps the packet until it is acknowledged
+func (q *sentPacketQueue) push(packet *netutil.Packet) {
+	packet.AddRefCount(1)
+	q.packets = append(q.packets, packet)
+	q.bytes += int(packet.GetPayloadLen())
+}
+
+// ack releases packets till the sequence number
+func (q *sentPacketQueue) ack(seq uint64) {
+	if seq <= q.ackedSeq {
+		return
+	}
+
+	n := seq - q.ackedSeq
+	if n > uint64(len(q.packets)) {
+		gwlog.Errorf("sentPacketQueue: ack %d, but only %d packets are sent", seq, q.ackedSeq+uint64(len(q.packets)))
+		n = uint64(len(q.packets))
+	}
+	q.release(int(n))
+}
+
+func (q *sentPacketQueue) release(n int) {
+	for i := 0; i < n; i++ {
+		q.bytes -= int(q.packets[i].GetPayloadLen())
+		q.packets[i].Release()
+		q.packets[i] = nil
+	}
+	q.packets = q.packets[n:]
+	q.ackedSeq += uint64(n)
+}
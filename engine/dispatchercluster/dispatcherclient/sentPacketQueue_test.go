@@ -0,0 +1,48 @@
+package dispatcherclient
+
+import (
+	"testing"
+
+	"github.com/sagacao/goworld/engine/consts"
+	"github.com/sagacao/goworld/engine/netutil"
+)
+
+func TestSentPacketQueue(t *testing.T) {
+	var q sentPacketQueue
+	var packets []*netutil.Packet
+	for i := 0; i < 5; i++ {
+		packet := netutil.NewPacket()
+		packet.AppendUint32(uint32(i))
+		q.push(packet)
+		packets = append(packets, packet)
+		packet.Release()
+	}
+
+	if q.firstSeq() != 1 || len(q.packets) != 5 || q.bytes != 20 {
+		t.Fatalf("all packets should be kept: firstSeq=%d, packets=%d, bytes=%d", q.firstSeq(), len(q.packets), q.bytes)
+	}
+
+	q.ack(2)
+	if q.firstSeq() != 3 || len(q.packets) != 3 || q.packets[0] != packets[2] || q.bytes != 12 {
+		t.Fatalf("packets 1~2 should be released: firstSeq=%d, packets=%d, bytes=%d", q.firstSeq(), len(q.packets), q.bytes)
+	}
+
+	// acknowledging old packets again is ignored
+	q.ack(1)
+	if q.firstSeq() != 3 || len(q.packets) != 3 {
+		t.Fatalf("old ack should be ignored: firstSeq=%d, packets=%d", q.firstSeq(), len(q.packets))
+	}
+
+	if q.isFull(consts.DISPATCHER_CLIENT_MAX_UNACKED_BYTES-12) || !q.isFull(consts.DISPATCHER_CLIENT_MAX_UNACKED_BYTES-11) {
+		t.Fatalf("queue should be full if packets exceed DISPATCHER_CLIENT_MAX_UNACKED_BYTES: bytes=%d", q.bytes)
+	}
+
+	// acknowledging packets which are not sent only releases sent packets
+	q.ack(100)
+	if q.firstSeq() != 6 || len(q.packets) != 0 {
+		t.Fatalf("all packets should be released: firstSeq=%d, packets=%d", q.firstSeq(), len(q.packets))
+	}
+	if q.isFull(consts.DISPATCHER_CLIENT_MAX_UNACKED_BYTES + 1) {
+		t.Fatalf("large packet should be kept if all packets are acknowledged")
+	}
+}
@@ -98,6 +98,10 @@ func SendSrvdisRegister(srvid string, info string, force bool) {
 	SelectBySrvID(srvid).SendSrvdisRegister(srvid, info, force)
 }
 
+func SendClaimCrontabSingleton(name string, fireTime int64) error {
+	return SelectBySrvID(name).SendClaimCrontabSingleton(name, fireTime)
+}
+
 func SendCallNilSpaces(exceptGameID uint16, method string, args []interface{}) {
 	// construct one packet for multiple sending
 	packet := proto.AllocCallNilSpacesPacket(exceptGameID, method, args)
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"reflect"
 
+	"sync/atomic"
+
 	"time"
 
 	"unsafe"
@@ -18,7 +20,6 @@ import (
 	"github.com/sagacao/goworld/engine/post"
 	"github.com/sagacao/goworld/engine/proto"
 	"github.com/sagacao/goworld/engine/storage"
-	"github.com/xiaonanln/go-aoi"
 	timer "github.com/xiaonanln/goTimer"
 	"github.com/xiaonanln/typeconv"
 )
@@ -36,33 +37,47 @@ type entityTimerInfo struct {
 	Method         string
 	Args           []interface{}
 	Repeat         bool
+	Persistent     bool // persistent timers are saved with the entity, see AddPersistentCallback
 	rawTimer       *timer.Timer
 }
 
 // Entity is the basic execution unit in GoWorld server. Entities can be used to
 // represent players, NPCs, monsters. Entities can migrate among spaces.
 type Entity struct {
-	ID                   common.EntityID
-	LoadID               common.EntityID
-	TypeName             string
-	I                    IEntity
-	V                    reflect.Value
-	destroyed            bool
-	typeDesc             *EntityTypeDesc
-	Space                *Space
-	Position             Vector3
-	InterestedIn         EntitySet
-	InterestedBy         EntitySet
-	aoi                  aoi.AOI
-	yaw                  Yaw
-	rawTimers            map[*timer.Timer]struct{}
-	timers               map[EntityTimerID]*entityTimerInfo
-	lastTimerId          EntityTimerID
-	client               *GameClient
-	syncingFromClient    bool
-	Attrs                *MapAttr
-	syncInfoFlag         syncInfoFlag
-	enteringSpaceRequest struct {
+	ID                      common.EntityID
+	LoadID                  common.EntityID
+	TypeName                string
+	I                       IEntity
+	V                       reflect.Value
+	destroyed               bool
+	ghost                   bool
+	partitionGen            uint64 // increased when entering cells of partitioned spaces, ghosts keep the generation of their owner
+	ghostAttrsDirty         bool   // all-client attributes are changed since mirrored to ghosts
+	typeDesc                *EntityTypeDesc
+	Space                   *Space
+	Position                Vector3
+	InterestedIn            EntitySet
+	InterestedBy            EntitySet
+	yaw                     Yaw
+	rawTimers               map[*timer.Timer]struct{}
+	timers                  map[EntityTimerID]*entityTimerInfo
+	lastTimerId             EntityTimerID
+	callReplies             map[uint32]*entityCallReplyInfo
+	lastCallReplyID         uint32
+	reliableCalls           reliableCallsData
+	reliableCallsDirty      bool
+	reliableCallsCommitting bool
+	reliableCallTimer       *timer.Timer
+	persistentTimersDirty   bool
+	client                  *GameClient
+	clientResumeTimer       *timer.Timer
+	syncingFromClient       bool
+	lastClientSyncTime      time.Time
+	Attrs                   *MapAttr
+	dirtyAttrs              common.StringSet
+	allAttrsDirty           bool
+	syncInfoFlag            syncInfoFlag
+	enteringSpaceRequest    struct {
 		SpaceID              common.EntityID
 		EnterPos             Vector3
 		RequestTime          int64
@@ -71,8 +86,14 @@ type Entity struct {
 }
 
 type clientData struct {
-	ClientID common.ClientID
-	GateID   uint16
+	ClientID       common.ClientID
+	GateID         uint16
+	ResumeToken    string            `msgpack:",omitempty"`
+	FilterProps    map[string]string `msgpack:",omitempty"`
+	Suspended      bool              `msgpack:",omitempty"`
+	ResumeDeadline int64             `msgpack:",omitempty"` // in unix nanoseconds
+	Buffered       [][]byte          `msgpack:",omitempty"`
+	BufferOverflow bool              `msgpack:",omitempty"`
 }
 
 // entity info that should be migrated
@@ -84,9 +105,14 @@ type entityMigrateData struct {
 	Yaw               Yaw                    `msgpack:"Yaw"`
 	SpaceID           common.EntityID        `msgpack:"SP"`
 	TimerData         []byte                 `msgpack:"TD,omitempty"`
+	CallReplyData     []byte                 `msgpack:"CRD,omitempty"`
+	ReliableCallData  []byte                 `msgpack:"RCD,omitempty"`
+	DirtyAttrs        []string               `msgpack:"DA,omitempty"`
+	AllAttrsDirty     bool                   `msgpack:"AD,omitempty"`
 	FilterProps       map[string]string      `msgpack:"FP"`
 	SyncingFromClient bool                   `msgpack""SFC`
 	SyncInfoFlag      syncInfoFlag           `msgpack:"SIF"`
+	PartitionGen      uint64                 `msgpack:"PG,omitempty"`
 }
 
 type syncInfoFlag int
@@ -116,6 +142,8 @@ type IEntity interface {
 	// Client Notifications
 	OnClientConnected()    // Called when Client is connected to entity (become player)
 	OnClientDisconnected() // Called when Client disconnected
+	OnClientSuspended()    // Called when Client disconnected and waiting to be resumed
+	OnClientResumed()      // Called when Client is resumed on a new connection
 
 	DescribeEntityType(desc *EntityTypeDesc) // Define entity attributes in this function
 }
@@ -130,11 +158,21 @@ func (e *Entity) Destroy() {
 		return
 	}
 	gwlog.Debugf("%s.Destroy ...", e)
-	e.destroyEntity(false)
+	e.destroyEntity(false, false)
+	dispatchercluster.SendNotifyDestroyEntity(e.ID)
+}
+
+// DestroyAndDelete destroys the entity and deletes its data from storage instead of saving it
+func (e *Entity) DestroyAndDelete() {
+	if e.destroyed {
+		return
+	}
+	gwlog.Debugf("%s.DestroyAndDelete ...", e)
+	e.destroyEntity(false, true)
 	dispatchercluster.SendNotifyDestroyEntity(e.ID)
 }
 
-func (e *Entity) destroyEntity(isMigrate bool) {
+func (e *Entity) destroyEntity(isMigrate bool, isDelete bool) {
 	e.Space.leave(e)
 
 	if !isMigrate {
@@ -148,7 +186,11 @@ func (e *Entity) destroyEntity(isMigrate bool) {
 
 	if !isMigrate {
 		e.SetClient(nil) // always set Client to nil before destroy
-		e.Save()
+		if !isDelete {
+			e.Save()
+		} else if e.IsPersistent() {
+			storage.Delete(e.TypeName, e.ID, nil)
+		}
 	} else {
 		e.assignClient(nil)
 	}
@@ -168,13 +210,33 @@ func (e *Entity) Save() {
 		return
 	}
 
+	e.save(nil)
+}
+
+// save saves the entity and calls the callback when all changes are saved
+func (e *Entity) save(callback storage.SaveCallbackFunc) {
 	if consts.DEBUG_SAVE_LOAD {
 		gwlog.Debugf("SAVING %s ...", e)
 	}
 
-	data := e.getPersistentData()
+	if !e.allAttrsDirty && len(e.dirtyAttrs) == 0 && !e.reliableCallsDirty && !e.persistentTimersDirty {
+		// persistent attributes are not changed since last save
+		if callback != nil {
+			post.Post(func() {
+				callback(nil)
+			})
+		}
+		return
+	}
 
-	storage.Save(e.TypeName, e.ID, data, nil)
+	if e.allAttrsDirty || !storage.IsUpdateSupported() {
+		data := e.getPersistentData()
+		storage.Save(e.TypeName, e.ID, data, callback)
+	} else {
+		updates, deletes := e.getDirtyPersistentData()
+		storage.Update(e.TypeName, e.ID, updates, deletes, callback)
+	}
+	e.clearDirtyAttrs()
 }
 
 // IsSpaceEntity returns if the entity is actually a space
@@ -201,14 +263,15 @@ func (e *Entity) init(typeName string, entityid common.EntityID, entityInstance
 
 	e.rawTimers = map[*timer.Timer]struct{}{}
 	e.timers = map[EntityTimerID]*entityTimerInfo{}
+	e.callReplies = map[uint32]*entityCallReplyInfo{}
 
 	attrs := NewMapAttr()
 	attrs.owner = e
 	e.Attrs = attrs
+	e.dirtyAttrs = common.StringSet{}
 
 	e.InterestedIn = EntitySet{}
 	e.InterestedBy = EntitySet{}
-	aoi.InitAOI(&e.aoi, aoi.Coord(e.typeDesc.aoiDistance), e, e)
 
 	e.I.OnInit()
 }
@@ -225,24 +288,28 @@ func SetSaveInterval(duration time.Duration) {
 
 // Space Operations related to aoi
 
-func (e *Entity) OnEnterAOI(otherAoi *aoi.AOI) {
-	e.interest(otherAoi.Data.(*Entity))
+// OnEnterAOI is called by AOIManager when other entity enters the AOI of this entity
+func (e *Entity) OnEnterAOI(other *Entity) {
+	e.interest(other)
 }
 
-func (e *Entity) OnLeaveAOI(otherAoi *aoi.AOI) {
-	e.uninterest(otherAoi.Data.(*Entity))
+// OnLeaveAOI is called by AOIManager when other entity leaves the AOI of this entity
+func (e *Entity) OnLeaveAOI(other *Entity) {
+	e.uninterest(other)
 }
 
 // Interests and Uninterest among entities
 func (e *Entity) interest(other *Entity) {
 	e.InterestedIn.Add(other)
 	other.InterestedBy.Add(e)
+	aoiInterestMetric.Inc()
 	e.client.sendCreateEntity(other, false)
 }
 
 func (e *Entity) uninterest(other *Entity) {
 	e.InterestedIn.Del(other)
 	other.InterestedBy.Del(e)
+	aoiInterestMetric.Dec()
 	e.client.sendDestroyEntity(other)
 }
 
@@ -270,15 +337,23 @@ func (tid EntityTimerID) IsValid() bool {
 //
 // The callback will be cancelled if entity is destroyed
 func (e *Entity) AddCallback(d time.Duration, method string, args ...interface{}) EntityTimerID {
+	return e.addCallback(d, method, args, false)
+}
+
+func (e *Entity) addCallback(d time.Duration, method string, args []interface{}, persistent bool) EntityTimerID {
 	tid := e.genTimerId()
 	now := time.Now()
 	info := &entityTimerInfo{
-		FireTime: now.Add(d),
-		Method:   method,
-		Args:     args,
-		Repeat:   false,
+		FireTime:   now.Add(d),
+		Method:     method,
+		Args:       args,
+		Repeat:     false,
+		Persistent: persistent,
 	}
 	e.timers[tid] = info
+	if persistent {
+		e.persistentTimersDirty = true
+	}
 	info.rawTimer = e.addRawCallback(d, func() {
 		e.triggerTimer(tid, false)
 	})
@@ -290,6 +365,10 @@ func (e *Entity) AddCallback(d time.Duration, method string, args ...interface{}
 //
 // The callback will be cancelled if entity is destroyed
 func (e *Entity) AddTimer(d time.Duration, method string, args ...interface{}) EntityTimerID {
+	return e.addTimer(d, method, args, false)
+}
+
+func (e *Entity) addTimer(d time.Duration, method string, args []interface{}, persistent bool) EntityTimerID {
 	if d < time.Millisecond*10 { // minimal interval for repeat timer
 		d = time.Millisecond * 10
 	}
@@ -302,8 +381,12 @@ func (e *Entity) AddTimer(d time.Duration, method string, args ...interface{}) E
 		Method:         method,
 		Args:           args,
 		Repeat:         true,
+		Persistent:     persistent,
 	}
 	e.timers[tid] = info
+	if persistent {
+		e.persistentTimersDirty = true
+	}
 	info.rawTimer = e.addRawTimer(d, func() {
 		e.triggerTimer(tid, true)
 	})
@@ -319,6 +402,9 @@ func (e *Entity) CancelTimer(tid EntityTimerID) {
 	}
 	delete(e.timers, tid)
 	e.cancelRawTimer(timerInfo.rawTimer)
+	if timerInfo.Persistent {
+		e.persistentTimersDirty = true
+	}
 }
 
 func (e *Entity) triggerTimer(tid EntityTimerID, isRepeat bool) {
@@ -335,6 +421,9 @@ func (e *Entity) triggerTimer(tid EntityTimerID, isRepeat bool) {
 		now := time.Now()
 		timerInfo.FireTime = now.Add(timerInfo.RepeatInterval)
 	}
+	if timerInfo.Persistent {
+		e.persistentTimersDirty = true
+	}
 
 	e.onCallFromLocal(timerInfo.Method, timerInfo.Args)
 }
@@ -382,6 +471,10 @@ func (e *Entity) restoreTimers(data []byte) error {
 
 		tid := e.genTimerId()
 		e.timers[tid] = timer
+		if timer.Persistent {
+			// persistent timers might have changed since last save
+			e.persistentTimersDirty = true
+		}
 
 		timer.rawTimer = e.addRawCallback(timer.FireTime.Sub(now), func() {
 			e.triggerTimer(tid, false)
@@ -430,9 +523,28 @@ func (e *Entity) Call(id common.EntityID, method string, args ...interface{}) {
 
 func (e *Entity) syncPositionYawFromClient(x, y, z Coord, yaw Yaw) {
 	//gwlog.Infof("%s.syncPositionYawFromClient: %v,%v,%v, Yaw %v, syncing %v", e, x, y, z, Yaw, e.SyncingFromClient)
-	if e.syncingFromClient {
-		e.setPositionYaw(Vector3{x, y, z}, yaw, true)
+	if !e.syncingFromClient {
+		return
 	}
+
+	pos := Vector3{x, y, z}
+	if validator := e.typeDesc.movementValidator; validator != nil {
+		now := time.Now()
+		validPos, ok := validator.validate(e, pos, now.Sub(e.lastClientSyncTime))
+		if !ok {
+			// reject the position and correct the position on client
+			gwlog.Debugf("%s: position %s synced from client is rejected", e, pos)
+			e.syncInfoFlag |= sifSyncOwnClient
+			return
+		}
+		e.lastClientSyncTime = now
+		if validPos != pos {
+			gwlog.Debugf("%s: position %s synced from client is clamped to %s", e, pos, validPos)
+			e.setPositionYaw(validPos, yaw, false)
+			return
+		}
+	}
+	e.setPositionYaw(pos, yaw, true)
 }
 
 // SetClientSyncing set if entity infos (position, Yaw) is syncing with Client
@@ -448,6 +560,11 @@ func (e *Entity) onCallFromLocal(methodName string, args []interface{}) {
 		}
 	}()
 
+	e.callRPCFromLocal(methodName, args)
+}
+
+// callRPCFromLocal calls the RPC method with local arguments and returns the results of the method
+func (e *Entity) callRPCFromLocal(methodName string, args []interface{}) []reflect.Value {
 	rpcDesc := e.typeDesc.rpcDescs[methodName]
 	if rpcDesc == nil {
 		// rpc not found
@@ -478,7 +595,7 @@ func (e *Entity) onCallFromLocal(methodName string, args []interface{}) {
 		in[i+1] = reflect.Zero(argType)
 	}
 
-	rpcDesc.Func.Call(in)
+	return rpcDesc.Func.Call(in)
 }
 
 func (e *Entity) onCallFromRemote(methodName string, args [][]byte, clientid common.ClientID) {
@@ -489,11 +606,19 @@ func (e *Entity) onCallFromRemote(methodName string, args [][]byte, clientid com
 		}
 	}()
 
+	if _, err := e.callRPCFromRemote(methodName, args, clientid); err != nil {
+		gwlog.Errorf("%s", err)
+	}
+}
+
+// callRPCFromRemote calls the RPC method with packed arguments and returns the results of the method
+//
+// callRPCFromRemote panics if the caller has no permission to call the method
+func (e *Entity) callRPCFromRemote(methodName string, args [][]byte, clientid common.ClientID) ([]reflect.Value, error) {
 	rpcDesc := e.typeDesc.rpcDescs[methodName]
 	if rpcDesc == nil {
 		// rpc not found
-		gwlog.Errorf("%s.onCallFromRemote: Method %s is not a valid RPC, args=%v", e, methodName, args)
-		return
+		return nil, errors.Errorf("%s.onCallFromRemote: Method %s is not a valid RPC, args=%v", e, methodName, args)
 	}
 
 	methodType := rpcDesc.MethodType
@@ -513,8 +638,7 @@ func (e *Entity) onCallFromRemote(methodName string, args [][]byte, clientid com
 	}
 
 	if rpcDesc.NumArgs < len(args) {
-		gwlog.Errorf("%s.onCallFromRemote: Method %s receives %d arguments, but given %d", e, methodName, rpcDesc.NumArgs, len(args))
-		return
+		return nil, errors.Errorf("%s.onCallFromRemote: Method %s receives %d arguments, but given %d", e, methodName, rpcDesc.NumArgs, len(args))
 	}
 
 	in := make([]reflect.Value, rpcDesc.NumArgs+1)
@@ -537,7 +661,7 @@ func (e *Entity) onCallFromRemote(methodName string, args [][]byte, clientid com
 		in[i+1] = reflect.Zero(argType)
 	}
 
-	rpcDesc.Func.Call(in)
+	return rpcDesc.Func.Call(in), nil
 }
 
 // OnInit is called when entity is initializing
@@ -610,14 +734,62 @@ func (e *Entity) IsPersistent() bool {
 //
 // Returns persistent attributes by default
 func (e *Entity) getPersistentData() map[string]interface{} {
-	return e.Attrs.ToMapWithFilter(e.typeDesc.persistentAttrs.Contains)
+	data := e.Attrs.ToMapWithFilter(e.typeDesc.persistentAttrs.Contains)
+	e.typeDesc.stampSchemaVersion(data)
+	e.putReliableCallsData(data)
+	e.putPersistentTimersData(data)
+	return data
 }
 
 // loadPersistentData loads persistent data
 //
-// Load persistent data to attributes
-func (e *Entity) loadPersistentData(data map[string]interface{}) {
+// Load persistent data to attributes, returns keys of invalid attributes which are fixed when loading
+func (e *Entity) loadPersistentData(data map[string]interface{}) []string {
+	e.loadReliableCallsData(data)
+	e.loadPersistentTimersData(data)
+	fixedAttrs := e.normalizePersistentData(data)
 	e.Attrs.AssignMap(data)
+	return fixedAttrs
+}
+
+// getDirtyPersistentData gets values of changed persistent attributes and persistent attributes that are deleted
+func (e *Entity) getDirtyPersistentData() (updates map[string]interface{}, deletes []string) {
+	updates = map[string]interface{}{}
+	for key := range e.dirtyAttrs {
+		if !e.Attrs.HasKey(key) {
+			deletes = append(deletes, key)
+			continue
+		}
+
+		switch a := e.Attrs.get(key).(type) {
+		case *MapAttr:
+			updates[key] = a.ToMap()
+		case *ListAttr:
+			updates[key] = a.ToList()
+		default:
+			updates[key] = a
+		}
+	}
+	if e.reliableCallsDirty {
+		e.putReliableCallsData(updates)
+	}
+	if e.persistentTimersDirty && !e.putPersistentTimersData(updates) {
+		deletes = append(deletes, _PERSISTENT_TIMERS_KEY)
+	}
+	return
+}
+
+func (e *Entity) markAttrDirty(key string) {
+	if e.typeDesc.persistentAttrs.Contains(key) {
+		e.dirtyAttrs.Add(key)
+	}
+}
+
+func (e *Entity) clearDirtyAttrs() {
+	e.dirtyAttrs = common.StringSet{}
+	e.allAttrsDirty = false
+	e.reliableCallsDirty = false
+	e.persistentTimersDirty = false
 }
 
 func (e *Entity) getClientData() map[string]interface{} {
@@ -636,16 +808,18 @@ func (e *Entity) GetMigrateData(spaceid common.EntityID) *entityMigrateData {
 		Pos:               e.Position,
 		Yaw:               e.yaw,
 		TimerData:         e.dumpTimers(),
+		CallReplyData:     e.dumpCallReplies(),
+		ReliableCallData:  e.dumpReliableCalls(),
+		DirtyAttrs:        e.dirtyAttrs.ToList(),
+		AllAttrsDirty:     e.allAttrsDirty,
 		SpaceID:           spaceid,
 		SyncingFromClient: e.syncingFromClient,
 		SyncInfoFlag:      e.syncInfoFlag,
+		PartitionGen:      e.partitionGen,
 	}
 
 	if e.client != nil {
-		md.Client = &clientData{
-			ClientID: e.client.clientid,
-			GateID:   e.client.gateid,
-		}
+		md.Client = e.client.getData()
 	}
 
 	return md
@@ -684,7 +858,7 @@ func (e *Entity) SetClient(client *GameClient) {
 
 	if oldClient != nil {
 		// send destroy entity to Client
-		dispatchercluster.SelectByEntityID(e.ID).SendClearClientFilterProp(oldClient.gateid, oldClient.clientid)
+		oldClient.sendClearClientFilterProps()
 
 		for neighbor := range e.InterestedBy {
 			oldClient.sendDestroyEntity(neighbor)
@@ -701,7 +875,7 @@ func (e *Entity) SetClient(client *GameClient) {
 
 	if client != nil {
 		// send create entity to new client
-		dispatchercluster.SelectByEntityID(e.ID).SendClearClientFilterProp(client.gateid, client.clientid)
+		client.sendClearClientFilterProps()
 		client.sendCreateEntity(e, true)
 
 		if !e.Space.IsNil() {
@@ -726,12 +900,19 @@ func (e *Entity) SetClient(client *GameClient) {
 
 func (e *Entity) assignClient(client *GameClient) {
 	if e.client != nil {
+		e.client.flushAttrChanges()
 		e.client.ownerid = ""
+		e.cancelClientResumeTimer()
+		atomic.AddInt64(&totalClientCount, -1)
 	}
 
 	e.client = client
 	if client != nil {
 		client.ownerid = e.ID
+		atomic.AddInt64(&totalClientCount, 1)
+		if client.suspended {
+			e.setupClientResumeTimer()
+		}
 	}
 }
 
@@ -760,6 +941,7 @@ func (e *Entity) GiveClientTo(other *Entity) {
 		gwlog.Debugf("%s.GiveClientTo(%s): Client=%s", e, other, e.client)
 	}
 	client := e.client
+	client.flushAttrChanges()
 	client.ownerid = other.ID // hack ownerid so that destroy entity messages will be synced with create entity messages
 	e.SetClient(nil)
 	other.SetClient(client)
@@ -802,6 +984,25 @@ func (e *Entity) OnClientDisconnected() {
 	}
 }
 
+// OnClientSuspended is called when Client is disconnected but can be resumed in the grace period
+//
+// Messages to the Client are buffered until it is resumed. OnClientDisconnected is called if the Client is not resumed
+// in time. Can override this function in custom entity type
+func (e *Entity) OnClientSuspended() {
+	if consts.DEBUG_CLIENTS {
+		gwlog.Debugf("%s.OnClientSuspended: %s", e, e.client)
+	}
+}
+
+// OnClientResumed is called when the suspended Client is resumed on a new connection
+//
+// Can override this function in custom entity type
+func (e *Entity) OnClientResumed() {
+	if consts.DEBUG_CLIENTS {
+		gwlog.Debugf("%s.OnClientResumed: %s", e, e.client)
+	}
+}
+
 func (e *Entity) getAttrFlag(attrName string) (flag attrFlag) {
 	if e.typeDesc.allClientAttrs.Contains(attrName) {
 		flag = afAllClient
@@ -817,19 +1018,14 @@ func (e *Entity) sendMapAttrChangeToClients(ma *MapAttr, key string, val interfa
 	if ma == e.Attrs {
 		// this is the root attr
 		flag = e.getAttrFlag(key)
+		e.markAttrDirty(key)
 	} else {
 		flag = ma.flag
+		e.markAttrDirty(rootAttrKey(ma.getPathFromOwner()))
 	}
 
-	if flag&afAllClient != 0 {
-		path := ma.getPathFromOwner()
-		e.client.sendNotifyMapAttrChange(e.ID, path, key, val)
-		for neighbor := range e.InterestedBy {
-			neighbor.client.sendNotifyMapAttrChange(e.ID, path, key, val)
-		}
-	} else if flag&afClient != 0 {
-		path := ma.getPathFromOwner()
-		e.client.sendNotifyMapAttrChange(e.ID, path, key, val)
+	if flag&(afClient|afAllClient) != 0 {
+		e.sendAttrChangeToClients(flag, &attrChange{msgtype: proto.MT_NOTIFY_MAP_ATTR_CHANGE_ON_CLIENT, entityID: e.ID, path: ma.getPathFromOwner(), key: key, val: val})
 	}
 }
 
@@ -838,19 +1034,14 @@ func (e *Entity) sendMapAttrDelToClients(ma *MapAttr, key string) {
 	if ma == e.Attrs {
 		// this is the root attr
 		flag = e.getAttrFlag(key)
+		e.markAttrDirty(key)
 	} else {
 		flag = ma.flag
+		e.markAttrDirty(rootAttrKey(ma.getPathFromOwner()))
 	}
 
-	if flag&afAllClient != 0 {
-		path := ma.getPathFromOwner()
-		e.client.sendNotifyMapAttrDel(e.ID, path, key)
-		for neighbor := range e.InterestedBy {
-			neighbor.client.sendNotifyMapAttrDel(e.ID, path, key)
-		}
-	} else if flag&afClient != 0 {
-		path := ma.getPathFromOwner()
-		e.client.sendNotifyMapAttrDel(e.ID, path, key)
+	if flag&(afClient|afAllClient) != 0 {
+		e.sendAttrChangeToClients(flag, &attrChange{msgtype: proto.MT_NOTIFY_MAP_ATTR_DEL_ON_CLIENT, entityID: e.ID, path: ma.getPathFromOwner(), key: key})
 	}
 }
 
@@ -860,60 +1051,37 @@ func (e *Entity) sendMapAttrClearToClients(ma *MapAttr) {
 		gwlog.Panicf("outmost e.Attrs can not be cleared")
 	}
 	flag := ma.flag
+	e.markAttrDirty(rootAttrKey(ma.getPathFromOwner()))
 
-	if flag&afAllClient != 0 {
-		path := ma.getPathFromOwner()
-		e.client.sendNotifyMapAttrClear(e.ID, path)
-		for neighbor := range e.InterestedBy {
-			neighbor.client.sendNotifyMapAttrClear(e.ID, path)
-		}
-	} else if flag&afClient != 0 {
-		path := ma.getPathFromOwner()
-		e.client.sendNotifyMapAttrClear(e.ID, path)
+	if flag&(afClient|afAllClient) != 0 {
+		e.sendAttrChangeToClients(flag, &attrChange{msgtype: proto.MT_NOTIFY_MAP_ATTR_CLEAR_ON_CLIENT, entityID: e.ID, path: ma.getPathFromOwner()})
 	}
 }
 
 func (e *Entity) sendListAttrChangeToClients(la *ListAttr, index int, val interface{}) {
 	flag := la.flag
+	e.markAttrDirty(rootAttrKey(la.getPathFromOwner()))
 
-	if flag&afAllClient != 0 {
-		// TODO: only pack 1 packet, do not marshal multiple times
-		path := la.getPathFromOwner()
-		e.client.sendNotifyListAttrChange(e.ID, path, uint32(index), val)
-		for neighbor := range e.InterestedBy {
-			neighbor.client.sendNotifyListAttrChange(e.ID, path, uint32(index), val)
-		}
-	} else if flag&afClient != 0 {
-		path := la.getPathFromOwner()
-		e.client.sendNotifyListAttrChange(e.ID, path, uint32(index), val)
+	if flag&(afClient|afAllClient) != 0 {
+		e.sendAttrChangeToClients(flag, &attrChange{msgtype: proto.MT_NOTIFY_LIST_ATTR_CHANGE_ON_CLIENT, entityID: e.ID, path: la.getPathFromOwner(), index: uint32(index), val: val})
 	}
 }
 
 func (e *Entity) sendListAttrPopToClients(la *ListAttr) {
 	flag := la.flag
-	if flag&afAllClient != 0 {
-		path := la.getPathFromOwner()
-		e.client.sendNotifyListAttrPop(e.ID, path)
-		for neighbor := range e.InterestedBy {
-			neighbor.client.sendNotifyListAttrPop(e.ID, path)
-		}
-	} else if flag&afClient != 0 {
-		path := la.getPathFromOwner()
-		e.client.sendNotifyListAttrPop(e.ID, path)
+	e.markAttrDirty(rootAttrKey(la.getPathFromOwner()))
+
+	if flag&(afClient|afAllClient) != 0 {
+		e.sendAttrChangeToClients(flag, &attrChange{msgtype: proto.MT_NOTIFY_LIST_ATTR_POP_ON_CLIENT, entityID: e.ID, path: la.getPathFromOwner()})
 	}
 }
 
 func (e *Entity) sendListAttrAppendToClients(la *ListAttr, val interface{}) {
 	flag := la.flag
-	if flag&afAllClient != 0 {
-		path := la.getPathFromOwner()
-		e.client.sendNotifyListAttrAppend(e.ID, path, val)
-		for neighbor := range e.InterestedBy {
-			neighbor.client.sendNotifyListAttrAppend(e.ID, path, val)
-		}
-	} else if flag&afClient != 0 {
-		path := la.getPathFromOwner()
-		e.client.sendNotifyListAttrAppend(e.ID, path, val)
+	e.markAttrDirty(rootAttrKey(la.getPathFromOwner()))
+
+	if flag&(afClient|afAllClient) != 0 {
+		e.sendAttrChangeToClients(flag, &attrChange{msgtype: proto.MT_NOTIFY_LIST_ATTR_APPEND_ON_CLIENT, entityID: e.ID, path: la.getPathFromOwner(), val: val})
 	}
 }
 
@@ -1097,8 +1265,9 @@ func (e *Entity) realMigrateTo(spaceid common.EntityID, pos Vector3, spaceGameID
 		gwlog.Panicf("%s is migrating to space %s, but pack migrate data failed: %s", e, spaceid, err)
 	}
 
-	e.destroyEntity(true) // disable the entity
+	e.destroyEntity(true, false) // disable the entity
 	dispatchercluster.SendRealMigrate(e.ID, spaceGameID, data)
+	migrationCountMetric.Inc("out")
 }
 
 // OnRealMigrate is used by entity migration
@@ -1113,6 +1282,7 @@ func OnRealMigrate(entityid common.EntityID, data []byte) {
 	}
 
 	restoreEntity(entityid, &md, false)
+	migrationCountMetric.Inc("in")
 }
 
 // OnMigrateOut is called when entity is migrating out
@@ -1220,40 +1390,11 @@ func getEntitySyncInfosPacket(gateid uint16) *netutil.Packet {
 }
 
 func CollectEntitySyncInfos() {
-	for eid, e := range entityManager.entities {
-		syncInfoFlag := e.syncInfoFlag
-		if syncInfoFlag == 0 {
-			continue
-		}
-
-		e.syncInfoFlag = 0
-		syncInfo := e.getSyncInfo()
-		if syncInfoFlag&sifSyncOwnClient != 0 && e.client != nil {
-			gateid := e.client.gateid
-			packet := getEntitySyncInfosPacket(gateid)
-			packet.AppendClientID(e.client.clientid)
-			packet.AppendEntityID(eid)
-			packet.AppendFloat32(syncInfo.X)
-			packet.AppendFloat32(syncInfo.Y)
-			packet.AppendFloat32(syncInfo.Z)
-			packet.AppendFloat32(syncInfo.Yaw)
-		}
-		if syncInfoFlag&sifSyncNeighborClients != 0 {
-			for neighbor := range e.InterestedBy {
-				client := neighbor.client
-				if client != nil {
-					gateid := client.gateid
-					packet := getEntitySyncInfosPacket(gateid)
-					packet.AppendClientID(client.clientid)
-					packet.AppendEntityID(eid)
-					packet.AppendFloat32(syncInfo.X)
-					packet.AppendFloat32(syncInfo.Y)
-					packet.AppendFloat32(syncInfo.Z)
-					packet.AppendFloat32(syncInfo.Yaw)
-				}
-			}
-		}
+	for _, e := range entityManager.entities {
+		e.collectSyncInfo()
 	}
+	// ghosts in partitioned spaces are synced to clients of neighbors as well
+	forEachGhost((*Entity).collectSyncInfo)
 
 	// send to dispatcher, one gate by one gate
 	if len(entitySyncInfosToGate) > 0 {
@@ -1267,6 +1408,43 @@ func CollectEntitySyncInfos() {
 	}
 }
 
+// collectSyncInfo appends the sync info of entity to packets of gates if the entity needs syncing
+func (e *Entity) collectSyncInfo() {
+	syncInfoFlag := e.syncInfoFlag
+	if syncInfoFlag == 0 {
+		return
+	}
+
+	eid := e.ID
+	e.syncInfoFlag = 0
+	syncInfo := e.getSyncInfo()
+	if syncInfoFlag&sifSyncOwnClient != 0 && e.client != nil && !e.client.suspended {
+		gateid := e.client.gateid
+		packet := getEntitySyncInfosPacket(gateid)
+		packet.AppendClientID(e.client.clientid)
+		packet.AppendEntityID(eid)
+		packet.AppendFloat32(syncInfo.X)
+		packet.AppendFloat32(syncInfo.Y)
+		packet.AppendFloat32(syncInfo.Z)
+		packet.AppendFloat32(syncInfo.Yaw)
+	}
+	if syncInfoFlag&sifSyncNeighborClients != 0 {
+		for neighbor := range e.InterestedBy {
+			client := neighbor.client
+			if client != nil && !client.suspended {
+				gateid := client.gateid
+				packet := getEntitySyncInfosPacket(gateid)
+				packet.AppendClientID(client.clientid)
+				packet.AppendEntityID(eid)
+				packet.AppendFloat32(syncInfo.X)
+				packet.AppendFloat32(syncInfo.Y)
+				packet.AppendFloat32(syncInfo.Z)
+				packet.AppendFloat32(syncInfo.Yaw)
+			}
+		}
+	}
+}
+
 func (e *Entity) getSyncInfo() proto.EntitySyncInfo {
 	return proto.EntitySyncInfo{
 		float32(e.Position.X),
@@ -5,6 +5,8 @@ import (
 
 	"strings"
 
+	"sync/atomic"
+
 	"github.com/pkg/errors"
 	"github.com/sagacao/goworld/engine/common"
 	"github.com/sagacao/goworld/engine/consts"
@@ -22,15 +24,22 @@ var (
 
 // EntityTypeDesc is the entity type description for registering entity types
 type EntityTypeDesc struct {
-	isService       bool
-	IsPersistent    bool
-	useAOI          bool
-	aoiDistance     Coord
-	entityType      reflect.Type
-	rpcDescs        rpcDescMap
-	allClientAttrs  common.StringSet
-	clientAttrs     common.StringSet
-	persistentAttrs common.StringSet
+	name               string
+	isService          bool
+	IsPersistent       bool
+	useAOI             bool
+	aoiDistance        Coord
+	entityType         reflect.Type
+	rpcDescs           rpcDescMap
+	allClientAttrs     common.StringSet
+	clientAttrs        common.StringSet
+	persistentAttrs    common.StringSet
+	attrSchemas        map[string]*attrSchema
+	schemaVersion      int
+	schemaUpgraders    map[int]SchemaUpgrader
+	movementValidator  *MovementValidator
+	rebalanceable      bool
+	timerCatchUpPolicy TimerCatchUpPolicy
 	//compositiveMethodComponentIndices map[string][]int
 	//definedAttrs                      bool
 }
@@ -58,14 +67,30 @@ func (desc *EntityTypeDesc) SetUseAOI(useAOI bool, aoiDistance Coord) *EntityTyp
 	return desc
 }
 
+// SetMovementValidator sets the validator of positions synced from clients, positions are not validated if nil
+func (desc *EntityTypeDesc) SetMovementValidator(validator *MovementValidator) *EntityTypeDesc {
+	desc.movementValidator = validator
+	return desc
+}
+
+// DefineAttr defines an attribute with properties: Client, AllClients and Persistent
+//
+// Type declarations can also be specified as properties: int, float, bool, str, map, list, map<T>, list<T>, as well as
+// default=V, min=V and max=V. Type declarations are enforced when attributes are set or loaded.
 func (desc *EntityTypeDesc) DefineAttr(attr string, defs ...string) *EntityTypeDesc {
 	gwlog.Infof("        Attr %s = %v", attr, defs)
 	isAllClient, isClient, isPersistent := false, false, false
+	schema := &attrSchema{}
+	hasSchema, rawDefault := false, ""
 
-	for _, def := range defs {
-		def := strings.ToLower(def)
+	for _, rawdef := range defs {
+		def := strings.ToLower(rawdef)
 
 		if !_VALID_ATTR_DEFS.Contains(def) {
+			if parseAttrSchemaDef(schema, rawdef, &rawDefault) {
+				hasSchema = true
+				continue
+			}
 			// not a valid def
 			gwlog.Panicf("attribute %s: invalid property: %s; all valid properties: %v", attr, def, _VALID_ATTR_DEFS.ToList())
 		}
@@ -93,6 +118,31 @@ func (desc *EntityTypeDesc) DefineAttr(attr string, defs ...string) *EntityTypeD
 	if isPersistent {
 		desc.persistentAttrs.Add(attr)
 	}
+	if hasSchema {
+		if schema.typ == attrTypeAny {
+			gwlog.Panicf("attribute %s: type is not declared", attr)
+		}
+		if (schema.min != nil || schema.max != nil) && schema.typ != attrTypeInt && schema.typ != attrTypeFloat {
+			gwlog.Panicf("attribute %s: min and max are only supported for int and float", attr)
+		}
+		if rawDefault != "" {
+			schema.setDefault(rawDefault)
+		}
+		desc.attrSchemas[attr] = schema
+	}
+	return desc
+}
+
+// DefineIndex defines an index of the persistent attribute in storage, so that entities can be found by the attribute
+//
+// The attribute should be defined as persistent before. Saves which violate unique indexes fail and are not retried.
+func (desc *EntityTypeDesc) DefineIndex(attr string, unique bool) *EntityTypeDesc {
+	gwlog.Infof("        Index %s unique=%v", attr, unique)
+	if !desc.persistentAttrs.Contains(attr) {
+		gwlog.Panicf("Entity type %s: index attribute %s should be defined as persistent", desc.name, attr)
+	}
+
+	storage.DefineIndex(desc.name, attr, unique)
 	return desc
 }
 
@@ -117,6 +167,8 @@ func (em *_EntityManager) put(entity *Entity) {
 	} else {
 		em.entitiesByType[etype] = EntityMap{eid: entity}
 	}
+	entityCountMetric.Add(etype, 1)
+	atomic.AddInt64(&totalEntityCount, 1)
 }
 
 func (em *_EntityManager) del(e *Entity) {
@@ -125,6 +177,8 @@ func (em *_EntityManager) del(e *Entity) {
 	if entities, ok := em.entitiesByType[e.TypeName]; ok {
 		entities.Del(eid)
 	}
+	entityCountMetric.Add(e.TypeName, -1)
+	atomic.AddInt64(&totalEntityCount, -1)
 }
 
 func (em *_EntityManager) get(id common.EntityID) *Entity {
@@ -141,8 +195,9 @@ func (em *_EntityManager) traverseByType(etype string, cb func(e *Entity)) {
 func (em *_EntityManager) onGateDisconnected(gateid uint16) {
 	for _, entity := range em.entities {
 		client := entity.client
-		if client != nil && client.gateid == gateid {
-			entity.notifyClientDisconnected()
+		if client != nil && client.gateid == gateid && !client.suspended {
+			// clients of the gate might reconnect to other gates and resume
+			entity.disconnectClient(true)
 		}
 	}
 }
@@ -163,6 +218,7 @@ func RegisterEntity(typeName string, entity IEntity, isService bool) *EntityType
 	// register the string of e
 	rpcDescs := rpcDescMap{}
 	entityTypeDesc := &EntityTypeDesc{
+		name:            typeName,
 		isService:       isService,
 		IsPersistent:    false,
 		useAOI:          false,
@@ -171,6 +227,8 @@ func RegisterEntity(typeName string, entity IEntity, isService bool) *EntityType
 		clientAttrs:     common.StringSet{},
 		allClientAttrs:  common.StringSet{},
 		persistentAttrs: common.StringSet{},
+		attrSchemas:     map[string]*attrSchema{},
+		schemaUpgraders: map[int]SchemaUpgrader{},
 		//compositiveMethodComponentIndices: map[string][]int{},
 	}
 	registeredEntityTypes[typeName] = entityTypeDesc
@@ -226,7 +284,10 @@ func isEntityType(t reflect.Type) bool {
 //	ccRestore
 //)
 
-func createEntity(typeName string, space *Space, pos Vector3, entityID common.EntityID, loadEntityID common.EntityID, data map[string]interface{}) *Entity {
+// createEntity creates entity of specified type locally
+//
+// isLoaded should be true if data is loaded from storage and needs no saving, otherwise all data is saved on next save
+func createEntity(typeName string, space *Space, pos Vector3, entityID common.EntityID, loadEntityID common.EntityID, data map[string]interface{}, isLoaded bool) *Entity {
 	//gwlog.Debugf("createEntity: %s in Space %s", typeName, space)
 	entityTypeDesc, ok := registeredEntityTypes[typeName]
 	if !ok {
@@ -248,8 +309,20 @@ func createEntity(typeName string, space *Space, pos Vector3, entityID common.En
 
 	entityManager.put(entity)
 	if data != nil {
-		entity.loadPersistentData(data)
-	} else {
+		invalidAttrs := entity.loadPersistentData(data)
+		if isLoaded {
+			// only invalid attributes fixed when loading need to be saved
+			entity.clearDirtyAttrs()
+			for _, key := range invalidAttrs {
+				entity.markAttrDirty(key)
+			}
+		}
+	}
+	if !isLoaded {
+		entity.allAttrsDirty = true
+	}
+	entity.setAttrDefaults()
+	if data == nil {
 		entity.Save() // save immediately after creation
 	}
 
@@ -293,22 +366,37 @@ func restoreEntity(entityID common.EntityID, mdata *entityMigrateData, isRestore
 
 	entityManager.put(entity)
 	entity.loadMigrateData(mdata.Attrs)
+	entity.clearDirtyAttrs()
+	for _, key := range mdata.DirtyAttrs {
+		entity.dirtyAttrs.Add(key)
+	}
+	entity.allAttrsDirty = mdata.AllAttrsDirty
 
 	timerData := mdata.TimerData
 	if timerData != nil {
 		entity.restoreTimers(timerData)
 	}
 
+	if mdata.CallReplyData != nil {
+		entity.restoreCallReplies(mdata.CallReplyData)
+	}
+
+	if mdata.ReliableCallData != nil {
+		entity.reliableCallsDirty = true
+		entity.restoreReliableCalls(mdata.ReliableCallData)
+	}
+
 	isPersistent := entity.IsPersistent()
 	if isPersistent { // startup the periodical timer for saving e
 		entity.setupSaveTimer()
 	}
 
 	entity.syncInfoFlag = mdata.SyncInfoFlag
+	entity.partitionGen = mdata.PartitionGen
 	entity.syncingFromClient = mdata.SyncingFromClient
 
 	if mdata.Client != nil {
-		client := MakeGameClient(mdata.Client.ClientID, mdata.Client.GateID)
+		client := newGameClientFromData(mdata.Client)
 		// assign Client to the newly created
 		entity.assignClient(client) // assign Client quietly
 	}
@@ -356,18 +444,17 @@ func loadEntityLocally(typeName string, entityID common.EntityID, loadEntityID c
 		}
 
 		data := _data.(map[string]interface{})
-		// need to remove NOT persistent fields from data
 		entityTypeDesc := registeredEntityTypes[typeName]
-		removeFields := []string{}
-		for k, _ := range data {
-			if !entityTypeDesc.persistentAttrs.Contains(k) {
-				removeFields = append(removeFields, k)
-			}
-		}
-		for _, f := range removeFields {
-			delete(data, f)
+		// upgrade data of old schema versions before removing NOT persistent fields, so upgraders can access stale fields
+		isUpgraded, err := entityTypeDesc.upgradePersistentData(typeName, entityID, data)
+		if err != nil {
+			dispatchercluster.SendNotifyDestroyEntity(entityID) // load entity failed, tell dispatcher
+			gwlog.Panicf("load entity %s.%s failed: %s", typeName, entityID, err)
 		}
-		createEntity(typeName, space, pos, entityID, loadEntityID, data)
+		// need to remove NOT persistent fields from data
+		entityTypeDesc.removeNonPersistentFields(data)
+		// upgraded data should be saved entirely to remove stale fields in storage
+		createEntity(typeName, space, pos, entityID, loadEntityID, data, !isUpgraded)
 	})
 }
 
@@ -379,12 +466,12 @@ func createEntitySomewhere(gameid uint16, typeName string, data map[string]inter
 
 // CreateEntityLocally creates new entity in the local game
 func CreateEntityLocally(typeName string, data map[string]interface{}) *Entity {
-	return createEntity(typeName, nil, Vector3{}, "", "", data)
+	return createEntity(typeName, nil, Vector3{}, "", "", data, false)
 }
 
 // CreateEntityLocallyWithEntityID creates new entity in the local game with specified entity ID
 func CreateEntityLocallyWithID(typeName string, data map[string]interface{}, id common.EntityID) *Entity {
-	return createEntity(typeName, nil, Vector3{}, id, "", data)
+	return createEntity(typeName, nil, Vector3{}, id, "", data, false)
 }
 
 // CreateEntitySomewhere creates new entity in any game
@@ -394,7 +481,7 @@ func CreateEntitySomewhere(gameid uint16, typeName string) common.EntityID {
 
 // OnCreateEntitySomewhere is called when CreateEntitySomewhere chooses this game
 func OnCreateEntitySomewhere(entityid common.EntityID, typeName string, data map[string]interface{}) {
-	createEntity(typeName, nil, Vector3{}, entityid, "", data)
+	createEntity(typeName, nil, Vector3{}, entityid, "", data, false)
 }
 
 // OnLoadEntitySomewhere loads entity in the local game.
@@ -414,11 +501,13 @@ func LoadEntityOnGame(typeName string, entityID common.EntityID, gameid uint16,
 }
 
 // OnClientDisconnected is called by engine when Client is disconnected
-func OnClientDisconnected(ownerID common.EntityID, clientid common.ClientID) {
+//
+// The owner entity keeps the Client for resuming if resumable and the grace period is set
+func OnClientDisconnected(ownerID common.EntityID, clientid common.ClientID, resumable bool) {
 	owner := entityManager.get(ownerID)
 	if owner != nil {
 		if owner.client != nil && owner.client.clientid == clientid {
-			owner.notifyClientDisconnected()
+			owner.disconnectClient(resumable)
 		} else {
 			gwlog.Warnf("client %s is disconnected, but owner entity %s has client %s", clientid, owner, owner.client)
 		}
@@ -578,6 +667,7 @@ func Freeze(gameid uint16) (*FreezeData, error) {
 		return nil, errors.Errorf("nil space not found")
 	}
 
+	FlushClientAttrChanges() // pending attribute changes are not frozen, so send them now
 	freeze.Entities = entityFreezeInfos
 	//registeredServices := make(map[string][]common.EntityID, len(entityManager.registeredServices))
 	//for serviceName, eids := range entityManager.registeredServices {
@@ -615,7 +705,7 @@ func RestoreFreezedEntities(freeze *FreezeData) (err error) {
 
 				var client *GameClient
 				if info.Client != nil {
-					client = MakeGameClient(info.Client.ClientID, info.Client.GateID)
+					client = newGameClientFromData(info.Client)
 					clients[eid] = client // save the Client to the map
 					info.Client = nil
 				}
@@ -658,3 +748,19 @@ func RestoreFreezedEntities(freeze *FreezeData) (err error) {
 func Entities() EntityMap {
 	return entityManager.entities
 }
+
+// counts of entities and clients for reporting loads, which are accessed atomically
+var (
+	totalEntityCount int64
+	totalClientCount int64
+)
+
+// GetEntityCount returns the number of entities in the game, it can be called in any goroutine
+func GetEntityCount() int {
+	return int(atomic.LoadInt64(&totalEntityCount))
+}
+
+// GetClientCount returns the number of clients owned by entities in the game, it can be called in any goroutine
+func GetClientCount() int {
+	return int(atomic.LoadInt64(&totalClientCount))
+}
@@ -2,31 +2,49 @@ package entity
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/sagacao/goworld/engine/common"
 	"github.com/sagacao/goworld/engine/consts"
 	"github.com/sagacao/goworld/engine/dispatchercluster"
 	"github.com/sagacao/goworld/engine/dispatchercluster/dispatcherclient"
 	"github.com/sagacao/goworld/engine/gwlog"
+	"github.com/sagacao/goworld/engine/proto"
 )
 
 // GameClient represents the game Client of entity
 //
 // Each entity can have at most one GameClient, and GameClient can be given to other entities
 type GameClient struct {
-	clientid common.ClientID
-	gateid   uint16
-	ownerid  common.EntityID
+	clientid    common.ClientID
+	gateid      uint16
+	ownerid     common.EntityID
+	resumeToken string            // token for resuming the client session on a new connection
+	filterProps map[string]string // filter props are set again on the new gate when the client is resumed
+
+	// the client is disconnected and waiting to be resumed, messages to the client are buffered for replaying
+	suspended      bool
+	resumeDeadline time.Time
+	buffered       [][]byte // buffered messages without gateid and clientid
+	bufferedSize   int
+	bufferOverflow bool
+	recorder       *proto.GoWorldConnection
 }
 
 // MakeGameClient creates a GameClient object using Client ID and Game ID
 func MakeGameClient(clientid common.ClientID, gateid uint16) *GameClient {
 	return &GameClient{
-		clientid: clientid,
-		gateid:   gateid,
+		clientid:    clientid,
+		gateid:      gateid,
+		filterProps: map[string]string{},
 	}
 }
 
+// SetResumeToken sets the token for resuming the client session
+func (client *GameClient) SetResumeToken(token string) {
+	client.resumeToken = token
+}
+
 func (client *GameClient) String() string {
 	if client == nil {
 		return "GameClient<nil>"
@@ -39,6 +57,7 @@ func (client *GameClient) sendCreateEntity(entity *Entity, isPlayer bool) {
 		return
 	}
 
+	client.flushAttrChanges()
 	var clientData map[string]interface{}
 	if !isPlayer {
 		clientData = entity.getAllClientData()
@@ -48,67 +67,52 @@ func (client *GameClient) sendCreateEntity(entity *Entity, isPlayer bool) {
 
 	pos := entity.Position
 	yaw := entity.yaw
-	client.selectDispatcher().SendCreateEntityOnClient(client.gateid, client.clientid, entity.TypeName, entity.ID, isPlayer,
+	client.conn().SendCreateEntityOnClient(client.gateid, client.clientid, entity.TypeName, entity.ID, isPlayer,
 		clientData, float32(pos.X), float32(pos.Y), float32(pos.Z), float32(yaw))
 }
 
 func (client *GameClient) sendDestroyEntity(entity *Entity) {
 	if client != nil {
-		client.selectDispatcher().SendDestroyEntityOnClient(client.gateid, client.clientid, entity.TypeName, entity.ID)
+		client.flushAttrChanges()
+		client.conn().SendDestroyEntityOnClient(client.gateid, client.clientid, entity.TypeName, entity.ID)
 	}
 }
 
 func (client *GameClient) call(entityID common.EntityID, method string, args []interface{}) {
 	if client != nil {
-		client.selectDispatcher().SendCallEntityMethodOnClient(client.gateid, client.clientid, entityID, method, args)
+		client.flushAttrChanges()
+		client.conn().SendCallEntityMethodOnClient(client.gateid, client.clientid, entityID, method, args)
 	}
 }
 
-// sendNotifyMapAttrChange updates MapAttr change to Client entity
-func (client *GameClient) sendNotifyMapAttrChange(entityID common.EntityID, path []interface{}, key string, val interface{}) {
-	if client != nil {
-		client.selectDispatcher().SendNotifyMapAttrChangeOnClient(client.gateid, client.clientid, entityID, path, key, val)
-	}
-}
-
-// sendNotifyMapAttrDel updates MapAttr delete to Client entity
-func (client *GameClient) sendNotifyMapAttrDel(entityID common.EntityID, path []interface{}, key string) {
-	if client != nil {
-		client.selectDispatcher().SendNotifyMapAttrDelOnClient(client.gateid, client.clientid, entityID, path, key)
-	}
-}
-
-func (client *GameClient) sendNotifyMapAttrClear(entityID common.EntityID, path []interface{}) {
-	if client != nil {
-		client.selectDispatcher().SendNotifyMapAttrClearOnClient(client.gateid, client.clientid, entityID, path)
-	}
-}
-
-// sendNotifyListAttrChange notifies Client of ListAttr item changing
-func (client *GameClient) sendNotifyListAttrChange(entityID common.EntityID, path []interface{}, index uint32, val interface{}) {
-	if client != nil {
-		client.selectDispatcher().SendNotifyListAttrChangeOnClient(client.gateid, client.clientid, entityID, path, index, val)
-	}
-}
-
-// sendNotifyListAttrPop notify Client of ListAttr popping
-func (client *GameClient) sendNotifyListAttrPop(entityID common.EntityID, path []interface{}) {
+func (client *GameClient) sendSetClientFilterProp(key, val string) {
 	if client != nil {
-		client.selectDispatcher().SendNotifyListAttrPopOnClient(client.gateid, client.clientid, entityID, path)
+		client.flushAttrChanges()
+		client.filterProps[key] = val
+		if !client.suspended {
+			client.selectDispatcher().SendSetClientFilterProp(client.gateid, client.clientid, key, val)
+		}
 	}
 }
 
-// sendNotifyListAttrAppend notify entity of ListAttr appending
-func (client *GameClient) sendNotifyListAttrAppend(entityID common.EntityID, path []interface{}, val interface{}) {
-	if client != nil {
-		client.selectDispatcher().SendNotifyListAttrAppendOnClient(client.gateid, client.clientid, entityID, path, val)
+func (client *GameClient) sendClearClientFilterProps() {
+	client.filterProps = map[string]string{}
+	if !client.suspended {
+		client.selectDispatcher().SendClearClientFilterProp(client.gateid, client.clientid)
 	}
 }
 
-func (client *GameClient) sendSetClientFilterProp(key, val string) {
-	if client != nil {
-		client.selectDispatcher().SendSetClientFilterProp(client.gateid, client.clientid, key, val)
+// conn returns the connection for sending messages to the client
+//
+// Messages are buffered instead of being sent if the client is suspended
+func (client *GameClient) conn() *proto.GoWorldConnection {
+	if client.suspended {
+		if client.recorder == nil {
+			client.recorder = proto.NewPacketRecorder(client.bufferPacket)
+		}
+		return client.recorder
 	}
+	return client.selectDispatcher().GoWorldConnection
 }
 
 func (client *GameClient) selectDispatcher() *dispatcherclient.DispatcherClient {
@@ -14,4 +14,6 @@ type ISpace interface {
 	OnEntityLeaveSpace(entity *Entity) // Called when any entity leaves space
 	// Game releated callbacks on nil space only
 	OnGameReady()
+	// Range of positions in space, override to customize the range
+	GetSpaceRange() (minX, minY, maxX, maxY Coord)
 }
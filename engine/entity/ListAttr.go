@@ -93,6 +93,10 @@ func (a *ListAttr) setOwner(owner *Entity, flag attrFlag) {
 
 // Set sets item value
 func (a *ListAttr) set(index int, val interface{}) {
+	if a.owner != nil {
+		a.owner.checkAttrSchema(a, index, val)
+	}
+
 	a.items[index] = val
 	switch sa := val.(type) {
 	case *MapAttr:
@@ -263,6 +267,10 @@ func (a *ListAttr) PopMapAttr() *MapAttr {
 
 // append puts item to the end of list
 func (a *ListAttr) append(val interface{}) {
+	if a.owner != nil {
+		a.owner.checkAttrSchema(a, len(a.items), val)
+	}
+
 	a.items = append(a.items, val)
 	index := len(a.items) - 1
 
@@ -81,6 +81,10 @@ func (a *MapAttr) ForEach(f func(key string, val interface{})) {
 
 // Set sets the key-attribute pair in MapAttr
 func (a *MapAttr) set(key string, val interface{}) {
+	if a.owner != nil {
+		a.owner.checkAttrSchema(a, key, val)
+	}
+
 	var flag attrFlag
 	a.attrs[key] = val
 	switch sa := val.(type) {
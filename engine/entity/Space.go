@@ -7,13 +7,13 @@ import (
 	"github.com/sagacao/goworld/engine/consts"
 	"github.com/sagacao/goworld/engine/gwlog"
 	"github.com/sagacao/goworld/engine/gwutils"
-	"github.com/xiaonanln/go-aoi"
 )
 
 const (
 	_SPACE_ENTITY_TYPE    = "__space__"
 	_SPACE_KIND_ATTR_KEY  = "_K"
 	_SPACE_ENABLE_AOI_KEY = "_EnableAOI"
+	_SPACE_AOI_MGR_KEY    = "_AOIMgr"
 )
 
 var (
@@ -30,7 +30,9 @@ type Space struct {
 	Kind     int
 	I        ISpace
 
-	aoiMgr aoi.AOIManager
+	aoiMgr             AOIManager
+	defaultAOIDistance Coord
+	partition          *cellPartition
 }
 
 func (space *Space) String() string {
@@ -49,6 +51,9 @@ func (space *Space) DescribeEntityType(desc *EntityTypeDesc) {
 	desc.DefineAttr(_SPACE_KIND_ATTR_KEY, "AllClients")
 }
 
+// GetSpaceRange returns the range of positions in space on the XZ plane, so minY and maxY are the range of Z
+//
+// Custom space type can override this function
 func (space *Space) GetSpaceRange() (minX, minY, maxX, maxY Coord) {
 	return -1000, -1000, 1000, 1000
 }
@@ -88,7 +93,17 @@ func (space *Space) OnCreated() {
 	space.I.OnSpaceCreated()
 }
 
+// EnableAOI enables AOI for the space using the sweep-and-prune AOI manager
+//
+// defaultAOIDistance is used by entities whose type does not specify an AOI distance
 func (space *Space) EnableAOI(defaultAOIDistance Coord) {
+	space.EnableAOIWith(AOISweepAndPrune, defaultAOIDistance)
+}
+
+// EnableAOIWith enables AOI for the space using the AOI manager registered by name
+//
+// Builtin AOI managers are AOISweepAndPrune and AOITower. Custom AOI managers can be registered by RegisterAOIManager
+func (space *Space) EnableAOIWith(aoiMgrName string, defaultAOIDistance Coord) {
 	if defaultAOIDistance <= 0 {
 		gwlog.Panicf("defaultAOIDistance < 0")
 	}
@@ -102,17 +117,18 @@ func (space *Space) EnableAOI(defaultAOIDistance Coord) {
 	}
 
 	space.Attrs.SetFloat(_SPACE_ENABLE_AOI_KEY, float64(defaultAOIDistance))
-	space.aoiMgr = aoi.NewXZListAOIManager(aoi.Coord(defaultAOIDistance))
-	//space.aoiMgr = aoi.NewTowerAOIManager(-500, 500, -500, 500, 10)
+	space.Attrs.SetStr(_SPACE_AOI_MGR_KEY, aoiMgrName)
+	space.aoiMgr = newAOIManager(aoiMgrName, defaultAOIDistance)
+	space.defaultAOIDistance = defaultAOIDistance
 }
 
-//func (space *Space) UseTowerAOI(minX, maxX, minY, maxY Coord, towerRange Coord) {
-//	if space.aoiMgr != nil || len(space.entities) > 0 {
-//		gwlog.Panicf("%s is already using AOI", space)
-//	}
-//
-//	space.aoiMgr = aoi.NewTowerAOIManager(aoi.Coord(minX), aoi.Coord(maxX), aoi.Coord(minY), aoi.Coord(maxY), aoi.Coord(towerRange))
-//}
+// aoiDistanceOf returns the AOI distance of entity type, or the default AOI distance of space if not specified
+func (space *Space) aoiDistanceOf(entity *Entity) Coord {
+	if entity.typeDesc.aoiDistance > 0 {
+		return entity.typeDesc.aoiDistance
+	}
+	return space.defaultAOIDistance
+}
 
 // OnRestored is called when space entity is restored
 func (space *Space) OnRestored() {
@@ -120,7 +136,11 @@ func (space *Space) OnRestored() {
 	//gwlog.Debugf("space %s restored: atts=%+v", space, space.Attrs)
 	aoidist := space.GetFloat(_SPACE_ENABLE_AOI_KEY)
 	if aoidist > 0 {
-		space.EnableAOI(Coord(aoidist))
+		aoiMgrName := space.GetStr(_SPACE_AOI_MGR_KEY)
+		if aoiMgrName == "" {
+			aoiMgrName = AOISweepAndPrune
+		}
+		space.EnableAOIWith(aoiMgrName, Coord(aoidist))
 	}
 }
 
@@ -137,6 +157,8 @@ func (space *Space) onSpaceCreated() {
 		gwlog.Infof("Created nil space: %s", nilSpace)
 		return
 	}
+
+	space.initPartition()
 }
 
 // OnSpaceCreated is called when space is created
@@ -151,6 +173,9 @@ func (space *Space) OnSpaceCreated() {
 // OnDestroy is called when Space entity is destroyed
 func (space *Space) OnDestroy() {
 	space.I.OnSpaceDestroy()
+	if space.partition != nil {
+		space.destroyPartition()
+	}
 	// destroy all entities
 	for e := range space.entities {
 		e.Destroy()
@@ -175,7 +200,7 @@ func (space *Space) IsNil() bool {
 
 // CreateEntity creates a new local entity in this space
 func (space *Space) CreateEntity(typeName string, pos Vector3) {
-	createEntity(typeName, space, pos, "", "", nil)
+	createEntity(typeName, space, pos, "", "", nil, false)
 }
 
 // LoadEntity loads a entity of specified entityID to the space
@@ -198,6 +223,12 @@ func (space *Space) enter(entity *Entity, pos Vector3, isRestore bool) {
 		return
 	}
 
+	if space.partition != nil {
+		// the entity is moving into this cell, and the real entity replaces its ghost
+		space.removeGhost(entity.ID)
+		entity.partitionGen += 1
+	}
+
 	entity.Space = space
 	space.entities.Add(entity)
 	entity.Position = pos
@@ -208,7 +239,8 @@ func (space *Space) enter(entity *Entity, pos Vector3, isRestore bool) {
 		entity.client.sendCreateEntity(&space.Entity, false) // create Space entity before every other entities
 
 		if space.aoiMgr != nil && entity.IsUseAOI() {
-			space.aoiMgr.Enter(&entity.aoi, aoi.Coord(pos.X), aoi.Coord(pos.Z))
+			space.aoiMgr.Enter(entity, space.aoiDistanceOf(entity), pos.X, pos.Z)
+			aoiEntityCountMetric.Inc()
 		}
 
 		gwutils.RunPanicless(func() {
@@ -218,7 +250,8 @@ func (space *Space) enter(entity *Entity, pos Vector3, isRestore bool) {
 	} else {
 		// restoring ...
 		if space.aoiMgr != nil && entity.IsUseAOI() {
-			space.aoiMgr.Enter(&entity.aoi, aoi.Coord(pos.X), aoi.Coord(pos.Z))
+			space.aoiMgr.Enter(entity, space.aoiDistanceOf(entity), pos.X, pos.Z)
+			aoiEntityCountMetric.Inc()
 		}
 
 	}
@@ -240,7 +273,8 @@ func (space *Space) leave(entity *Entity) {
 	entity.Space = nilSpace
 
 	if space.aoiMgr != nil && entity.IsUseAOI() {
-		space.aoiMgr.Leave(&entity.aoi)
+		space.aoiMgr.Leave(entity)
+		aoiEntityCountMetric.Dec()
 	}
 
 	entity.client.sendDestroyEntity(&space.Entity)
@@ -256,7 +290,7 @@ func (space *Space) move(entity *Entity, newPos Vector3) {
 	}
 
 	entity.Position = newPos
-	space.aoiMgr.Moved(&entity.aoi, aoi.Coord(newPos.X), aoi.Coord(newPos.Z))
+	space.aoiMgr.Moved(entity, newPos.X, newPos.Z)
 	gwlog.Debugf("%s: %s move to %v", space, entity, newPos)
 }
 
@@ -0,0 +1,156 @@
+package entity
+
+import (
+	"github.com/sagacao/goworld/engine/gwlog"
+)
+
+const (
+	// AOISweepAndPrune is the name of the AOI manager which keeps entities sorted along X axis
+	AOISweepAndPrune = "SweepAndPrune"
+	// AOITower is the name of the AOI manager which divides the space into grid towers
+	AOITower = "Tower"
+)
+
+// AOIManager is the interface of AOI algorithms used by spaces
+//
+// Entity A is interested in entity B if both |A.X - B.X| and |A.Z - B.Z| are not larger than the AOI distance of A,
+// so entities with different AOI distances can coexist in the same space. AOI managers should call OnEnterAOI and
+// OnLeaveAOI of entities when the interest relations change.
+type AOIManager interface {
+	Enter(entity *Entity, dist Coord, x, z Coord) // Called when entity enters the space with specified AOI distance
+	Leave(entity *Entity)                         // Called when entity leaves the space
+	Moved(entity *Entity, x, z Coord)             // Called when entity moves in the space
+}
+
+// AOIManagerFactory creates AOI managers for spaces
+type AOIManagerFactory func(defaultAOIDistance Coord) AOIManager
+
+var registeredAOIManagers = map[string]AOIManagerFactory{}
+
+func init() {
+	RegisterAOIManager(AOISweepAndPrune, func(defaultAOIDistance Coord) AOIManager {
+		return newSweepAndPruneAOIManager()
+	})
+	RegisterAOIManager(AOITower, func(defaultAOIDistance Coord) AOIManager {
+		return newTowerAOIManager(defaultAOIDistance)
+	})
+}
+
+// RegisterAOIManager registers an AOI manager factory which can be used by Space.EnableAOIWith
+func RegisterAOIManager(name string, factory AOIManagerFactory) {
+	if _, ok := registeredAOIManagers[name]; ok {
+		gwlog.Panicf("AOI manager %s is already registered", name)
+	}
+	registeredAOIManagers[name] = factory
+}
+
+func newAOIManager(name string, defaultAOIDistance Coord) AOIManager {
+	factory := registeredAOIManagers[name]
+	if factory == nil {
+		gwlog.Panicf("AOI manager %s is not registered", name)
+	}
+	return factory(defaultAOIDistance)
+}
+
+// aoiNode is the per-entity AOI state shared by builtin AOI managers
+type aoiNode struct {
+	entity *Entity
+	x, z   Coord
+	dist   Coord
+}
+
+func (node *aoiNode) canSee(other *aoiNode) bool {
+	return inAOIRange(node.x-other.x, node.z-other.z, node.dist)
+}
+
+func inAOIRange(dx, dz Coord, dist Coord) bool {
+	return dx >= -dist && dx <= dist && dz >= -dist && dz <= dist
+}
+
+// aoiDistances tracks AOI distances of all entities in an AOI manager for calculating the max AOI distance
+type aoiDistances struct {
+	counts map[Coord]int
+	max    Coord
+}
+
+func (ad *aoiDistances) add(dist Coord) {
+	if ad.counts == nil {
+		ad.counts = map[Coord]int{}
+	}
+	ad.counts[dist] += 1
+	if dist > ad.max {
+		ad.max = dist
+	}
+}
+
+func (ad *aoiDistances) remove(dist Coord) {
+	ad.counts[dist] -= 1
+	if ad.counts[dist] > 0 {
+		return
+	}
+
+	delete(ad.counts, dist)
+	if dist < ad.max {
+		return
+	}
+
+	ad.max = 0
+	for d := range ad.counts {
+		if d > ad.max {
+			ad.max = d
+		}
+	}
+}
+
+// updateAOINode re-evaluates interest relations between node and all other nodes
+//
+// visitNearby should visit all other nodes within the max AOI distance of the AOI manager. Relations with entities
+// which are not visited are removed.
+func updateAOINode(node *aoiNode, visitNearby func(f func(other *aoiNode))) {
+	entity := node.entity
+	visited := EntitySet{}
+
+	visitNearby(func(other *aoiNode) {
+		visited.Add(other.entity)
+
+		if node.canSee(other) {
+			if !entity.IsInterestedIn(other.entity) {
+				entity.OnEnterAOI(other.entity)
+			}
+		} else if entity.IsInterestedIn(other.entity) {
+			entity.OnLeaveAOI(other.entity)
+		}
+
+		if other.canSee(node) {
+			if !other.entity.IsInterestedIn(entity) {
+				other.entity.OnEnterAOI(entity)
+			}
+		} else if other.entity.IsInterestedIn(entity) {
+			other.entity.OnLeaveAOI(entity)
+		}
+	})
+
+	for other := range entity.InterestedIn {
+		if !visited.Contains(other) {
+			entity.OnLeaveAOI(other)
+		}
+	}
+
+	for other := range entity.InterestedBy {
+		if !visited.Contains(other) {
+			other.OnLeaveAOI(entity)
+		}
+	}
+}
+
+// clearAOINode removes all interest relations of node
+func clearAOINode(node *aoiNode) {
+	entity := node.entity
+	for other := range entity.InterestedIn {
+		entity.OnLeaveAOI(other)
+	}
+
+	for other := range entity.InterestedBy {
+		other.OnLeaveAOI(entity)
+	}
+}
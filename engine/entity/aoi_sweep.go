@@ -0,0 +1,135 @@
+package entity
+
+import "github.com/sagacao/goworld/engine/gwlog"
+
+type sweepAOINode struct {
+	aoiNode
+	prev, next *sweepAOINode
+}
+
+// sweepAndPruneAOIManager keeps all entities in a list sorted by X coordinate
+//
+// Moving an entity only shifts it among its neighbors in the list, and only entities within the max AOI distance
+// along X axis are checked when updating interest relations.
+type sweepAndPruneAOIManager struct {
+	nodes     map[*Entity]*sweepAOINode
+	head      *sweepAOINode
+	distances aoiDistances
+}
+
+func newSweepAndPruneAOIManager() *sweepAndPruneAOIManager {
+	return &sweepAndPruneAOIManager{
+		nodes: map[*Entity]*sweepAOINode{},
+	}
+}
+
+func (mgr *sweepAndPruneAOIManager) Enter(entity *Entity, dist Coord, x, z Coord) {
+	if _, ok := mgr.nodes[entity]; ok {
+		gwlog.Panicf("%s already entered AOI", entity)
+	}
+
+	node := &sweepAOINode{aoiNode: aoiNode{entity: entity, x: x, z: z, dist: dist}}
+	mgr.nodes[entity] = node
+	mgr.distances.add(dist)
+	mgr.insert(node)
+	mgr.update(node)
+}
+
+func (mgr *sweepAndPruneAOIManager) Leave(entity *Entity) {
+	node := mgr.nodes[entity]
+	if node == nil {
+		gwlog.Panicf("%s is not in AOI", entity)
+	}
+
+	clearAOINode(&node.aoiNode)
+	mgr.unlink(node)
+	mgr.distances.remove(node.dist)
+	delete(mgr.nodes, entity)
+}
+
+func (mgr *sweepAndPruneAOIManager) Moved(entity *Entity, x, z Coord) {
+	node := mgr.nodes[entity]
+	if node == nil {
+		gwlog.Panicf("%s is not in AOI", entity)
+	}
+
+	oldX := node.x
+	node.x, node.z = x, z
+
+	if x > oldX {
+		for node.next != nil && node.next.x < x {
+			mgr.swapWithNext(node)
+		}
+	} else if x < oldX {
+		for node.prev != nil && node.prev.x > x {
+			mgr.swapWithNext(node.prev)
+		}
+	}
+	mgr.update(node)
+}
+
+func (mgr *sweepAndPruneAOIManager) update(node *sweepAOINode) {
+	maxDist := mgr.distances.max
+	updateAOINode(&node.aoiNode, func(f func(other *aoiNode)) {
+		for other := node.prev; other != nil && node.x-other.x <= maxDist; other = other.prev {
+			f(&other.aoiNode)
+		}
+		for other := node.next; other != nil && other.x-node.x <= maxDist; other = other.next {
+			f(&other.aoiNode)
+		}
+	})
+}
+
+// insert inserts node to the sorted list
+func (mgr *sweepAndPruneAOIManager) insert(node *sweepAOINode) {
+	if mgr.head == nil || mgr.head.x >= node.x {
+		node.next = mgr.head
+		if mgr.head != nil {
+			mgr.head.prev = node
+		}
+		mgr.head = node
+		return
+	}
+
+	prev := mgr.head
+	for prev.next != nil && prev.next.x < node.x {
+		prev = prev.next
+	}
+	node.prev, node.next = prev, prev.next
+	if prev.next != nil {
+		prev.next.prev = node
+	}
+	prev.next = node
+}
+
+func (mgr *sweepAndPruneAOIManager) unlink(node *sweepAOINode) {
+	if node.prev != nil {
+		node.prev.next = node.next
+	} else {
+		mgr.head = node.next
+	}
+	if node.next != nil {
+		node.next.prev = node.prev
+	}
+	node.prev, node.next = nil, nil
+}
+
+// swapWithNext swaps node with its next node in the list
+func (mgr *sweepAndPruneAOIManager) swapWithNext(node *sweepAOINode) {
+	next := node.next
+	prev := node.prev
+
+	if prev != nil {
+		prev.next = next
+	} else {
+		mgr.head = next
+	}
+	if next.next != nil {
+		next.next.prev = node
+	}
+
+	node.next = next.next
+	node.prev = next
+	next.prev = prev
+	next.next = node
+}
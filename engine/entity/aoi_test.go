@@ -0,0 +1,89 @@
+package entity
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func newTestAOIEntity() *Entity {
+	return &Entity{
+		InterestedIn: EntitySet{},
+		InterestedBy: EntitySet{},
+	}
+}
+
+func TestSweepAndPruneAOIManager(t *testing.T) {
+	testAOIManager(t, newSweepAndPruneAOIManager())
+}
+
+func TestTowerAOIManager(t *testing.T) {
+	testAOIManager(t, newTowerAOIManager(10))
+}
+
+func testAOIManager(t *testing.T, aoiMgr AOIManager) {
+	boss, chest := newTestAOIEntity(), newTestAOIEntity()
+	aoiMgr.Enter(boss, 100, 0, 0)
+	aoiMgr.Enter(chest, 5, 50, 0)
+	if !boss.IsInterestedIn(chest) || chest.IsInterestedIn(boss) {
+		t.Fatalf("boss should see chest, but chest should not see boss")
+	}
+
+	aoiMgr.Moved(boss, 47, 3)
+	if !boss.IsInterestedIn(chest) || !chest.IsInterestedIn(boss) {
+		t.Fatalf("boss and chest should see each other")
+	}
+
+	aoiMgr.Moved(boss, -200, 0)
+	if boss.IsInterestedIn(chest) || chest.IsInterestedIn(boss) {
+		t.Fatalf("boss and chest should not see each other")
+	}
+	aoiMgr.Leave(boss)
+	aoiMgr.Leave(chest)
+
+	type entityPos struct {
+		x, z, dist Coord
+	}
+	positions := map[*Entity]*entityPos{}
+	randCoord := func() Coord {
+		return Coord(rand.Intn(200) - 100)
+	}
+
+	for i := 0; i < 1000; i++ {
+		var e *Entity
+		for e = range positions {
+			break
+		}
+
+		switch op := rand.Intn(4); {
+		case op == 0 || len(positions) == 0:
+			e = newTestAOIEntity()
+			pos := &entityPos{randCoord(), randCoord(), Coord(rand.Intn(30))}
+			positions[e] = pos
+			aoiMgr.Enter(e, pos.dist, pos.x, pos.z)
+		case op == 1:
+			delete(positions, e)
+			aoiMgr.Leave(e)
+			if len(e.InterestedIn) > 0 || len(e.InterestedBy) > 0 {
+				t.Fatalf("entity should not have interest relations after leaving AOI")
+			}
+		default:
+			pos := positions[e]
+			pos.x += Coord(rand.Intn(21) - 10)
+			pos.z += Coord(rand.Intn(21) - 10)
+			aoiMgr.Moved(e, pos.x, pos.z)
+		}
+
+		for e1, p1 := range positions {
+			for e2, p2 := range positions {
+				if e1 == e2 {
+					continue
+				}
+
+				expected := inAOIRange(p1.x-p2.x, p1.z-p2.z, p1.dist)
+				if e1.IsInterestedIn(e2) != expected || e2.InterestedBy.Contains(e1) != expected {
+					t.Fatalf("interest relation is wrong: %+v -> %+v, expected %v", *p1, *p2, expected)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package entity
+
+import (
+	"math"
+
+	"github.com/sagacao/goworld/engine/gwlog"
+)
+
+type towerCoord struct {
+	X, Z int
+}
+
+type towerAOINode struct {
+	aoiNode
+	tower towerCoord
+}
+
+// towerAOIManager divides the space into square towers (grid cells) of the same size
+//
+// Towers are created on demand, so the space range is unlimited. Only towers within the max AOI distance are checked
+// when updating interest relations.
+type towerAOIManager struct {
+	towerSize Coord
+	nodes     map[*Entity]*towerAOINode
+	towers    map[towerCoord]map[*towerAOINode]struct{}
+	distances aoiDistances
+}
+
+func newTowerAOIManager(towerSize Coord) *towerAOIManager {
+	if towerSize <= 0 {
+		gwlog.Panicf("invalid tower size: %v", towerSize)
+	}
+
+	return &towerAOIManager{
+		towerSize: towerSize,
+		nodes:     map[*Entity]*towerAOINode{},
+		towers:    map[towerCoord]map[*towerAOINode]struct{}{},
+	}
+}
+
+func (mgr *towerAOIManager) Enter(entity *Entity, dist Coord, x, z Coord) {
+	if _, ok := mgr.nodes[entity]; ok {
+		gwlog.Panicf("%s already entered AOI", entity)
+	}
+
+	node := &towerAOINode{aoiNode: aoiNode{entity: entity, x: x, z: z, dist: dist}}
+	mgr.nodes[entity] = node
+	mgr.distances.add(dist)
+	node.tower = mgr.towerOf(x, z)
+	mgr.addToTower(node)
+	mgr.update(node)
+}
+
+func (mgr *towerAOIManager) Leave(entity *Entity) {
+	node := mgr.nodes[entity]
+	if node == nil {
+		gwlog.Panicf("%s is not in AOI", entity)
+	}
+
+	clearAOINode(&node.aoiNode)
+	mgr.removeFromTower(node)
+	mgr.distances.remove(node.dist)
+	delete(mgr.nodes, entity)
+}
+
+func (mgr *towerAOIManager) Moved(entity *Entity, x, z Coord) {
+	node := mgr.nodes[entity]
+	if node == nil {
+		gwlog.Panicf("%s is not in AOI", entity)
+	}
+
+	node.x, node.z = x, z
+	if tower := mgr.towerOf(x, z); tower != node.tower {
+		mgr.removeFromTower(node)
+		node.tower = tower
+		mgr.addToTower(node)
+	}
+	mgr.update(node)
+}
+
+func (mgr *towerAOIManager) update(node *towerAOINode) {
+	minTower := mgr.towerOf(node.x-mgr.distances.max, node.z-mgr.distances.max)
+	maxTower := mgr.towerOf(node.x+mgr.distances.max, node.z+mgr.distances.max)
+
+	updateAOINode(&node.aoiNode, func(f func(other *aoiNode)) {
+		if (maxTower.X-minTower.X+1)*(maxTower.Z-minTower.Z+1) > len(mgr.towers) {
+			// less towers than the covered area, just iterate over all towers
+			for tc, tower := range mgr.towers {
+				if tc.X >= minTower.X && tc.X <= maxTower.X && tc.Z >= minTower.Z && tc.Z <= maxTower.Z {
+					mgr.visitTower(node, tower, f)
+				}
+			}
+			return
+		}
+
+		for tx := minTower.X; tx <= maxTower.X; tx++ {
+			for tz := minTower.Z; tz <= maxTower.Z; tz++ {
+				if tower, ok := mgr.towers[towerCoord{tx, tz}]; ok {
+					mgr.visitTower(node, tower, f)
+				}
+			}
+		}
+	})
+}
+
+func (mgr *towerAOIManager) visitTower(node *towerAOINode, tower map[*towerAOINode]struct{}, f func(other *aoiNode)) {
+	for other := range tower {
+		if other != node {
+			f(&other.aoiNode)
+		}
+	}
+}
+
+func (mgr *towerAOIManager) towerOf(x, z Coord) towerCoord {
+	return towerCoord{
+		X: int(math.Floor(float64(x / mgr.towerSize))),
+		Z: int(math.Floor(float64(z / mgr.towerSize))),
+	}
+}
+
+func (mgr *towerAOIManager) addToTower(node *towerAOINode) {
+	tower := mgr.towers[node.tower]
+	if tower == nil {
+		tower = map[*towerAOINode]struct{}{}
+		mgr.towers[node.tower] = tower
+	}
+	tower[node] = struct{}{}
+}
+
+func (mgr *towerAOIManager) removeFromTower(node *towerAOINode) {
+	tower := mgr.towers[node.tower]
+	delete(tower, node)
+	if len(tower) == 0 {
+		delete(mgr.towers, node.tower)
+	}
+}
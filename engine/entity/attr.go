@@ -35,6 +35,11 @@ forloop:
 	return path
 }
 
+// rootAttrKey returns the key of the outermost attribute in path returned by getPathFromOwner
+func rootAttrKey(path []interface{}) string {
+	return path[len(path)-1].(string)
+}
+
 // uniformAttrType convert v to uniform attr type: int64, float64, bool, string
 func uniformAttrType(v interface{}) interface{} {
 	switch av := v.(type) {
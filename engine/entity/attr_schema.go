@@ -0,0 +1,371 @@
+package entity
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sagacao/goworld/engine/gwlog"
+)
+
+type attrType int
+
+const (
+	attrTypeAny attrType = iota
+	attrTypeInt
+	attrTypeFloat
+	attrTypeBool
+	attrTypeStr
+	attrTypeMap
+	attrTypeList
+)
+
+var attrTypeNames = map[string]attrType{
+	"int":   attrTypeInt,
+	"float": attrTypeFloat,
+	"bool":  attrTypeBool,
+	"str":   attrTypeStr,
+	"map":   attrTypeMap,
+	"list":  attrTypeList,
+}
+
+func (t attrType) String() string {
+	for name, at := range attrTypeNames {
+		if at == t {
+			return name
+		}
+	}
+	return "any"
+}
+
+// attrSchema is the optional type declaration of an attribute defined by DefineAttr
+//
+// Valid type declarations are int, float, bool, str, map, list, map<T> and list<T> where T is the type of items.
+// Default value can be specified as default=V for int, float, bool and str attributes, and value range can be specified
+// as min=V and max=V for int and float attributes.
+type attrSchema struct {
+	typ        attrType
+	elemType   attrType
+	defaultVal interface{}
+	min, max   *float64
+}
+
+// parseAttrSchemaDef parses type declaration def into schema, returns false if def is not a type declaration
+func parseAttrSchemaDef(schema *attrSchema, def string, rawDefault *string) bool {
+	if i := strings.IndexByte(def, '='); i >= 0 {
+		name, val := strings.ToLower(strings.TrimSpace(def[:i])), strings.TrimSpace(def[i+1:])
+		switch name {
+		case "default":
+			*rawDefault = val
+		case "min", "max":
+			v, err := strconv.ParseFloat(val, 64)
+			if err != nil {
+				gwlog.Panicf("invalid %s value: %s", name, val)
+			}
+			if name == "min" {
+				schema.min = &v
+			} else {
+				schema.max = &v
+			}
+		default:
+			return false
+		}
+		return true
+	}
+
+	def = strings.ToLower(def)
+	elemType := attrTypeAny
+	if i := strings.IndexByte(def, '<'); i >= 0 && strings.HasSuffix(def, ">") {
+		var ok bool
+		if elemType, ok = attrTypeNames[def[i+1:len(def)-1]]; !ok {
+			return false
+		}
+		def = def[:i]
+	}
+
+	typ, ok := attrTypeNames[def]
+	if !ok {
+		return false
+	}
+	if elemType != attrTypeAny && typ != attrTypeMap && typ != attrTypeList {
+		gwlog.Panicf("only map and list can declare item type")
+	}
+	if schema.typ != attrTypeAny {
+		gwlog.Panicf("duplicate type declarations: %s and %s", schema.typ, typ)
+	}
+	schema.typ, schema.elemType = typ, elemType
+	return true
+}
+
+// setDefault parses the raw default value according to the attribute type
+func (schema *attrSchema) setDefault(rawDefault string) {
+	var err error
+	switch schema.typ {
+	case attrTypeInt:
+		schema.defaultVal, err = strconv.ParseInt(rawDefault, 10, 64)
+	case attrTypeFloat:
+		schema.defaultVal, err = strconv.ParseFloat(rawDefault, 64)
+	case attrTypeBool:
+		schema.defaultVal, err = strconv.ParseBool(rawDefault)
+	case attrTypeStr:
+		schema.defaultVal = rawDefault
+	default:
+		gwlog.Panicf("default value is not supported for %s attribute", schema.typ)
+	}
+
+	if err != nil {
+		gwlog.Panicf("invalid default value for %s attribute: %s", schema.typ, rawDefault)
+	}
+	if err := schema.checkRange(schema.defaultVal); err != nil {
+		gwlog.Panicf("invalid default value: %v", err)
+	}
+}
+
+// check checks if val matches the attribute type and range
+//
+// If any item of MapAttr or ListAttr violates the item type, the key of the item is also returned
+func (schema *attrSchema) check(val interface{}) (interface{}, error) {
+	if err := checkAttrType(schema.typ, val); err != nil {
+		return nil, err
+	}
+	if err := schema.checkRange(val); err != nil {
+		return nil, err
+	}
+
+	if schema.elemType == attrTypeAny {
+		return nil, nil
+	}
+
+	switch a := val.(type) {
+	case *MapAttr:
+		for k, v := range a.attrs {
+			if err := checkAttrType(schema.elemType, v); err != nil {
+				return k, err
+			}
+		}
+	case *ListAttr:
+		for i, v := range a.items {
+			if err := checkAttrType(schema.elemType, v); err != nil {
+				return i, err
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (schema *attrSchema) checkRange(val interface{}) error {
+	var v float64
+	switch nv := val.(type) {
+	case int64:
+		v = float64(nv)
+	case float64:
+		v = nv
+	default:
+		return nil
+	}
+
+	if schema.min != nil && v < *schema.min {
+		return errors.Errorf("%v is less than min value %v", val, *schema.min)
+	}
+	if schema.max != nil && v > *schema.max {
+		return errors.Errorf("%v is larger than max value %v", val, *schema.max)
+	}
+	return nil
+}
+
+// normalize converts loaded value to the attribute type if possible
+//
+// Numbers are converted between int and float if no precision is lost. If any item of map or list can not be converted,
+// the key of the item is also returned
+func (schema *attrSchema) normalize(val interface{}) (interface{}, interface{}, error) {
+	val, err := normalizeAttrValue(schema.typ, val)
+	if err != nil || schema.elemType == attrTypeAny {
+		return val, nil, err
+	}
+
+	switch a := val.(type) {
+	case map[string]interface{}:
+		for k, v := range a {
+			if a[k], err = normalizeAttrValue(schema.elemType, v); err != nil {
+				return nil, k, err
+			}
+		}
+	case []interface{}:
+		for i, v := range a {
+			if a[i], err = normalizeAttrValue(schema.elemType, v); err != nil {
+				return nil, i, err
+			}
+		}
+	}
+	return val, nil, nil
+}
+
+func (schema *attrSchema) clamp(v float64) float64 {
+	if schema.min != nil && v < *schema.min {
+		v = *schema.min
+	}
+	if schema.max != nil && v > *schema.max {
+		v = *schema.max
+	}
+	return v
+}
+
+// checkAttrType checks if val is of attribute type typ in MapAttr and ListAttr
+func checkAttrType(typ attrType, val interface{}) error {
+	var ok bool
+	switch typ {
+	case attrTypeAny:
+		ok = true
+	case attrTypeInt:
+		_, ok = val.(int64)
+	case attrTypeFloat:
+		_, ok = val.(float64)
+	case attrTypeBool:
+		_, ok = val.(bool)
+	case attrTypeStr:
+		_, ok = val.(string)
+	case attrTypeMap:
+		_, ok = val.(*MapAttr)
+	case attrTypeList:
+		_, ok = val.(*ListAttr)
+	}
+
+	if !ok {
+		return errors.Errorf("expect %s, but got %T", typ, val)
+	}
+	return nil
+}
+
+// normalizeAttrValue converts native value to attribute type typ if possible
+func normalizeAttrValue(typ attrType, val interface{}) (interface{}, error) {
+	switch typ {
+	case attrTypeMap:
+		if _, ok := val.(map[string]interface{}); ok {
+			return val, nil
+		}
+	case attrTypeList:
+		if _, ok := val.([]interface{}); ok {
+			return val, nil
+		}
+	case attrTypeAny:
+		return val, nil
+	default:
+		switch val.(type) {
+		case nil, map[string]interface{}, []interface{}:
+		default:
+			val = uniformAttrType(val)
+		}
+
+		switch nv := val.(type) {
+		case int64:
+			if typ == attrTypeFloat {
+				return float64(nv), nil
+			}
+		case float64:
+			if typ == attrTypeInt && nv == math.Trunc(nv) {
+				return int64(nv), nil
+			}
+		}
+
+		if err := checkAttrType(typ, val); err == nil {
+			return val, nil
+		}
+	}
+
+	return nil, errors.Errorf("expect %s, but got %T", typ, val)
+}
+
+// formatAttrPath formats attribute path like root.key for MapAttr items and root[index] for ListAttr items
+func formatAttrPath(rootKey string, itemKey interface{}) string {
+	if index, ok := itemKey.(int); ok {
+		return fmt.Sprintf("%s[%d]", rootKey, index)
+	}
+	return fmt.Sprintf("%s.%v", rootKey, itemKey)
+}
+
+// checkAttrSchema checks if val can be set at key of parent attribute, panics if attribute schema is violated
+func (e *Entity) checkAttrSchema(parent interface{}, key interface{}, val interface{}) {
+	if len(e.typeDesc.attrSchemas) == 0 {
+		return
+	}
+
+	var path []interface{}
+	switch pa := parent.(type) {
+	case *MapAttr:
+		path = pa.getPathFromOwner()
+	case *ListAttr:
+		path = pa.getPathFromOwner()
+	}
+
+	var err error
+	var attrPath string
+	switch len(path) {
+	case 0: // setting root attribute
+		rootKey := key.(string)
+		attrPath = rootKey
+		if schema := e.typeDesc.attrSchemas[rootKey]; schema != nil {
+			var itemKey interface{}
+			if itemKey, err = schema.check(val); itemKey != nil {
+				attrPath = formatAttrPath(rootKey, itemKey)
+			}
+		}
+	case 1: // setting item of root attribute
+		rootKey := path[0].(string)
+		attrPath = formatAttrPath(rootKey, key)
+		if schema := e.typeDesc.attrSchemas[rootKey]; schema != nil {
+			err = checkAttrType(schema.elemType, val)
+		}
+	}
+
+	if err != nil {
+		gwlog.Panicf("entity type %s: attribute %s: %v", e.TypeName, attrPath, err)
+	}
+}
+
+// normalizePersistentData validates loaded data against attribute schemas
+//
+// Out of range numbers are clamped. Attributes of wrong types are dropped, so that default values will be used.
+// Returns keys of invalid attributes
+func (e *Entity) normalizePersistentData(data map[string]interface{}) (invalidAttrs []string) {
+	for key, val := range data {
+		schema := e.typeDesc.attrSchemas[key]
+		if schema == nil {
+			continue
+		}
+
+		nval, itemKey, err := schema.normalize(val)
+		if err != nil {
+			attrPath := key
+			if itemKey != nil {
+				attrPath = formatAttrPath(key, itemKey)
+			}
+			gwlog.Errorf("entity %s of type %s: load attribute %s failed: %v", e.ID, e.TypeName, attrPath, err)
+			delete(data, key)
+			invalidAttrs = append(invalidAttrs, key)
+			continue
+		}
+
+		if err := schema.checkRange(nval); err != nil {
+			if schema.typ == attrTypeInt {
+				nval = int64(schema.clamp(float64(nval.(int64))))
+			} else {
+				nval = schema.clamp(nval.(float64))
+			}
+			gwlog.Errorf("entity %s of type %s: load attribute %s: %v, clamped to %v", e.ID, e.TypeName, key, err, nval)
+			invalidAttrs = append(invalidAttrs, key)
+		}
+		data[key] = nval
+	}
+	return
+}
+
+// setAttrDefaults sets default values for attributes which are not set yet
+func (e *Entity) setAttrDefaults() {
+	for key, schema := range e.typeDesc.attrSchemas {
+		if schema.defaultVal != nil && !e.Attrs.HasKey(key) {
+			e.Attrs.set(key, schema.defaultVal)
+		}
+	}
+}
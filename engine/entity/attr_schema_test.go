@@ -0,0 +1,88 @@
+package entity
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+type TestSchemaEntity struct {
+	Entity
+}
+
+func (e *TestSchemaEntity) DescribeEntityType(desc *EntityTypeDesc) {
+	desc.DefineAttr("level", "int", "default=1", "min=1", "max=100")
+	desc.DefineAttr("exp", "float")
+	desc.DefineAttr("name", "str", "default=Nobody")
+	desc.DefineAttr("bag", "map<int>")
+	desc.DefineAttr("titles", "list<str>")
+}
+
+func expectAttrSchemaPanic(t *testing.T, path string, f func()) {
+	defer func() {
+		err := recover()
+		if err == nil {
+			t.Fatalf("setting %s should panic", path)
+		}
+		if msg := fmt.Sprint(err); !strings.Contains(msg, "TestSchemaEntity") || !strings.Contains(msg, "attribute "+path+":") {
+			t.Fatalf("wrong error message: %s", msg)
+		}
+	}()
+	f()
+}
+
+func TestAttrSchema(t *testing.T) {
+	RegisterEntity("TestSchemaEntity", &TestSchemaEntity{}, false)
+	e := CreateEntityLocally("TestSchemaEntity", nil)
+
+	if e.GetInt("level") != 1 || e.GetStr("name") != "Nobody" {
+		t.Fatalf("default values are not set: %s", e.Attrs)
+	}
+
+	e.Attrs.SetInt("level", 10)
+	e.Attrs.SetFloat("exp", 1.5)
+	e.Attrs.GetMapAttr("bag").SetInt("gold", 100)
+	e.Attrs.GetListAttr("titles").AppendStr("hero")
+
+	expectAttrSchemaPanic(t, "level", func() { e.Attrs.SetStr("level", "10") })
+	expectAttrSchemaPanic(t, "level", func() { e.Attrs.SetInt("level", 101) })
+	expectAttrSchemaPanic(t, "exp", func() { e.Attrs.SetInt("exp", 1) })
+	expectAttrSchemaPanic(t, "bag.gold", func() { e.Attrs.GetMapAttr("bag").SetStr("gold", "100") })
+	expectAttrSchemaPanic(t, "titles[1]", func() { e.Attrs.GetListAttr("titles").AppendInt(1) })
+	expectAttrSchemaPanic(t, "titles[0]", func() { e.Attrs.GetListAttr("titles").SetBool(0, true) })
+
+	bag := NewMapAttr()
+	bag.SetStr("gem", "ruby")
+	expectAttrSchemaPanic(t, "bag.gem", func() { e.Attrs.SetMapAttr("bag", bag) })
+
+	if e.GetInt("level") != 10 || e.Attrs.GetMapAttr("bag").GetInt("gold") != 100 {
+		t.Fatalf("attributes should not be changed by invalid values: %s", e.Attrs)
+	}
+}
+
+func TestAttrSchemaLoadPersistentData(t *testing.T) {
+	RegisterEntity("TestSchemaLoadEntity", &TestSchemaEntity{}, false)
+	e := createEntity("TestSchemaLoadEntity", nil, Vector3{}, "", "", map[string]interface{}{
+		"level":  float64(1000), // int stored as float, out of range
+		"exp":    int64(3),      // float stored as int
+		"name":   123,           // wrong type, use default
+		"bag":    map[string]interface{}{"gold": float64(5)},
+		"titles": []interface{}{"hero", 1}, // wrong item type
+	}, true)
+
+	if level := e.GetInt("level"); level != 100 {
+		t.Fatalf("level should be clamped to 100, but is %d", level)
+	}
+	if exp := e.GetFloat("exp"); exp != 3 {
+		t.Fatalf("exp should be 3, but is %v", exp)
+	}
+	if name := e.GetStr("name"); name != "Nobody" {
+		t.Fatalf("name should be default value, but is %s", name)
+	}
+	if gold := e.Attrs.GetMapAttr("bag").GetInt("gold"); gold != 5 {
+		t.Fatalf("gold should be 5, but is %d", gold)
+	}
+	if e.Attrs.HasKey("titles") {
+		t.Fatalf("invalid titles should be dropped")
+	}
+}
@@ -0,0 +1,215 @@
+package entity
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/sagacao/goworld/engine/common"
+	"github.com/sagacao/goworld/engine/consts"
+	"github.com/sagacao/goworld/engine/gwlog"
+	"github.com/sagacao/goworld/engine/netutil"
+	"github.com/sagacao/goworld/engine/proto"
+)
+
+// pendingAttrChanges is attribute changes of current tick which are not sent to clients yet
+var pendingAttrChanges = map[*GameClient]*clientAttrChanges{}
+
+// attrChange is one attribute change to be synced to clients
+//
+// The same attrChange can be queued for multiple clients, so it is packed only once
+type attrChange struct {
+	msgtype  proto.MsgType
+	entityID common.EntityID
+	path     []interface{}
+	key      string // key of MapAttr changes
+	index    uint32 // index of ListAttr changes
+	val      interface{}
+
+	pathData []byte
+	valData  []byte
+}
+
+// coalesceKey returns the key of changes which can be replaced by later changes with the same key
+//
+// Changes that can alter what a path refers to (clearing MapAttr, popping or appending ListAttr, setting MapAttr or
+// ListAttr values) can not be coalesced.
+func (c *attrChange) coalesceKey() (string, bool) {
+	switch c.msgtype {
+	case proto.MT_NOTIFY_MAP_ATTR_CHANGE_ON_CLIENT, proto.MT_NOTIFY_LIST_ATTR_CHANGE_ON_CLIENT:
+		switch c.val.(type) {
+		case map[string]interface{}, []interface{}:
+			return "", false
+		}
+	case proto.MT_NOTIFY_MAP_ATTR_DEL_ON_CLIENT:
+	default:
+		return "", false
+	}
+
+	var b strings.Builder
+	for _, p := range c.path {
+		switch k := p.(type) {
+		case string:
+			b.WriteString(k)
+		case int:
+			b.WriteString(strconv.Itoa(k))
+		}
+		b.WriteByte(0)
+	}
+	if c.msgtype == proto.MT_NOTIFY_LIST_ATTR_CHANGE_ON_CLIENT {
+		b.WriteString(strconv.FormatUint(uint64(c.index), 10))
+	} else {
+		b.WriteString(c.key)
+	}
+	return b.String(), true
+}
+
+func (c *attrChange) appendToPacket(packet *netutil.Packet) {
+	if c.pathData == nil {
+		c.pathData = packAttrChangeData(c.path)
+		switch c.msgtype {
+		case proto.MT_NOTIFY_MAP_ATTR_CHANGE_ON_CLIENT, proto.MT_NOTIFY_LIST_ATTR_CHANGE_ON_CLIENT, proto.MT_NOTIFY_LIST_ATTR_APPEND_ON_CLIENT:
+			c.valData = packAttrChangeData(c.val)
+		}
+	}
+
+	packet.AppendUint16(uint16(c.msgtype))
+	packet.AppendEntityID(c.entityID)
+	packet.AppendVarBytes(c.pathData)
+	switch c.msgtype {
+	case proto.MT_NOTIFY_MAP_ATTR_CHANGE_ON_CLIENT:
+		packet.AppendVarStr(c.key)
+		packet.AppendVarBytes(c.valData)
+	case proto.MT_NOTIFY_MAP_ATTR_DEL_ON_CLIENT:
+		packet.AppendVarStr(c.key)
+	case proto.MT_NOTIFY_LIST_ATTR_CHANGE_ON_CLIENT:
+		packet.AppendUint32(c.index)
+		packet.AppendVarBytes(c.valData)
+	case proto.MT_NOTIFY_LIST_ATTR_APPEND_ON_CLIENT:
+		packet.AppendVarBytes(c.valData)
+	}
+}
+
+func packAttrChangeData(data interface{}) []byte {
+	b, err := netutil.MSG_PACKER.PackMsg(data, nil)
+	if err != nil {
+		gwlog.Panic(err)
+	}
+	return b
+}
+
+// clientAttrChanges is the ordered attribute changes to one client
+type clientAttrChanges struct {
+	changes []*attrChange
+	// indexes of changes which can be coalesced, for each entity
+	coalescable map[common.EntityID]map[string]int
+}
+
+func newClientAttrChanges() *clientAttrChanges {
+	return &clientAttrChanges{
+		coalescable: map[common.EntityID]map[string]int{},
+	}
+}
+
+func (cc *clientAttrChanges) add(change *attrChange) {
+	key, ok := change.coalesceKey()
+	if !ok {
+		// paths might refer to other attributes after this change, so earlier changes of the entity can not be replaced any more
+		delete(cc.coalescable, change.entityID)
+		cc.changes = append(cc.changes, change)
+		return
+	}
+
+	indexes := cc.coalescable[change.entityID]
+	if indexes == nil {
+		indexes = map[string]int{}
+		cc.coalescable[change.entityID] = indexes
+	}
+
+	if i, ok := indexes[key]; ok {
+		cc.changes[i] = change
+		return
+	}
+
+	indexes[key] = len(cc.changes)
+	cc.changes = append(cc.changes, change)
+}
+
+// send sends changes to client in MT_NOTIFY_ATTR_CHANGES_ON_CLIENT packets
+func (cc *clientAttrChanges) send(client *GameClient) {
+	var packet *netutil.Packet
+	for _, change := range cc.changes {
+		if packet == nil {
+			packet = netutil.NewPacket()
+			packet.AppendUint16(proto.MT_NOTIFY_ATTR_CHANGES_ON_CLIENT)
+			packet.AppendUint16(client.gateid)
+			packet.AppendClientID(client.clientid)
+		}
+
+		change.appendToPacket(packet)
+		if packet.GetPayloadLen() >= consts.ATTR_CHANGES_PACKET_PAYLOAD_LIMIT {
+			client.conn().SendPacket(packet)
+			packet.Release()
+			packet = nil
+		}
+	}
+
+	if packet != nil {
+		client.conn().SendPacket(packet)
+		packet.Release()
+	}
+}
+
+// queueAttrChange queues the attribute change to be sent at the end of current tick
+func (client *GameClient) queueAttrChange(change *attrChange) {
+	if client == nil {
+		return
+	}
+
+	cc := pendingAttrChanges[client]
+	if cc == nil {
+		cc = newClientAttrChanges()
+		pendingAttrChanges[client] = cc
+	}
+	cc.add(change)
+}
+
+// flushAttrChanges sends pending attribute changes to the client
+//
+// It should be called before sending other messages to the client, so that the client receives messages in order
+func (client *GameClient) flushAttrChanges() {
+	if client == nil {
+		return
+	}
+
+	if cc := pendingAttrChanges[client]; cc != nil {
+		delete(pendingAttrChanges, client)
+		cc.send(client)
+	}
+}
+
+// FlushClientAttrChanges sends attribute changes of current tick to clients
+//
+// Changes to one client are sent in MT_NOTIFY_ATTR_CHANGES_ON_CLIENT packets, and changes to the same attribute are
+// coalesced so that only the latest value is sent.
+func FlushClientAttrChanges() {
+	if len(pendingAttrChanges) == 0 {
+		return
+	}
+
+	for client, cc := range pendingAttrChanges {
+		cc.send(client)
+	}
+	pendingAttrChanges = map[*GameClient]*clientAttrChanges{}
+}
+
+func (e *Entity) sendAttrChangeToClients(flag attrFlag, change *attrChange) {
+	if flag&afAllClient != 0 {
+		e.ghostAttrsDirty = true
+		e.client.queueAttrChange(change)
+		for neighbor := range e.InterestedBy {
+			neighbor.client.queueAttrChange(change)
+		}
+	} else if flag&afClient != 0 {
+		e.client.queueAttrChange(change)
+	}
+}
@@ -0,0 +1,90 @@
+package entity
+
+import (
+	"testing"
+
+	"github.com/sagacao/goworld/engine/netutil"
+	"github.com/sagacao/goworld/engine/proto"
+)
+
+type TestAttrSyncEntity struct {
+	Entity
+}
+
+func (e *TestAttrSyncEntity) DescribeEntityType(desc *EntityTypeDesc) {
+	desc.DefineAttr("hp", "Client")
+	desc.DefineAttr("mp", "Client")
+	desc.DefineAttr("bag", "Client")
+	desc.DefineAttr("secret")
+}
+
+func TestAttrChangesCoalesced(t *testing.T) {
+	RegisterEntity("TestAttrSyncEntity", &TestAttrSyncEntity{}, false)
+	e := CreateEntityLocally("TestAttrSyncEntity", nil)
+	client := MakeGameClient("TestAttrSyncClient", 1)
+	e.assignClient(client)
+	defer delete(pendingAttrChanges, client)
+
+	for i := 1; i <= 10; i++ {
+		e.Attrs.SetInt("hp", int64(i))
+		e.Attrs.SetInt("mp", int64(i))
+		e.Attrs.SetInt("secret", int64(i))
+	}
+	bag := NewMapAttr()
+	bag.SetInt("gold", 1)
+	e.Attrs.SetMapAttr("bag", bag)
+	bag.SetInt("gold", 2)
+	bag.SetInt("gold", 3)
+	e.Attrs.SetInt("hp", 100)
+	e.Attrs.Del("mp")
+
+	cc := pendingAttrChanges[client]
+	if cc == nil {
+		t.Fatalf("attribute changes should be pending")
+	}
+
+	packet := netutil.NewPacket()
+	defer packet.Release()
+	for _, change := range cc.changes {
+		change.appendToPacket(packet)
+	}
+
+	var changes []proto.AttrChange
+	for packet.HasUnreadPayload() {
+		changes = append(changes, proto.ReadAttrChange(packet))
+	}
+
+	// hp and mp changes before setting bag are coalesced, bag.gold changes after setting bag are coalesced
+	expected := []struct {
+		msgtype proto.MsgType
+		key     string
+		val     interface{}
+	}{
+		{proto.MT_NOTIFY_MAP_ATTR_CHANGE_ON_CLIENT, "hp", int64(10)},
+		{proto.MT_NOTIFY_MAP_ATTR_CHANGE_ON_CLIENT, "mp", int64(10)},
+		{proto.MT_NOTIFY_MAP_ATTR_CHANGE_ON_CLIENT, "bag", nil},
+		{proto.MT_NOTIFY_MAP_ATTR_CHANGE_ON_CLIENT, "gold", int64(3)},
+		{proto.MT_NOTIFY_MAP_ATTR_CHANGE_ON_CLIENT, "hp", int64(100)},
+		{proto.MT_NOTIFY_MAP_ATTR_DEL_ON_CLIENT, "mp", nil},
+	}
+	if len(changes) != len(expected) {
+		t.Fatalf("expect %d changes, but got %d: %v", len(expected), len(changes), changes)
+	}
+
+	for i, change := range changes {
+		exp := expected[i]
+		if change.EntityID != e.ID || change.MsgType != exp.msgtype || change.Key != exp.key {
+			t.Fatalf("change %d is wrong: %+v", i, change)
+		}
+		if exp.val != nil && change.Val != exp.val {
+			t.Fatalf("change %d should have value %v, but got %v", i, exp.val, change.Val)
+		}
+	}
+
+	if bagVal, ok := changes[2].Val.(map[string]interface{}); !ok || len(bagVal) != 1 {
+		t.Fatalf("bag should be sent as map with gold: %v", changes[2].Val)
+	}
+	if len(changes[3].Path) != 1 || changes[3].Path[0] != "bag" {
+		t.Fatalf("wrong path for bag.gold: %v", changes[3].Path)
+	}
+}
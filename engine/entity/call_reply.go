@@ -0,0 +1,247 @@
+package entity
+
+import (
+	"reflect"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sagacao/goworld/engine/common"
+	"github.com/sagacao/goworld/engine/consts"
+	"github.com/sagacao/goworld/engine/dispatchercluster"
+	"github.com/sagacao/goworld/engine/gwlog"
+	"github.com/sagacao/goworld/engine/gwutils"
+	"github.com/sagacao/goworld/engine/netutil"
+	timer "github.com/xiaonanln/goTimer"
+)
+
+// ErrCallReplyTimeout is passed to the reply callback if the reply is not received in time
+var ErrCallReplyTimeout = errors.New("call reply timeout")
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// entityCallReplyInfo is a pending call of the caller entity which is waiting for reply
+type entityCallReplyInfo struct {
+	Callback string
+	Deadline time.Time
+	rawTimer *timer.Timer
+}
+
+// entityCallRepliesData is the migrate data of pending calls
+type entityCallRepliesData struct {
+	LastReplyID uint32                          `msgpack:"L"`
+	Replies     map[uint32]*entityCallReplyInfo `msgpack:"R"`
+}
+
+// CallWithReply calls the method of other entity and receives results of the method in the callback method of this entity
+//
+// The callback method should be defined as `func (a *MyEntity) OnReply(results []interface{}, err error)`.
+// err is not nil if the method returns a non-nil error as the last result, if the method paniced, or if the reply
+// is not received within timeout (ErrCallReplyTimeout). Just like AddCallback, the callback is specified by method name
+// so that pending calls survive migration: replies are always routed to the caller entity wherever it is.
+func (e *Entity) CallWithReply(id common.EntityID, method string, args []interface{}, timeout time.Duration, callback string) {
+	if timeout <= 0 {
+		gwlog.Panicf("%s.CallWithReply %s.%s: timeout must be positive, but is %s", e, id, method, timeout)
+	}
+
+	if rpcDesc := e.typeDesc.rpcDescs[callback]; rpcDesc == nil || rpcDesc.NumArgs != 2 {
+		gwlog.Panicf("%s.CallWithReply %s.%s: callback %s is not a valid reply callback", e, id, method, callback)
+	}
+
+	replyID := e.genCallReplyID()
+	info := &entityCallReplyInfo{
+		Callback: callback,
+		Deadline: time.Now().Add(timeout),
+	}
+	e.callReplies[replyID] = info
+	info.rawTimer = e.addRawCallback(timeout, func() {
+		e.onCallReplyTimeout(replyID)
+	})
+
+	callWithReply(id, method, args, e.ID, replyID)
+}
+
+func (e *Entity) genCallReplyID() uint32 {
+	e.lastCallReplyID += 1
+	return e.lastCallReplyID
+}
+
+func callWithReply(id common.EntityID, method string, args []interface{}, callerID common.EntityID, replyID uint32) {
+	if consts.OPTIMIZE_LOCAL_ENTITY_CALL {
+		e := entityManager.get(id)
+		if e != nil { // this entity is local, just call entity directly
+			e.Post(func() {
+				e.replyCall(callerID, replyID, func() ([]reflect.Value, error) {
+					return e.callRPCFromLocal(method, args), nil
+				})
+			})
+			return
+		}
+	}
+
+	dispatchercluster.SelectByEntityID(id).SendCallEntityMethodWithReply(id, method, args, callerID, replyID)
+}
+
+// replyCall runs the call and sends the results back to the caller entity
+func (e *Entity) replyCall(callerID common.EntityID, replyID uint32, call func() ([]reflect.Value, error)) {
+	var outs []reflect.Value
+	var err error
+	if perr := gwutils.CatchPanic(func() {
+		outs, err = call()
+	}); perr != nil {
+		err = errors.Errorf("%s paniced: %v", e, perr)
+	}
+
+	var results []interface{}
+	if err == nil {
+		if len(outs) > 0 && outs[len(outs)-1].Type() == errorType {
+			// the last result of method is error
+			if errVal := outs[len(outs)-1]; !errVal.IsNil() {
+				err = errVal.Interface().(error)
+			}
+			outs = outs[:len(outs)-1]
+		}
+
+		results = make([]interface{}, len(outs))
+		for i, out := range outs {
+			results[i] = out.Interface()
+		}
+	}
+
+	sendCallReply(callerID, replyID, results, err)
+}
+
+func sendCallReply(callerID common.EntityID, replyID uint32, results []interface{}, err error) {
+	var errmsg string
+	if err != nil {
+		errmsg = err.Error()
+	}
+
+	if consts.OPTIMIZE_LOCAL_ENTITY_CALL {
+		caller := entityManager.get(callerID)
+		if caller != nil { // caller is local, just reply directly
+			if err != nil {
+				err = errors.New(errmsg) // errors are always passed to callback as strings
+			}
+			caller.Post(func() {
+				caller.onCallReply(replyID, results, err)
+			})
+			return
+		}
+	}
+
+	dispatchercluster.SelectByEntityID(callerID).SendCallEntityMethodReply(callerID, replyID, errmsg, results)
+}
+
+func (e *Entity) onCallReply(replyID uint32, results []interface{}, err error) {
+	info := e.callReplies[replyID]
+	if info == nil {
+		gwlog.Warnf("%s: reply %d is received, but call is not found, might be timeout", e, replyID)
+		return
+	}
+
+	delete(e.callReplies, replyID)
+	e.cancelRawTimer(info.rawTimer)
+	e.invokeCallReplyCallback(info.Callback, results, err)
+}
+
+func (e *Entity) onCallReplyTimeout(replyID uint32) {
+	info := e.callReplies[replyID]
+	if info == nil {
+		return // reply already received
+	}
+
+	delete(e.callReplies, replyID)
+	e.invokeCallReplyCallback(info.Callback, nil, ErrCallReplyTimeout)
+}
+
+func (e *Entity) invokeCallReplyCallback(callback string, results []interface{}, err error) {
+	defer func() {
+		err := recover() // recover from any error during reply callback
+		if err != nil {
+			gwlog.TraceError("%s.%s paniced: %s", e, callback, err)
+		}
+	}()
+
+	rpcDesc := e.typeDesc.rpcDescs[callback]
+	if rpcDesc == nil || rpcDesc.NumArgs != 2 {
+		gwlog.Panicf("%s: reply callback %s is not valid", e, callback)
+	}
+
+	errVal := reflect.Zero(rpcDesc.MethodType.In(2))
+	if err != nil {
+		errVal = reflect.ValueOf(err)
+	}
+	rpcDesc.Func.Call([]reflect.Value{e.V, reflect.ValueOf(results), errVal})
+}
+
+func (e *Entity) dumpCallReplies() []byte {
+	if len(e.callReplies) == 0 && e.lastCallReplyID == 0 {
+		return nil
+	}
+
+	crd := entityCallRepliesData{
+		LastReplyID: e.lastCallReplyID,
+		Replies:     e.callReplies,
+	}
+	e.callReplies = nil // no more CallWithReply
+	data, err := timersPacker.PackMsg(crd, nil)
+	if err != nil {
+		gwlog.TraceError("%s dump call replies failed: %s", e, err)
+	}
+	return data
+}
+
+func (e *Entity) restoreCallReplies(data []byte) error {
+	var crd entityCallRepliesData
+	if err := timersPacker.UnpackMsg(data, &crd); err != nil {
+		return err
+	}
+
+	e.lastCallReplyID = crd.LastReplyID
+	now := time.Now()
+	for replyID, info := range crd.Replies {
+		replyID := replyID
+		e.callReplies[replyID] = info
+		info.rawTimer = e.addRawCallback(info.Deadline.Sub(now), func() {
+			e.onCallReplyTimeout(replyID)
+		})
+	}
+	return nil
+}
+
+// OnCallWithReply is called by engine when method call with reply reaches in the game
+func OnCallWithReply(id common.EntityID, method string, args [][]byte, callerID common.EntityID, replyID uint32) {
+	e := entityManager.get(id)
+	if e == nil {
+		// entity not found, may destroyed before call
+		sendCallReply(callerID, replyID, nil, errors.Errorf("entity %s is not found while calling %s", id, method))
+		return
+	}
+
+	e.replyCall(callerID, replyID, func() ([]reflect.Value, error) {
+		return e.callRPCFromRemote(method, args, "")
+	})
+}
+
+// OnCallReply is called by engine when reply of method call reaches the caller entity in the game
+func OnCallReply(callerID common.EntityID, replyID uint32, errmsg string, results [][]byte) {
+	e := entityManager.get(callerID)
+	if e == nil {
+		gwlog.Warnf("OnCallReply: caller entity %s is not found, reply %d is dropped", callerID, replyID)
+		return
+	}
+
+	var err error
+	if errmsg != "" {
+		err = errors.New(errmsg)
+	}
+
+	values := make([]interface{}, len(results))
+	for i, result := range results {
+		if uerr := netutil.MSG_PACKER.UnpackMsg(result, &values[i]); uerr != nil && err == nil {
+			err = errors.Wrapf(uerr, "unpack result %d failed", i)
+		}
+	}
+
+	e.onCallReply(replyID, values, err)
+}
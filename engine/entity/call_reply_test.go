@@ -0,0 +1,79 @@
+package entity
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sagacao/goworld/engine/common"
+	"github.com/sagacao/goworld/engine/netutil"
+	"github.com/sagacao/goworld/engine/post"
+)
+
+type TestReplyEntity struct {
+	Entity
+	sum      int
+	replyErr error
+}
+
+func (e *TestReplyEntity) DescribeEntityType(*EntityTypeDesc) {
+}
+
+func (e *TestReplyEntity) Add(a, b int) (int, error) {
+	if a < 0 {
+		return 0, errors.Errorf("negative")
+	}
+	return a + b, nil
+}
+
+func (e *TestReplyEntity) OnAddReply(results []interface{}, err error) {
+	e.replyErr = err
+	if err == nil {
+		e.sum = results[0].(int)
+	}
+}
+
+func TestCallWithReply(t *testing.T) {
+	RegisterEntity("TestReplyEntity", &TestReplyEntity{}, false)
+	caller := CreateEntityLocally("TestReplyEntity", nil)
+	callee := CreateEntityLocally("TestReplyEntity", nil)
+
+	caller.CallWithReply(callee.ID, "Add", []interface{}{1, 2}, time.Second, "OnAddReply")
+	post.Tick()
+	if sum := caller.I.(*TestReplyEntity).sum; sum != 3 {
+		t.Fatalf("sum should be 3, but is %d", sum)
+	}
+	if len(caller.callReplies) != 0 {
+		t.Fatalf("call replies should be cleared after reply")
+	}
+
+	caller.CallWithReply(callee.ID, "Add", []interface{}{-1, 2}, time.Second, "OnAddReply")
+	post.Tick()
+	if err := caller.I.(*TestReplyEntity).replyErr; err == nil || err.Error() != "negative" {
+		t.Fatalf("reply error should be negative, but is %v", err)
+	}
+}
+
+func TestCallRepliesMigrateData(t *testing.T) {
+	RegisterEntity("TestReplyMigrateEntity", &TestReplyEntity{}, false)
+	e := CreateEntityLocally("TestReplyMigrateEntity", nil)
+	e.CallWithReply(e.ID, "Add", []interface{}{1, 2}, time.Minute, "OnAddReply")
+
+	md := e.GetMigrateData(common.GenEntityID())
+	data, err := netutil.MSG_PACKER.PackMsg(md, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var umd entityMigrateData
+	if err := netutil.MSG_PACKER.UnpackMsg(data, &umd); err != nil {
+		t.Fatal(err)
+	}
+
+	other := CreateEntityLocally("TestReplyMigrateEntity", nil)
+	if err := other.restoreCallReplies(umd.CallReplyData); err != nil {
+		t.Fatal(err)
+	}
+	if other.lastCallReplyID != 1 || other.callReplies[1] == nil || other.callReplies[1].Callback != "OnAddReply" {
+		t.Fatalf("call replies not restored: last=%d, replies=%v", other.lastCallReplyID, other.callReplies)
+	}
+}
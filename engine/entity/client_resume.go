@@ -0,0 +1,198 @@
+package entity
+
+import (
+	"time"
+
+	"github.com/sagacao/goworld/engine/common"
+	"github.com/sagacao/goworld/engine/consts"
+	"github.com/sagacao/goworld/engine/dispatchercluster"
+	"github.com/sagacao/goworld/engine/gwlog"
+	"github.com/sagacao/goworld/engine/gwutils"
+	"github.com/sagacao/goworld/engine/netutil"
+	"github.com/sagacao/goworld/engine/post"
+)
+
+// clientResumeGracePeriod is the period during which the disconnected client can be resumed, 0 to disable resuming
+var clientResumeGracePeriod time.Duration
+
+// SetClientResumeGracePeriod sets the period during which owner entities keep disconnected clients for resuming
+func SetClientResumeGracePeriod(d time.Duration) {
+	clientResumeGracePeriod = d
+	gwlog.Infof("Client resume grace period set to %s", clientResumeGracePeriod)
+}
+
+func newGameClientFromData(data *clientData) *GameClient {
+	client := MakeGameClient(data.ClientID, data.GateID)
+	client.resumeToken = data.ResumeToken
+	if data.FilterProps != nil {
+		client.filterProps = data.FilterProps
+	}
+	client.suspended = data.Suspended
+	if data.Suspended {
+		client.resumeDeadline = time.Unix(0, data.ResumeDeadline)
+	}
+	client.buffered = data.Buffered
+	for _, msg := range client.buffered {
+		client.bufferedSize += len(msg)
+	}
+	client.bufferOverflow = data.BufferOverflow
+	return client
+}
+
+func (client *GameClient) getData() *clientData {
+	// pending attribute changes are buffered before the client is migrated
+	client.flushAttrChanges()
+
+	data := &clientData{
+		ClientID:       client.clientid,
+		GateID:         client.gateid,
+		ResumeToken:    client.resumeToken,
+		FilterProps:    client.filterProps,
+		Suspended:      client.suspended,
+		Buffered:       client.buffered,
+		BufferOverflow: client.bufferOverflow,
+	}
+	if client.suspended {
+		data.ResumeDeadline = client.resumeDeadline.UnixNano()
+	}
+	return data
+}
+
+// bufferPacket buffers the message to the suspended client
+func (client *GameClient) bufferPacket(packet *netutil.Packet) {
+	if client.bufferOverflow {
+		return
+	}
+
+	// messages to clients start with msgtype, gateid and clientid, only msgtype and the following payload are buffered
+	payload := packet.Payload()
+	msg := make([]byte, len(payload)-2-common.CLIENTID_LENGTH)
+	copy(msg, payload[:2])
+	copy(msg[2:], payload[4+common.CLIENTID_LENGTH:])
+
+	if client.bufferedSize+len(msg) > consts.CLIENT_RESUME_BUFFER_LIMIT {
+		// too many messages are missed, the client can not be resumed any more
+		gwlog.Warnf("%s: too many messages are buffered for resuming (%d bytes), drop the client", client, client.bufferedSize)
+		client.bufferOverflow = true
+		client.buffered = nil
+		client.bufferedSize = 0
+
+		post.Post(func() {
+			if owner := entityManager.get(client.ownerid); owner != nil && owner.client == client && client.suspended {
+				owner.notifyClientDisconnected()
+			}
+		})
+		return
+	}
+
+	client.buffered = append(client.buffered, msg)
+	client.bufferedSize += len(msg)
+}
+
+// makeReplayPacket makes the packet of the buffered message to the client of gateid and clientid
+func makeReplayPacket(msg []byte, gateid uint16, clientid common.ClientID) *netutil.Packet {
+	packet := netutil.NewPacket()
+	packet.AppendBytes(msg[:2])
+	packet.AppendUint16(gateid)
+	packet.AppendClientID(clientid)
+	packet.AppendBytes(msg[2:])
+	return packet
+}
+
+// disconnectClient is called when the Client of entity is disconnected from the gate
+func (e *Entity) disconnectClient(resumable bool) {
+	client := e.client
+	if !resumable || clientResumeGracePeriod <= 0 || client.resumeToken == "" {
+		e.notifyClientDisconnected()
+		return
+	}
+
+	if client.suspended {
+		return
+	}
+
+	gwlog.Infof("%s: client %s is suspended for resuming in %s", e, client, clientResumeGracePeriod)
+	client.suspended = true
+	client.resumeDeadline = time.Now().Add(clientResumeGracePeriod)
+	client.flushAttrChanges() // pending attribute changes are not sent yet, so buffer them
+	e.setupClientResumeTimer()
+
+	gwutils.RunPanicless(e.I.OnClientSuspended)
+}
+
+func (e *Entity) setupClientResumeTimer() {
+	e.cancelClientResumeTimer()
+
+	client := e.client
+	e.clientResumeTimer = e.addRawCallback(time.Until(client.resumeDeadline), func() {
+		e.clientResumeTimer = nil
+		if e.client == client && client.suspended {
+			gwlog.Infof("%s: client %s is not resumed in time", e, client)
+			e.notifyClientDisconnected()
+		}
+	})
+}
+
+func (e *Entity) cancelClientResumeTimer() {
+	if e.clientResumeTimer != nil {
+		e.cancelRawTimer(e.clientResumeTimer)
+		e.clientResumeTimer = nil
+	}
+}
+
+// resumeClient moves the Client of entity to the new connection of clientid at gateid and replays buffered messages
+func (e *Entity) resumeClient(clientid common.ClientID, gateid uint16, resumeToken string) {
+	client := e.client
+	if !client.suspended {
+		// the old connection is not closed yet (e.g. the client reconnects before the gate notices the disconnection),
+		// so the client is taken over by the new connection
+		client.flushAttrChanges()
+		client.selectDispatcher().SendClearClientFilterProp(client.gateid, client.clientid)
+	} else {
+		client.flushAttrChanges()
+		e.cancelClientResumeTimer()
+	}
+
+	gwlog.Infof("%s: client %s is resumed as %s@%d, replaying %d messages", e, client, clientid, gateid, len(client.buffered))
+	client.clientid = clientid
+	client.gateid = gateid
+	client.resumeToken = resumeToken
+	client.suspended = false
+	buffered := client.buffered
+	client.buffered = nil
+	client.bufferedSize = 0
+
+	dispatcher := client.selectDispatcher()
+	dispatcher.SendNotifyClientResumedOnClient(gateid, clientid, e.ID, true)
+	for key, val := range client.filterProps {
+		dispatcher.SendSetClientFilterProp(gateid, clientid, key, val)
+	}
+	for _, msg := range buffered {
+		dispatcher.SendPacketRelease(makeReplayPacket(msg, gateid, clientid))
+	}
+
+	// positions are not synced to suspended clients, so sync positions of the entity and its neighbors again
+	e.syncInfoFlag |= sifSyncOwnClient
+	for neighbor := range e.InterestedIn {
+		neighbor.syncInfoFlag |= sifSyncNeighborClients
+	}
+
+	gwutils.RunPanicless(e.I.OnClientResumed)
+}
+
+// OnClientResume is called by engine when the client requests to resume the session of the owner entity on a new connection
+func OnClientResume(ownerID common.EntityID, clientid common.ClientID, gateid uint16, resumeToken string, newResumeToken string) {
+	owner := entityManager.get(ownerID)
+	if owner == nil {
+		gwlog.Warnf("client %s resume failed: owner entity %s not found", clientid, ownerID)
+	} else if owner.client == nil || owner.client.resumeToken == "" || owner.client.resumeToken != resumeToken {
+		gwlog.Warnf("client %s resume failed: %s has client %s, token mismatch", clientid, owner, owner.client)
+	} else if owner.client.bufferOverflow {
+		gwlog.Warnf("client %s resume failed: %s has missed too many messages", clientid, owner)
+	} else {
+		owner.resumeClient(clientid, gateid, newResumeToken)
+		return
+	}
+
+	dispatchercluster.SelectByEntityID(ownerID).SendNotifyClientResumedOnClient(gateid, clientid, ownerID, false)
+}
@@ -0,0 +1,74 @@
+package entity
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sagacao/goworld/engine/common"
+	"github.com/sagacao/goworld/engine/proto"
+)
+
+type TestClientResumeEntity struct {
+	Entity
+	suspended    bool
+	disconnected bool
+}
+
+func (e *TestClientResumeEntity) DescribeEntityType(*EntityTypeDesc) {
+}
+
+func (e *TestClientResumeEntity) OnClientSuspended() {
+	e.suspended = true
+}
+
+func (e *TestClientResumeEntity) OnClientDisconnected() {
+	e.disconnected = true
+}
+
+func TestClientSuspend(t *testing.T) {
+	SetClientResumeGracePeriod(time.Minute)
+	defer SetClientResumeGracePeriod(0)
+
+	RegisterEntity("TestClientResumeEntity", &TestClientResumeEntity{}, false)
+	e := CreateEntityLocally("TestClientResumeEntity", nil)
+	client := MakeGameClient(common.GenClientID(), 1)
+	client.SetResumeToken("token")
+	e.assignClient(client)
+
+	e.disconnectClient(true)
+	if !client.suspended || !e.I.(*TestClientResumeEntity).suspended || e.clientResumeTimer == nil {
+		t.Fatalf("client should be suspended")
+	}
+
+	// messages to the suspended client are buffered
+	e.CallClient("Foo", 1)
+	if len(client.buffered) != 1 {
+		t.Fatalf("1 message should be buffered, but %d", len(client.buffered))
+	}
+
+	newClientID := common.GenClientID()
+	packet := makeReplayPacket(client.buffered[0], 2, newClientID)
+	if msgtype := proto.MsgType(packet.ReadUint16()); msgtype != proto.MT_CALL_ENTITY_METHOD_ON_CLIENT {
+		t.Fatalf("wrong msgtype: %d", msgtype)
+	}
+	if gateid, clientid := packet.ReadUint16(), packet.ReadClientID(); gateid != 2 || clientid != newClientID {
+		t.Fatalf("replayed message should be sent to the new client, but sent to %s@%d", clientid, gateid)
+	}
+	if eid, method := packet.ReadEntityID(), packet.ReadVarStr(); eid != e.ID || method != "Foo" {
+		t.Fatalf("wrong replayed message: %s.%s", eid, method)
+	}
+	packet.Release()
+
+	// suspended clients are migrated with buffered messages
+	migratedClient := newGameClientFromData(client.getData())
+	if !migratedClient.suspended || len(migratedClient.buffered) != 1 || migratedClient.resumeToken != "token" ||
+		!migratedClient.resumeDeadline.Equal(client.resumeDeadline) {
+		t.Fatalf("suspended client is not migrated correctly")
+	}
+
+	// the client is dropped if it can not be resumed
+	e.disconnectClient(false)
+	if e.client != nil || !e.I.(*TestClientResumeEntity).disconnected || e.clientResumeTimer != nil {
+		t.Fatalf("client should be disconnected")
+	}
+}
@@ -0,0 +1,56 @@
+package entity
+
+import (
+	"testing"
+)
+
+type TestDirtyEntity struct {
+	Entity
+}
+
+func (e *TestDirtyEntity) DescribeEntityType(desc *EntityTypeDesc) {
+	desc.SetPersistent(true)
+	desc.DefineAttr("gold", "Persistent")
+	desc.DefineAttr("bag", "Persistent")
+	desc.DefineAttr("titles", "Persistent")
+	desc.DefineAttr("temp")
+}
+
+func TestDirtyAttrs(t *testing.T) {
+	RegisterEntity("TestDirtyEntity", &TestDirtyEntity{}, false)
+	e := createEntity("TestDirtyEntity", nil, Vector3{}, "", "", map[string]interface{}{
+		"gold":   1,
+		"bag":    map[string]interface{}{"sword": 1},
+		"titles": []interface{}{"hero"},
+	}, true)
+
+	if e.allAttrsDirty || len(e.dirtyAttrs) != 0 {
+		t.Fatalf("loaded entity should be clean: %v", e.dirtyAttrs)
+	}
+
+	e.Attrs.SetInt("temp", 1)
+	if len(e.dirtyAttrs) != 0 {
+		t.Fatalf("non persistent attributes should not be dirty: %v", e.dirtyAttrs)
+	}
+
+	e.Attrs.GetMapAttr("bag").SetInt("shield", 1)
+	e.Attrs.GetListAttr("titles").AppendStr("king")
+	e.Attrs.Del("gold")
+	updates, deletes := e.getDirtyPersistentData()
+	if len(updates) != 2 || updates["bag"].(map[string]interface{})["shield"] != int64(1) || len(updates["titles"].([]interface{})) != 2 {
+		t.Fatalf("wrong updates: %v", updates)
+	}
+	if len(deletes) != 1 || deletes[0] != "gold" {
+		t.Fatalf("wrong deletes: %v", deletes)
+	}
+
+	e.Save()
+	if len(e.dirtyAttrs) != 0 {
+		t.Fatalf("entity should be clean after save: %v", e.dirtyAttrs)
+	}
+
+	created := CreateEntityLocally("TestDirtyEntity", map[string]interface{}{"gold": 1})
+	if !created.allAttrsDirty {
+		t.Fatalf("all attributes of new entity should be dirty")
+	}
+}
@@ -0,0 +1,12 @@
+package entity
+
+import (
+	"github.com/sagacao/goworld/engine/metrics"
+)
+
+var (
+	entityCountMetric    = metrics.NewGaugeVec("goworld_entities", "Number of entities in the game by type", "type")
+	migrationCountMetric = metrics.NewCounterVec("goworld_entity_migrations_total", "Number of entity migrations by direction (in or out)", "direction")
+	aoiEntityCountMetric = metrics.NewGauge("goworld_aoi_entities", "Number of entities in AOI of spaces")
+	aoiInterestMetric    = metrics.NewGauge("goworld_aoi_interests", "Number of interested entity pairs in AOI")
+)
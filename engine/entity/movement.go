@@ -0,0 +1,68 @@
+package entity
+
+import (
+	"time"
+)
+
+// max elapsed time used for checking speed of movements, so that clients can not move far after a long idle
+const _MAX_MOVEMENT_ELAPSED = time.Second
+
+// MovementValidator validates positions synced from clients for entities with client syncing enabled
+//
+// Invalid positions are rejected, or clamped to valid positions if Clamp is set, and the corrected position
+// is synced to the owning client.
+type MovementValidator struct {
+	MaxSpeed        Coord // max moving distance per second, 0 for unlimited
+	CheckSpaceRange bool  // positions must be in the range of space, see ISpace.GetSpaceRange
+	Clamp           bool  // clamp invalid positions instead of rejecting them
+	// Collision checks the movement from the current position, returns the position the entity can move to and
+	// if the movement is valid
+	Collision func(e *Entity, from, to Vector3) (Vector3, bool)
+}
+
+// validate validates the movement of entity to the position, returns the valid position and if the movement is accepted
+func (v *MovementValidator) validate(e *Entity, pos Vector3, elapsed time.Duration) (Vector3, bool) {
+	valid := true
+	from := e.Position
+
+	if v.MaxSpeed > 0 {
+		if elapsed > _MAX_MOVEMENT_ELAPSED || elapsed < 0 {
+			elapsed = _MAX_MOVEMENT_ELAPSED
+		}
+		maxDist := v.MaxSpeed * Coord(elapsed.Seconds())
+		if dist := from.DistanceTo(pos); dist > maxDist {
+			valid = false
+			pos = from.Add(pos.Sub(from).Mul(maxDist / dist))
+		}
+	}
+
+	if v.CheckSpaceRange && e.Space != nil {
+		minX, minZ, maxX, maxZ := e.Space.I.GetSpaceRange()
+		clamped := Vector3{clampCoord(pos.X, minX, maxX), pos.Y, clampCoord(pos.Z, minZ, maxZ)}
+		if clamped != pos {
+			valid = false
+			pos = clamped
+		}
+	}
+
+	if v.Collision != nil {
+		var ok bool
+		pos, ok = v.Collision(e, from, pos)
+		valid = valid && ok
+	}
+
+	if !valid && !v.Clamp {
+		return from, false
+	}
+	return pos, true
+}
+
+func clampCoord(c, min, max Coord) Coord {
+	if c < min {
+		return min
+	}
+	if c > max {
+		return max
+	}
+	return c
+}
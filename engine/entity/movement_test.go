@@ -0,0 +1,51 @@
+package entity
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMovementValidator(t *testing.T) {
+	space := &Space{}
+	space.I = space
+	e := &Entity{Space: space, Position: Vector3{0, 0, 0}}
+
+	v := &MovementValidator{MaxSpeed: 10, CheckSpaceRange: true}
+	if pos, ok := v.validate(e, Vector3{3, 0, 4}, time.Second/2); !ok || pos != (Vector3{3, 0, 4}) {
+		t.Fatalf("movement in speed should be accepted, but got %s, %v", pos, ok)
+	}
+	if _, ok := v.validate(e, Vector3{30, 0, 40}, time.Second/2); ok {
+		t.Fatalf("movement too fast should be rejected")
+	}
+	if _, ok := v.validate(e, Vector3{30, 0, 40}, time.Hour); ok {
+		t.Fatalf("elapsed time should be limited")
+	}
+
+	e.Position = Vector3{995, 0, 0}
+	if _, ok := v.validate(e, Vector3{1001, 0, 0}, time.Second); ok {
+		t.Fatalf("movement out of space range should be rejected")
+	}
+
+	v.Clamp = true
+	if pos, ok := v.validate(e, Vector3{1001, 0, 0}, time.Second); !ok || pos != (Vector3{1000, 0, 0}) {
+		t.Fatalf("movement should be clamped to space range, but got %s, %v", pos, ok)
+	}
+	e.Position = Vector3{0, 0, 0}
+	if pos, ok := v.validate(e, Vector3{0, 0, 20}, time.Second); !ok || pos != (Vector3{0, 0, 10}) {
+		t.Fatalf("movement should be clamped by speed, but got %s, %v", pos, ok)
+	}
+
+	v = &MovementValidator{Collision: func(e *Entity, from, to Vector3) (Vector3, bool) {
+		if to.X > 5 {
+			return Vector3{5, to.Y, to.Z}, false
+		}
+		return to, true
+	}}
+	if _, ok := v.validate(e, Vector3{6, 0, 0}, time.Second); ok {
+		t.Fatalf("movement should be rejected by collision")
+	}
+	v.Clamp = true
+	if pos, ok := v.validate(e, Vector3{6, 0, 0}, time.Second); !ok || pos != (Vector3{5, 0, 0}) {
+		t.Fatalf("movement should be clamped by collision, but got %s, %v", pos, ok)
+	}
+}
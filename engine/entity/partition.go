@@ -0,0 +1,466 @@
+package entity
+
+import (
+	"crypto/md5"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/sagacao/goworld/engine/common"
+	"github.com/sagacao/goworld/engine/dispatchercluster"
+	"github.com/sagacao/goworld/engine/gwlog"
+	"github.com/sagacao/goworld/engine/uuid"
+)
+
+const (
+	_SPACE_PARTITION_WORLD_KEY = "_PW"
+	_SPACE_PARTITION_CELL_KEY  = "_PC"
+	_PARTITION_CHECK_INTERVAL  = time.Millisecond * 100
+	// _REMOVED_GHOST_TTL is the time to keep generations of removed ghosts for ignoring late messages from old cells
+	_REMOVED_GHOST_TTL = time.Second * 10
+)
+
+// SpacePartition is the config of partitioned spaces of a kind
+//
+// The range of a partitioned space (see ISpace.GetSpaceRange) is split into Cols x Rows cells on the XZ plane, and
+// each cell is a space which can be created on a different game. Entities migrate to neighbor cells automatically
+// when they move across cell borders, and entities near borders are mirrored into neighbor cells as ghosts, so that
+// entities in neighbor cells can see each other through AOI.
+type SpacePartition struct {
+	Cols int
+	Rows int
+	// entities within GhostDistance of neighbor cells are mirrored into them, should not be less than the AOI distance
+	GhostDistance Coord
+	GameIDs       []uint16 // games which cells are created on in turn, empty for any game
+}
+
+var spacePartitions = map[int]*SpacePartition{}
+
+// SetSpacePartition sets the partition config of the space kind
+//
+// SetSpacePartition should be called on all games before the game starts. GetSpaceRange of the space type should
+// only depend on Kind for partitioned spaces, since the range is also used for locating cells without a space instance.
+func SetSpacePartition(kind int, partition SpacePartition) {
+	if kind == 0 {
+		gwlog.Panicf("nil space can not be partitioned")
+	}
+	if partition.Cols <= 0 || partition.Rows <= 0 {
+		gwlog.Panicf("invalid space partition %dx%d for kind %d", partition.Cols, partition.Rows, kind)
+	}
+	if partition.GhostDistance < 0 {
+		gwlog.Panicf("invalid ghost distance %v for kind %d", partition.GhostDistance, kind)
+	}
+	spacePartitions[kind] = &partition
+}
+
+// CreatePartitionedSpace creates all cells of a partitioned space of the kind, returns the world ID of the partitioned space
+//
+// Use GetPartitionCellID to find the cell for entering the partitioned space.
+func CreatePartitionedSpace(kind int) common.EntityID {
+	partition := spacePartitions[kind]
+	if partition == nil {
+		gwlog.Panicf("space kind %d is not partitioned", kind)
+	}
+
+	worldID := common.GenEntityID()
+	for cell := 0; cell < partition.Cols*partition.Rows; cell++ {
+		var gameid uint16
+		if len(partition.GameIDs) > 0 {
+			gameid = partition.GameIDs[cell%len(partition.GameIDs)]
+		}
+		dispatchercluster.SendCreateEntitySomewhere(gameid, partitionCellID(worldID, cell), _SPACE_ENTITY_TYPE, map[string]interface{}{
+			_SPACE_KIND_ATTR_KEY:       kind,
+			_SPACE_PARTITION_WORLD_KEY: string(worldID),
+			_SPACE_PARTITION_CELL_KEY:  cell,
+		})
+	}
+	return worldID
+}
+
+// GetPartitionCellID returns the ID of the cell space which contains the position in the partitioned space
+func GetPartitionCellID(kind int, worldID common.EntityID, pos Vector3) common.EntityID {
+	partition := spacePartitions[kind]
+	if partition == nil {
+		gwlog.Panicf("space kind %d is not partitioned", kind)
+	}
+
+	// GetSpaceRange is called on a bare space instance, since cells might not be on this game
+	spaceVal := reflect.New(spaceType)
+	spaceVal.Elem().FieldByName("Kind").SetInt(int64(kind))
+	grid := newPartitionGrid(partition, spaceVal.Interface().(ISpace))
+	return partitionCellID(worldID, grid.cellAt(pos))
+}
+
+func partitionCellID(worldID common.EntityID, cell int) common.EntityID {
+	// fixed UUIDs are generated from 12 bytes, so the hash of world ID and cell is used
+	sum := md5.Sum([]byte(string(worldID) + "#" + strconv.Itoa(cell)))
+	return common.EntityID(uuid.GenFixedUUID(sum[:]))
+}
+
+// partitionGrid splits the range of space into cells
+type partitionGrid struct {
+	cols, rows             int
+	minX, minZ, maxX, maxZ Coord
+	ghostDistance          Coord
+}
+
+func newPartitionGrid(partition *SpacePartition, space ISpace) partitionGrid {
+	minX, minZ, maxX, maxZ := space.GetSpaceRange()
+	if maxX <= minX || maxZ <= minZ {
+		gwlog.Panicf("invalid range of partitioned space: (%v, %v) - (%v, %v)", minX, minZ, maxX, maxZ)
+	}
+	return partitionGrid{
+		cols:          partition.Cols,
+		rows:          partition.Rows,
+		minX:          minX,
+		minZ:          minZ,
+		maxX:          maxX,
+		maxZ:          maxZ,
+		ghostDistance: partition.GhostDistance,
+	}
+}
+
+func gridIndex(c, min, max Coord, n int) int {
+	i := int((c - min) * Coord(n) / (max - min))
+	if i < 0 {
+		return 0
+	}
+	if i >= n {
+		return n - 1
+	}
+	return i
+}
+
+// cellAt returns the cell which contains the position, positions out of range belong to the nearest cell
+func (g *partitionGrid) cellAt(pos Vector3) int {
+	return gridIndex(pos.Z, g.minZ, g.maxZ, g.rows)*g.cols + gridIndex(pos.X, g.minX, g.maxX, g.cols)
+}
+
+// cellRect returns the range of the cell on the XZ plane
+func (g *partitionGrid) cellRect(cell int) (minX, minZ, maxX, maxZ Coord) {
+	col, row := cell%g.cols, cell/g.cols
+	w, h := (g.maxX-g.minX)/Coord(g.cols), (g.maxZ-g.minZ)/Coord(g.rows)
+	return g.minX + w*Coord(col), g.minZ + h*Coord(row), g.minX + w*Coord(col+1), g.minZ + h*Coord(row+1)
+}
+
+// distanceToCell returns the distance from the position to the cell on the XZ plane, 0 if the position is in the cell
+func (g *partitionGrid) distanceToCell(pos Vector3, cell int) Coord {
+	minX, minZ, maxX, maxZ := g.cellRect(cell)
+	return pos.DistanceTo(Vector3{clampCoord(pos.X, minX, maxX), pos.Y, clampCoord(pos.Z, minZ, maxZ)})
+}
+
+// ghostCells returns neighbor cells of the cell which the entity at the position should be mirrored into
+func (g *partitionGrid) ghostCells(pos Vector3, cell int) []int {
+	if g.ghostDistance <= 0 {
+		return nil
+	}
+
+	var cells []int
+	col, row := cell%g.cols, cell/g.cols
+	for r := row - 1; r <= row+1; r++ {
+		for c := col - 1; c <= col+1; c++ {
+			if r < 0 || r >= g.rows || c < 0 || c >= g.cols || (r == row && c == col) {
+				continue
+			}
+			if neighbor := r*g.cols + c; g.distanceToCell(pos, neighbor) <= g.ghostDistance {
+				cells = append(cells, neighbor)
+			}
+		}
+	}
+	return cells
+}
+
+func containsCell(cells []int, cell int) bool {
+	for _, c := range cells {
+		if c == cell {
+			return true
+		}
+	}
+	return false
+}
+
+// cellPartition is the partition state of a cell space
+//
+// An entity migrating between cells is mirrored by both the old and the new cell for a while, and messages from them
+// to a neighbor cell are not ordered. Ghosts keep the partition generation of the entity in the cell which mirrors
+// them, and messages of older generations are ignored.
+type cellPartition struct {
+	partitionGrid
+	worldID       common.EntityID
+	cell          int
+	ghosts        map[common.EntityID]*Entity      // ghosts of entities in neighbor cells
+	removedGhosts map[common.EntityID]removedGhost // generations of recently removed ghosts
+	ghosted       map[common.EntityID]*ghostInfo   // entities in this cell which are mirrored into neighbor cells
+}
+
+type ghostInfo struct {
+	cells []int
+	gen   uint64
+	pos   Vector3
+	yaw   Yaw
+}
+
+type removedGhost struct {
+	gen        uint64
+	removeTime time.Time
+}
+
+// IsGhost returns if the entity is a ghost mirrored from a neighbor cell of partitioned space
+//
+// Ghosts are only for AOI, calls to the entity ID always reach the real entity.
+func (e *Entity) IsGhost() bool {
+	return e.ghost
+}
+
+// GetPartitionWorldID returns the world ID of the partitioned space which the space is a cell of, or empty if the space is not partitioned
+func (space *Space) GetPartitionWorldID() common.EntityID {
+	if space.partition == nil {
+		return ""
+	}
+	return space.partition.worldID
+}
+
+func (space *Space) initPartition() {
+	partition := spacePartitions[space.Kind]
+	worldID := common.EntityID(space.GetStr(_SPACE_PARTITION_WORLD_KEY))
+	if partition == nil || worldID == "" {
+		return
+	}
+
+	space.partition = &cellPartition{
+		partitionGrid: newPartitionGrid(partition, space.I),
+		worldID:       worldID,
+		cell:          int(space.GetInt(_SPACE_PARTITION_CELL_KEY)),
+		ghosts:        map[common.EntityID]*Entity{},
+		removedGhosts: map[common.EntityID]removedGhost{},
+		ghosted:       map[common.EntityID]*ghostInfo{},
+	}
+	space.addRawTimer(_PARTITION_CHECK_INTERVAL, space.checkPartition)
+	gwlog.Infof("%s is cell %d of partitioned space %s", space, space.partition.cell, worldID)
+}
+
+// checkPartition migrates entities which moved out of the cell, and mirrors entities near borders into neighbor cells
+func (space *Space) checkPartition() {
+	p := space.partition
+	for e := range space.entities {
+		if e.isEnteringSpace() {
+			continue
+		}
+
+		// entities migrate only when they are far enough from the cell, so that moving along borders does not
+		// cause migrations back and forth. They are still mirrored into the cell they are in.
+		if p.distanceToCell(e.Position, p.cell) > p.ghostDistance/2 {
+			target := p.cellAt(e.Position)
+			gwlog.Debugf("%s: %s moved to cell %d at %s", space, e, target, e.Position)
+			e.EnterSpace(partitionCellID(p.worldID, target), e.Position)
+			continue
+		}
+
+		if e.IsUseAOI() {
+			space.updateGhostsOf(e)
+		}
+	}
+
+	for eid, info := range p.ghosted {
+		if e := entityManager.get(eid); e == nil || e.Space != space {
+			space.removeGhostsFrom(eid, info)
+			delete(p.ghosted, eid)
+		}
+	}
+
+	now := time.Now()
+	for eid, removed := range p.removedGhosts {
+		if now.Sub(removed.removeTime) >= _REMOVED_GHOST_TTL {
+			delete(p.removedGhosts, eid)
+		}
+	}
+}
+
+func (space *Space) updateGhostsOf(e *Entity) {
+	p := space.partition
+	cells := p.ghostCells(e.Position, p.cell)
+	attrsDirty := e.ghostAttrsDirty
+	e.ghostAttrsDirty = false
+	info := p.ghosted[e.ID]
+	if info == nil {
+		if len(cells) == 0 {
+			return
+		}
+		info = &ghostInfo{}
+		p.ghosted[e.ID] = info
+	}
+
+	for _, cell := range info.cells {
+		if !containsCell(cells, cell) {
+			space.Call(partitionCellID(p.worldID, cell), "RemoveGhost", e.ID, info.gen)
+		}
+	}
+
+	moved := info.pos != e.Position || info.yaw != e.yaw
+	pos := e.Position
+	var attrs map[string]interface{}
+	for _, cell := range cells {
+		if !containsCell(info.cells, cell) || attrsDirty {
+			// all attributes are mirrored when the ghost is created or attributes are changed
+			if attrs == nil {
+				attrs = e.getAllClientData()
+			}
+			space.Call(partitionCellID(p.worldID, cell), "UpdateGhost", e.ID, e.TypeName, e.partitionGen, pos.X, pos.Y, pos.Z, e.yaw, attrs)
+		} else if moved {
+			space.Call(partitionCellID(p.worldID, cell), "UpdateGhost", e.ID, e.TypeName, e.partitionGen, pos.X, pos.Y, pos.Z, e.yaw)
+		}
+	}
+
+	if len(cells) == 0 {
+		delete(p.ghosted, e.ID)
+		return
+	}
+	info.cells, info.gen, info.pos, info.yaw = cells, e.partitionGen, e.Position, e.yaw
+}
+
+func (space *Space) removeGhostsFrom(eid common.EntityID, info *ghostInfo) {
+	for _, cell := range info.cells {
+		space.Call(partitionCellID(space.partition.worldID, cell), "RemoveGhost", eid, info.gen)
+	}
+}
+
+// UpdateGhost is called by neighbor cells of partitioned space to create or move the ghost of the entity in this cell
+//
+// attrs is nil if only the position is changed.
+func (space *Space) UpdateGhost(eid common.EntityID, typeName string, gen uint64, x, y, z Coord, yaw Yaw, attrs map[string]interface{}) {
+	p := space.partition
+	if p == nil {
+		gwlog.Warnf("%s.UpdateGhost: space is not partitioned", space)
+		return
+	}
+	if e := entityManager.get(eid); e != nil && e.Space == space {
+		// the real entity already entered this cell
+		return
+	}
+	if removed, ok := p.removedGhosts[eid]; ok && gen < removed.gen {
+		// late message from the old cell of the entity
+		return
+	}
+
+	pos := Vector3{x, y, z}
+	ghost := p.ghosts[eid]
+	if ghost == nil {
+		if attrs == nil {
+			// the ghost is removed, and can not be created without attributes
+			return
+		}
+		ghost = newGhostEntity(typeName, eid, attrs)
+		if ghost == nil {
+			return
+		}
+		p.ghosts[eid] = ghost
+		delete(p.removedGhosts, eid)
+		ghost.partitionGen = gen
+		ghost.Space = space
+		ghost.Position = pos
+		ghost.yaw = yaw
+		if space.aoiMgr != nil {
+			space.aoiMgr.Enter(ghost, space.aoiDistanceOf(ghost), pos.X, pos.Z)
+			aoiEntityCountMetric.Inc()
+		}
+		return
+	}
+
+	if gen < ghost.partitionGen {
+		// late message from the old cell of the entity
+		return
+	}
+	ghost.partitionGen = gen
+	if attrs != nil {
+		for _, key := range ghost.Attrs.Keys() {
+			if _, ok := attrs[key]; !ok {
+				ghost.Attrs.Del(key)
+			}
+		}
+		ghost.Attrs.AssignMap(attrs) // changes are synced to clients of neighbors
+	}
+	ghost.Position = pos
+	ghost.yaw = yaw
+	if space.aoiMgr != nil {
+		space.aoiMgr.Moved(ghost, pos.X, pos.Z)
+	}
+	ghost.syncInfoFlag |= sifSyncNeighborClients
+}
+
+// RemoveGhost is called by neighbor cells of partitioned space to remove the ghost of the entity in this cell
+func (space *Space) RemoveGhost(eid common.EntityID, gen uint64) {
+	p := space.partition
+	if p == nil {
+		gwlog.Warnf("%s.RemoveGhost: space is not partitioned", space)
+		return
+	}
+	if ghost := p.ghosts[eid]; ghost != nil && gen < ghost.partitionGen {
+		// late message from the old cell of the entity
+		return
+	}
+	if removed, ok := p.removedGhosts[eid]; ok && gen < removed.gen {
+		return
+	}
+
+	space.removeGhost(eid)
+	p.removedGhosts[eid] = removedGhost{gen, time.Now()}
+}
+
+func (space *Space) removeGhost(eid common.EntityID) {
+	ghost := space.partition.ghosts[eid]
+	if ghost == nil {
+		return
+	}
+
+	delete(space.partition.ghosts, eid)
+	if space.aoiMgr != nil {
+		space.aoiMgr.Leave(ghost)
+		aoiEntityCountMetric.Dec()
+	}
+	ghost.Space = nil
+	ghost.destroyed = true
+}
+
+// destroyPartition removes ghosts in this cell and ghosts of entities in this cell from neighbor cells
+func (space *Space) destroyPartition() {
+	p := space.partition
+	for eid := range p.ghosts {
+		space.removeGhost(eid)
+	}
+	for eid, info := range p.ghosted {
+		space.removeGhostsFrom(eid, info)
+	}
+	p.ghosted = map[common.EntityID]*ghostInfo{}
+}
+
+// newGhostEntity creates a ghost entity which is not managed by entity manager and is unknown to dispatchers
+func newGhostEntity(typeName string, eid common.EntityID, attrs map[string]interface{}) *Entity {
+	desc := registeredEntityTypes[typeName]
+	if desc == nil {
+		gwlog.Errorf("create ghost %s of unknown type %s", eid, typeName)
+		return nil
+	}
+	if !desc.useAOI {
+		gwlog.Errorf("create ghost %s: type %s is not using AOI", eid, typeName)
+		return nil
+	}
+
+	entityInstance := reflect.New(desc.entityType)
+	ghost := reflect.Indirect(entityInstance).FieldByName("Entity").Addr().Interface().(*Entity)
+	ghost.init(typeName, eid, entityInstance)
+	ghost.ghost = true
+	ghost.Attrs.AssignMap(attrs)
+	return ghost
+}
+
+// forEachGhost visits ghosts in all cells of partitioned spaces on this game
+func forEachGhost(f func(ghost *Entity)) {
+	for _, space := range spaceManager.spaces {
+		if space.partition == nil {
+			continue
+		}
+		for _, ghost := range space.partition.ghosts {
+			f(ghost)
+		}
+	}
+}
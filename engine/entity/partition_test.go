@@ -0,0 +1,72 @@
+package entity
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/sagacao/goworld/engine/common"
+)
+
+func TestPartitionGrid(t *testing.T) {
+	space := &Space{}
+	grid := newPartitionGrid(&SpacePartition{Cols: 2, Rows: 2, GhostDistance: 50}, space)
+
+	for _, c := range []struct {
+		pos  Vector3
+		cell int
+	}{
+		{Vector3{-500, 0, -500}, 0},
+		{Vector3{500, 0, -500}, 1},
+		{Vector3{-500, 0, 500}, 2},
+		{Vector3{500, 0, 500}, 3},
+		{Vector3{0, 0, 0}, 3},
+		{Vector3{-5000, 0, 5000}, 2},
+		{Vector3{5000, 0, 5000}, 3},
+	} {
+		if cell := grid.cellAt(c.pos); cell != c.cell {
+			t.Errorf("cell at %s should be %d, but got %d", c.pos, c.cell, cell)
+		}
+	}
+
+	if minX, minZ, maxX, maxZ := grid.cellRect(1); minX != 0 || minZ != -1000 || maxX != 1000 || maxZ != 0 {
+		t.Errorf("wrong rect of cell 1: (%v, %v) - (%v, %v)", minX, minZ, maxX, maxZ)
+	}
+	if d := grid.distanceToCell(Vector3{-30, 0, -500}, 1); d != 30 {
+		t.Errorf("distance to cell 1 should be 30, but got %v", d)
+	}
+	if d := grid.distanceToCell(Vector3{30, 0, -500}, 1); d != 0 {
+		t.Errorf("distance to cell 1 should be 0, but got %v", d)
+	}
+
+	for _, c := range []struct {
+		pos   Vector3
+		cells []int
+	}{
+		{Vector3{-500, 0, -500}, nil},
+		{Vector3{-30, 0, -500}, []int{1}},
+		{Vector3{-30, 0, -30}, []int{1, 2, 3}},
+		{Vector3{-40, 0, -40}, []int{1, 2}}, // the corner of cell 3 is farther than ghost distance
+	} {
+		if cells := grid.ghostCells(c.pos, 0); !reflect.DeepEqual(cells, c.cells) {
+			t.Errorf("ghost cells at %s should be %v, but got %v", c.pos, c.cells, cells)
+		}
+	}
+
+	grid.ghostDistance = 0
+	if cells := grid.ghostCells(Vector3{-1, 0, -1}, 0); cells != nil {
+		t.Errorf("ghosts should be disabled, but got %v", cells)
+	}
+}
+
+func TestPartitionCellID(t *testing.T) {
+	worldID := common.GenEntityID()
+	if partitionCellID(worldID, 1) != partitionCellID(worldID, 1) {
+		t.Fatalf("cell ID should be fixed")
+	}
+	if partitionCellID(worldID, 1) == partitionCellID(worldID, 2) || partitionCellID(worldID, 1) == partitionCellID(common.GenEntityID(), 1) {
+		t.Fatalf("cell IDs should be different")
+	}
+	if len(partitionCellID(worldID, 1)) != common.ENTITYID_LENGTH {
+		t.Fatalf("cell ID should be a valid entity ID")
+	}
+}
@@ -0,0 +1,145 @@
+package entity
+
+import (
+	"encoding/base64"
+	"time"
+
+	"github.com/sagacao/goworld/engine/gwlog"
+)
+
+const (
+	// _PERSISTENT_TIMERS_KEY is the key of persistent timers in persistent data
+	_PERSISTENT_TIMERS_KEY = "_PT"
+	// max number of missed intervals fired for a repeat timer with CatchUpAll policy
+	_MAX_TIMER_CATCH_UP = 100
+)
+
+// TimerCatchUpPolicy decides how persistent timers which are overdue when the entity is loaded are fired
+type TimerCatchUpPolicy int
+
+const (
+	// CatchUpOnce fires overdue timers once immediately, and repeat timers continue repeating from then
+	CatchUpOnce TimerCatchUpPolicy = iota
+	// CatchUpAll fires repeat timers once for each missed interval immediately, at most 100 times
+	CatchUpAll
+	// CatchUpSkip drops overdue callbacks, and repeat timers skip missed intervals and keep their phase
+	CatchUpSkip
+)
+
+// SetTimerCatchUpPolicy sets how overdue persistent timers of this type are fired when entities are loaded, default to CatchUpOnce
+func (desc *EntityTypeDesc) SetTimerCatchUpPolicy(policy TimerCatchUpPolicy) *EntityTypeDesc {
+	desc.timerCatchUpPolicy = policy
+	return desc
+}
+
+// AddPersistentCallback adds a one-time callback which is saved with the entity
+//
+// Unlike AddCallback, the callback is not lost when the entity is destroyed and loaded later, so it can be used for
+// buff expirations and build queues. Overdue callbacks are fired when the entity is loaded according to the timer
+// catch-up policy of the entity type. Arguments must be serializable since they are saved.
+func (e *Entity) AddPersistentCallback(d time.Duration, method string, args ...interface{}) EntityTimerID {
+	return e.addCallback(d, method, args, true)
+}
+
+// AddPersistentTimer adds a repeat timer which is saved with the entity
+//
+// See AddPersistentCallback for details
+func (e *Entity) AddPersistentTimer(d time.Duration, method string, args ...interface{}) EntityTimerID {
+	return e.addTimer(d, method, args, true)
+}
+
+// putPersistentTimersData puts persistent timers in persistent data, returns false if there is no persistent timer
+func (e *Entity) putPersistentTimersData(data map[string]interface{}) bool {
+	var timers []*entityTimerInfo
+	for _, t := range e.timers {
+		if t.Persistent {
+			timers = append(timers, t)
+		}
+	}
+	if len(timers) == 0 {
+		return false
+	}
+
+	b, err := timersPacker.PackMsg(timers, nil)
+	if err != nil {
+		gwlog.Errorf("%s: dump persistent timers failed: %s", e, err)
+		return false
+	}
+	data[_PERSISTENT_TIMERS_KEY] = base64.StdEncoding.EncodeToString(b)
+	return true
+}
+
+// loadPersistentTimersData loads persistent timers from persistent data and removes them from data
+func (e *Entity) loadPersistentTimersData(data map[string]interface{}) {
+	v, ok := data[_PERSISTENT_TIMERS_KEY]
+	if !ok {
+		return
+	}
+
+	delete(data, _PERSISTENT_TIMERS_KEY)
+	s, _ := v.(string)
+	b, err := base64.StdEncoding.DecodeString(s)
+	var timers []*entityTimerInfo
+	if err == nil {
+		err = timersPacker.UnpackMsg(b, &timers)
+	}
+	if err != nil {
+		gwlog.Errorf("%s: load persistent timers failed: %s", e, err)
+		return
+	}
+
+	now := time.Now()
+	for _, t := range timers {
+		e.restorePersistentTimer(t, now)
+	}
+	gwlog.Debugf("%s: %d persistent timers loaded", e, len(timers))
+}
+
+// restorePersistentTimer schedules the loaded timer, overdue timers are fired according to the catch-up policy
+func (e *Entity) restorePersistentTimer(t *entityTimerInfo, now time.Time) {
+	t.Persistent = true
+	extraFires, ok := t.catchUp(e.typeDesc.timerCatchUpPolicy, now)
+	if !ok {
+		gwlog.Debugf("%s: overdue persistent callback %s is dropped", e, t.Method)
+		e.persistentTimersDirty = true
+		return
+	}
+
+	tid := e.genTimerId()
+	e.timers[tid] = t
+	t.rawTimer = e.addRawCallback(t.FireTime.Sub(now), func() {
+		for i := 0; i < extraFires; i++ {
+			e.onCallFromLocal(t.Method, t.Args)
+		}
+		e.triggerTimer(tid, false)
+	})
+}
+
+// catchUp applies the catch-up policy to the loaded timer, returns the number of missed fires which should be fired
+// in addition to the next fire, or false if the timer should be dropped
+func (t *entityTimerInfo) catchUp(policy TimerCatchUpPolicy, now time.Time) (int, bool) {
+	overdue := now.Sub(t.FireTime)
+	if overdue <= 0 {
+		return 0, true
+	}
+
+	if !t.Repeat {
+		return 0, policy != CatchUpSkip
+	}
+	if t.RepeatInterval <= 0 {
+		return 0, true
+	}
+
+	missed := int(overdue/t.RepeatInterval) + 1
+	switch policy {
+	case CatchUpAll:
+		if missed > _MAX_TIMER_CATCH_UP {
+			missed = _MAX_TIMER_CATCH_UP
+		}
+		return missed - 1, true
+	case CatchUpSkip:
+		// the next fire time after now which keeps the phase of the timer
+		t.FireTime = t.FireTime.Add(t.RepeatInterval * time.Duration(missed))
+	}
+	return 0, true
+}
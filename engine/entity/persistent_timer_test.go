@@ -0,0 +1,89 @@
+package entity
+
+import (
+	"testing"
+	"time"
+)
+
+type TestPersistentTimerEntity struct {
+	Entity
+}
+
+func (e *TestPersistentTimerEntity) DescribeEntityType(*EntityTypeDesc) {
+}
+
+func (e *TestPersistentTimerEntity) Expire(buff string) {
+}
+
+func TestPersistentTimersData(t *testing.T) {
+	RegisterEntity("TestPersistentTimerEntity", &TestPersistentTimerEntity{}, false)
+	e := CreateEntityLocally("TestPersistentTimerEntity", nil)
+	e.AddCallback(time.Minute, "Expire", "temp")
+
+	data := map[string]interface{}{}
+	if e.putPersistentTimersData(data) {
+		t.Fatalf("non-persistent timers should not be saved")
+	}
+
+	e.AddPersistentCallback(time.Minute, "Expire", "haste")
+	e.AddPersistentTimer(time.Second, "Expire", "poison")
+	if !e.persistentTimersDirty {
+		t.Fatalf("persistent timers should be dirty")
+	}
+	if !e.putPersistentTimersData(data) {
+		t.Fatalf("persistent timers should be saved")
+	}
+
+	other := CreateEntityLocally("TestPersistentTimerEntity", nil)
+	other.loadPersistentTimersData(data)
+	if _, ok := data[_PERSISTENT_TIMERS_KEY]; ok {
+		t.Fatalf("persistent timers should be removed from data after loading")
+	}
+	if len(other.timers) != 2 {
+		t.Fatalf("2 persistent timers should be loaded, but got %d", len(other.timers))
+	}
+	for _, timer := range other.timers {
+		if !timer.Persistent || timer.Method != "Expire" || timer.rawTimer == nil {
+			t.Fatalf("wrong persistent timer loaded: %+v", timer)
+		}
+		if arg := timer.Args[0]; arg != "haste" && arg != "poison" {
+			t.Fatalf("wrong timer args: %v", timer.Args)
+		}
+	}
+
+	for tid := range other.timers {
+		other.CancelTimer(tid)
+	}
+	updates, deletes := other.getDirtyPersistentData()
+	if _, ok := updates[_PERSISTENT_TIMERS_KEY]; ok || len(deletes) != 1 || deletes[0] != _PERSISTENT_TIMERS_KEY {
+		t.Fatalf("persistent timers should be deleted: updates=%v, deletes=%v", updates, deletes)
+	}
+}
+
+func TestPersistentTimerCatchUp(t *testing.T) {
+	now := time.Now()
+	for _, c := range []struct {
+		policy     TimerCatchUpPolicy
+		timer      entityTimerInfo
+		extraFires int
+		ok         bool
+		fireTime   time.Time
+	}{
+		{CatchUpOnce, entityTimerInfo{FireTime: now.Add(time.Second)}, 0, true, now.Add(time.Second)},
+		{CatchUpSkip, entityTimerInfo{FireTime: now.Add(time.Second)}, 0, true, now.Add(time.Second)},
+		{CatchUpOnce, entityTimerInfo{FireTime: now.Add(-time.Hour)}, 0, true, now.Add(-time.Hour)},
+		{CatchUpAll, entityTimerInfo{FireTime: now.Add(-time.Hour)}, 0, true, now.Add(-time.Hour)},
+		{CatchUpSkip, entityTimerInfo{FireTime: now.Add(-time.Hour)}, 0, false, now.Add(-time.Hour)},
+		{CatchUpOnce, entityTimerInfo{FireTime: now.Add(-25 * time.Second), Repeat: true, RepeatInterval: 10 * time.Second}, 0, true, now.Add(-25 * time.Second)},
+		{CatchUpAll, entityTimerInfo{FireTime: now.Add(-25 * time.Second), Repeat: true, RepeatInterval: 10 * time.Second}, 2, true, now.Add(-25 * time.Second)},
+		{CatchUpAll, entityTimerInfo{FireTime: now.Add(-time.Hour), Repeat: true, RepeatInterval: time.Second}, _MAX_TIMER_CATCH_UP - 1, true, now.Add(-time.Hour)},
+		{CatchUpSkip, entityTimerInfo{FireTime: now.Add(-25 * time.Second), Repeat: true, RepeatInterval: 10 * time.Second}, 0, true, now.Add(5 * time.Second)},
+	} {
+		timer := c.timer
+		extraFires, ok := timer.catchUp(c.policy, now)
+		if extraFires != c.extraFires || ok != c.ok || !timer.FireTime.Equal(c.fireTime) {
+			t.Errorf("policy %d, timer %+v: expect (%d, %v, %s), but got (%d, %v, %s)", c.policy, c.timer,
+				c.extraFires, c.ok, c.fireTime.Sub(now), extraFires, ok, timer.FireTime.Sub(now))
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package entity
+
+import (
+	"github.com/sagacao/goworld/engine/common"
+	"github.com/sagacao/goworld/engine/gwlog"
+)
+
+// SetRebalanceable sets if entities of this type can be migrated to other games automatically when the game is overloaded
+//
+// Only entities in the nil space are migrated, and they enter the nil space of the target game.
+func (desc *EntityTypeDesc) SetRebalanceable(rebalanceable bool) *EntityTypeDesc {
+	desc.rebalanceable = rebalanceable
+	return desc
+}
+
+// selectRebalanceEntities selects at most count entities which can be migrated for rebalancing
+func selectRebalanceEntities(count int) []*Entity {
+	var entities []*Entity
+	for _, e := range entityManager.entities {
+		if len(entities) >= count {
+			break
+		}
+		if !e.typeDesc.rebalanceable || e.typeDesc.isService || e.IsSpaceEntity() || e.IsDestroyed() ||
+			e.Space == nil || !e.Space.IsNil() || e.isEnteringSpace() {
+			continue
+		}
+		entities = append(entities, e)
+	}
+	return entities
+}
+
+// OnRebalanceEntities is called by engine when the dispatcher requests to migrate entities to the target game for rebalancing
+func OnRebalanceEntities(targetGameID uint16, count int, dryRun bool) {
+	targetSpaceID := GetNilSpaceID(targetGameID)
+	if nilSpace == nil || nilSpace.ID == targetSpaceID {
+		gwlog.Warnf("rebalance entities: invalid target game%d", targetGameID)
+		return
+	}
+
+	entities := selectRebalanceEntities(count)
+	if dryRun {
+		eids := make([]common.EntityID, len(entities))
+		for i, e := range entities {
+			eids[i] = e.ID
+		}
+		gwlog.Infof("rebalance entities (dry run): %d entities would be migrated to game%d: %v", len(entities), targetGameID, eids)
+		return
+	}
+
+	gwlog.Infof("rebalance entities: migrating %d entities to game%d", len(entities), targetGameID)
+	for _, e := range entities {
+		e.EnterSpace(targetSpaceID, e.Position)
+	}
+}
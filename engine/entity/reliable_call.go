@@ -0,0 +1,432 @@
+package entity
+
+import (
+	"encoding/base64"
+
+	"github.com/pkg/errors"
+	"github.com/sagacao/goworld/engine/common"
+	"github.com/sagacao/goworld/engine/consts"
+	"github.com/sagacao/goworld/engine/dispatchercluster"
+	"github.com/sagacao/goworld/engine/gwlog"
+	"github.com/sagacao/goworld/engine/gwutils"
+	"github.com/sagacao/goworld/engine/netutil"
+	"github.com/sagacao/goworld/engine/post"
+	"github.com/sagacao/goworld/engine/storage/storage_common"
+)
+
+const (
+	// _RELIABLE_CALLS_KEY is the key of reliable calls state in persistent data
+	_RELIABLE_CALLS_KEY = "_RC"
+)
+
+// reliableCall is a reliable call which is sent by the caller, or received out of order by the callee
+type reliableCall struct {
+	Seq    uint64   `msgpack:"S"`
+	Method string   `msgpack:"M"`
+	Args   [][]byte `msgpack:"A"` // arguments packed by MSG_PACKER
+}
+
+// reliableCallOutbox keeps reliable calls from the caller entity to one callee until they are acknowledged
+type reliableCallOutbox struct {
+	LastSeq  uint64          `msgpack:"L"` // sequence number of the last call
+	SavedSeq uint64          `msgpack:"V"` // calls till SavedSeq are saved with the caller and can be sent
+	Calls    []*reliableCall `msgpack:"C"` // calls not acknowledged yet
+}
+
+// reliableCallInbox keeps the state of reliable calls from one caller to the callee entity
+type reliableCallInbox struct {
+	LastSeq uint64 `msgpack:"L"` // sequence number of the last applied call
+	AckSeq  uint64 `msgpack:"A"` // calls till AckSeq are saved with the callee and acknowledged
+	pending map[uint64]*reliableCall
+}
+
+// reliableCallsData is the reliable calls state of entity, which is saved and migrated with the entity
+type reliableCallsData struct {
+	Outboxes map[common.EntityID]*reliableCallOutbox `msgpack:"O,omitempty"`
+	Inboxes  map[common.EntityID]*reliableCallInbox  `msgpack:"I,omitempty"`
+}
+
+func (rcd *reliableCallsData) isEmpty() bool {
+	return len(rcd.Outboxes) == 0 && len(rcd.Inboxes) == 0
+}
+
+// CallReliable calls the method of other entity reliably
+//
+// Reliable calls from one entity to another are applied by the callee exactly once and in the order of calling, even if
+// either entity migrates, is frozen, or is reloaded from storage: calls are retransmitted until they are acknowledged by
+// the callee, and duplicated calls are dropped by the callee. Persistent callers send calls only after they are saved,
+// and persistent callees acknowledge calls only after the changes made by calls are saved. Calls to entities which are
+// not loaded are retransmitted until the callee is loaded. Calls of non-persistent callers are lost when the caller is
+// destroyed.
+//
+// Callees keep the sequence number of every caller, so reliable calls should be used for important calls (e.g.
+// transferring items or money) between a limited set of entities.
+func (e *Entity) CallReliable(id common.EntityID, method string, args ...interface{}) {
+	packedArgs := make([][]byte, len(args))
+	for i, arg := range args {
+		data, err := netutil.MSG_PACKER.PackMsg(arg, nil)
+		if err != nil {
+			gwlog.Panicf("%s.CallReliable %s.%s: pack argument %d failed: %s", e, id, method, i, err)
+		}
+		packedArgs[i] = data
+	}
+
+	if e.reliableCalls.Outboxes == nil {
+		e.reliableCalls.Outboxes = map[common.EntityID]*reliableCallOutbox{}
+	}
+	outbox := e.reliableCalls.Outboxes[id]
+	if outbox == nil {
+		outbox = &reliableCallOutbox{}
+		e.reliableCalls.Outboxes[id] = outbox
+	}
+
+	outbox.LastSeq += 1
+	outbox.Calls = append(outbox.Calls, &reliableCall{
+		Seq:    outbox.LastSeq,
+		Method: method,
+		Args:   packedArgs,
+	})
+	e.reliableCallsDirty = true
+	e.setupReliableCallTimer()
+	e.commitReliableCalls()
+}
+
+// commitReliableCalls sends new reliable calls and acknowledges applied calls
+//
+// Persistent entities are saved before sending and acknowledging. Calls and acks in the same tick are committed together.
+func (e *Entity) commitReliableCalls() {
+	if !e.IsPersistent() {
+		e.onReliableCallsCommitted(e.getUncommittedReliableCalls())
+		return
+	}
+
+	if e.reliableCallsCommitting {
+		return
+	}
+
+	e.reliableCallsCommitting = true
+	e.Post(func() {
+		e.reliableCallsCommitting = false
+		if e.IsDestroyed() {
+			return
+		}
+
+		commit := e.getUncommittedReliableCalls()
+		entityID := e.ID
+		e.save(func(err error) {
+			if err != nil && errors.Cause(err) != storagecommon.ErrDuplicateIndexValue {
+				// changes of applied calls are not saved, they are committed again later
+				gwlog.Errorf("%s.%s: commit reliable calls failed: %s", e.TypeName, entityID, err)
+				if e := entityManager.get(entityID); e != nil {
+					e.allAttrsDirty, e.reliableCallsDirty = true, true
+				}
+				return
+			}
+
+			if e := entityManager.get(entityID); e != nil {
+				e.onReliableCallsCommitted(commit)
+				return
+			}
+
+			// the callee is migrated or destroyed, but changes of applied calls are already saved
+			for callerID, seq := range commit.acks {
+				sendReliableCallAck(callerID, entityID, seq)
+			}
+		})
+	})
+}
+
+// reliableCallsCommit is sequence numbers of calls to be sent and acknowledged
+type reliableCallsCommit struct {
+	calls map[common.EntityID]uint64
+	acks  map[common.EntityID]uint64
+}
+
+func (e *Entity) getUncommittedReliableCalls() (commit reliableCallsCommit) {
+	commit.calls = map[common.EntityID]uint64{}
+	commit.acks = map[common.EntityID]uint64{}
+	for calleeID, outbox := range e.reliableCalls.Outboxes {
+		if outbox.SavedSeq < outbox.LastSeq {
+			commit.calls[calleeID] = outbox.LastSeq
+		}
+	}
+	for callerID, inbox := range e.reliableCalls.Inboxes {
+		if inbox.AckSeq < inbox.LastSeq {
+			commit.acks[callerID] = inbox.LastSeq
+		}
+	}
+	return
+}
+
+func (e *Entity) onReliableCallsCommitted(commit reliableCallsCommit) {
+	for calleeID, seq := range commit.calls {
+		outbox := e.reliableCalls.Outboxes[calleeID]
+		if outbox != nil && outbox.SavedSeq < seq {
+			outbox.SavedSeq = seq
+			e.sendReliableCalls(calleeID, outbox)
+		}
+	}
+
+	for callerID, seq := range commit.acks {
+		inbox := e.reliableCalls.Inboxes[callerID]
+		if inbox != nil && inbox.AckSeq < seq {
+			inbox.AckSeq = seq
+		}
+		sendReliableCallAck(callerID, e.ID, seq)
+	}
+}
+
+// sendReliableCalls sends saved calls which are not acknowledged to the callee
+func (e *Entity) sendReliableCalls(calleeID common.EntityID, outbox *reliableCallOutbox) {
+	for _, call := range outbox.Calls {
+		if call.Seq > outbox.SavedSeq {
+			break
+		}
+		sendReliableCall(calleeID, e.ID, call)
+	}
+}
+
+func sendReliableCall(calleeID common.EntityID, callerID common.EntityID, call *reliableCall) {
+	if consts.OPTIMIZE_LOCAL_ENTITY_CALL {
+		e := entityManager.get(calleeID)
+		if e != nil { // this entity is local, just call entity directly
+			e.Post(func() {
+				if !e.IsDestroyed() {
+					e.onReliableCall(callerID, call)
+				}
+			})
+			return
+		}
+	}
+
+	dispatchercluster.SelectByEntityID(calleeID).SendCallEntityMethodReliable(calleeID, call.Method, call.Args, callerID, call.Seq)
+}
+
+func sendReliableCallAck(callerID common.EntityID, calleeID common.EntityID, seq uint64) {
+	if consts.OPTIMIZE_LOCAL_ENTITY_CALL {
+		e := entityManager.get(callerID)
+		if e != nil { // caller is local, just ack directly
+			e.Post(func() {
+				if !e.IsDestroyed() {
+					e.onReliableCallAck(calleeID, seq)
+				}
+			})
+			return
+		}
+	}
+
+	dispatchercluster.SelectByEntityID(callerID).SendReliableCallAck(callerID, calleeID, seq)
+}
+
+// onReliableCall applies the reliable call if all previous calls from the caller are applied
+func (e *Entity) onReliableCall(callerID common.EntityID, call *reliableCall) {
+	if e.reliableCalls.Inboxes == nil {
+		e.reliableCalls.Inboxes = map[common.EntityID]*reliableCallInbox{}
+	}
+	inbox := e.reliableCalls.Inboxes[callerID]
+	if inbox == nil {
+		inbox = &reliableCallInbox{}
+		e.reliableCalls.Inboxes[callerID] = inbox
+	}
+
+	if call.Seq <= inbox.LastSeq {
+		// duplicated call, acknowledge again in case that the previous ack is lost
+		if inbox.AckSeq > 0 {
+			sendReliableCallAck(callerID, e.ID, inbox.AckSeq)
+		}
+		return
+	}
+
+	if call.Seq > inbox.LastSeq+1 {
+		// previous calls are not received yet, keep the call until they are received
+		if inbox.pending == nil {
+			inbox.pending = map[uint64]*reliableCall{}
+		}
+		if len(inbox.pending) < consts.RELIABLE_CALL_MAX_PENDING {
+			inbox.pending[call.Seq] = call
+		}
+		return
+	}
+
+	for call != nil {
+		e.applyReliableCall(callerID, call)
+		inbox.LastSeq = call.Seq
+		call = inbox.pending[inbox.LastSeq+1]
+		delete(inbox.pending, inbox.LastSeq+1)
+	}
+
+	for seq := range inbox.pending {
+		if seq <= inbox.LastSeq {
+			delete(inbox.pending, seq)
+		}
+	}
+
+	e.reliableCallsDirty = true
+	e.commitReliableCalls()
+}
+
+func (e *Entity) applyReliableCall(callerID common.EntityID, call *reliableCall) {
+	// the call is applied even if it fails, otherwise the failed call blocks all following calls
+	if err := gwutils.CatchPanic(func() {
+		if _, err := e.callRPCFromRemote(call.Method, call.Args, ""); err != nil {
+			gwlog.Errorf("%s: reliable call %s from %s failed: %s", e, call.Method, callerID, err)
+		}
+	}); err != nil {
+		gwlog.TraceError("%s: reliable call %s from %s paniced: %v", e, call.Method, callerID, err)
+	}
+}
+
+// onReliableCallAck removes calls to the callee which are acknowledged
+func (e *Entity) onReliableCallAck(calleeID common.EntityID, seq uint64) {
+	outbox := e.reliableCalls.Outboxes[calleeID]
+	if outbox == nil {
+		return
+	}
+
+	n := 0
+	for n < len(outbox.Calls) && outbox.Calls[n].Seq <= seq {
+		n++
+	}
+	if n == 0 {
+		return
+	}
+
+	// the outbox is kept after all calls are acknowledged, so that sequence numbers of following calls keep increasing
+	outbox.Calls = append([]*reliableCall(nil), outbox.Calls[n:]...)
+	e.reliableCallsDirty = true
+	if !e.hasUnacknowledgedReliableCalls() && e.reliableCallTimer != nil {
+		e.cancelRawTimer(e.reliableCallTimer)
+		e.reliableCallTimer = nil
+	}
+}
+
+func (e *Entity) hasUnacknowledgedReliableCalls() bool {
+	for _, outbox := range e.reliableCalls.Outboxes {
+		if len(outbox.Calls) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// setupReliableCallTimer starts the timer for resending unacknowledged calls
+func (e *Entity) setupReliableCallTimer() {
+	if e.reliableCallTimer != nil {
+		return
+	}
+
+	e.reliableCallTimer = e.addRawTimer(consts.RELIABLE_CALL_RESEND_INTERVAL, e.resendReliableCalls)
+}
+
+func (e *Entity) resendReliableCalls() {
+	for calleeID, outbox := range e.reliableCalls.Outboxes {
+		e.sendReliableCalls(calleeID, outbox)
+	}
+}
+
+// dumpReliableCalls packs the reliable calls state, returns nil if reliable calls are never used
+func (e *Entity) dumpReliableCalls() []byte {
+	if e.reliableCalls.isEmpty() {
+		return nil
+	}
+
+	data, err := timersPacker.PackMsg(e.reliableCalls, nil)
+	if err != nil {
+		gwlog.TraceError("%s dump reliable calls failed: %s", e, err)
+	}
+	return data
+}
+
+// restoreReliableCalls restores the reliable calls state which is migrated or frozen
+func (e *Entity) restoreReliableCalls(data []byte) error {
+	if err := timersPacker.UnpackMsg(data, &e.reliableCalls); err != nil {
+		return err
+	}
+
+	if e.hasUnacknowledgedReliableCalls() {
+		e.setupReliableCallTimer()
+	}
+	// calls and acks which are not committed before migration might not be saved yet
+	for _, outbox := range e.reliableCalls.Outboxes {
+		if outbox.SavedSeq < outbox.LastSeq {
+			e.commitReliableCalls()
+			return nil
+		}
+	}
+	for _, inbox := range e.reliableCalls.Inboxes {
+		if inbox.AckSeq < inbox.LastSeq {
+			e.commitReliableCalls()
+			return nil
+		}
+	}
+	return nil
+}
+
+// putReliableCallsData puts the reliable calls state in persistent data
+func (e *Entity) putReliableCallsData(data map[string]interface{}) {
+	if b := e.dumpReliableCalls(); b != nil {
+		data[_RELIABLE_CALLS_KEY] = base64.StdEncoding.EncodeToString(b)
+	}
+}
+
+// loadReliableCallsData loads the reliable calls state from persistent data and removes it from data
+func (e *Entity) loadReliableCallsData(data map[string]interface{}) {
+	v, ok := data[_RELIABLE_CALLS_KEY]
+	if !ok {
+		return
+	}
+
+	delete(data, _RELIABLE_CALLS_KEY)
+	s, _ := v.(string)
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err == nil {
+		err = timersPacker.UnpackMsg(b, &e.reliableCalls)
+	}
+	if err != nil {
+		gwlog.Errorf("%s: load reliable calls failed: %s", e, err)
+		return
+	}
+
+	// everything loaded from storage is saved
+	for _, outbox := range e.reliableCalls.Outboxes {
+		outbox.SavedSeq = outbox.LastSeq
+	}
+	for _, inbox := range e.reliableCalls.Inboxes {
+		inbox.AckSeq = inbox.LastSeq
+	}
+	if e.hasUnacknowledgedReliableCalls() {
+		e.setupReliableCallTimer()
+		post.Post(func() {
+			if !e.IsDestroyed() {
+				e.resendReliableCalls()
+			}
+		})
+	}
+}
+
+// OnCallReliable is called by engine when reliable method call reaches in the game
+func OnCallReliable(id common.EntityID, method string, args [][]byte, callerID common.EntityID, seq uint64) {
+	e := entityManager.get(id)
+	if e == nil {
+		// entity not found, the call is not acknowledged and will be resent by the caller
+		gwlog.Warnf("OnCallReliable: entity %s is not found while calling %s, call %d from %s is dropped", id, method, seq, callerID)
+		return
+	}
+
+	e.onReliableCall(callerID, &reliableCall{
+		Seq:    seq,
+		Method: method,
+		Args:   args,
+	})
+}
+
+// OnReliableCallAck is called by engine when ack of reliable calls reaches the caller entity in the game
+func OnReliableCallAck(callerID common.EntityID, calleeID common.EntityID, seq uint64) {
+	e := entityManager.get(callerID)
+	if e == nil {
+		gwlog.Warnf("OnReliableCallAck: caller entity %s is not found, ack %d from %s is dropped", callerID, seq, calleeID)
+		return
+	}
+
+	e.onReliableCallAck(calleeID, seq)
+}
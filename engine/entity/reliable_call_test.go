@@ -0,0 +1,108 @@
+package entity
+
+import (
+	"testing"
+
+	"github.com/sagacao/goworld/engine/common"
+	"github.com/sagacao/goworld/engine/netutil"
+	"github.com/sagacao/goworld/engine/post"
+)
+
+type TestReliableCallEntity struct {
+	Entity
+	received []int
+}
+
+func (e *TestReliableCallEntity) DescribeEntityType(*EntityTypeDesc) {
+}
+
+func (e *TestReliableCallEntity) Receive(n int) {
+	e.received = append(e.received, n)
+}
+
+func packReliableCallArgs(t *testing.T, args ...interface{}) [][]byte {
+	packedArgs := make([][]byte, len(args))
+	for i, arg := range args {
+		data, err := netutil.MSG_PACKER.PackMsg(arg, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packedArgs[i] = data
+	}
+	return packedArgs
+}
+
+func TestCallReliable(t *testing.T) {
+	RegisterEntity("TestReliableCallEntity", &TestReliableCallEntity{}, false)
+	caller := CreateEntityLocally("TestReliableCallEntity", nil)
+	callee := CreateEntityLocally("TestReliableCallEntity", nil)
+
+	caller.CallReliable(callee.ID, "Receive", 1)
+	caller.CallReliable(callee.ID, "Receive", 2)
+	post.Tick()
+	if received := callee.I.(*TestReliableCallEntity).received; len(received) != 2 || received[0] != 1 || received[1] != 2 {
+		t.Fatalf("calls should be received in order, but received %v", received)
+	}
+	if outbox := caller.reliableCalls.Outboxes[callee.ID]; outbox.LastSeq != 2 || len(outbox.Calls) != 0 {
+		t.Fatalf("calls should be acknowledged: last=%d, calls=%d", outbox.LastSeq, len(outbox.Calls))
+	}
+
+	// resent calls are not applied again
+	callee.onReliableCall(caller.ID, &reliableCall{Seq: 1, Method: "Receive", Args: packReliableCallArgs(t, 1)})
+	post.Tick()
+	if received := callee.I.(*TestReliableCallEntity).received; len(received) != 2 {
+		t.Fatalf("duplicated call should be dropped, but received %v", received)
+	}
+}
+
+func TestReliableCallsOutOfOrder(t *testing.T) {
+	RegisterEntity("TestReliableCallOrderEntity", &TestReliableCallEntity{}, false)
+	callee := CreateEntityLocally("TestReliableCallOrderEntity", nil)
+	callerID := CreateEntityLocally("TestReliableCallOrderEntity", nil).ID
+
+	callee.onReliableCall(callerID, &reliableCall{Seq: 3, Method: "Receive", Args: packReliableCallArgs(t, 3)})
+	callee.onReliableCall(callerID, &reliableCall{Seq: 2, Method: "Receive", Args: packReliableCallArgs(t, 2)})
+	if received := callee.I.(*TestReliableCallEntity).received; len(received) != 0 {
+		t.Fatalf("calls should wait for previous calls, but received %v", received)
+	}
+
+	callee.onReliableCall(callerID, &reliableCall{Seq: 1, Method: "Receive", Args: packReliableCallArgs(t, 1)})
+	callee.onReliableCall(callerID, &reliableCall{Seq: 2, Method: "Receive", Args: packReliableCallArgs(t, 2)})
+	if received := callee.I.(*TestReliableCallEntity).received; len(received) != 3 || received[0] != 1 || received[1] != 2 || received[2] != 3 {
+		t.Fatalf("calls should be applied once in order, but received %v", received)
+	}
+	if inbox := callee.reliableCalls.Inboxes[callerID]; inbox.LastSeq != 3 || inbox.AckSeq != 3 || len(inbox.pending) != 0 {
+		t.Fatalf("wrong inbox state: last=%d, ack=%d, pending=%d", inbox.LastSeq, inbox.AckSeq, len(inbox.pending))
+	}
+}
+
+func TestReliableCallsPersistentData(t *testing.T) {
+	RegisterEntity("TestReliableCallDataEntity", &TestReliableCallEntity{}, false)
+	e := CreateEntityLocally("TestReliableCallDataEntity", nil)
+	calleeID := CreateEntityLocally("TestReliableCallDataEntity", nil).ID
+	e.CallReliable(calleeID, "Receive", 1)
+
+	data := map[string]interface{}{}
+	e.putReliableCallsData(data)
+	if _, ok := data[_RELIABLE_CALLS_KEY]; !ok {
+		t.Fatalf("reliable calls should be saved")
+	}
+
+	other := CreateEntityLocally("TestReliableCallDataEntity", nil)
+	other.loadReliableCallsData(data)
+	if _, ok := data[_RELIABLE_CALLS_KEY]; ok {
+		t.Fatalf("reliable calls should be removed from data after loading")
+	}
+	outbox := other.reliableCalls.Outboxes[calleeID]
+	if outbox == nil || outbox.LastSeq != 1 || outbox.SavedSeq != 1 || len(outbox.Calls) != 1 || outbox.Calls[0].Method != "Receive" {
+		t.Fatalf("reliable calls not loaded: %+v", outbox)
+	}
+	if other.reliableCallTimer == nil {
+		t.Fatalf("unacknowledged calls should be resent")
+	}
+
+	md := e.GetMigrateData(common.GenEntityID())
+	if md.ReliableCallData == nil {
+		t.Fatalf("reliable calls should be migrated")
+	}
+}
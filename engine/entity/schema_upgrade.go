@@ -0,0 +1,144 @@
+package entity
+
+import (
+	"github.com/pkg/errors"
+	"github.com/sagacao/goworld/engine/common"
+	"github.com/sagacao/goworld/engine/gwlog"
+	"github.com/sagacao/goworld/engine/storage"
+	"github.com/xiaonanln/typeconv"
+)
+
+const (
+	_SCHEMA_VERSION_KEY = "_SV"
+)
+
+// SchemaUpgrader upgrades persistent data of entity from one schema version to the next version
+//
+// Upgraders can add, rename, restructure or delete keys in data. Keys which are not persistent attributes after all
+// upgrades are removed when entity is loaded.
+type SchemaUpgrader func(data map[string]interface{})
+
+// SetSchemaVersion sets the current schema version of persistent data
+//
+// Entities are saved with the schema version, and data of older versions is upgraded by schema upgraders when loaded
+func (desc *EntityTypeDesc) SetSchemaVersion(version int) *EntityTypeDesc {
+	if version < 0 {
+		gwlog.Panicf("schema version < 0")
+	}
+
+	desc.schemaVersion = version
+	return desc
+}
+
+// AddSchemaUpgrader adds the upgrader which upgrades data from fromVersion to fromVersion+1
+func (desc *EntityTypeDesc) AddSchemaUpgrader(fromVersion int, upgrader SchemaUpgrader) *EntityTypeDesc {
+	if _, ok := desc.schemaUpgraders[fromVersion]; ok {
+		gwlog.Panicf("schema upgrader from version %d already added", fromVersion)
+	}
+
+	desc.schemaUpgraders[fromVersion] = upgrader
+	return desc
+}
+
+// upgradePersistentData upgrades data loaded from storage to the current schema version
+//
+// Returns true if data is upgraded. Data of newer schema versions is refused, since saving it with the current version
+// would downgrade the data and drop fields unknown to the current code.
+func (desc *EntityTypeDesc) upgradePersistentData(typeName string, entityID common.EntityID, data map[string]interface{}) (bool, error) {
+	version := 0
+	if v, ok := data[_SCHEMA_VERSION_KEY]; ok {
+		version = int(typeconv.Int(v))
+		delete(data, _SCHEMA_VERSION_KEY)
+	}
+
+	if version > desc.schemaVersion {
+		return false, errors.Errorf("entity %s.%s has schema version %d, which is newer than %d", typeName, entityID, version, desc.schemaVersion)
+	}
+
+	for v := version; v < desc.schemaVersion; v++ {
+		upgrader := desc.schemaUpgraders[v]
+		if upgrader == nil {
+			return false, errors.Errorf("entity %s.%s: schema upgrader from version %d is missing", typeName, entityID, v)
+		}
+		upgrader(data)
+	}
+
+	if version < desc.schemaVersion {
+		gwlog.Infof("entity %s.%s: schema upgraded from version %d to %d", typeName, entityID, version, desc.schemaVersion)
+		return true, nil
+	}
+	return false, nil
+}
+
+// removeNonPersistentFields removes keys which are not persistent attributes from data
+//
+// Reliable calls state is kept since it is saved with persistent attributes
+func (desc *EntityTypeDesc) removeNonPersistentFields(data map[string]interface{}) {
+	for k := range data {
+		if !desc.persistentAttrs.Contains(k) && k != _RELIABLE_CALLS_KEY && k != _PERSISTENT_TIMERS_KEY {
+			delete(data, k)
+		}
+	}
+}
+
+// stampSchemaVersion puts the current schema version in persistent data
+func (desc *EntityTypeDesc) stampSchemaVersion(data map[string]interface{}) {
+	if desc.schemaVersion > 0 {
+		data[_SCHEMA_VERSION_KEY] = desc.schemaVersion
+	}
+}
+
+// UpgradeStoredEntities upgrades persistent data of all stored entities of the type to the current schema version
+//
+// callback is called with number of entities stored and upgraded when all entities are processed
+func UpgradeStoredEntities(typeName string, callback func(total int, upgraded int, err error)) {
+	desc := registeredEntityTypes[typeName]
+	if desc == nil {
+		callback(0, 0, errors.Errorf("unknown entity type: %s", typeName))
+		return
+	}
+	if !desc.IsPersistent {
+		callback(0, 0, errors.Errorf("entity type %s is not persistent", typeName))
+		return
+	}
+
+	storage.ListEntityIDs(typeName, func(eids []common.EntityID, err error) {
+		if err != nil {
+			callback(0, 0, err)
+			return
+		}
+
+		upgradeStoredEntity(desc, typeName, eids, 0, 0, callback)
+	})
+}
+
+// upgradeStoredEntity upgrades the stored entity eids[index], and then upgrades the next one
+func upgradeStoredEntity(desc *EntityTypeDesc, typeName string, eids []common.EntityID, index int, upgraded int, callback func(total int, upgraded int, err error)) {
+	if index >= len(eids) {
+		callback(len(eids), upgraded, nil)
+		return
+	}
+
+	entityID := eids[index]
+	storage.Load(typeName, entityID, func(_data interface{}, err error) {
+		if err != nil {
+			callback(len(eids), upgraded, errors.Wrapf(err, "load entity %s.%s failed", typeName, entityID))
+			return
+		}
+
+		data := _data.(map[string]interface{})
+		isUpgraded, err := desc.upgradePersistentData(typeName, entityID, data)
+		if err != nil {
+			callback(len(eids), upgraded, err)
+			return
+		}
+
+		if isUpgraded {
+			upgraded += 1
+			desc.removeNonPersistentFields(data)
+			desc.stampSchemaVersion(data)
+			storage.Save(typeName, entityID, data, nil)
+		}
+		upgradeStoredEntity(desc, typeName, eids, index+1, upgraded, callback)
+	})
+}
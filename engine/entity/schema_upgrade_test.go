@@ -0,0 +1,59 @@
+package entity
+
+import (
+	"testing"
+)
+
+type TestUpgradeEntity struct {
+	Entity
+}
+
+func (e *TestUpgradeEntity) DescribeEntityType(desc *EntityTypeDesc) {
+	desc.SetPersistent(true).SetSchemaVersion(2)
+	desc.DefineAttr("nickname", "Persistent")
+	desc.DefineAttr("gold", "Persistent")
+	// version 0 => 1: rename name to nickname
+	desc.AddSchemaUpgrader(0, func(data map[string]interface{}) {
+		data["nickname"] = data["name"]
+		delete(data, "name")
+	})
+	// version 1 => 2: money is moved into gold
+	desc.AddSchemaUpgrader(1, func(data map[string]interface{}) {
+		data["gold"] = data["money"]
+	})
+}
+
+func TestUpgradePersistentData(t *testing.T) {
+	RegisterEntity("TestUpgradeEntity", &TestUpgradeEntity{}, false)
+	desc := GetEntityTypeDesc("TestUpgradeEntity")
+
+	data := map[string]interface{}{"name": "foo", "money": 100}
+	upgraded, err := desc.upgradePersistentData("TestUpgradeEntity", "", data)
+	if !upgraded || err != nil {
+		t.Fatalf("data should be upgraded: %v", err)
+	}
+	desc.removeNonPersistentFields(data)
+	if len(data) != 2 || data["nickname"] != "foo" || data["gold"] != 100 {
+		t.Fatalf("wrong upgraded data: %v", data)
+	}
+
+	data = map[string]interface{}{"nickname": "foo", "money": 100, _SCHEMA_VERSION_KEY: 1}
+	if upgraded, _ := desc.upgradePersistentData("TestUpgradeEntity", "", data); !upgraded || data["nickname"] != "foo" || data["gold"] != 100 {
+		t.Fatalf("data should be upgraded from version 1: %v", data)
+	}
+
+	data = map[string]interface{}{"nickname": "foo", _SCHEMA_VERSION_KEY: 2}
+	if upgraded, _ := desc.upgradePersistentData("TestUpgradeEntity", "", data); upgraded || len(data) != 1 {
+		t.Fatalf("data should not be upgraded: %v", data)
+	}
+
+	data = map[string]interface{}{"nickname": "foo", _SCHEMA_VERSION_KEY: 3}
+	if _, err := desc.upgradePersistentData("TestUpgradeEntity", "", data); err == nil {
+		t.Fatalf("data of newer schema version should be refused")
+	}
+
+	e := CreateEntityLocally("TestUpgradeEntity", map[string]interface{}{"nickname": "bar"})
+	if version := e.getPersistentData()[_SCHEMA_VERSION_KEY]; version != 2 {
+		t.Fatalf("schema version should be stamped, but is %v", version)
+	}
+}
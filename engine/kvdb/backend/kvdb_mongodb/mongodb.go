@@ -5,6 +5,9 @@ import (
 
 	"io"
 
+	"strconv"
+	"time"
+
 	"github.com/sagacao/goworld/engine/gwlog"
 	"github.com/sagacao/goworld/engine/kvdb/types"
 	"gopkg.in/mgo.v2/bson"
@@ -13,6 +16,7 @@ import (
 const (
 	_DEFAULT_DB_NAME = "goworld"
 	_VAL_KEY         = "_"
+	_EXPIRE_KEY      = "e"
 )
 
 type mongoKVDB struct {
@@ -20,6 +24,17 @@ type mongoKVDB struct {
 	c *mgo.Collection
 }
 
+// mongoKVDoc is the document of a key, documents are removed by the TTL index on _EXPIRE_KEY after they expire
+type mongoKVDoc struct {
+	Key      string    `bson:"_id"`
+	Val      string    `bson:"_"`
+	ExpireAt time.Time `bson:"e,omitempty"`
+}
+
+func (doc *mongoKVDoc) isExpired(now time.Time) bool {
+	return !doc.ExpireAt.IsZero() && !doc.ExpireAt.After(now)
+}
+
 // OpenMongoKVDB opens mongodb as KVDB engine
 func OpenMongoKVDB(url string, dbname string, collectionName string) (kvdbtypes.KVDBEngine, error) {
 	gwlog.Debugf("Connecting MongoDB ...")
@@ -35,6 +50,11 @@ func OpenMongoKVDB(url string, dbname string, collectionName string) (kvdbtypes.
 	}
 	db := session.DB(dbname)
 	c := db.C(collectionName)
+	// the TTL index only removes expired documents periodically, so expired documents are also filtered when reading
+	if err := c.EnsureIndex(mgo.Index{Key: []string{_EXPIRE_KEY}, ExpireAfter: time.Second}); err != nil {
+		session.Close()
+		return nil, err
+	}
 	return &mongoKVDB{
 		s: session,
 		c: c,
@@ -49,30 +69,25 @@ func (kvdb *mongoKVDB) Put(key string, val string) error {
 }
 
 func (kvdb *mongoKVDB) Get(key string) (val string, err error) {
-	q := kvdb.c.FindId(key)
-	var doc map[string]string
-	err = q.One(&doc)
-	if err != nil {
-		if err == mgo.ErrNotFound {
-			err = nil
-		}
-		return
-	}
-	val = doc[_VAL_KEY]
-	return
+	return kvdb.get(key)
 }
 
 func (kvdb *mongoKVDB) HGet(name string, key string) (val string, err error) {
-	q := kvdb.c.FindId(key)
-	var doc map[string]string
-	err = q.One(&doc)
+	return kvdb.get(key)
+}
+
+func (kvdb *mongoKVDB) get(key string) (val string, err error) {
+	var doc mongoKVDoc
+	err = kvdb.c.FindId(key).One(&doc)
 	if err != nil {
 		if err == mgo.ErrNotFound {
 			err = nil
 		}
 		return
 	}
-	val = doc[_VAL_KEY]
+	if !doc.isExpired(time.Now()) {
+		val = doc.Val
+	}
 	return
 }
 
@@ -83,17 +98,121 @@ func (kvdb *mongoKVDB) HPut(name string, key string, val string) (err error) {
 	return
 }
 
+func (kvdb *mongoKVDB) Delete(key string) error {
+	err := kvdb.c.RemoveId(key)
+	if err == mgo.ErrNotFound {
+		err = nil
+	}
+	return err
+}
+
+func (kvdb *mongoKVDB) CompareAndSwap(key string, oldVal string, newVal string) (bool, error) {
+	if oldVal == "" {
+		return kvdb.putIfAbsent(&mongoKVDoc{Key: key, Val: newVal})
+	}
+
+	selector := aliveSelector(time.Now())
+	selector["_id"] = key
+	selector[_VAL_KEY] = oldVal
+	err := kvdb.c.Update(selector, bson.M{"$set": bson.M{_VAL_KEY: newVal}})
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (kvdb *mongoKVDB) PutIfAbsent(key string, val string, ttl time.Duration) (string, error) {
+	doc := &mongoKVDoc{Key: key, Val: val}
+	if ttl > 0 {
+		doc.ExpireAt = time.Now().Add(ttl)
+	}
+
+	put, err := kvdb.putIfAbsent(doc)
+	if err != nil || put {
+		return "", err
+	}
+	return kvdb.get(key)
+}
+
+// putIfAbsent inserts the document, or replaces the existing document if it is empty or expired
+func (kvdb *mongoKVDB) putIfAbsent(doc *mongoKVDoc) (bool, error) {
+	err := kvdb.c.Insert(doc)
+	if !mgo.IsDup(err) {
+		return err == nil, err
+	}
+
+	err = kvdb.c.Update(bson.M{"_id": doc.Key, "$or": []bson.M{
+		{_VAL_KEY: ""},
+		{_EXPIRE_KEY: bson.M{"$lte": time.Now()}},
+	}}, doc)
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (kvdb *mongoKVDB) Incr(key string, delta int64) (int64, error) {
+	// values are stored as strings which can not be increased by $inc, so retry compare-and-swap until it succeeds
+	for {
+		val, err := kvdb.get(key)
+		if err != nil {
+			return 0, err
+		}
+
+		var n int64
+		if val != "" {
+			if n, err = strconv.ParseInt(val, 10, 64); err != nil {
+				return 0, err
+			}
+		}
+		n += delta
+
+		swapped, err := kvdb.CompareAndSwap(key, val, strconv.FormatInt(n, 10))
+		if err != nil {
+			return 0, err
+		} else if swapped {
+			return n, nil
+		}
+	}
+}
+
+func (kvdb *mongoKVDB) Expire(key string, ttl time.Duration) error {
+	now := time.Now()
+	selector := aliveSelector(now)
+	selector["_id"] = key
+	var update bson.M
+	if ttl > 0 {
+		update = bson.M{"$set": bson.M{_EXPIRE_KEY: now.Add(ttl)}}
+	} else {
+		update = bson.M{"$unset": bson.M{_EXPIRE_KEY: ""}}
+	}
+
+	err := kvdb.c.Update(selector, update)
+	if err == mgo.ErrNotFound {
+		err = nil
+	}
+	return err
+}
+
+// aliveSelector returns the selector of documents which are not expired
+func aliveSelector(now time.Time) bson.M {
+	return bson.M{"$or": []bson.M{
+		{_EXPIRE_KEY: bson.M{"$exists": false}},
+		{_EXPIRE_KEY: bson.M{"$gt": now}},
+	}}
+}
+
 type mongoKVIterator struct {
 	it *mgo.Iter
 }
 
 func (it *mongoKVIterator) Next() (kvdbtypes.KVItem, error) {
-	var doc map[string]string
+	var doc mongoKVDoc
 	ok := it.it.Next(&doc)
 	if ok {
 		return kvdbtypes.KVItem{
-			Key: doc["_id"],
-			Val: doc["_"],
+			Key: doc.Key,
+			Val: doc.Val,
 		}, nil
 	}
 
@@ -105,7 +224,9 @@ func (it *mongoKVIterator) Next() (kvdbtypes.KVItem, error) {
 }
 
 func (kvdb *mongoKVDB) Find(beginKey string, endKey string) (kvdbtypes.Iterator, error) {
-	q := kvdb.c.Find(bson.M{"_id": bson.M{"$gte": beginKey, "$lt": endKey}})
+	selector := aliveSelector(time.Now())
+	selector["_id"] = bson.M{"$gte": beginKey, "$lt": endKey}
+	q := kvdb.c.Find(selector)
 	it := q.Iter()
 	return &mongoKVIterator{
 		it: it,
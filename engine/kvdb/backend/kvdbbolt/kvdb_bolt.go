@@ -0,0 +1,213 @@
+package kvdbbolt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/sagacao/goworld/engine/boltdb"
+	"github.com/sagacao/goworld/engine/kvdb/types"
+	"go.etcd.io/bbolt"
+)
+
+const (
+	_KVDB_BUCKET = "_kvdb"
+	// _KVDB_HASH_BUCKET contains buckets of HGet and HPut
+	_KVDB_HASH_BUCKET = "_kvdb_hash"
+)
+
+// boltKVDB saves key-values in a bucket of bolt database
+//
+// Each value is saved with the expire time in milliseconds (0 for no TTL) as an 8-byte prefix. Expired values are treated
+// as not existing until they are overwritten.
+type boltKVDB struct {
+	db *boltdb.DB
+}
+
+// OpenBoltKVDB opens the bolt database file as KVDB engine
+func OpenBoltKVDB(path string) (kvdbtypes.KVDBEngine, error) {
+	db, err := boltdb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &boltKVDB{
+		db: db,
+	}, nil
+}
+
+func encodeValue(val string, expireAt int64) []byte {
+	b := make([]byte, 8+len(val))
+	binary.BigEndian.PutUint64(b, uint64(expireAt))
+	copy(b[8:], val)
+	return b
+}
+
+// decodeValue returns the value and expire time, values which are expired are returned as ""
+func decodeValue(b []byte, now int64) (string, int64) {
+	if len(b) < 8 {
+		return "", 0
+	}
+	expireAt := int64(binary.BigEndian.Uint64(b))
+	if expireAt != 0 && expireAt <= now {
+		return "", 0
+	}
+	return string(b[8:]), expireAt
+}
+
+func nowMillis() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+func ttlMillis(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return nowMillis() + int64(ttl/time.Millisecond)
+}
+
+func (kvdb *boltKVDB) Get(key string) (val string, err error) {
+	err = kvdb.db.View(func(tx *bbolt.Tx) error {
+		if b := tx.Bucket([]byte(_KVDB_BUCKET)); b != nil {
+			val, _ = decodeValue(b.Get([]byte(key)), nowMillis())
+		}
+		return nil
+	})
+	return
+}
+
+func (kvdb *boltKVDB) Put(key string, val string) error {
+	return kvdb.update(func(b *bbolt.Bucket, now int64) error {
+		return b.Put([]byte(key), encodeValue(val, 0))
+	})
+}
+
+func (kvdb *boltKVDB) HGet(name string, key string) (val string, err error) {
+	err = kvdb.db.View(func(tx *bbolt.Tx) error {
+		if b := boltdb.LookupBucket(tx, _KVDB_HASH_BUCKET, name); b != nil {
+			val = string(b.Get([]byte(key)))
+		}
+		return nil
+	})
+	return
+}
+
+func (kvdb *boltKVDB) HPut(name string, key string, val string) error {
+	return kvdb.db.Update(func(tx *bbolt.Tx) error {
+		b, err := boltdb.Bucket(tx, _KVDB_HASH_BUCKET, name)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), []byte(val))
+	})
+}
+
+func (kvdb *boltKVDB) Delete(key string) error {
+	return kvdb.update(func(b *bbolt.Bucket, now int64) error {
+		return b.Delete([]byte(key))
+	})
+}
+
+func (kvdb *boltKVDB) CompareAndSwap(key string, oldVal string, newVal string) (swapped bool, err error) {
+	err = kvdb.update(func(b *bbolt.Bucket, now int64) error {
+		val, expireAt := decodeValue(b.Get([]byte(key)), now)
+		if val != oldVal {
+			return nil
+		}
+		swapped = true
+		return b.Put([]byte(key), encodeValue(newVal, expireAt))
+	})
+	return
+}
+
+func (kvdb *boltKVDB) PutIfAbsent(key string, val string, ttl time.Duration) (oldVal string, err error) {
+	err = kvdb.update(func(b *bbolt.Bucket, now int64) error {
+		oldVal, _ = decodeValue(b.Get([]byte(key)), now)
+		if oldVal != "" {
+			return nil
+		}
+		return b.Put([]byte(key), encodeValue(val, ttlMillis(ttl)))
+	})
+	return
+}
+
+func (kvdb *boltKVDB) Incr(key string, delta int64) (n int64, err error) {
+	err = kvdb.update(func(b *bbolt.Bucket, now int64) error {
+		val, expireAt := decodeValue(b.Get([]byte(key)), now)
+		if val != "" {
+			var err error
+			if n, err = strconv.ParseInt(val, 10, 64); err != nil {
+				return err
+			}
+		}
+		n += delta
+		return b.Put([]byte(key), encodeValue(strconv.FormatInt(n, 10), expireAt))
+	})
+	return
+}
+
+func (kvdb *boltKVDB) Expire(key string, ttl time.Duration) error {
+	return kvdb.update(func(b *bbolt.Bucket, now int64) error {
+		val, _ := decodeValue(b.Get([]byte(key)), now)
+		if val == "" {
+			return nil
+		}
+		return b.Put([]byte(key), encodeValue(val, ttlMillis(ttl)))
+	})
+}
+
+// update executes fn on the KVDB bucket in a read-write transaction
+func (kvdb *boltKVDB) update(fn func(b *bbolt.Bucket, now int64) error) error {
+	return kvdb.db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(_KVDB_BUCKET))
+		if err != nil {
+			return err
+		}
+		return fn(b, nowMillis())
+	})
+}
+
+type boltKVIterator struct {
+	items []kvdbtypes.KVItem
+}
+
+func (it *boltKVIterator) Next() (kvdbtypes.KVItem, error) {
+	if len(it.items) == 0 {
+		return kvdbtypes.KVItem{}, io.EOF
+	}
+
+	item := it.items[0]
+	it.items = it.items[1:]
+	return item, nil
+}
+
+// Find returns items in range in one transaction, since the database file is closed after each transaction
+func (kvdb *boltKVDB) Find(beginKey string, endKey string) (kvdbtypes.Iterator, error) {
+	it := &boltKVIterator{}
+	err := kvdb.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(_KVDB_BUCKET))
+		if b == nil {
+			return nil
+		}
+
+		now := nowMillis()
+		c := b.Cursor()
+		for k, v := c.Seek([]byte(beginKey)); k != nil && bytes.Compare(k, []byte(endKey)) < 0; k, v = c.Next() {
+			if val, _ := decodeValue(v, now); val != "" {
+				it.items = append(it.items, kvdbtypes.KVItem{Key: string(k), Val: val})
+			}
+		}
+		return nil
+	})
+	return it, err
+}
+
+func (kvdb *boltKVDB) Close() {
+	// the database file is only opened in transactions
+}
+
+func (kvdb *boltKVDB) IsConnectionError(err error) bool {
+	return false
+}
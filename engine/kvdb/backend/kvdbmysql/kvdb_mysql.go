@@ -9,6 +9,8 @@ import (
 
 	"strconv"
 
+	"time"
+
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/sagacao/goworld/engine/gwlog"
 	"github.com/sagacao/goworld/engine/kvdb/types"
@@ -16,6 +18,8 @@ import (
 
 const (
 	_MAX_KEY_LENGTH = 256
+	// _ALIVE_CONDITION filters out expired keys, `expire_at` is the expire time in milliseconds or 0 for no TTL
+	_ALIVE_CONDITION = "(`expire_at` = 0 OR `expire_at` > ?)"
 )
 
 type mysqlKVDB struct {
@@ -37,7 +41,17 @@ func OpenMySQLKVDB(dataSourceName string) (kvdbtypes.KVDBEngine, error) {
 	}
 
 	// try to create the __kv__ table if not exists
-	_, err = db.Exec("CREATE TABLE IF NOT EXISTS `__kv__`(`key` VARCHAR(" + strconv.Itoa(_MAX_KEY_LENGTH) + ") NOT NULL PRIMARY KEY, `val` BLOB NOT NULL)")
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS `__kv__`(`key` VARCHAR(" + strconv.Itoa(_MAX_KEY_LENGTH) + ") NOT NULL PRIMARY KEY, `val` BLOB NOT NULL, `expire_at` BIGINT NOT NULL DEFAULT 0)")
+	if err != nil {
+		return nil, err
+	}
+
+	// add the `expire_at` column to tables created by older versions
+	var n int
+	err = db.QueryRow("SELECT COUNT(*) FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = '__kv__' AND COLUMN_NAME = 'expire_at'").Scan(&n)
+	if err == nil && n == 0 {
+		_, err = db.Exec("ALTER TABLE `__kv__` ADD COLUMN `expire_at` BIGINT NOT NULL DEFAULT 0")
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -54,7 +68,7 @@ func (sqlkvdb *mysqlKVDB) String() string {
 }
 
 func (sqlkvdb *mysqlKVDB) Get(key string) (val string, err error) {
-	row := sqlkvdb.db.QueryRow("SELECT `val` FROM `__kv__` WHERE `key` = ?", key)
+	row := sqlkvdb.db.QueryRow("SELECT `val` FROM `__kv__` WHERE `key` = ? AND "+_ALIVE_CONDITION, key, nowMillis())
 	err = row.Scan(&val)
 	if err == sql.ErrNoRows {
 		err = nil // not found, use default val ""
@@ -64,12 +78,115 @@ func (sqlkvdb *mysqlKVDB) Get(key string) (val string, err error) {
 }
 
 func (sqlkvdb *mysqlKVDB) Put(key string, val string) (err error) {
-	_, err = sqlkvdb.db.Exec("INSERT INTO `__kv__`(`key`, `val`) VALUES(?, ?) ON DUPLICATE KEY UPDATE `val`=?", key, val, val)
+	_, err = sqlkvdb.db.Exec("INSERT INTO `__kv__`(`key`, `val`) VALUES(?, ?) ON DUPLICATE KEY UPDATE `val`=?, `expire_at`=0", key, val, val)
 	return
 }
 
+func (sqlkvdb *mysqlKVDB) Delete(key string) (err error) {
+	_, err = sqlkvdb.db.Exec("DELETE FROM `__kv__` WHERE `key` = ?", key)
+	return
+}
+
+func (sqlkvdb *mysqlKVDB) CompareAndSwap(key string, oldVal string, newVal string) (bool, error) {
+	if oldVal == "" {
+		return sqlkvdb.putIfAbsent(key, newVal, 0)
+	}
+	if oldVal == newVal {
+		// affected rows is 0 if the value is not changed, so just check the current value
+		val, err := sqlkvdb.Get(key)
+		return err == nil && val == oldVal, err
+	}
+
+	res, err := sqlkvdb.db.Exec("UPDATE `__kv__` SET `val` = ? WHERE `key` = ? AND `val` = ? AND "+_ALIVE_CONDITION, newVal, key, oldVal, nowMillis())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return err == nil && n == 1, err
+}
+
+func (sqlkvdb *mysqlKVDB) PutIfAbsent(key string, val string, ttl time.Duration) (string, error) {
+	var expireAt int64
+	if ttl > 0 {
+		expireAt = nowMillis() + int64(ttl/time.Millisecond)
+	}
+
+	put, err := sqlkvdb.putIfAbsent(key, val, expireAt)
+	if err != nil || put {
+		return "", err
+	}
+	return sqlkvdb.Get(key)
+}
+
+// putIfAbsent inserts the row, or replaces the existing row if it is empty or expired
+func (sqlkvdb *mysqlKVDB) putIfAbsent(key string, val string, expireAt int64) (bool, error) {
+	res, err := sqlkvdb.db.Exec("INSERT INTO `__kv__`(`key`, `val`, `expire_at`) VALUES(?, ?, ?) ON DUPLICATE KEY UPDATE `key`=`key`", key, val, expireAt)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 1 {
+		return err == nil, err
+	}
+
+	res, err = sqlkvdb.db.Exec("UPDATE `__kv__` SET `val` = ?, `expire_at` = ? WHERE `key` = ? AND (`val` = '' OR (`expire_at` <> 0 AND `expire_at` <= ?))", val, expireAt, key, nowMillis())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return err == nil && n == 1, err
+}
+
+func (sqlkvdb *mysqlKVDB) Incr(key string, delta int64) (val int64, err error) {
+	tx, err := sqlkvdb.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	// make sure the row exists and is not expired, so that it is locked until the transaction ends
+	now := nowMillis()
+	_, err = tx.Exec("INSERT INTO `__kv__`(`key`, `val`, `expire_at`) VALUES(?, '', 0) ON DUPLICATE KEY UPDATE "+
+		"`val` = IF(`expire_at` <> 0 AND `expire_at` <= ?, '', `val`), `expire_at` = IF(`expire_at` <> 0 AND `expire_at` <= ?, 0, `expire_at`)", key, now, now)
+	if err != nil {
+		return
+	}
+
+	var s string
+	if err = tx.QueryRow("SELECT `val` FROM `__kv__` WHERE `key` = ? FOR UPDATE", key).Scan(&s); err != nil {
+		return
+	}
+	if s != "" {
+		if val, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return
+		}
+	}
+	val += delta
+	_, err = tx.Exec("UPDATE `__kv__` SET `val` = ? WHERE `key` = ?", strconv.FormatInt(val, 10), key)
+	return
+}
+
+func (sqlkvdb *mysqlKVDB) Expire(key string, ttl time.Duration) (err error) {
+	now := nowMillis()
+	var expireAt int64
+	if ttl > 0 {
+		expireAt = now + int64(ttl/time.Millisecond)
+	}
+	_, err = sqlkvdb.db.Exec("UPDATE `__kv__` SET `expire_at` = ? WHERE `key` = ? AND "+_ALIVE_CONDITION, expireAt, key, now)
+	return
+}
+
+func nowMillis() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
 func (sqlkvdb *mysqlKVDB) HGet(name string, key string) (val string, err error) {
-	row := sqlkvdb.db.QueryRow("SELECT `val` FROM `__kv__` WHERE `key` = ?", key)
+	row := sqlkvdb.db.QueryRow("SELECT `val` FROM `__kv__` WHERE `key` = ? AND "+_ALIVE_CONDITION, key, nowMillis())
 	err = row.Scan(&val)
 	if err == sql.ErrNoRows {
 		err = nil // not found, use default val ""
@@ -79,7 +196,7 @@ func (sqlkvdb *mysqlKVDB) HGet(name string, key string) (val string, err error)
 }
 
 func (sqlkvdb *mysqlKVDB) HPut(name string, key string, val string) (err error) {
-	_, err = sqlkvdb.db.Exec("INSERT INTO `__kv__`(`key`, `val`) VALUES(?, ?) ON DUPLICATE KEY UPDATE `val`=?", key, val, val)
+	_, err = sqlkvdb.db.Exec("INSERT INTO `__kv__`(`key`, `val`) VALUES(?, ?) ON DUPLICATE KEY UPDATE `val`=?, `expire_at`=0", key, val, val)
 	return
 }
 
@@ -98,7 +215,7 @@ func (it *sqlKVDBIterator) Next() (kvdbtypes.KVItem, error) {
 }
 
 func (sqlkvdb *mysqlKVDB) Find(beginKey string, endKey string) (kvdbtypes.Iterator, error) {
-	rows, err := sqlkvdb.db.Query("SELECT `key`, `val` FROM `__kv__` WHERE `key` >= ? AND `key` < ?", beginKey, endKey)
+	rows, err := sqlkvdb.db.Query("SELECT `key`, `val` FROM `__kv__` WHERE `key` >= ? AND `key` < ? AND "+_ALIVE_CONDITION, beginKey, endKey, nowMillis())
 	if err != nil {
 		return nil, err
 	}
@@ -3,6 +3,7 @@ package kvdbredis
 import (
 	"io"
 	"strings"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
 	"github.com/pkg/errors"
@@ -13,6 +14,16 @@ const (
 	keyPrefix = "_KV_"
 )
 
+var (
+	getScript            = redis.NewScript(2, LuaGet)
+	putScript            = redis.NewScript(2, LuaPut)
+	deleteScript         = redis.NewScript(2, LuaDelete)
+	compareAndSwapScript = redis.NewScript(2, LuaCompareAndSwap)
+	putIfAbsentScript    = redis.NewScript(2, LuaPutIfAbsent)
+	incrScript           = redis.NewScript(2, LuaIncr)
+	expireScript         = redis.NewScript(2, LuaExpire)
+)
+
 type redisKVDB struct {
 	c       redis.Conn
 	kPrefix string
@@ -97,7 +108,7 @@ func (db *redisKVDB) Get(key string) (val string, err error) {
 	// }
 	// return string(r.([]byte)), err
 
-	r, err := redis.String(db.c.Do("HGET", db.kPrefix, key))
+	r, err := redis.String(db.eval(getScript, key))
 	if err != nil && !strings.Contains(err.Error(), "nil returned") {
 		return "", err
 	}
@@ -106,10 +117,38 @@ func (db *redisKVDB) Get(key string) (val string, err error) {
 
 func (db *redisKVDB) Put(key string, val string) error {
 	//_, err := db.c.Do("SET", db.kPrefix+key, val)
-	_, err := db.c.Do("HSET", db.kPrefix, key, val)
+	_, err := db.eval(putScript, key, val)
+	return err
+}
+
+func (db *redisKVDB) Delete(key string) error {
+	_, err := db.eval(deleteScript, key)
+	return err
+}
+
+func (db *redisKVDB) CompareAndSwap(key string, oldVal string, newVal string) (bool, error) {
+	return redis.Bool(db.eval(compareAndSwapScript, key, oldVal, newVal))
+}
+
+func (db *redisKVDB) PutIfAbsent(key string, val string, ttl time.Duration) (string, error) {
+	return redis.String(db.eval(putIfAbsentScript, key, val, int64(ttl/time.Millisecond)))
+}
+
+func (db *redisKVDB) Incr(key string, delta int64) (int64, error) {
+	return redis.Int64(db.eval(incrScript, key, delta))
+}
+
+func (db *redisKVDB) Expire(key string, ttl time.Duration) error {
+	_, err := db.eval(expireScript, key, int64(ttl/time.Millisecond))
 	return err
 }
 
+// eval runs the script on key with the current time, see kvdb_redis_scripts.go for arguments of scripts
+func (db *redisKVDB) eval(script *redis.Script, key string, args ...interface{}) (interface{}, error) {
+	keysAndArgs := []interface{}{db.kPrefix, TTLKey(db.kPrefix), time.Now().UnixNano() / int64(time.Millisecond), key}
+	return script.Do(db.c, append(keysAndArgs, args...)...)
+}
+
 func (db *redisKVDB) HGet(name string, key string) (val string, err error) {
 	dbname := strings.Join([]string{db.kPrefix, name}, "_")
 	r, err := redis.String(db.c.Do("HGET", dbname, key))
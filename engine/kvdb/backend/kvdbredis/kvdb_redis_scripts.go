@@ -0,0 +1,101 @@
+package kvdbredis
+
+// Lua scripts of atomic operations on KVDB, shared with the redis cluster backend
+//
+// Keys are fields of the KVDB hash (KEYS[1]), and expire times (in milliseconds) of keys with TTL are stored in a sorted
+// set (KEYS[2]). Expired fields are removed by the scripts lazily. ARGV[1] is the current time in milliseconds and
+// ARGV[2] is the key.
+const (
+	luaPurgeExpired = `
+local function purge(key, now)
+	local e = redis.call('ZSCORE', KEYS[2], key)
+	if e and tonumber(e) <= now then
+		redis.call('HDEL', KEYS[1], key)
+		redis.call('ZREM', KEYS[2], key)
+	end
+	local expired = redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', now, 'LIMIT', 0, 100)
+	for _, k in ipairs(expired) do
+		redis.call('HDEL', KEYS[1], k)
+		redis.call('ZREM', KEYS[2], k)
+	end
+end
+purge(ARGV[2], tonumber(ARGV[1]))
+`
+
+	// LuaGet returns the value of key, or nil if the key is expired
+	LuaGet = `
+local e = redis.call('ZSCORE', KEYS[2], ARGV[2])
+if e and tonumber(e) <= tonumber(ARGV[1]) then
+	return false
+end
+return redis.call('HGET', KEYS[1], ARGV[2])
+`
+
+	// LuaPut puts the value (ARGV[3]) and clears the TTL of key
+	LuaPut = `
+redis.call('HSET', KEYS[1], ARGV[2], ARGV[3])
+redis.call('ZREM', KEYS[2], ARGV[2])
+return 1
+`
+
+	// LuaDelete deletes the key
+	LuaDelete = `
+redis.call('HDEL', KEYS[1], ARGV[2])
+redis.call('ZREM', KEYS[2], ARGV[2])
+return 1
+`
+
+	// LuaCompareAndSwap sets the value to ARGV[4] if the current value is ARGV[3], returns 1 if swapped
+	LuaCompareAndSwap = luaPurgeExpired + `
+local cur = redis.call('HGET', KEYS[1], ARGV[2]) or ''
+if cur ~= ARGV[3] then
+	return 0
+end
+redis.call('HSET', KEYS[1], ARGV[2], ARGV[4])
+return 1
+`
+
+	// LuaPutIfAbsent puts the value (ARGV[3]) with TTL (ARGV[4] in milliseconds, 0 for no TTL) if the key does not exist,
+	// returns the current value
+	LuaPutIfAbsent = luaPurgeExpired + `
+local cur = redis.call('HGET', KEYS[1], ARGV[2]) or ''
+if cur ~= '' then
+	return cur
+end
+redis.call('HSET', KEYS[1], ARGV[2], ARGV[3])
+local ttl = tonumber(ARGV[4])
+if ttl > 0 then
+	redis.call('ZADD', KEYS[2], tonumber(ARGV[1]) + ttl, ARGV[2])
+else
+	redis.call('ZREM', KEYS[2], ARGV[2])
+end
+return ''
+`
+
+	// LuaIncr increases the value by ARGV[3], returns the new value
+	LuaIncr = luaPurgeExpired + `
+if redis.call('HGET', KEYS[1], ARGV[2]) == '' then
+	redis.call('HDEL', KEYS[1], ARGV[2])
+end
+return redis.call('HINCRBY', KEYS[1], ARGV[2], ARGV[3])
+`
+
+	// LuaExpire sets the TTL (ARGV[3] in milliseconds) of key if the key exists, TTL <= 0 removes the TTL
+	LuaExpire = luaPurgeExpired + `
+if redis.call('HEXISTS', KEYS[1], ARGV[2]) == 0 then
+	return 0
+end
+local ttl = tonumber(ARGV[3])
+if ttl > 0 then
+	redis.call('ZADD', KEYS[2], tonumber(ARGV[1]) + ttl, ARGV[2])
+else
+	redis.call('ZREM', KEYS[2], ARGV[2])
+end
+return 1
+`
+)
+
+// TTLKey returns the key of the sorted set of expire times, which is in the same slot with the KVDB hash in redis cluster
+func TTLKey(prefix string) string {
+	return "{" + prefix + "}_ttl"
+}
@@ -8,6 +8,7 @@ import (
 
 	redis "github.com/chasex/redis-go-cluster"
 	"github.com/pkg/errors"
+	"github.com/sagacao/goworld/engine/kvdb/backend/kvdbredis"
 	"github.com/sagacao/goworld/engine/kvdb/types"
 )
 
@@ -102,7 +103,7 @@ func (db *redisKVDB) Get(key string) (val string, err error) {
 	// }
 	// return string(r.([]byte)), err
 
-	r, err := redis.String(db.c.Do("HGET", db.kPrefix, key))
+	r, err := redis.String(db.eval(kvdbredis.LuaGet, key))
 	if err != nil && !strings.Contains(err.Error(), "nil returned") {
 		return "", err
 	}
@@ -111,10 +112,42 @@ func (db *redisKVDB) Get(key string) (val string, err error) {
 
 func (db *redisKVDB) Put(key string, val string) error {
 	//_, err := db.c.Do("SET", db.kPrefix+key, val)
-	_, err := db.c.Do("HSET", db.kPrefix, key, val)
+	_, err := db.eval(kvdbredis.LuaPut, key, val)
 	return err
 }
 
+func (db *redisKVDB) Delete(key string) error {
+	_, err := db.eval(kvdbredis.LuaDelete, key)
+	return err
+}
+
+func (db *redisKVDB) CompareAndSwap(key string, oldVal string, newVal string) (bool, error) {
+	return redis.Bool(db.eval(kvdbredis.LuaCompareAndSwap, key, oldVal, newVal))
+}
+
+func (db *redisKVDB) PutIfAbsent(key string, val string, ttl time.Duration) (string, error) {
+	return redis.String(db.eval(kvdbredis.LuaPutIfAbsent, key, val, int64(ttl/time.Millisecond)))
+}
+
+func (db *redisKVDB) Incr(key string, delta int64) (int64, error) {
+	return redis.Int64(db.eval(kvdbredis.LuaIncr, key, delta))
+}
+
+func (db *redisKVDB) Expire(key string, ttl time.Duration) error {
+	_, err := db.eval(kvdbredis.LuaExpire, key, int64(ttl/time.Millisecond))
+	return err
+}
+
+// eval runs the script on key with the current time, the KVDB hash and the TTL set are in the same slot
+//
+// The cluster client routes commands by the first argument, which is the script for EVAL, so the script is prefixed
+// with a comment containing the hash tag of the KVDB hash to be sent to the node of the slot.
+func (db *redisKVDB) eval(script string, key string, args ...interface{}) (interface{}, error) {
+	script = "-- {" + db.kPrefix + "}\n" + script
+	keysAndArgs := []interface{}{script, 2, db.kPrefix, kvdbredis.TTLKey(db.kPrefix), time.Now().UnixNano() / int64(time.Millisecond), key}
+	return db.c.Do("EVAL", append(keysAndArgs, args...)...)
+}
+
 func (db *redisKVDB) HGet(name string, key string) (val string, err error) {
 	dbname := strings.Join([]string{db.kPrefix, name}, "_")
 	r, err := redis.String(db.c.Do("HGET", dbname, key))
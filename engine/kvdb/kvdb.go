@@ -11,6 +11,7 @@ import (
 	"github.com/sagacao/goworld/engine/config"
 	"github.com/sagacao/goworld/engine/gwlog"
 	"github.com/sagacao/goworld/engine/kvdb/backend/kvdb_mongodb"
+	"github.com/sagacao/goworld/engine/kvdb/backend/kvdbbolt"
 	"github.com/sagacao/goworld/engine/kvdb/backend/kvdbmysql"
 	"github.com/sagacao/goworld/engine/kvdb/backend/kvdbredis"
 	"github.com/sagacao/goworld/engine/kvdb/backend/kvdbrediscluster"
@@ -34,9 +35,15 @@ type KVDBPutCallback func(err error)
 // KVDBGetRangeCallback is type of KVDB GetRange callback
 type KVDBGetRangeCallback func(items []kvdbtypes.KVItem, err error)
 
-// KVDBGetOrPutCallback is type of KVDB GetOrPut callback
+// KVDBGetOrPutCallback is type of KVDB GetOrPut and PutIfAbsent callback
 type KVDBGetOrPutCallback func(oldVal string, err error)
 
+// KVDBCompareAndSwapCallback is type of KVDB CompareAndSwap callback
+type KVDBCompareAndSwapCallback func(swapped bool, err error)
+
+// KVDBIncrCallback is type of KVDB Incr callback
+type KVDBIncrCallback func(val int64, err error)
+
 // Initialize the KVDB
 //
 // Called by game server engine
@@ -76,6 +83,8 @@ func assureKVDBEngineReady() (err error) {
 		} else {
 			gwlog.Fatalf("KVDB mysql driver %s is unknown", kvdbCfg.Driver)
 		}
+	} else if kvdbCfg.Type == "bolt" {
+		kvdbEngine, err = kvdbbolt.OpenBoltKVDB(kvdbCfg.Url)
 	} else {
 		gwlog.Fatalf("KVDB type %s is not implemented", kvdbCfg.Type)
 	}
@@ -186,14 +195,99 @@ func GetOrPut(key string, val string, callback KVDBGetOrPutCallback) {
 	}
 
 	async.AppendAsyncJob(_KVDB_ASYNC_JOB_GROUP, kvdbRoutine(func() (res interface{}, err error) {
-		oldVal, err := kvdbEngine.Get(key)
-		if err == nil {
-			if oldVal == "" {
-				err = kvdbEngine.Put(key, val)
+		res, err = kvdbEngine.PutIfAbsent(key, val, 0)
+		return
+	}), ac)
+}
+
+// Delete deletes key from KVDB, returns in callback
+func Delete(key string, callback KVDBPutCallback) {
+	var ac async.AsyncCallback
+	if callback != nil {
+		ac = func(res interface{}, err error) {
+			callback(err)
+		}
+	}
+
+	async.AppendAsyncJob(_KVDB_ASYNC_JOB_GROUP, kvdbRoutine(func() (res interface{}, err error) {
+		err = kvdbEngine.Delete(key)
+		return
+	}), ac)
+}
+
+// CompareAndSwap sets value of key to newVal atomically if the current value is oldVal, returns in callback whether the value is swapped
+//
+// oldVal "" means the key does not exist
+func CompareAndSwap(key string, oldVal string, newVal string, callback KVDBCompareAndSwapCallback) {
+	var ac async.AsyncCallback
+	if callback != nil {
+		ac = func(res interface{}, err error) {
+			if err == nil {
+				callback(res.(bool), nil)
+			} else {
+				callback(false, err)
+			}
+		}
+	}
+
+	async.AppendAsyncJob(_KVDB_ASYNC_JOB_GROUP, kvdbRoutine(func() (res interface{}, err error) {
+		res, err = kvdbEngine.CompareAndSwap(key, oldVal, newVal)
+		return
+	}), ac)
+}
+
+// PutIfAbsent puts key-value to KVDB atomically if key not exists, the key expires after ttl if ttl > 0
+//
+// The current value is returned in callback if key exists, otherwise "" is returned and the value is put.
+func PutIfAbsent(key string, val string, ttl time.Duration, callback KVDBGetOrPutCallback) {
+	var ac async.AsyncCallback
+	if callback != nil {
+		ac = func(res interface{}, err error) {
+			if err == nil {
+				callback(res.(string), nil)
+			} else {
+				callback("", err)
+			}
+		}
+	}
+
+	async.AppendAsyncJob(_KVDB_ASYNC_JOB_GROUP, kvdbRoutine(func() (res interface{}, err error) {
+		res, err = kvdbEngine.PutIfAbsent(key, val, ttl)
+		return
+	}), ac)
+}
+
+// Incr increases the integer value of key by delta atomically, returns the new value in callback
+func Incr(key string, delta int64, callback KVDBIncrCallback) {
+	var ac async.AsyncCallback
+	if callback != nil {
+		ac = func(res interface{}, err error) {
+			if err == nil {
+				callback(res.(int64), nil)
+			} else {
+				callback(0, err)
 			}
 		}
+	}
 
-		return oldVal, err
+	async.AppendAsyncJob(_KVDB_ASYNC_JOB_GROUP, kvdbRoutine(func() (res interface{}, err error) {
+		res, err = kvdbEngine.Incr(key, delta)
+		return
+	}), ac)
+}
+
+// Expire sets TTL of key if key exists, the key is deleted after ttl. ttl <= 0 removes the TTL of key
+func Expire(key string, ttl time.Duration, callback KVDBPutCallback) {
+	var ac async.AsyncCallback
+	if callback != nil {
+		ac = func(res interface{}, err error) {
+			callback(err)
+		}
+	}
+
+	async.AppendAsyncJob(_KVDB_ASYNC_JOB_GROUP, kvdbRoutine(func() (res interface{}, err error) {
+		err = kvdbEngine.Expire(key, ttl)
+		return
 	}), ac)
 }
 
@@ -9,8 +9,12 @@ import (
 	"io"
 
 	"os"
+	"path/filepath"
+
+	"time"
 
 	"github.com/sagacao/goworld/engine/kvdb/backend/kvdb_mongodb"
+	"github.com/sagacao/goworld/engine/kvdb/backend/kvdbbolt"
 	"github.com/sagacao/goworld/engine/kvdb/backend/kvdbmysql"
 	"github.com/sagacao/goworld/engine/kvdb/backend/kvdbredis"
 	. "github.com/sagacao/goworld/engine/kvdb/types"
@@ -54,6 +58,79 @@ func testKVDBBackendSet(t *testing.T, kvdb KVDBEngine) {
 
 }
 
+func TestMongoBackendAtomic(t *testing.T) {
+	testBackendAtomic(t, openTestMongoKVDB(t))
+}
+
+func TestRedisBackendAtomic(t *testing.T) {
+	testBackendAtomic(t, openTestRedisKVDB(t))
+}
+
+func TestMySQLBackendAtomic(t *testing.T) {
+	testBackendAtomic(t, openTestMySQLKVDB(t))
+}
+
+func testBackendAtomic(t *testing.T, kvdb KVDBEngine) {
+	key := "__atomic_" + strconv.Itoa(rand.Intn(10000))
+	if err := kvdb.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+
+	if oldVal, err := kvdb.PutIfAbsent(key, "a", 0); err != nil || oldVal != "" {
+		t.Fatalf("put if absent should succeed: %q, %v", oldVal, err)
+	}
+	if oldVal, err := kvdb.PutIfAbsent(key, "b", 0); err != nil || oldVal != "a" {
+		t.Fatalf("put if absent should return the current value: %q, %v", oldVal, err)
+	}
+	if swapped, err := kvdb.CompareAndSwap(key, "b", "c"); err != nil || swapped {
+		t.Fatalf("compare and swap should fail: %v, %v", swapped, err)
+	}
+	if swapped, err := kvdb.CompareAndSwap(key, "a", "c"); err != nil || !swapped {
+		t.Fatalf("compare and swap should succeed: %v, %v", swapped, err)
+	}
+	if val, err := kvdb.Get(key); err != nil || val != "c" {
+		t.Fatalf("value should be swapped: %q, %v", val, err)
+	}
+
+	if err := kvdb.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if swapped, err := kvdb.CompareAndSwap(key, "", "d"); err != nil || !swapped {
+		t.Fatalf("compare and swap on deleted key should succeed: %v, %v", swapped, err)
+	}
+	kvdb.Delete(key)
+
+	for i := int64(1); i <= 3; i++ {
+		if val, err := kvdb.Incr(key, 2); err != nil || val != i*2 {
+			t.Fatalf("incr should return %d, but got %d, %v", i*2, val, err)
+		}
+	}
+
+	if err := kvdb.Expire(key, time.Millisecond*100); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 200)
+	if val, err := kvdb.Get(key); err != nil || val != "" {
+		t.Fatalf("key should be expired: %q, %v", val, err)
+	}
+	if oldVal, err := kvdb.PutIfAbsent(key, "e", time.Hour); err != nil || oldVal != "" {
+		t.Fatalf("put if absent on expired key should succeed: %q, %v", oldVal, err)
+	}
+	kvdb.Delete(key)
+}
+
+func TestBoltBackendSet(t *testing.T) {
+	testKVDBBackendSet(t, openTestBoltKVDB(t))
+}
+
+func TestBoltBackendAtomic(t *testing.T) {
+	testBackendAtomic(t, openTestBoltKVDB(t))
+}
+
+func TestBoltBackendFind(t *testing.T) {
+	testBackendFind(t, openTestBoltKVDB(t))
+}
+
 func TestMongoBackendFind(t *testing.T) {
 	testBackendFind(t, openTestMongoKVDB(t))
 }
@@ -138,6 +215,10 @@ func BenchmarkSQLBackendGetSet(b *testing.B) {
 	benchmarkBackendGetSet(b, openTestMySQLKVDB(b))
 }
 
+func BenchmarkBoltBackendGetSet(b *testing.B) {
+	benchmarkBackendGetSet(b, openTestBoltKVDB(b))
+}
+
 func benchmarkBackendGetSet(b *testing.B, kvdb KVDBEngine) {
 	key := "testkey"
 
@@ -212,7 +293,15 @@ func openTestMongoKVDB(f _Fataler) KVDBEngine {
 }
 
 func openTestRedisKVDB(f _Fataler) KVDBEngine {
-	kvdb, err := kvdbredis.OpenRedisKVDB("redis://127.0.0.1:6379", "", 0)
+	kvdb, err := kvdbredis.OpenRedisKVDB("redis://127.0.0.1:6379", "", "", 0)
+	if err != nil {
+		f.Fatal(err)
+	}
+	return kvdb
+}
+
+func openTestBoltKVDB(f _Fataler) KVDBEngine {
+	kvdb, err := kvdbbolt.OpenBoltKVDB(filepath.Join(os.TempDir(), "goworld_test_kvdb.db"))
 	if err != nil {
 		f.Fatal(err)
 	}
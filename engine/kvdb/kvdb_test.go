@@ -3,13 +3,18 @@ package kvdb
 import (
 	"testing"
 
-	"github.com/sagacao/goworld/engine/config"
 	"github.com/sagacao/goworld/engine/kvdb/types"
 )
 
 func init() {
-	config.SetConfigFile("../../goworld.ini")
-	Initialize()
+	// use the embedded bolt engine so that tests can run without database services
+	kvdbEngine = openTestBoltKVDB(fatalPanicker{})
+}
+
+type fatalPanicker struct{}
+
+func (fatalPanicker) Fatal(args ...interface{}) {
+	panic(args[0])
 }
 
 func TestBasic(t *testing.T) {
@@ -58,7 +63,7 @@ func TestBasic(t *testing.T) {
 			return
 		}
 		if oldVal == "" {
-			t.Errorf("wrong old val: " + oldVal)
+			t.Errorf("wrong old val: %s", oldVal)
 			return
 		}
 		Get("a", func(val string, err error) {
@@ -78,7 +83,7 @@ func TestBasic(t *testing.T) {
 			return
 		}
 		if oldVal != "" {
-			t.Errorf("wrong old val: " + oldVal)
+			t.Errorf("wrong old val: %s", oldVal)
 			return
 		}
 		Get("__key_not_exists__", func(val string, err error) {
@@ -1,9 +1,25 @@
 package kvdbtypes
 
+import "time"
+
 // KVDBEngine defines the interface of a KVDB engine implementation
+//
+// Empty value means the key does not exist. Keys can expire after a TTL set by PutIfAbsent or Expire, expired keys are
+// never returned and Put clears the TTL of the key. Delete, CompareAndSwap, PutIfAbsent, Incr and Expire are atomic
+// across all clients of the database.
 type KVDBEngine interface {
 	Get(key string) (val string, err error)
 	Put(key string, val string) (err error)
+	// Delete deletes the key, deleting a key which does not exist is not an error
+	Delete(key string) (err error)
+	// CompareAndSwap sets value of key to newVal only if the current value is oldVal, oldVal "" means the key does not exist
+	CompareAndSwap(key string, oldVal string, newVal string) (swapped bool, err error)
+	// PutIfAbsent puts the key-value with TTL (0 for no TTL) if key does not exist, returns the current value otherwise
+	PutIfAbsent(key string, val string, ttl time.Duration) (oldVal string, err error)
+	// Incr increases the integer value of key by delta and returns the new value, key not exist is treated as 0
+	Incr(key string, delta int64) (val int64, err error)
+	// Expire sets the TTL of key if key exists, ttl <= 0 removes the TTL
+	Expire(key string, ttl time.Duration) (err error)
 	HGet(name string, key string) (val string, err error)
 	HPut(name string, key string, val string) (err error)
 	Find(beginKey string, endKey string) (Iterator, error)
@@ -0,0 +1,349 @@
+// Package metrics collects metrics of GoWorld components and exports them in Prometheus text format
+//
+// Metrics are registered by name when created, and exported on the /metrics endpoint of the http server of every
+// component. All metrics are safe to be updated in any goroutine.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sagacao/goworld/engine/gwlog"
+)
+
+// DefaultDurationBuckets are the default histogram buckets for durations in seconds
+var DefaultDurationBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+var (
+	registryLock sync.Mutex
+	registry     = map[string]metric{}
+)
+
+func register(name string, m metric) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	if _, ok := registry[name]; ok {
+		gwlog.Panicf("metric %s is already registered", name)
+	}
+	registry[name] = m
+}
+
+// WriteMetrics writes all metrics to w in Prometheus text format
+func WriteMetrics(w io.Writer) {
+	registryLock.Lock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	metrics := make([]metric, len(names))
+	sort.Strings(names)
+	for i, name := range names {
+		metrics[i] = registry[name]
+	}
+	registryLock.Unlock()
+
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// Handler returns the http handler which exports all metrics
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		WriteMetrics(&buf)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(buf.Bytes())
+	})
+}
+
+// desc is the description of metric
+type desc struct {
+	name  string
+	help  string
+	typ   string
+	label string // label name of metric vectors
+}
+
+func (d *desc) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, escapeHelp(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.typ)
+}
+
+func (d *desc) writeSample(w io.Writer, suffix string, labelValue string, extraLabels string, value float64) {
+	var labels []string
+	if d.label != "" {
+		labels = append(labels, fmt.Sprintf("%s=\"%s\"", d.label, escapeLabelValue(labelValue)))
+	}
+	if extraLabels != "" {
+		labels = append(labels, extraLabels)
+	}
+
+	if len(labels) > 0 {
+		fmt.Fprintf(w, "%s%s{%s} %s\n", d.name, suffix, strings.Join(labels, ","), formatValue(value))
+	} else {
+		fmt.Fprintf(w, "%s%s %s\n", d.name, suffix, formatValue(value))
+	}
+}
+
+// Counter is a metric which only increases
+type Counter struct {
+	desc
+	value uint64
+}
+
+// NewCounter creates and registers a counter
+func NewCounter(name string, help string) *Counter {
+	c := &Counter{desc: desc{name: name, help: help, typ: "counter"}}
+	register(name, c)
+	return c
+}
+
+// Inc increases the counter by 1
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+// Add increases the counter by n
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.value, n)
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.writeHeader(w)
+	c.writeSample(w, "", "", "", float64(atomic.LoadUint64(&c.value)))
+}
+
+// CounterVec is a set of counters partitioned by value of one label
+type CounterVec struct {
+	desc
+	lock   sync.Mutex
+	values map[string]uint64
+}
+
+// NewCounterVec creates and registers a counter vector with the label name
+func NewCounterVec(name string, help string, label string) *CounterVec {
+	c := &CounterVec{desc: desc{name: name, help: help, typ: "counter", label: label}, values: map[string]uint64{}}
+	register(name, c)
+	return c
+}
+
+// Inc increases the counter of the label value by 1
+func (c *CounterVec) Inc(labelValue string) {
+	c.lock.Lock()
+	c.values[labelValue] += 1
+	c.lock.Unlock()
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.writeHeader(w)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, labelValue := range sortedKeys(c.values) {
+		c.writeSample(w, "", labelValue, "", float64(c.values[labelValue]))
+	}
+}
+
+// Gauge is a metric which can increase and decrease
+type Gauge struct {
+	desc
+	value int64
+}
+
+// NewGauge creates and registers a gauge
+func NewGauge(name string, help string) *Gauge {
+	g := &Gauge{desc: desc{name: name, help: help, typ: "gauge"}}
+	register(name, g)
+	return g
+}
+
+// Set sets the value of gauge
+func (g *Gauge) Set(v int64) {
+	atomic.StoreInt64(&g.value, v)
+}
+
+// Add adds delta to the gauge
+func (g *Gauge) Add(delta int64) {
+	atomic.AddInt64(&g.value, delta)
+}
+
+// Inc increases the gauge by 1
+func (g *Gauge) Inc() {
+	g.Add(1)
+}
+
+// Dec decreases the gauge by 1
+func (g *Gauge) Dec() {
+	g.Add(-1)
+}
+
+func (g *Gauge) write(w io.Writer) {
+	g.writeHeader(w)
+	g.writeSample(w, "", "", "", float64(atomic.LoadInt64(&g.value)))
+}
+
+// GaugeVec is a set of gauges partitioned by value of one label
+type GaugeVec struct {
+	desc
+	lock   sync.Mutex
+	values map[string]int64
+}
+
+// NewGaugeVec creates and registers a gauge vector with the label name
+func NewGaugeVec(name string, help string, label string) *GaugeVec {
+	g := &GaugeVec{desc: desc{name: name, help: help, typ: "gauge", label: label}, values: map[string]int64{}}
+	register(name, g)
+	return g
+}
+
+// Add adds delta to the gauge of the label value
+func (g *GaugeVec) Add(labelValue string, delta int64) {
+	g.lock.Lock()
+	g.values[labelValue] += delta
+	g.lock.Unlock()
+}
+
+func (g *GaugeVec) write(w io.Writer) {
+	g.writeHeader(w)
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for _, labelValue := range sortedKeys(g.values) {
+		g.writeSample(w, "", labelValue, "", float64(g.values[labelValue]))
+	}
+}
+
+// GaugeFunc is a gauge whose value is collected by calling the function when exported
+type GaugeFunc struct {
+	desc
+	f func() float64
+}
+
+// NewGaugeFunc creates and registers a gauge function
+//
+// f is called in http server goroutines, so it should be safe to be called in any goroutine (e.g. length of channels)
+func NewGaugeFunc(name string, help string, f func() float64) *GaugeFunc {
+	g := &GaugeFunc{desc: desc{name: name, help: help, typ: "gauge"}, f: f}
+	register(name, g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	g.writeHeader(w)
+	g.writeSample(w, "", "", "", g.f())
+}
+
+// HistogramVec is a set of histograms partitioned by value of one label
+type HistogramVec struct {
+	desc
+	buckets    []float64
+	lock       sync.Mutex
+	histograms map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // counts[i] is the number of observations <= buckets[i]
+	count  uint64
+	sum    float64
+}
+
+// NewHistogramVec creates and registers a histogram vector with the label name and upper bounds of buckets
+func NewHistogramVec(name string, help string, label string, buckets []float64) *HistogramVec {
+	if !sort.Float64sAreSorted(buckets) {
+		gwlog.Panicf("histogram %s: buckets are not sorted: %v", name, buckets)
+	}
+
+	h := &HistogramVec{desc: desc{name: name, help: help, typ: "histogram", label: label}, buckets: buckets, histograms: map[string]*histogram{}}
+	register(name, h)
+	return h
+}
+
+// Observe adds an observation to the histogram of the label value
+func (h *HistogramVec) Observe(labelValue string, v float64) {
+	h.lock.Lock()
+	hist := h.histograms[labelValue]
+	if hist == nil {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.histograms[labelValue] = hist
+	}
+	for i, upperBound := range h.buckets {
+		if v <= upperBound {
+			hist.counts[i] += 1
+		}
+	}
+	hist.count += 1
+	hist.sum += v
+	h.lock.Unlock()
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.writeHeader(w)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	labelValues := make([]string, 0, len(h.histograms))
+	for labelValue := range h.histograms {
+		labelValues = append(labelValues, labelValue)
+	}
+	sort.Strings(labelValues)
+
+	for _, labelValue := range labelValues {
+		hist := h.histograms[labelValue]
+		for i, upperBound := range h.buckets {
+			h.writeSample(w, "_bucket", labelValue, fmt.Sprintf("le=\"%s\"", formatValue(upperBound)), float64(hist.counts[i]))
+		}
+		h.writeSample(w, "_bucket", labelValue, "le=\"+Inf\"", float64(hist.count))
+		h.writeSample(w, "_sum", labelValue, "", hist.sum)
+		h.writeSample(w, "_count", labelValue, "", float64(hist.count))
+	}
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]uint64:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]int64:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	} else if math.IsInf(v, -1) {
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper       = strings.NewReplacer("\\", `\\`, "\n", `\n`)
+	labelValueEscaper = strings.NewReplacer("\\", `\\`, "\n", `\n`, "\"", `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabelValue(s string) string {
+	return labelValueEscaper.Replace(s)
+}
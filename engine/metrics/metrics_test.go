@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	counter := NewCounterVec("test_calls_total", "Number of calls", "method")
+	counter.Inc("Foo")
+	counter.Inc("Foo")
+	counter.Inc(`Bar"`)
+
+	gauge := NewGauge("test_clients", "Number of clients")
+	gauge.Inc()
+	gauge.Inc()
+	gauge.Dec()
+
+	NewGaugeFunc("test_queue_length", "Length of queue", func() float64 {
+		return 3
+	})
+
+	hist := NewHistogramVec("test_duration_seconds", "Duration", "op", []float64{0.1, 1})
+	hist.Observe("save", 0.05)
+	hist.Observe("save", 0.5)
+	hist.Observe("save", 2)
+
+	var buf bytes.Buffer
+	WriteMetrics(&buf)
+	output := buf.String()
+
+	expected := []string{
+		"# TYPE test_calls_total counter\n",
+		"test_calls_total{method=\"Foo\"} 2\n",
+		"test_calls_total{method=\"Bar\\\"\"} 1\n",
+		"# HELP test_clients Number of clients\n",
+		"test_clients 1\n",
+		"test_queue_length 3\n",
+		"# TYPE test_duration_seconds histogram\n",
+		"test_duration_seconds_bucket{op=\"save\",le=\"0.1\"} 1\n",
+		"test_duration_seconds_bucket{op=\"save\",le=\"1\"} 2\n",
+		"test_duration_seconds_bucket{op=\"save\",le=\"+Inf\"} 3\n",
+		"test_duration_seconds_sum{op=\"save\"} 2.55\n",
+		"test_duration_seconds_count{op=\"save\"} 3\n",
+	}
+	for _, line := range expected {
+		if !strings.Contains(output, line) {
+			t.Errorf("%q is not found in output:\n%s", line, output)
+		}
+	}
+
+	// metrics are written in order of names
+	if strings.Index(output, "test_calls_total") > strings.Index(output, "test_clients") {
+		t.Errorf("metrics are not sorted:\n%s", output)
+	}
+}
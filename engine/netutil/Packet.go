@@ -178,9 +178,7 @@ func (p *Packet) UnreadPayload() []byte {
 
 // HasUnreadPayload returns if all payload is read
 func (p *Packet) HasUnreadPayload() bool {
-	pos := p.readCursor + _PREPAYLOAD_SIZE
-	plen := p.GetPayloadLen()
-	return pos < plen
+	return p.readCursor < p.GetPayloadLen()
 }
 
 func (p *Packet) data() []byte {
@@ -125,3 +125,23 @@ func TestPacketConnection(t *testing.T) {
 	}
 
 }
+
+func TestPacketHasUnreadPayload(t *testing.T) {
+	packet := NewPacket()
+	defer packet.Release()
+	if packet.HasUnreadPayload() {
+		t.Fatalf("empty packet should have no unread payload")
+	}
+
+	packet.AppendByte(1)
+	packet.AppendUint16(2)
+	if !packet.HasUnreadPayload() || packet.ReadOneByte() != 1 {
+		t.Fatalf("the first byte should be unread")
+	}
+	if !packet.HasUnreadPayload() || packet.ReadUint16() != 2 {
+		t.Fatalf("the last uint16 should be unread")
+	}
+	if packet.HasUnreadPayload() {
+		t.Fatalf("all payload should be read")
+	}
+}
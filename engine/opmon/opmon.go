@@ -11,6 +11,7 @@ import (
 
 	"github.com/sagacao/goworld/engine/consts"
 	"github.com/sagacao/goworld/engine/gwlog"
+	"github.com/sagacao/goworld/engine/metrics"
 )
 
 var (
@@ -21,6 +22,8 @@ var (
 	}
 
 	monitor = newMonitor()
+
+	operationDurations = metrics.NewHistogramVec("goworld_operation_duration_seconds", "Durations of monitored operations", "operation", metrics.DefaultDurationBuckets)
 )
 
 func init() {
@@ -65,6 +68,7 @@ func (monitor *_Monitor) record(opname string, duration time.Duration) {
 		info.maxDuration = duration
 	}
 	monitor.Unlock()
+	operationDurations.Observe(opname, duration.Seconds())
 }
 
 func (monitor *_Monitor) Dump() {
@@ -15,9 +15,10 @@ import (
 
 // GoWorldConnection is the network protocol implementation of GoWorld components (dispatcher, gate, game)
 type GoWorldConnection struct {
-	packetConn   *netutil.PacketConnection
-	closed       xnsyncutil.AtomicBool
-	autoFlushing bool
+	packetConn     *netutil.PacketConnection
+	closed         xnsyncutil.AtomicBool
+	autoFlushing   bool
+	sendPacketHook func(packet *netutil.Packet) error
 }
 
 // NewGoWorldConnection creates a GoWorldConnection using network connection
@@ -33,8 +34,11 @@ func NewGoWorldConnection(conn netutil.Connection, compressConnection bool, comp
 }
 
 // SendSetGameID sends MT_SET_GAME_ID message
+//
+// Packets sent after MT_SET_GAME_ID are numbered from firstSeq, and epoch identifies the sequence. dispatcherEpoch is
+// the latest epoch of active dispatchers known by the game.
 func (gwc *GoWorldConnection) SendSetGameID(id uint16, isReconnect bool, isRestore bool, isBanBootEntity bool,
-	eids []common.EntityID) error {
+	eids []common.EntityID, epoch uint64, firstSeq uint64, dispatcherEpoch uint64) error {
 	packet := gwc.packetConn.NewPacket()
 	packet.AppendUint16(MT_SET_GAME_ID)
 	packet.AppendUint16(id)
@@ -47,17 +51,60 @@ func (gwc *GoWorldConnection) SendSetGameID(id uint16, isReconnect bool, isResto
 	for _, eid := range eids {
 		packet.AppendEntityID(eid)
 	}
+	packet.AppendUint64(epoch)
+	packet.AppendUint64(firstSeq)
+	packet.AppendUint64(dispatcherEpoch)
 	return gwc.SendPacketRelease(packet)
 }
 
 // SendSetGateID sends MT_SET_GATE_ID message
-func (gwc *GoWorldConnection) SendSetGateID(id uint16) error {
+//
+// Packets sent after MT_SET_GATE_ID are numbered from firstSeq, and epoch identifies the sequence. dispatcherEpoch is
+// the latest epoch of active dispatchers known by the gate.
+func (gwc *GoWorldConnection) SendSetGateID(id uint16, epoch uint64, firstSeq uint64, dispatcherEpoch uint64) error {
 	packet := gwc.packetConn.NewPacket()
 	packet.AppendUint16(MT_SET_GATE_ID)
 	packet.AppendUint16(id)
+	packet.AppendUint64(epoch)
+	packet.AppendUint64(firstSeq)
+	packet.AppendUint64(dispatcherEpoch)
 	return gwc.SendPacketRelease(packet)
 }
 
+// SendSetStandbyDispatcher sends MT_SET_STANDBY_DISPATCHER message
+//
+// isActive and epoch are the role of the sending dispatcher, which are used by the peer to decide which one is active
+func (gwc *GoWorldConnection) SendSetStandbyDispatcher(dispid uint16, isActive bool, epoch uint64) error {
+	packet := gwc.packetConn.NewPacket()
+	packet.AppendUint16(MT_SET_STANDBY_DISPATCHER)
+	packet.AppendUint16(dispid)
+	packet.AppendBool(isActive)
+	packet.AppendUint64(epoch)
+	return gwc.SendPacketRelease(packet)
+}
+
+// SendDispatcherAck sends MT_DISPATCHER_ACK message
+func (gwc *GoWorldConnection) SendDispatcherAck(dispatcherEpoch uint64, seq uint64) error {
+	packet := gwc.packetConn.NewPacket()
+	packet.AppendUint16(MT_DISPATCHER_ACK)
+	packet.AppendUint64(dispatcherEpoch)
+	packet.AppendUint64(seq)
+	return gwc.SendPacketRelease(packet)
+}
+
+// SendDispatcherClientAck sends MT_DISPATCHER_CLIENT_ACK message
+//
+// seq is the number of packets received from dispatcher on the connection. It is sent without the send packet hook, so
+// that it is not kept for resending.
+func (gwc *GoWorldConnection) SendDispatcherClientAck(seq uint64) error {
+	packet := gwc.packetConn.NewPacket()
+	packet.AppendUint16(MT_DISPATCHER_CLIENT_ACK)
+	packet.AppendUint64(seq)
+	err := gwc.SendPacketNoHook(packet)
+	packet.Release()
+	return err
+}
+
 // SendNotifyCreateEntity sends MT_NOTIFY_CREATE_ENTITY message
 func (gwc *GoWorldConnection) SendNotifyCreateEntity(id common.EntityID) error {
 	packet := gwc.packetConn.NewPacket()
@@ -75,20 +122,35 @@ func (gwc *GoWorldConnection) SendNotifyDestroyEntity(id common.EntityID) error
 }
 
 // SendNotifyClientConnected sends MT_NOTIFY_CLIENT_CONNECTED message
-func (gwc *GoWorldConnection) SendNotifyClientConnected(id common.ClientID, bootEid common.EntityID) error {
+func (gwc *GoWorldConnection) SendNotifyClientConnected(id common.ClientID, bootEid common.EntityID, resumeToken string) error {
 	packet := gwc.packetConn.NewPacket()
 	packet.AppendUint16(MT_NOTIFY_CLIENT_CONNECTED)
 	packet.AppendClientID(id)
 	packet.AppendEntityID(bootEid)
+	packet.AppendVarStr(resumeToken)
 	return gwc.SendPacketRelease(packet)
 }
 
 // SendNotifyClientDisconnected sends MT_NOTIFY_CLIENT_DISCONNECTED message
-func (gwc *GoWorldConnection) SendNotifyClientDisconnected(id common.ClientID, ownerEntityID common.EntityID) error {
+//
+// If resumable is true, the owner entity can keep the client for resuming the session on a new connection
+func (gwc *GoWorldConnection) SendNotifyClientDisconnected(id common.ClientID, ownerEntityID common.EntityID, resumable bool) error {
 	packet := gwc.packetConn.NewPacket()
 	packet.AppendUint16(MT_NOTIFY_CLIENT_DISCONNECTED)
 	packet.AppendEntityID(ownerEntityID)
 	packet.AppendClientID(id)
+	packet.AppendBool(resumable)
+	return gwc.SendPacketRelease(packet)
+}
+
+// SendResumeClient sends MT_RESUME_CLIENT message
+func (gwc *GoWorldConnection) SendResumeClient(ownerEntityID common.EntityID, clientid common.ClientID, resumeToken string, newResumeToken string) error {
+	packet := gwc.packetConn.NewPacket()
+	packet.AppendUint16(MT_RESUME_CLIENT)
+	packet.AppendEntityID(ownerEntityID)
+	packet.AppendClientID(clientid)
+	packet.AppendVarStr(resumeToken)
+	packet.AppendVarStr(newResumeToken)
 	return gwc.SendPacketRelease(packet)
 }
 
@@ -134,6 +196,56 @@ func (gwc *GoWorldConnection) SendCallEntityMethod(id common.EntityID, method st
 	return gwc.SendPacketRelease(packet)
 }
 
+// SendCallEntityMethodWithReply sends MT_CALL_ENTITY_METHOD_WITH_REPLY message
+func (gwc *GoWorldConnection) SendCallEntityMethodWithReply(id common.EntityID, method string, args []interface{}, callerID common.EntityID, replyID uint32) error {
+	packet := gwc.packetConn.NewPacket()
+	packet.AppendUint16(MT_CALL_ENTITY_METHOD_WITH_REPLY)
+	packet.AppendEntityID(id)
+	packet.AppendVarStr(method)
+	packet.AppendArgs(args)
+	packet.AppendEntityID(callerID)
+	packet.AppendUint32(replyID)
+	return gwc.SendPacketRelease(packet)
+}
+
+// SendCallEntityMethodReply sends MT_CALL_ENTITY_METHOD_REPLY message
+func (gwc *GoWorldConnection) SendCallEntityMethodReply(callerID common.EntityID, replyID uint32, errmsg string, results []interface{}) error {
+	packet := gwc.packetConn.NewPacket()
+	packet.AppendUint16(MT_CALL_ENTITY_METHOD_REPLY)
+	packet.AppendEntityID(callerID)
+	packet.AppendUint32(replyID)
+	packet.AppendVarStr(errmsg)
+	packet.AppendArgs(results)
+	return gwc.SendPacketRelease(packet)
+}
+
+// SendCallEntityMethodReliable sends MT_CALL_ENTITY_METHOD_RELIABLE message
+//
+// args are arguments packed by MSG_PACKER
+func (gwc *GoWorldConnection) SendCallEntityMethodReliable(id common.EntityID, method string, args [][]byte, callerID common.EntityID, seq uint64) error {
+	packet := gwc.packetConn.NewPacket()
+	packet.AppendUint16(MT_CALL_ENTITY_METHOD_RELIABLE)
+	packet.AppendEntityID(id)
+	packet.AppendVarStr(method)
+	packet.AppendUint16(uint16(len(args)))
+	for _, arg := range args {
+		packet.AppendVarBytes(arg)
+	}
+	packet.AppendEntityID(callerID)
+	packet.AppendUint64(seq)
+	return gwc.SendPacketRelease(packet)
+}
+
+// SendReliableCallAck sends MT_RELIABLE_CALL_ACK message
+func (gwc *GoWorldConnection) SendReliableCallAck(callerID common.EntityID, calleeID common.EntityID, seq uint64) error {
+	packet := gwc.packetConn.NewPacket()
+	packet.AppendUint16(MT_RELIABLE_CALL_ACK)
+	packet.AppendEntityID(callerID)
+	packet.AppendEntityID(calleeID)
+	packet.AppendUint64(seq)
+	return gwc.SendPacketRelease(packet)
+}
+
 // SendCallEntityMethodFromClient sends MT_CALL_ENTITY_METHOD_FROM_CLIENT message
 func (gwc *GoWorldConnection) SendCallEntityMethodFromClient(id common.EntityID, method string, args []interface{}) error {
 	packet := gwc.packetConn.NewPacket()
@@ -174,12 +286,23 @@ func (gwc *GoWorldConnection) SendSyncPositionYawFromClient(entityID common.Enti
 	return gwc.SendPacketRelease(packet)
 }
 
-//func (gwc *GoWorldConnection) SendSetClientClientID(clientid common.ClientID) error {
-//	packet := gwc.packetConn.NewPacket()
-//	packet.AppendUint16(MT_SET_CLIENT_CLIENTID)
-//	packet.AppendClientID(clientid)
-//	return gwc.SendPacketRelease(packet)
-//}
+// SendSetClientClientID sends MT_SET_CLIENT_CLIENTID message
+func (gwc *GoWorldConnection) SendSetClientClientID(clientid common.ClientID, resumeToken string) error {
+	packet := gwc.packetConn.NewPacket()
+	packet.AppendUint16(MT_SET_CLIENT_CLIENTID)
+	packet.AppendClientID(clientid)
+	packet.AppendVarStr(resumeToken)
+	return gwc.SendPacketRelease(packet)
+}
+
+// SendResumeClientFromClient sends MT_RESUME_CLIENT_FROM_CLIENT message
+func (gwc *GoWorldConnection) SendResumeClientFromClient(ownerEntityID common.EntityID, resumeToken string) error {
+	packet := gwc.packetConn.NewPacket()
+	packet.AppendUint16(MT_RESUME_CLIENT_FROM_CLIENT)
+	packet.AppendEntityID(ownerEntityID)
+	packet.AppendVarStr(resumeToken)
+	return gwc.SendPacketRelease(packet)
+}
 
 func (gwc *GoWorldConnection) SetHeartbeatFromClient() error {
 	packet := gwc.packetConn.NewPacket()
@@ -283,6 +406,17 @@ func (gwc *GoWorldConnection) SendCallEntityMethodOnClient(gateid uint16, client
 	return gwc.SendPacketRelease(packet)
 }
 
+// SendNotifyClientResumedOnClient sends MT_NOTIFY_CLIENT_RESUMED_ON_CLIENT message
+func (gwc *GoWorldConnection) SendNotifyClientResumedOnClient(gateid uint16, clientid common.ClientID, ownerEntityID common.EntityID, resumed bool) error {
+	packet := gwc.packetConn.NewPacket()
+	packet.AppendUint16(MT_NOTIFY_CLIENT_RESUMED_ON_CLIENT)
+	packet.AppendUint16(gateid)
+	packet.AppendClientID(clientid)
+	packet.AppendEntityID(ownerEntityID)
+	packet.AppendBool(resumed)
+	return gwc.SendPacketRelease(packet)
+}
+
 // SendSetClientFilterProp sends MT_SET_CLIENTPROXY_FILTER_PROP message
 func (gwc *GoWorldConnection) SendSetClientFilterProp(gateid uint16, clientid common.ClientID, key, val string) (err error) {
 	packet := gwc.packetConn.NewPacket()
@@ -332,6 +466,25 @@ func AllocGameLBCInfoPacket(lbcinfo GameLBCInfo) *netutil.Packet {
 	return packet
 }
 
+// SendRebalanceEntities sends MT_REBALANCE_ENTITIES message
+func (gwc *GoWorldConnection) SendRebalanceEntities(targetGameID uint16, count int, dryRun bool) error {
+	packet := gwc.packetConn.NewPacket()
+	packet.AppendUint16(MT_REBALANCE_ENTITIES)
+	packet.AppendUint16(targetGameID)
+	packet.AppendUint32(uint32(count))
+	packet.AppendBool(dryRun)
+	return gwc.SendPacketRelease(packet)
+}
+
+// SendClaimCrontabSingleton sends MT_CLAIM_CRONTAB_SINGLETON message
+func (gwc *GoWorldConnection) SendClaimCrontabSingleton(name string, fireTime int64) error {
+	packet := gwc.packetConn.NewPacket()
+	packet.AppendUint16(MT_CLAIM_CRONTAB_SINGLETON)
+	packet.AppendVarStr(name)
+	packet.AppendUint64(uint64(fireTime))
+	return gwc.SendPacketRelease(packet)
+}
+
 // SendQuerySpaceGameIDForMigrate sends MT_QUERY_SPACE_GAMEID_FOR_MIGRATE message
 func (gwc *GoWorldConnection) SendQuerySpaceGameIDForMigrate(spaceid common.EntityID, entityid common.EntityID) error {
 	packet := gwc.packetConn.NewPacket()
@@ -423,18 +576,46 @@ func (gwc *GoWorldConnection) SendSetGameIDAck(dispid uint16, isDeploymentReady
 	return gwc.SendPacketRelease(pkt)
 }
 
+// NewPacketRecorder creates a GoWorldConnection which passes all packets to record instead of sending them
+//
+// It can be used to build packets using Send* methods. The packet is released after record returns, so record should
+// copy the payload if it is kept.
+func NewPacketRecorder(record func(packet *netutil.Packet)) *GoWorldConnection {
+	return &GoWorldConnection{
+		sendPacketHook: func(packet *netutil.Packet) error {
+			record(packet)
+			return nil
+		},
+	}
+}
+
 // SendPacket send a packet to remote
 func (gwc *GoWorldConnection) SendPacket(packet *netutil.Packet) error {
+	if gwc.sendPacketHook != nil {
+		return gwc.sendPacketHook(packet)
+	}
 	return gwc.packetConn.SendPacket(packet)
 }
 
 // SendPacketRelease send a packet to remote and then release the packet
 func (gwc *GoWorldConnection) SendPacketRelease(packet *netutil.Packet) error {
-	err := gwc.packetConn.SendPacket(packet)
+	err := gwc.SendPacket(packet)
 	packet.Release()
 	return err
 }
 
+// SendPacketNoHook sends a packet to remote directly, even if a send packet hook is set
+func (gwc *GoWorldConnection) SendPacketNoHook(packet *netutil.Packet) error {
+	return gwc.packetConn.SendPacket(packet)
+}
+
+// SetSendPacketHook sets the hook which sends packets instead of the connection
+//
+// The hook should be set before the connection is used by other goroutines. It can use SendPacketNoHook to send packets.
+func (gwc *GoWorldConnection) SetSendPacketHook(hook func(packet *netutil.Packet) error) {
+	gwc.sendPacketHook = hook
+}
+
 // Flush connection writes
 func (gwc *GoWorldConnection) Flush(reason string) error {
 	return gwc.packetConn.Flush(reason)
@@ -73,6 +73,28 @@ const (
 	MT_NOTIFY_DEPLOYMENT_READY
 	// MT_GAME_LBC_INFO contains game load balacing info
 	MT_GAME_LBC_INFO
+	// MT_CALL_ENTITY_METHOD_WITH_REPLY is a message type for calling entity methods which expect a reply
+	MT_CALL_ENTITY_METHOD_WITH_REPLY
+	// MT_CALL_ENTITY_METHOD_REPLY is a message type for replying entity method calls to the caller entity
+	MT_CALL_ENTITY_METHOD_REPLY
+	// MT_SET_STANDBY_DISPATCHER is sent by standby dispatcher to the active dispatcher of the same slot to start state replication
+	MT_SET_STANDBY_DISPATCHER
+	// MT_REPLICATE_DISPATCHER_STATE is sent by active dispatcher to standby dispatcher to replicate routing tables and srvdis data
+	MT_REPLICATE_DISPATCHER_STATE
+	// MT_DISPATCHER_ACK is sent by dispatcher to games and gates to acknowledge received packets
+	MT_DISPATCHER_ACK
+	// MT_CALL_ENTITY_METHOD_RELIABLE is a message type for reliable entity method calls
+	MT_CALL_ENTITY_METHOD_RELIABLE
+	// MT_RELIABLE_CALL_ACK is sent by callee entity to the caller entity to acknowledge reliable calls
+	MT_RELIABLE_CALL_ACK
+	// MT_RESUME_CLIENT is sent by gate to the owner entity of a disconnected client to resume the client session on a new connection
+	MT_RESUME_CLIENT
+	// MT_REBALANCE_ENTITIES is sent by dispatcher to an overloaded game to migrate entities to another game
+	MT_REBALANCE_ENTITIES
+	// MT_CLAIM_CRONTAB_SINGLETON is sent by game to claim the run of a singleton crontab job, and replied by dispatcher
+	MT_CLAIM_CRONTAB_SINGLETON
+	// MT_DISPATCHER_CLIENT_ACK is sent by games and gates to dispatcher to acknowledge packets received from dispatcher
+	MT_DISPATCHER_CLIENT_ACK
 )
 
 // Alias message types
@@ -80,6 +102,7 @@ const (
 	// MT_MIGRATE_REQUEST_ACK is a message type for entity migrations
 	MT_MIGRATE_REQUEST_ACK                = MT_MIGRATE_REQUEST
 	MT_QUERY_SPACE_GAMEID_FOR_MIGRATE_ACK = MT_QUERY_SPACE_GAMEID_FOR_MIGRATE
+	MT_CLAIM_CRONTAB_SINGLETON_ACK        = MT_CLAIM_CRONTAB_SINGLETON
 )
 
 const (
@@ -109,6 +132,16 @@ const (
 	MT_CLEAR_CLIENTPROXY_FILTER_PROPS
 	// MT_NOTIFY_MAP_ATTR_CLEAR_ON_CLIENT message type
 	MT_NOTIFY_MAP_ATTR_CLEAR_ON_CLIENT
+	// MT_NOTIFY_ATTR_CHANGES_ON_CLIENT message type: attribute changes of one tick to one client
+	//
+	// The payload is gateid, clientid and then a sequence of changes till the end of packet. Each change starts with
+	// the message type of the single change message (MT_NOTIFY_MAP_ATTR_CHANGE_ON_CLIENT, MT_NOTIFY_LIST_ATTR_POP_ON_CLIENT, etc.)
+	// and is followed by the payload of that message without gateid and clientid. Changes must be applied in order.
+	MT_NOTIFY_ATTR_CHANGES_ON_CLIENT
+	// MT_NOTIFY_CLIENT_RESUMED_ON_CLIENT message type: result of resuming the client session
+	//
+	// If the session is resumed, messages missed during disconnection are replayed after this message
+	MT_NOTIFY_CLIENT_RESUMED_ON_CLIENT
 	// MT_REDIRECT_TO_GATEPROXY_MSG_TYPE_STOP message type
 	MT_REDIRECT_TO_GATEPROXY_MSG_TYPE_STOP = 1499
 )
@@ -124,12 +157,14 @@ const (
 
 // Messages types that is sent directly between Gate & Client
 const (
-	// MT_SET_CLIENT_CLIENTID message is sent to client to set its clientid
+	// MT_SET_CLIENT_CLIENTID message is sent to client to set its clientid and the token for resuming the session
 	MT_SET_CLIENT_CLIENTID = 2001 + iota
 	MT_UDP_SYNC_CONN_NOTIFY_CLIENTID
 	MT_UDP_SYNC_CONN_NOTIFY_CLIENTID_ACK
 	// MT_HEARTBEAT_FROM_CLIENT is sent by client to notify the gate server that the client is alive
 	MT_HEARTBEAT_FROM_CLIENT
+	// MT_RESUME_CLIENT_FROM_CLIENT is sent by client on a new connection to resume the session of a disconnected connection
+	MT_RESUME_CLIENT_FROM_CLIENT
 )
 
 const (
@@ -164,5 +199,52 @@ func init() {
 
 // GameLBCInfo defines the info for game load balancing
 type GameLBCInfo struct {
-	CPUPercent float64 `msgpack:"cp"`
+	CPUPercent  float64 `msgpack:"cp"`
+	EntityCount int     `msgpack:"ec"`
+	ClientCount int     `msgpack:"cc"`
+	MemoryBytes uint64  `msgpack:"mem"` // resident memory of the game process
+	Weight      int     `msgpack:"w"`   // weight of the game for weighted round robin
+}
+
+// AttrChange is one attribute change in MT_NOTIFY_ATTR_CHANGES_ON_CLIENT message
+type AttrChange struct {
+	MsgType  MsgType
+	EntityID common.EntityID
+	Path     []interface{}
+	Key      string      // for MapAttr changes
+	Index    uint32      // for ListAttr changes
+	Val      interface{} // for changing and appending
+}
+
+// ReadAttrChange reads one attribute change of MT_NOTIFY_ATTR_CHANGES_ON_CLIENT message from packet
+//
+// Clients should read changes until the packet has no unread payload
+func ReadAttrChange(packet *netutil.Packet) (change AttrChange) {
+	msgtype := MsgType(packet.ReadUint16())
+	return ReadAttrChangeOfType(msgtype, packet)
+}
+
+// ReadAttrChangeOfType reads one attribute change of the message type from packet
+//
+// Packet of a single change message (e.g. MT_NOTIFY_MAP_ATTR_CHANGE_ON_CLIENT) should be read after gateid and clientid
+func ReadAttrChangeOfType(msgtype MsgType, packet *netutil.Packet) (change AttrChange) {
+	change.MsgType = msgtype
+	change.EntityID = packet.ReadEntityID()
+	packet.ReadData(&change.Path)
+	switch change.MsgType {
+	case MT_NOTIFY_MAP_ATTR_CHANGE_ON_CLIENT:
+		change.Key = packet.ReadVarStr()
+		packet.ReadData(&change.Val)
+	case MT_NOTIFY_MAP_ATTR_DEL_ON_CLIENT:
+		change.Key = packet.ReadVarStr()
+	case MT_NOTIFY_LIST_ATTR_CHANGE_ON_CLIENT:
+		change.Index = packet.ReadUint32()
+		packet.ReadData(&change.Val)
+	case MT_NOTIFY_LIST_ATTR_APPEND_ON_CLIENT:
+		packet.ReadData(&change.Val)
+	case MT_NOTIFY_MAP_ATTR_CLEAR_ON_CLIENT, MT_NOTIFY_LIST_ATTR_POP_ON_CLIENT:
+	default:
+		gwlog.Panicf("invalid attribute change message type: %d", change.MsgType)
+	}
+	return
 }
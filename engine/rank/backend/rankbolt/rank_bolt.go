@@ -0,0 +1,212 @@
+package rankbolt
+
+import (
+	"encoding/binary"
+	"io"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/sagacao/goworld/engine/boltdb"
+	"github.com/sagacao/goworld/engine/netutil"
+	"github.com/sagacao/goworld/engine/rank/types"
+	"go.etcd.io/bbolt"
+)
+
+const (
+	_RANK_BUCKET      = "_rank"
+	_RANK_DATA_BUCKET = "_rank_data"
+	// _SCORES_BUCKET maps fields to scores in the bucket of each rank
+	_SCORES_BUCKET = "scores"
+	// _INDEX_BUCKET contains sort keys of scores and fields in the bucket of each rank
+	_INDEX_BUCKET = "index"
+)
+
+var (
+	dataPacker = netutil.MessagePackMsgPacker{}
+)
+
+// boltRank saves ranks in bolt database, fields are ordered by scores and then fields in descending order like redis ZREVRANGE
+type boltRank struct {
+	db *boltdb.DB
+}
+
+// OpenBoltRank opens the bolt database file as Rank backend
+func OpenBoltRank(path string) (ranktypes.RankEngine, error) {
+	db, err := boltdb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &boltRank{
+		db: db,
+	}, nil
+}
+
+func encodeScore(score int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(score)^(1<<63)) // flip the sign bit so that bytes are ordered as scores
+	return b
+}
+
+func decodeScore(b []byte) int64 {
+	return int64(binary.BigEndian.Uint64(b) ^ (1 << 63))
+}
+
+func sortKey(score []byte, field string) []byte {
+	return append(append([]byte{}, score...), field...)
+}
+
+func (db *boltRank) Get(key string) (val map[string]string, err error) {
+	err = db.db.View(func(tx *bbolt.Tx) error {
+		val, err = getData(tx, key)
+		return err
+	})
+	return
+}
+
+func getData(tx *bbolt.Tx, field string) (map[string]string, error) {
+	var val map[string]string
+	b := tx.Bucket([]byte(_RANK_DATA_BUCKET))
+	if b == nil {
+		return val, nil
+	}
+	data := b.Get([]byte(field))
+	if data == nil {
+		return val, nil
+	}
+	err := dataPacker.UnpackMsg(data, &val)
+	return val, err
+}
+
+func (db *boltRank) Put(key string, field string, score int64, val interface{}) error {
+	data, err := dataPacker.PackMsg(val, nil)
+	if err != nil {
+		return err
+	}
+
+	return db.db.Update(func(tx *bbolt.Tx) error {
+		scores, err := boltdb.Bucket(tx, _RANK_BUCKET, key, _SCORES_BUCKET)
+		if err != nil {
+			return err
+		}
+		index, err := boltdb.Bucket(tx, _RANK_BUCKET, key, _INDEX_BUCKET)
+		if err != nil {
+			return err
+		}
+
+		if old := scores.Get([]byte(field)); old != nil {
+			if err := index.Delete(sortKey(old, field)); err != nil {
+				return err
+			}
+		}
+		s := encodeScore(score)
+		if err := scores.Put([]byte(field), s); err != nil {
+			return err
+		}
+		if err := index.Put(sortKey(s, field), nil); err != nil {
+			return err
+		}
+
+		dataBucket, err := tx.CreateBucketIfNotExists([]byte(_RANK_DATA_BUCKET))
+		if err != nil {
+			return err
+		}
+		return dataBucket.Put([]byte(field), data)
+	})
+}
+
+func (db *boltRank) GetRank(key string, uid string) (rank int, err error) {
+	rank = -1
+	err = db.db.View(func(tx *bbolt.Tx) error {
+		scores := boltdb.LookupBucket(tx, _RANK_BUCKET, key, _SCORES_BUCKET)
+		index := boltdb.LookupBucket(tx, _RANK_BUCKET, key, _INDEX_BUCKET)
+		var s []byte
+		if scores != nil {
+			s = scores.Get([]byte(uid))
+		}
+		if s == nil {
+			return errors.Errorf("%s is not in rank %s", uid, key)
+		}
+
+		// count fields ranked before uid, which have larger sort keys
+		c := index.Cursor()
+		for k, _ := c.Seek(sortKey(s, uid)); k != nil; k, _ = c.Next() {
+			rank++
+		}
+		return nil
+	})
+	return
+}
+
+type boltRankIterator struct {
+	items []ranktypes.KVItem
+}
+
+func (it *boltRankIterator) Next() (ranktypes.KVItem, error) {
+	if len(it.items) == 0 {
+		return ranktypes.KVItem{}, io.EOF
+	}
+
+	item := it.items[0]
+	it.items = it.items[1:]
+	return item, nil
+}
+
+// List returns items ranked from beginKey to endKey (inclusive, negative ranks count from the end) like redis ZREVRANGE
+func (db *boltRank) List(key string, beginKey string, endKey string) (ranktypes.Iterator, error) {
+	start, err := strconv.Atoi(beginKey)
+	if err != nil {
+		return nil, err
+	}
+	stop, err := strconv.Atoi(endKey)
+	if err != nil {
+		return nil, err
+	}
+
+	it := &boltRankIterator{}
+	err = db.db.View(func(tx *bbolt.Tx) error {
+		index := boltdb.LookupBucket(tx, _RANK_BUCKET, key, _INDEX_BUCKET)
+		if index == nil {
+			return nil
+		}
+
+		n := index.Stats().KeyN
+		if start < 0 {
+			start += n
+		}
+		if stop < 0 {
+			stop += n
+		}
+		if start < 0 {
+			start = 0
+		}
+
+		c := index.Cursor()
+		rank := 0
+		for k, _ := c.Last(); k != nil && rank <= stop; k, _ = c.Prev() {
+			if rank >= start {
+				field := string(k[8:])
+				val, err := getData(tx, field)
+				if err != nil {
+					return err
+				}
+				if val == nil {
+					val = map[string]string{}
+				}
+				val["score"] = strconv.FormatInt(decodeScore(k[:8]), 10)
+				it.items = append(it.items, ranktypes.KVItem{Key: field, Val: val})
+			}
+			rank++
+		}
+		return nil
+	})
+	return it, err
+}
+
+func (db *boltRank) Close() {
+	// the database file is only opened in transactions
+}
+
+func (db *boltRank) IsConnectionError(err error) bool {
+	return false
+}
@@ -0,0 +1,60 @@
+package rankbolt
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sagacao/goworld/engine/rank/types"
+)
+
+func TestBoltRank(t *testing.T) {
+	dir, err := os.MkdirTemp("", "goworld_bolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := OpenBoltRank(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		field string
+		score int64
+	}{{"a", 10}, {"b", -5}, {"c", 30}, {"d", 10}, {"b", 20}} {
+		if err := db.Put("level", c.field, c.score, map[string]string{"name": c.field}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for field, rank := range map[string]int{"c": 0, "b": 1, "d": 2, "a": 3} {
+		if r, err := db.GetRank("level", field); r != rank || err != nil {
+			t.Errorf("rank of %s should be %d, but got %d, %v", field, rank, r, err)
+		}
+	}
+	if _, err := db.GetRank("level", "x"); err == nil {
+		t.Errorf("field not in rank should fail")
+	}
+
+	if val, err := db.Get("b"); err != nil || val["name"] != "b" {
+		t.Errorf("wrong data: %v, %v", val, err)
+	}
+
+	it, err := db.List("level", "1", "-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var items []ranktypes.KVItem
+	for {
+		item, err := it.Next()
+		if err == io.EOF {
+			break
+		}
+		items = append(items, item)
+	}
+	if len(items) != 2 || items[0].Key != "b" || items[1].Key != "d" || items[0].Val.(map[string]string)["score"] != "20" {
+		t.Errorf("wrong items: %v", items)
+	}
+}
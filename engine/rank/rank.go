@@ -10,6 +10,7 @@ import (
 	"github.com/sagacao/goworld/engine/async"
 	"github.com/sagacao/goworld/engine/config"
 	"github.com/sagacao/goworld/engine/gwlog"
+	"github.com/sagacao/goworld/engine/rank/backend/rankbolt"
 	"github.com/sagacao/goworld/engine/rank/backend/rankredis"
 	"github.com/sagacao/goworld/engine/rank/backend/rankrediscluster"
 	"github.com/sagacao/goworld/engine/rank/types"
@@ -66,6 +67,8 @@ func assureRankEngineReady() (err error) {
 		rankEngine, err = rankredis.OpenRedisRank(rankCfg.Url, rankCfg.Prefix, rankCfg.Auth, dbindex)
 	} else if rankCfg.Type == "redis_cluster" {
 		rankEngine, err = rankrediscluster.OpenRedisRank(rankCfg.StartNodes.ToList(), rankCfg.Prefix, rankCfg.Auth)
+	} else if rankCfg.Type == "bolt" {
+		rankEngine, err = rankbolt.OpenBoltRank(rankCfg.Url)
 	} else {
 		gwlog.Fatalf("RANK type %s is not implemented", rankCfg.Type)
 	}
@@ -1,7 +1,10 @@
 package service
 
 import (
+	"crypto/md5"
 	"fmt"
+	"hash/fnv"
+	"sort"
 	"time"
 
 	"strings"
@@ -17,6 +20,7 @@ import (
 	"github.com/sagacao/goworld/engine/gwvar"
 	"github.com/sagacao/goworld/engine/srvdis"
 	"github.com/sagacao/goworld/engine/storage"
+	"github.com/sagacao/goworld/engine/uuid"
 	"github.com/xiaonanln/goTimer"
 )
 
@@ -28,19 +32,45 @@ const (
 )
 
 var (
-	registeredServices = common.StringSet{}
+	registeredServices = map[string]*ServiceDesc{}
 	gameid             uint16
-	serviceMap         = map[string]common.EntityID{} // ServiceName -> Entity ID
+	getOnlineGames     func() common.Uint16Set
+	serviceMap         = map[string][]common.EntityID{}       // ServiceName -> Entity IDs of shards
+	localShards        = map[string]map[int]common.EntityID{} // ServiceName -> Shard Index -> Entity ID of local shard entity
+	roundRobinIndex    = map[string]int{}
 	checkTimer         *timer.Timer
 )
 
-func RegisterService(typeName string, entityPtr entity.IEntity) {
+// ServiceDesc is the description of registered service
+type ServiceDesc struct {
+	name       string
+	shardCount int
+}
+
+// SetShardCount sets the number of shards of the service
+//
+// Each shard is a service entity on one of the games. If the game of a shard is down, the shard is re-created on another game.
+func (desc *ServiceDesc) SetShardCount(shardCount int) *ServiceDesc {
+	if shardCount < 1 {
+		gwlog.Panicf("service %s: invalid shard count: %d", desc.name, shardCount)
+	}
+
+	desc.shardCount = shardCount
+	return desc
+}
+
+// RegisterService registers a service type with 1 shard
+func RegisterService(typeName string, entityPtr entity.IEntity) *ServiceDesc {
 	entity.RegisterEntity(typeName, entityPtr, true)
-	registeredServices.Add(typeName)
+	desc := &ServiceDesc{name: typeName, shardCount: 1}
+	registeredServices[typeName] = desc
+	return desc
 }
 
-func Setup(gameid_ uint16) {
+// Setup setups the service module, getOnlineGames should return IDs of all online games
+func Setup(gameid_ uint16, getOnlineGames_ func() common.Uint16Set) {
 	gameid = gameid_
+	getOnlineGames = getOnlineGames_
 	srvdis.AddPostCallback(checkServicesLater)
 }
 
@@ -49,9 +79,14 @@ func OnDeploymentReady() {
 	checkServicesLater()
 }
 
-type serviceInfo struct {
-	Registered bool
-	EntityID   common.EntityID
+// OnGameDisconnected is called when a game is down, so that shards on that game can be re-created
+func OnGameDisconnected(gid uint16) {
+	checkServicesLater()
+}
+
+type shardInfo struct {
+	GameID   uint16
+	EntityID common.EntityID
 }
 
 func checkServicesLater() {
@@ -69,15 +104,19 @@ func checkServices() {
 		return
 	}
 	gwlog.Infof("service: checking services ...")
-	dispRegisteredServices := map[string]*serviceInfo{} // all services that are registered on dispatchers
-	needLocalServiceEntities := common.StringSet{}
-	newServiceMap := make(map[string]common.EntityID, len(registeredServices))
+	dispRegisteredShards := map[string]map[int]*shardInfo{} // all service shards that are registered on dispatchers
+	newServiceMap := make(map[string][]common.EntityID, len(registeredServices))
 
-	getServiceInfo := func(serviceName string) *serviceInfo {
-		info := dispRegisteredServices[serviceName]
+	getShardInfo := func(serviceName string, shard int) *shardInfo {
+		shards := dispRegisteredShards[serviceName]
+		if shards == nil {
+			shards = map[int]*shardInfo{}
+			dispRegisteredShards[serviceName] = shards
+		}
+		info := shards[shard]
 		if info == nil {
-			info = &serviceInfo{}
-			dispRegisteredServices[serviceName] = info
+			info = &shardInfo{}
+			shards[shard] = info
 		}
 		return info
 	}
@@ -85,92 +124,126 @@ func checkServices() {
 	srvdis.TraverseByPrefix(serviceSrvdisPrefix, func(srvid string, srvinfo string) {
 		servicePath := strings.Split(srvid[serviceSrvdisPrefixLen:], "/")
 		//gwlog.Infof("service: found service %v = %+v", servicePath, srvinfo)
+		if len(servicePath) < 2 {
+			gwlog.Warnf("unknown srvdis info: %s = %s", srvid, srvinfo)
+			return
+		}
 
-		if len(servicePath) == 1 {
-			// ServiceName = gameX
-			serviceName := servicePath[0]
+		serviceName := servicePath[0]
+		shard, err := strconv.Atoi(servicePath[1])
+		if err != nil {
+			gwlog.Warnf("unknown srvdis info: %s = %s", srvid, srvinfo)
+			return
+		}
+
+		if len(servicePath) == 2 {
+			// ServiceName/Shard = gameX
 			targetGameID, err := strconv.Atoi(srvinfo[4:])
 			if err != nil {
 				gwlog.Panic(errors.Wrap(err, "parse targetGameID failed"))
 			}
-			// XxxService = gameX
-			getServiceInfo(serviceName).Registered = true
-
-			if int(gameid) == targetGameID {
-				needLocalServiceEntities.Add(serviceName)
-			}
-		} else if len(servicePath) == 2 {
-			// ServiceName/EntityID = Xxxx
-			serviceName := servicePath[0]
-			fieldName := servicePath[1]
-			switch fieldName {
-			case "EntityID":
-				getServiceInfo(serviceName).EntityID = common.EntityID(srvinfo)
-			default:
-				gwlog.Warnf("unknown srvdis info: %s = %s", srvid, srvinfo)
-			}
+			getShardInfo(serviceName, shard).GameID = uint16(targetGameID)
+		} else if len(servicePath) == 3 && servicePath[2] == "EntityID" {
+			// ServiceName/Shard/EntityID = Xxxx
+			getShardInfo(serviceName, shard).EntityID = common.EntityID(srvinfo)
 		} else {
-			gwlog.Panic(servicePath)
+			gwlog.Warnf("unknown srvdis info: %s = %s", srvid, srvinfo)
 		}
 	})
 
-	for serviceName, info := range dispRegisteredServices {
-		if info.Registered && !info.EntityID.IsNil() {
-			newServiceMap[serviceName] = info.EntityID
+	onlineGames := getOnlineGames()
+	isGameOnline := func(gid uint16) bool {
+		return gid == gameid || onlineGames.Contains(gid)
+	}
+
+	for serviceName, desc := range registeredServices {
+		shardEids := make([]common.EntityID, desc.shardCount)
+		for shard := 0; shard < desc.shardCount; shard++ {
+			info := getShardInfo(serviceName, shard)
+			if info.GameID != 0 && isGameOnline(info.GameID) {
+				shardEids[shard] = info.EntityID
+			}
 		}
+		newServiceMap[serviceName] = shardEids
 	}
 	serviceMap = newServiceMap
 
-	// destroy all service entities that is on this game, but is not verified by dispatcher
-	for serviceName := range registeredServices {
-		if !needLocalServiceEntities.Contains(serviceName) {
-			// this service should not be local
-			serviceEntities := entity.GetEntitiesByType(serviceName)
-			for _, e := range serviceEntities {
-				e.Destroy()
+	// forget local shards which are moved to other games or destroyed
+	for serviceName, shards := range localShards {
+		for shard, eid := range shards {
+			if getShardInfo(serviceName, shard).GameID != gameid {
+				delete(shards, shard)
+			} else if !eid.IsNil() && entity.GetEntity(eid) == nil && !entity.GetEntityTypeDesc(serviceName).IsPersistent {
+				// non-persistent shard entity is destroyed, so it should be re-created
+				delete(shards, shard)
 			}
 		}
 	}
 
-	// create all service entities that should be created on this game
-	for serviceName := range needLocalServiceEntities {
-		serviceEntities := entity.GetEntitiesByType(serviceName)
-		if len(serviceEntities) == 0 {
-			createServiceEntity(serviceName)
-		} else if len(serviceEntities) == 1 {
-			// make sure the current service entity is the
-			localEid := serviceEntities.Keys()[0]
-			//gwlog.Infof("service %s: found service entity: %s, service info: %+v", serviceName, serviceEntities.Values()[0], getServiceInfo(serviceName))
-			if localEid != getServiceInfo(serviceName).EntityID {
-				// might happen if dispatchers recover from crash
-				gwlog.Warnf("service %s: local entity is %s, but has %s on dispatchers", serviceName, localEid, getServiceInfo(serviceName).EntityID)
-				srvdis.Register(getSrvID(serviceName)+"/EntityID", string(localEid), true)
-			}
-		} else {
-			// multiple service entities ? should never happen! so just destroy all invalid service entities
-			correctEid := getServiceInfo(serviceName).EntityID
-			for _, e := range serviceEntities {
-				if e.ID != correctEid {
-					e.Destroy()
-				}
+	for serviceName, desc := range registeredServices {
+		for shard := 0; shard < desc.shardCount; shard++ {
+			info := getShardInfo(serviceName, shard)
+			if info.GameID == 0 {
+				// register all service shards that are not registered to dispatcher yet
+				gwlog.Warnf("service: %s shard %d not found, registering srvdis ...", serviceName, shard)
+				// delay for a random time so that each game might register servcie randomly
+				randomDelay := time.Millisecond * time.Duration(rand.Intn(100))
+				srvid := getShardSrvID(serviceName, shard)
+				timer.AddCallback(randomDelay, func() {
+					srvdis.Register(srvid, fmt.Sprintf("game%d", gameid), false)
+				})
+			} else if info.GameID == gameid {
+				// create all service shards that should be created on this game
+				checkLocalShard(serviceName, shard, info.EntityID)
+			} else if !isGameOnline(info.GameID) && chooseGameForShard(serviceName, shard, onlineGames) == gameid {
+				// the game of the shard is down, take over the shard
+				gwlog.Warnf("service: %s shard %d is on game%d which is down, taking over ...", serviceName, shard, info.GameID)
+				srvdis.Register(getShardSrvID(serviceName, shard), fmt.Sprintf("game%d", gameid), true)
 			}
 		}
 	}
 
-	// register all service types that are not registered to dispatcher yet
+	// destroy all service entities that is on this game, but is not verified by dispatcher
 	for serviceName := range registeredServices {
-		if !getServiceInfo(serviceName).Registered {
-			gwlog.Warnf("service: %s not found, registering srvdis ...", serviceName)
-			// delay for a random time so that each game might register servcie randomly
-			randomDelay := time.Millisecond * time.Duration(rand.Intn(100))
-			_serviceName := serviceName
-			timer.AddCallback(randomDelay, func() {
-				srvdis.Register(getSrvID(_serviceName), fmt.Sprintf("game%d", gameid), false)
-			})
+		for eid, e := range entity.GetEntitiesByType(serviceName) {
+			if !isLocalShardEntity(serviceName, eid) {
+				e.Destroy()
+			}
 		}
 	}
 }
-func createServiceEntity(serviceName string) {
+
+// checkLocalShard makes sure the shard entity exists on this game and is registered to dispatcher
+func checkLocalShard(serviceName string, shard int, registeredEid common.EntityID) {
+	shards := localShards[serviceName]
+	if shards == nil {
+		shards = map[int]common.EntityID{}
+		localShards[serviceName] = shards
+	}
+
+	localEid, ok := shards[shard]
+	if !ok && !registeredEid.IsNil() && entity.GetEntity(registeredEid) != nil {
+		// the shard entity is restored after game is freezed
+		shards[shard] = registeredEid
+	} else if !ok {
+		createShardEntity(serviceName, shard, registeredEid)
+	} else if !localEid.IsNil() && localEid != registeredEid {
+		// might happen if dispatchers recover from crash
+		gwlog.Warnf("service %s shard %d: local entity is %s, but has %s on dispatchers", serviceName, shard, localEid, registeredEid)
+		srvdis.Register(getShardSrvID(serviceName, shard)+"/EntityID", string(localEid), true)
+	}
+}
+
+func isLocalShardEntity(serviceName string, eid common.EntityID) bool {
+	for _, localEid := range localShards[serviceName] {
+		if localEid == eid {
+			return true
+		}
+	}
+	return false
+}
+
+func createShardEntity(serviceName string, shard int, registeredEid common.EntityID) {
 	desc := entity.GetEntityTypeDesc(serviceName)
 	if desc == nil {
 		gwlog.Panicf("create service entity locally failed: service %s is not registered", serviceName)
@@ -178,54 +251,184 @@ func createServiceEntity(serviceName string) {
 
 	if !desc.IsPersistent {
 		e := entity.CreateEntityLocally(serviceName, nil)
-		gwlog.Infof("Created service entity: %s: %s", serviceName, e)
-		srvdis.Register(getSrvID(serviceName)+"/EntityID", string(e.ID), true)
+		gwlog.Infof("Created service entity: %s shard %d: %s", serviceName, shard, e)
+		setLocalShard(serviceName, shard, e.ID)
+	} else if !registeredEid.IsNil() {
+		// the shard was on another game, load it on the current game
+		loadPersistentShardEntity(serviceName, shard, registeredEid)
 	} else {
-		createPersistentServiceEntity(serviceName)
+		createPersistentShardEntity(serviceName, shard)
 	}
 }
 
-func createPersistentServiceEntity(serviceName string) {
+func createPersistentShardEntity(serviceName string, shard int) {
+	localShards[serviceName][shard] = "" // creating
 	storage.ListEntityIDs(serviceName, func(ids []common.EntityID, err error) {
 		if err != nil {
 			gwlog.Panic(errors.Wrap(err, "storage.ListEntityIDs failed"))
 		}
 
-		if len(entity.GetEntitiesByType(serviceName)) > 0 {
-			// service exists now
-			gwlog.Warnf("Was creating service %s, but found existing: %v", serviceName, entity.GetEntitiesByType(serviceName))
+		if eid, ok := localShards[serviceName][shard]; !ok || !eid.IsNil() {
+			// shard is moved to other game or created now
+			gwlog.Warnf("Was creating service %s shard %d, but the shard is not creating any more", serviceName, shard)
 			return
 		}
 
-		var eid common.EntityID
-		if len(ids) == 0 {
-			eid = entity.CreateEntityLocally(serviceName, nil).ID
-			gwlog.Infof("Created service entity: %s: %s", serviceName, eid)
-		} else {
-			eid = ids[0]
-			// try to load entity on the current game, but we need to tell dispatcher first
-			entity.LoadEntityOnGame(serviceName, eid, gameid, common.EntityID(""))
-			gwlog.Infof("Loading service entity: %s: %s", serviceName, eid)
+		shardEid := getPersistentShardEntityID(serviceName, shard)
+		for _, eid := range ids {
+			if eid == shardEid {
+				loadPersistentShardEntity(serviceName, shard, eid)
+				return
+			}
+		}
+
+		if shard == 0 {
+			// load the service entity created before the service is sharded
+			for _, eid := range ids {
+				if !isPersistentShardEntityID(serviceName, eid) {
+					loadPersistentShardEntity(serviceName, shard, eid)
+					return
+				}
+			}
 		}
 
-		srvdis.Register(getSrvID(serviceName)+"/EntityID", string(eid), true)
+		entity.CreateEntityLocallyWithID(serviceName, nil, shardEid)
+		gwlog.Infof("Created service entity: %s shard %d: %s", serviceName, shard, shardEid)
+		setLocalShard(serviceName, shard, shardEid)
 	})
 }
 
+func loadPersistentShardEntity(serviceName string, shard int, eid common.EntityID) {
+	// try to load entity on the current game, but we need to tell dispatcher first
+	entity.LoadEntityOnGame(serviceName, eid, gameid, common.EntityID(""))
+	gwlog.Infof("Loading service entity: %s shard %d: %s", serviceName, shard, eid)
+	setLocalShard(serviceName, shard, eid)
+}
+
+func setLocalShard(serviceName string, shard int, eid common.EntityID) {
+	localShards[serviceName][shard] = eid
+	srvdis.Register(getShardSrvID(serviceName, shard)+"/EntityID", string(eid), true)
+}
+
+// getPersistentShardEntityID returns the fixed entity ID of persistent service shard, so that shard data is never mixed
+func getPersistentShardEntityID(serviceName string, shard int) common.EntityID {
+	sum := md5.Sum([]byte(getShardSrvID(serviceName, shard)))
+	return common.EntityID(uuid.GenFixedUUID(sum[:12]))
+}
+
+func isPersistentShardEntityID(serviceName string, eid common.EntityID) bool {
+	for shard := 0; shard < registeredServices[serviceName].shardCount; shard++ {
+		if eid == getPersistentShardEntityID(serviceName, shard) {
+			return true
+		}
+	}
+	return false
+}
+
+// chooseGameForShard chooses the game to re-create the shard, all games should choose the same game
+func chooseGameForShard(serviceName string, shard int, onlineGames common.Uint16Set) uint16 {
+	gameids := make([]int, 0, len(onlineGames)+1)
+	gameids = append(gameids, int(gameid))
+	for gid := range onlineGames {
+		if gid != gameid {
+			gameids = append(gameids, int(gid))
+		}
+	}
+	sort.Ints(gameids)
+	return uint16(gameids[jumpHash(hashShardKey(getShardSrvID(serviceName, shard)), len(gameids))])
+}
+
 func getSrvID(serviceName string) string {
 	return serviceSrvdisPrefix + serviceName
 }
 
+func getShardSrvID(serviceName string, shard int) string {
+	return getSrvID(serviceName) + "/" + strconv.Itoa(shard)
+}
+
+func hashShardKey(shardKey string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(shardKey))
+	return h.Sum64()
+}
+
+// jumpHash is the jump consistent hash, which maps key to [0, n) and moves minimal keys when n changes
+func jumpHash(key uint64, n int) int {
+	var b, j int64 = -1, 0
+	for j < int64(n) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+// CallService calls the service, shards of the service are called in round-robin
 func CallService(serviceName string, method string, args []interface{}) {
-	serviceEid := serviceMap[serviceName]
-	if serviceEid.IsNil() {
+	shardEids := serviceMap[serviceName]
+	if len(shardEids) == 0 {
+		gwlog.Errorf("CallService %s.%s: service entity is not created yet!", serviceName, method)
+		return
+	}
+
+	// skip shards which are not created yet
+	for i := 0; i < len(shardEids); i++ {
+		shard := roundRobinIndex[serviceName] % len(shardEids)
+		roundRobinIndex[serviceName] = shard + 1
+		if !shardEids[shard].IsNil() {
+			entity.Call(shardEids[shard], method, args)
+			return
+		}
+	}
+	gwlog.Errorf("CallService %s.%s: service entity is not created yet!", serviceName, method)
+}
+
+// CallServiceShardKey calls the shard of the service which is chosen by consistent hash of shardKey
+//
+// Calls with the same shardKey (e.g. an entity ID) are always sent to the same shard.
+func CallServiceShardKey(serviceName string, shardKey string, method string, args []interface{}) {
+	shardEids := serviceMap[serviceName]
+	if len(shardEids) == 0 {
 		gwlog.Errorf("CallService %s.%s: service entity is not created yet!", serviceName, method)
 		return
 	}
 
+	callServiceShard(serviceName, shardEids, jumpHash(hashShardKey(shardKey), len(shardEids)), method, args)
+}
+
+// CallServiceShardIndex calls the specified shard of the service
+func CallServiceShardIndex(serviceName string, shard int, method string, args []interface{}) {
+	shardEids := serviceMap[serviceName]
+	if shard < 0 || shard >= len(shardEids) {
+		gwlog.Errorf("CallService %s.%s: shard %d is not created yet!", serviceName, method, shard)
+		return
+	}
+
+	callServiceShard(serviceName, shardEids, shard, method, args)
+}
+
+func callServiceShard(serviceName string, shardEids []common.EntityID, shard int, method string, args []interface{}) {
+	serviceEid := shardEids[shard]
+	if serviceEid.IsNil() {
+		gwlog.Errorf("CallService %s.%s: service entity of shard %d is not created yet!", serviceName, method, shard)
+		return
+	}
+
 	entity.Call(serviceEid, method, args)
 }
 
-func GetServiceEntityID(serviceName string) common.EntityID {
+// GetServiceEntityID returns entity IDs of all shards of the service
+//
+// The entity ID of a shard is nil if the shard is not created yet.
+func GetServiceEntityID(serviceName string) []common.EntityID {
 	return serviceMap[serviceName]
 }
+
+// GetServiceShardCount returns the number of shards of the service
+func GetServiceShardCount(serviceName string) int {
+	desc := registeredServices[serviceName]
+	if desc == nil {
+		return 0
+	}
+	return desc.shardCount
+}
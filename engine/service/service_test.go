@@ -0,0 +1,57 @@
+package service
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/sagacao/goworld/engine/common"
+)
+
+func TestJumpHash(t *testing.T) {
+	moved := 0
+	for i := 0; i < 10000; i++ {
+		key := hashShardKey(strconv.Itoa(i))
+		s9, s10 := jumpHash(key, 9), jumpHash(key, 10)
+		if s9 < 0 || s9 >= 9 || s10 < 0 || s10 >= 10 {
+			t.Fatalf("shard out of range: %d, %d", s9, s10)
+		}
+		if s9 != s10 {
+			if s10 != 9 {
+				t.Fatalf("key should only move to the new shard, but moved from %d to %d", s9, s10)
+			}
+			moved += 1
+		}
+	}
+
+	if moved < 500 || moved > 1500 {
+		t.Fatalf("about 1/10 keys should be moved, but %d moved", moved)
+	}
+}
+
+func TestChooseGameForShard(t *testing.T) {
+	gameid = 2
+	onlineGames := common.Uint16Set{}
+	onlineGames.Add(1)
+	onlineGames.Add(3)
+
+	chosen := map[uint16]int{}
+	for shard := 0; shard < 100; shard++ {
+		gid := chooseGameForShard("TestService", shard, onlineGames)
+		if gid != chooseGameForShard("TestService", shard, onlineGames) {
+			t.Fatalf("game should be chosen deterministically")
+		}
+		chosen[gid] += 1
+	}
+
+	if len(chosen) != 3 {
+		t.Fatalf("shards should be distributed to all games: %v", chosen)
+	}
+}
+
+func TestPersistentShardEntityID(t *testing.T) {
+	eid0 := getPersistentShardEntityID("TestService", 0)
+	eid1 := getPersistentShardEntityID("TestService", 1)
+	if len(eid0) != common.ENTITYID_LENGTH || eid0 == eid1 || eid0 != getPersistentShardEntityID("TestService", 0) {
+		t.Fatalf("wrong shard entity IDs: %s, %s", eid0, eid1)
+	}
+}
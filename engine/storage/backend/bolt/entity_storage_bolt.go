@@ -0,0 +1,281 @@
+package entitystoragebolt
+
+import (
+	"bytes"
+
+	"github.com/pkg/errors"
+	"github.com/sagacao/goworld/engine/boltdb"
+	"github.com/sagacao/goworld/engine/common"
+	"github.com/sagacao/goworld/engine/netutil"
+	"github.com/sagacao/goworld/engine/storage/storage_common"
+	"go.etcd.io/bbolt"
+)
+
+const (
+	_STORAGE_BUCKET = "_storage"
+	// _INDEX_BUCKET contains buckets of indexes of each entity type, keys of which are index values and entity IDs
+	_INDEX_BUCKET = "_storage_index"
+)
+
+var (
+	dataPacker = netutil.MessagePackMsgPacker{}
+)
+
+// boltEntityStorage saves entity data in bolt database, data of each entity type is in a bucket
+type boltEntityStorage struct {
+	db      *boltdb.DB
+	indexes storagecommon.Indexes
+}
+
+// OpenBolt opens the bolt database file as entity storage
+func OpenBolt(path string) (storagecommon.EntityStorage, error) {
+	db, err := boltdb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &boltEntityStorage{
+		db:      db,
+		indexes: storagecommon.Indexes{},
+	}, nil
+}
+
+func (es *boltEntityStorage) List(typeName string) ([]common.EntityID, error) {
+	var eids []common.EntityID
+	err := es.db.View(func(tx *bbolt.Tx) error {
+		b := boltdb.LookupBucket(tx, _STORAGE_BUCKET, typeName)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			eids = append(eids, common.EntityID(k))
+			return nil
+		})
+	})
+	return eids, err
+}
+
+func (es *boltEntityStorage) Write(typeName string, entityID common.EntityID, data interface{}) error {
+	b, err := dataPacker.PackMsg(data, nil)
+	if err != nil {
+		return err
+	}
+
+	return es.db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := boltdb.Bucket(tx, _STORAGE_BUCKET, typeName)
+		if err != nil {
+			return err
+		}
+		if len(es.indexes[typeName]) > 0 {
+			old, err := unpackData(bucket.Get([]byte(entityID)))
+			if err != nil {
+				return err
+			}
+			if err := es.updateIndexes(tx, typeName, entityID, es.indexes.Values(typeName, old), es.indexes.Values(typeName, data.(map[string]interface{}))); err != nil {
+				return err
+			}
+		}
+		return bucket.Put([]byte(entityID), b)
+	})
+}
+
+// Update sets and deletes keys of entity data in one transaction
+func (es *boltEntityStorage) Update(typeName string, entityID common.EntityID, updates map[string]interface{}, deletes []string) error {
+	return es.db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := boltdb.Bucket(tx, _STORAGE_BUCKET, typeName)
+		if err != nil {
+			return err
+		}
+
+		data, err := unpackData(bucket.Get([]byte(entityID)))
+		if err != nil {
+			return err
+		}
+		oldIndexValues := es.indexes.Values(typeName, data)
+		for k, v := range updates {
+			data[k] = v
+		}
+		for _, k := range deletes {
+			delete(data, k)
+		}
+
+		if err := es.updateIndexes(tx, typeName, entityID, oldIndexValues, es.indexes.Values(typeName, data)); err != nil {
+			return err
+		}
+
+		b, err := dataPacker.PackMsg(data, nil)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(entityID), b)
+	})
+}
+
+func unpackData(b []byte) (map[string]interface{}, error) {
+	data := map[string]interface{}{}
+	if b == nil {
+		return data, nil
+	}
+	if err := dataPacker.UnpackMsg(b, &data); err != nil {
+		return nil, err
+	}
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+	return data, nil
+}
+
+func indexKey(value string, entityID common.EntityID) []byte {
+	return []byte(value + "\x00" + string(entityID))
+}
+
+// updateIndexes replaces index values of the entity from old to new
+func (es *boltEntityStorage) updateIndexes(tx *bbolt.Tx, typeName string, entityID common.EntityID, old, new map[string]string) error {
+	for attr, unique := range es.indexes[typeName] {
+		oldVal, hasOld := old[attr]
+		newVal, hasNew := new[attr]
+		if hasOld == hasNew && oldVal == newVal {
+			continue
+		}
+
+		bucket, err := boltdb.Bucket(tx, _INDEX_BUCKET, typeName, attr)
+		if err != nil {
+			return err
+		}
+		if hasNew && unique {
+			if eids := findIndex(bucket, newVal); len(eids) > 0 && eids[0] != entityID {
+				return errors.Wrapf(storagecommon.ErrDuplicateIndexValue, "%s.%s", typeName, attr)
+			}
+		}
+		if hasOld {
+			if err := bucket.Delete(indexKey(oldVal, entityID)); err != nil {
+				return err
+			}
+		}
+		if hasNew {
+			if err := bucket.Put(indexKey(newVal, entityID), nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func findIndex(bucket *bbolt.Bucket, value string) (eids []common.EntityID) {
+	prefix := []byte(value + "\x00")
+	c := bucket.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		eids = append(eids, common.EntityID(k[len(prefix):]))
+	}
+	return
+}
+
+// DefineIndex defines the index of the attribute, which is built from existing entities if not exists
+func (es *boltEntityStorage) DefineIndex(typeName string, attr string, unique bool) error {
+	es.indexes.Define(typeName, attr, unique)
+	return es.db.Update(func(tx *bbolt.Tx) error {
+		if boltdb.LookupBucket(tx, _INDEX_BUCKET, typeName, attr) != nil {
+			return nil
+		}
+
+		indexBucket, err := boltdb.Bucket(tx, _INDEX_BUCKET, typeName, attr)
+		if err != nil {
+			return err
+		}
+		bucket := boltdb.LookupBucket(tx, _STORAGE_BUCKET, typeName)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			data, err := unpackData(v)
+			if err != nil {
+				return err
+			}
+			if val, ok := storagecommon.IndexValue(data[attr]); ok {
+				return indexBucket.Put(indexKey(val, common.EntityID(k)), nil)
+			}
+			return nil
+		})
+	})
+}
+
+// FindByAttr returns IDs of entities of which the attribute equals to value
+func (es *boltEntityStorage) FindByAttr(typeName string, attr string, value interface{}) (eids []common.EntityID, err error) {
+	if _, ok := es.indexes[typeName][attr]; !ok {
+		return nil, errors.Errorf("%s.%s is not indexed", typeName, attr)
+	}
+	val, ok := storagecommon.IndexValue(value)
+	if !ok {
+		return nil, errors.Errorf("%s.%s: value of type %T can not be indexed", typeName, attr, value)
+	}
+
+	err = es.db.View(func(tx *bbolt.Tx) error {
+		if bucket := boltdb.LookupBucket(tx, _INDEX_BUCKET, typeName, attr); bucket != nil {
+			eids = findIndex(bucket, val)
+		}
+		return nil
+	})
+	return
+}
+
+func (es *boltEntityStorage) Read(typeName string, entityID common.EntityID) (interface{}, error) {
+	var data map[string]interface{}
+	found := false
+	err := es.db.View(func(tx *bbolt.Tx) error {
+		bucket := boltdb.LookupBucket(tx, _STORAGE_BUCKET, typeName)
+		if bucket == nil {
+			return nil
+		}
+		b := bucket.Get([]byte(entityID))
+		if b == nil {
+			return nil
+		}
+		found = true
+		return dataPacker.UnpackMsg(b, &data)
+	})
+	if err != nil || !found {
+		// entity not exists
+		return nil, err
+	}
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+	return data, nil
+}
+
+func (es *boltEntityStorage) Exists(typeName string, entityID common.EntityID) (exists bool, err error) {
+	err = es.db.View(func(tx *bbolt.Tx) error {
+		bucket := boltdb.LookupBucket(tx, _STORAGE_BUCKET, typeName)
+		exists = bucket != nil && bucket.Get([]byte(entityID)) != nil
+		return nil
+	})
+	return
+}
+
+// Delete deletes the entity data and index values in one transaction
+func (es *boltEntityStorage) Delete(typeName string, entityID common.EntityID) error {
+	return es.db.Update(func(tx *bbolt.Tx) error {
+		bucket := boltdb.LookupBucket(tx, _STORAGE_BUCKET, typeName)
+		if bucket == nil {
+			return nil
+		}
+		if len(es.indexes[typeName]) > 0 {
+			old, err := unpackData(bucket.Get([]byte(entityID)))
+			if err != nil {
+				return err
+			}
+			if err := es.updateIndexes(tx, typeName, entityID, es.indexes.Values(typeName, old), nil); err != nil {
+				return err
+			}
+		}
+		return bucket.Delete([]byte(entityID))
+	})
+}
+
+func (es *boltEntityStorage) Close() {
+	// the database file is only opened in transactions
+}
+
+func (es *boltEntityStorage) IsEOF(err error) bool {
+	return false
+}
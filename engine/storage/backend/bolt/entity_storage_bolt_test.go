@@ -0,0 +1,158 @@
+package entitystoragebolt
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/sagacao/goworld/engine/common"
+	"github.com/sagacao/goworld/engine/storage/storage_common"
+	"github.com/xiaonanln/typeconv"
+)
+
+func TestBoltEntityStorage(t *testing.T) {
+	dir, err := os.MkdirTemp("", "goworld_bolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	es, err := OpenBolt(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entityID := common.GenEntityID()
+	if data, err := es.Read("Avatar", entityID); data != nil || err != nil {
+		t.Errorf("should be nil: %v, %v", data, err)
+	}
+	if exists, err := es.Exists("Avatar", entityID); exists || err != nil {
+		t.Errorf("should not exist: %v", err)
+	}
+
+	testData := map[string]interface{}{
+		"a": 1,
+		"b": "2",
+		"c": true,
+		"d": 1.11,
+	}
+	if err := es.Write("Avatar", entityID, testData); err != nil {
+		t.Fatal(err)
+	}
+
+	verifyData, err := es.Read("Avatar", entityID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if typeconv.Int(verifyData.(map[string]interface{})["a"]) != 1 {
+		t.Errorf("read wrong data: %v", verifyData)
+	}
+	if verifyData.(map[string]interface{})["b"].(string) != "2" {
+		t.Errorf("read wrong data: %v", verifyData)
+	}
+	if verifyData.(map[string]interface{})["c"].(bool) != true {
+		t.Errorf("read wrong data: %v", verifyData)
+	}
+	if verifyData.(map[string]interface{})["d"].(float64) != 1.11 {
+		t.Errorf("read wrong data: %v", verifyData)
+	}
+	if exists, err := es.Exists("Avatar", entityID); !exists || err != nil {
+		t.Errorf("should exist: %v", err)
+	}
+
+	if err := es.(storagecommon.EntityStorageUpdater).Update("Avatar", entityID, map[string]interface{}{"b": "3"}, []string{"c"}); err != nil {
+		t.Fatal(err)
+	}
+	verifyData, err = es.Read("Avatar", entityID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := verifyData.(map[string]interface{}); m["b"] != "3" || m["c"] != nil || typeconv.Int(m["a"]) != 1 {
+		t.Errorf("wrong data after update: %v", m)
+	}
+
+	avatarIDs, err := es.List("Avatar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(avatarIDs) != 1 || avatarIDs[0] != entityID {
+		t.Errorf("wrong avatar IDs: %v", avatarIDs)
+	}
+	if ids, err := es.List("Monster"); len(ids) != 0 || err != nil {
+		t.Errorf("wrong monster IDs: %v, %v", ids, err)
+	}
+
+	if err := es.Delete("Avatar", entityID); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := es.Exists("Avatar", entityID); exists || err != nil {
+		t.Errorf("should not exist after deleted: %v", err)
+	}
+	if err := es.Delete("Monster", entityID); err != nil {
+		t.Errorf("deleting entity which does not exist should not fail: %v", err)
+	}
+}
+
+func TestBoltEntityStorageIndex(t *testing.T) {
+	dir, err := os.MkdirTemp("", "goworld_bolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	es, err := OpenBolt(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	account1, account2 := common.GenEntityID(), common.GenEntityID()
+	if err := es.Write("Account", account1, map[string]interface{}{"username": "alice", "level": 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	indexer := es.(storagecommon.EntityStorageIndexer)
+	if _, err := indexer.FindByAttr("Account", "username", "alice"); err == nil {
+		t.Errorf("should fail to find by attribute which is not indexed")
+	}
+	if err := indexer.DefineIndex("Account", "username", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := indexer.DefineIndex("Account", "level", false); err != nil {
+		t.Fatal(err)
+	}
+	if eids, err := indexer.FindByAttr("Account", "username", "alice"); err != nil || len(eids) != 1 || eids[0] != account1 {
+		t.Errorf("existing entities should be indexed: %v, %v", eids, err)
+	}
+
+	if err := es.Write("Account", account2, map[string]interface{}{"username": "alice", "level": 1}); errors.Cause(err) != storagecommon.ErrDuplicateIndexValue {
+		t.Errorf("write should fail with duplicate unique index value: %v", err)
+	}
+	if exists, _ := es.Exists("Account", account2); exists {
+		t.Errorf("entity violating unique index should not be written")
+	}
+	if err := es.Write("Account", account2, map[string]interface{}{"username": "bob", "level": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if eids, err := indexer.FindByAttr("Account", "level", 1.0); err != nil || len(eids) != 2 {
+		t.Errorf("should find 2 entities of level 1: %v, %v", eids, err)
+	}
+
+	if err := es.(storagecommon.EntityStorageUpdater).Update("Account", account1, map[string]interface{}{"username": "carol"}, []string{"level"}); err != nil {
+		t.Fatal(err)
+	}
+	if eids, err := indexer.FindByAttr("Account", "username", "alice"); err != nil || len(eids) != 0 {
+		t.Errorf("old index value should be removed: %v, %v", eids, err)
+	}
+	if eids, err := indexer.FindByAttr("Account", "username", "carol"); err != nil || len(eids) != 1 || eids[0] != account1 {
+		t.Errorf("new index value should be added: %v, %v", eids, err)
+	}
+	if eids, err := indexer.FindByAttr("Account", "level", 1); err != nil || len(eids) != 1 || eids[0] != account2 {
+		t.Errorf("deleted attribute should be removed from index: %v, %v", eids, err)
+	}
+
+	if err := es.Delete("Account", account1); err != nil {
+		t.Fatal(err)
+	}
+	if eids, err := indexer.FindByAttr("Account", "username", "carol"); err != nil || len(eids) != 0 {
+		t.Errorf("deleted entity should be removed from index: %v, %v", eids, err)
+	}
+}
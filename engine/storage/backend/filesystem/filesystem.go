@@ -1,6 +1,8 @@
 package entitystoragefilesystem
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
 	"path/filepath"
 
 	"io/ioutil"
@@ -12,15 +14,29 @@ import (
 
 	"strings"
 
+	"github.com/pkg/errors"
 	"github.com/sagacao/goworld/engine/common"
 	"github.com/sagacao/goworld/engine/consts"
 	"github.com/sagacao/goworld/engine/gwlog"
 	"github.com/sagacao/goworld/engine/storage/storage_common"
 )
 
+const (
+	// _INDEX_DIRECTORY contains index directories of entity types, in which files of entity IDs are in directories of index values
+	_INDEX_DIRECTORY = "_index"
+	// _UNIQUE_DIRECTORY contains files of values of unique indexes, which are created exclusively by entities claiming them
+	_UNIQUE_DIRECTORY = "_unique"
+	// _MAX_INDEX_FILE_NAME_LENGTH is the max length of file names of index values
+	_MAX_INDEX_FILE_NAME_LENGTH = 200
+	// _UNIQUE_BUILT_SUFFIX is the suffix of the file which is created after values of the unique index are claimed by
+	// existing entities
+	_UNIQUE_BUILT_SUFFIX = "$built"
+)
+
 // FileSystemEntityStorage is an implementation of Entity Storage using filesystem
 type FileSystemEntityStorage struct {
 	directory string
+	indexes   storagecommon.Indexes
 }
 
 func getFileName(name string, entityID common.EntityID) string {
@@ -39,10 +55,271 @@ func (es *FileSystemEntityStorage) Write(typeName string, entityID common.Entity
 		return err
 	}
 
+	var oldIndexValues, newIndexValues map[string]string
+	if len(es.indexes[typeName]) > 0 {
+		if oldIndexValues, err = es.readIndexValues(typeName, entityID); err != nil {
+			return err
+		}
+		newIndexValues = es.indexes.Values(typeName, data.(map[string]interface{}))
+		if err = es.claimUniqueIndexes(typeName, entityID, oldIndexValues, newIndexValues); err != nil {
+			return err
+		}
+	}
+
 	if consts.DEBUG_SAVE_LOAD {
 		gwlog.Debugf("Saving to file %s: %s", stringSaveFile, string(dataBytes))
 	}
-	return ioutil.WriteFile(stringSaveFile, dataBytes, 0644)
+	// claimed values are kept if fail, since they are claimed again when retrying
+	if err = ioutil.WriteFile(stringSaveFile, dataBytes, 0644); err != nil {
+		return err
+	}
+	if err = es.releaseUniqueIndexes(typeName, entityID, oldIndexValues, newIndexValues); err != nil {
+		return err
+	}
+	return es.updateIndexes(typeName, entityID, oldIndexValues, newIndexValues)
+}
+
+// indexFileName returns the file name of the index value, long values are hashed
+func indexFileName(value string) string {
+	fn := base64.URLEncoding.EncodeToString([]byte(value))
+	if len(fn) <= _MAX_INDEX_FILE_NAME_LENGTH {
+		return fn
+	}
+	// lengths of base64 strings are multiples of 4, so hashed names never equal to names of short values
+	sum := sha1.Sum([]byte(value))
+	return "h" + hex.EncodeToString(sum[:])
+}
+
+func (es *FileSystemEntityStorage) getIndexPath(typeName string, attr string, value string) string {
+	return filepath.Join(es.directory, _INDEX_DIRECTORY, typeName, attr, indexFileName(value))
+}
+
+func (es *FileSystemEntityStorage) getUniquePath(typeName string, attr string, value string) string {
+	return filepath.Join(es.directory, _UNIQUE_DIRECTORY, typeName, attr, indexFileName(value))
+}
+
+func (es *FileSystemEntityStorage) readIndexValues(typeName string, entityID common.EntityID) (map[string]string, error) {
+	data, err := es.Read(typeName, entityID)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	return es.indexes.Values(typeName, data.(map[string]interface{})), nil
+}
+
+func (es *FileSystemEntityStorage) findIndex(typeName string, attr string, value string) ([]common.EntityID, error) {
+	files, err := ioutil.ReadDir(es.getIndexPath(typeName, attr, value))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	eids := make([]common.EntityID, 0, len(files))
+	for _, f := range files {
+		idbytes, err := base64.URLEncoding.DecodeString(f.Name())
+		if err != nil {
+			gwlog.TraceError("fail to parse index file %s", f.Name())
+			continue
+		}
+		eids = append(eids, common.EntityID(idbytes))
+	}
+	return eids, nil
+}
+
+// claimUniqueIndexes claims new values of unique indexes for the entity, values which are claimed are released if fail
+func (es *FileSystemEntityStorage) claimUniqueIndexes(typeName string, entityID common.EntityID, old, new map[string]string) error {
+	var claimed []string
+	for attr, unique := range es.indexes[typeName] {
+		v, ok := new[attr]
+		if !unique || !ok || old[attr] == v {
+			continue
+		}
+
+		path := es.getUniquePath(typeName, attr, v)
+		ok, err := claim(path, entityID)
+		if err == nil && !ok {
+			err = errors.Wrapf(storagecommon.ErrDuplicateIndexValue, "%s.%s", typeName, attr)
+		}
+		if err != nil {
+			for _, path := range claimed {
+				release(path, entityID)
+			}
+			return err
+		}
+		claimed = append(claimed, path)
+	}
+	return nil
+}
+
+// releaseUniqueIndexes releases old values of unique indexes which are not used by the entity any more
+func (es *FileSystemEntityStorage) releaseUniqueIndexes(typeName string, entityID common.EntityID, old, new map[string]string) error {
+	for attr, unique := range es.indexes[typeName] {
+		v, ok := old[attr]
+		if !unique || !ok {
+			continue
+		}
+		if newVal, hasNew := new[attr]; hasNew && newVal == v {
+			continue
+		}
+		if err := release(es.getUniquePath(typeName, attr, v), entityID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// claim creates the file exclusively with the entity ID, returns false if the file is created by another entity
+func claim(path string, entityID common.EntityID) (bool, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return false, err
+	}
+	for {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = f.Write([]byte(entityID))
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(path)
+				return false, err
+			}
+			return true, nil
+		} else if !os.IsExist(err) {
+			return false, err
+		}
+
+		owner, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue // released after created, try again
+		} else if err != nil {
+			return false, err
+		}
+		// the file is empty if being created by another entity
+		return common.EntityID(owner) == entityID, nil
+	}
+}
+
+// release removes the file if it is created by the entity
+func release(path string, entityID common.EntityID) error {
+	owner, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) || (err == nil && common.EntityID(owner) != entityID) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (es *FileSystemEntityStorage) updateIndexes(typeName string, entityID common.EntityID, old, new map[string]string) error {
+	fn := base64.URLEncoding.EncodeToString([]byte(entityID))
+	for attr := range es.indexes[typeName] {
+		oldVal, hasOld := old[attr]
+		newVal, hasNew := new[attr]
+		if hasOld == hasNew && oldVal == newVal {
+			continue
+		}
+		if hasOld {
+			if err := os.Remove(filepath.Join(es.getIndexPath(typeName, attr, oldVal), fn)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if hasNew {
+			if err := es.addIndex(typeName, attr, newVal, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (es *FileSystemEntityStorage) addIndex(typeName string, attr string, value string, fn string) error {
+	dir := es.getIndexPath(typeName, attr, value)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, fn), nil, 0644)
+}
+
+// DefineIndex defines the index of the attribute, which is built from existing entities if not exists
+//
+// Values of unique indexes are also claimed by existing entities, which is built separately since indexes defined by
+// older versions do not claim values.
+func (es *FileSystemEntityStorage) DefineIndex(typeName string, attr string, unique bool) error {
+	es.indexes.Define(typeName, attr, unique)
+	indexDir := filepath.Join(es.directory, _INDEX_DIRECTORY, typeName, attr)
+	if _, err := os.Stat(indexDir); os.IsNotExist(err) {
+		err = es.buildIndex(typeName, attr, func(eid common.EntityID, v string) error {
+			return es.addIndex(typeName, attr, v, base64.URLEncoding.EncodeToString([]byte(eid)))
+		})
+		if err != nil {
+			return err
+		}
+		if err = os.MkdirAll(indexDir, 0755); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	if !unique {
+		return nil
+	}
+
+	builtFile := filepath.Join(es.directory, _UNIQUE_DIRECTORY, typeName, attr+_UNIQUE_BUILT_SUFFIX)
+	if _, err := os.Stat(builtFile); err == nil || !os.IsNotExist(err) {
+		return err
+	}
+	err := es.buildIndex(typeName, attr, func(eid common.EntityID, v string) error {
+		ok, err := claim(es.getUniquePath(typeName, attr, v), eid)
+		if err == nil && !ok {
+			err = errors.Wrapf(storagecommon.ErrDuplicateIndexValue, "%s.%s", typeName, attr)
+		}
+		return err
+	})
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(builtFile), 0755)
+	}
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(builtFile, nil, 0644)
+}
+
+// buildIndex calls build with index values of existing entities
+func (es *FileSystemEntityStorage) buildIndex(typeName string, attr string, build func(eid common.EntityID, v string) error) error {
+	eids, err := es.List(typeName)
+	if err != nil {
+		return err
+	}
+	for _, eid := range eids {
+		data, err := es.Read(typeName, eid)
+		if err != nil {
+			return err
+		}
+		m, _ := data.(map[string]interface{})
+		if v, ok := storagecommon.IndexValue(m[attr]); ok {
+			if err := build(eid, v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// FindByAttr returns IDs of entities of which the attribute equals to value
+func (es *FileSystemEntityStorage) FindByAttr(typeName string, attr string, value interface{}) ([]common.EntityID, error) {
+	if _, ok := es.indexes[typeName][attr]; !ok {
+		return nil, errors.Errorf("%s.%s is not indexed", typeName, attr)
+	}
+	v, ok := storagecommon.IndexValue(value)
+	if !ok {
+		return nil, errors.Errorf("%s.%s: value of type %T can not be indexed", typeName, attr, value)
+	}
+	return es.findIndex(typeName, attr, v)
 }
 
 // Read reads entity data from entity storage
@@ -69,7 +346,10 @@ func (es *FileSystemEntityStorage) Read(typeName string, entityID common.EntityI
 func (es *FileSystemEntityStorage) Exists(typeName string, entityID common.EntityID) (exists bool, err error) {
 	stringSaveFile := es.getFilePath(typeName, entityID)
 	_, err = os.Stat(stringSaveFile)
-	exists = err == nil || os.IsExist(err)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	exists = err == nil
 	return
 }
 
@@ -99,6 +379,25 @@ func (es *FileSystemEntityStorage) List(typeName string) ([]common.EntityID, err
 	return res, nil
 }
 
+// Delete deletes entity data file and index files of entity
+func (es *FileSystemEntityStorage) Delete(typeName string, entityID common.EntityID) error {
+	var oldIndexValues map[string]string
+	if len(es.indexes[typeName]) > 0 {
+		var err error
+		if oldIndexValues, err = es.readIndexValues(typeName, entityID); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Remove(es.getFilePath(typeName, entityID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := es.releaseUniqueIndexes(typeName, entityID, oldIndexValues, nil); err != nil {
+		return err
+	}
+	return es.updateIndexes(typeName, entityID, oldIndexValues, nil)
+}
+
 // Close the entity storage
 func (es *FileSystemEntityStorage) Close() {
 	// need to do nothing
@@ -117,5 +416,6 @@ func OpenDirectory(directory string) (storagecommon.EntityStorage, error) {
 
 	return &FileSystemEntityStorage{
 		directory: directory,
+		indexes:   storagecommon.Indexes{},
 	}, nil
 }
@@ -3,8 +3,14 @@ package entitystoragefilesystem
 import (
 	"testing"
 
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
 	"github.com/sagacao/goworld/engine/common"
 	"github.com/sagacao/goworld/engine/gwlog"
+	"github.com/sagacao/goworld/engine/storage/storage_common"
 )
 
 func TestFileSystemEntityStorage(t *testing.T) {
@@ -64,3 +70,128 @@ func TestFileSystemEntityStorage(t *testing.T) {
 	}
 
 }
+
+func TestFileSystemEntityStorageIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goworld_entity_storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	es, err := OpenDirectory(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account1, account2 := common.GenEntityID(), common.GenEntityID()
+	if err := es.Write("Account", account1, map[string]interface{}{"username": "alice", "level": 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	indexer := es.(storagecommon.EntityStorageIndexer)
+	if err := indexer.DefineIndex("Account", "username", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := indexer.DefineIndex("Account", "level", false); err != nil {
+		t.Fatal(err)
+	}
+	if eids, err := indexer.FindByAttr("Account", "level", 1); err != nil || len(eids) != 1 || eids[0] != account1 {
+		t.Errorf("existing entities should be indexed: %v, %v", eids, err)
+	}
+	if err := es.Write("Account", account2, map[string]interface{}{"username": "alice"}); errors.Cause(err) != storagecommon.ErrDuplicateIndexValue {
+		t.Errorf("write should fail with duplicate unique index value: %v", err)
+	}
+
+	if err := es.Write("Account", account1, map[string]interface{}{"username": "bob", "level": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := es.Write("Account", account2, map[string]interface{}{"username": "alice", "level": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if eids, err := indexer.FindByAttr("Account", "username", "alice"); err != nil || len(eids) != 1 || eids[0] != account2 {
+		t.Errorf("wrong entities found: %v, %v", eids, err)
+	}
+	if eids, err := indexer.FindByAttr("Account", "level", 1); err != nil || len(eids) != 2 {
+		t.Errorf("should find 2 entities of level 1: %v, %v", eids, err)
+	}
+
+	if err := es.Delete("Account", account2); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := es.Exists("Account", account2); exists || err != nil {
+		t.Errorf("should not exist after deleted: %v", err)
+	}
+	if eids, err := indexer.FindByAttr("Account", "username", "alice"); err != nil || len(eids) != 0 {
+		t.Errorf("deleted entity should be removed from index: %v, %v", eids, err)
+	}
+	if err := es.Delete("Account", account2); err != nil {
+		t.Errorf("deleting entity which does not exist should not fail: %v", err)
+	}
+}
+
+func TestFileSystemEntityStorageUniqueIndexRace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goworld_entity_storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// storages of different write workers or games share the directory
+	const N = 10
+	var storages []storagecommon.EntityStorage
+	for i := 0; i < N; i++ {
+		es, err := OpenDirectory(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = es.(storagecommon.EntityStorageIndexer).DefineIndex("Account", "username", true); err != nil {
+			t.Fatal(err)
+		}
+		storages = append(storages, es)
+	}
+
+	errs := make(chan error, N)
+	for _, es := range storages {
+		go func(es storagecommon.EntityStorage) {
+			errs <- es.Write("Account", common.GenEntityID(), map[string]interface{}{"username": "alice"})
+		}(es)
+	}
+	written := 0
+	for i := 0; i < N; i++ {
+		if err := <-errs; err == nil {
+			written++
+		} else if errors.Cause(err) != storagecommon.ErrDuplicateIndexValue {
+			t.Fatal(err)
+		}
+	}
+	if written != 1 {
+		t.Fatalf("unique index value should be written by exactly 1 entity, but got %d", written)
+	}
+}
+
+func TestFileSystemEntityStorageLongIndexValue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goworld_entity_storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	es, err := OpenDirectory(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexer := es.(storagecommon.EntityStorageIndexer)
+	if err := indexer.DefineIndex("Account", "username", true); err != nil {
+		t.Fatal(err)
+	}
+	username := strings.Repeat("alice", 200)
+	account1, account2 := common.GenEntityID(), common.GenEntityID()
+	if err := es.Write("Account", account1, map[string]interface{}{"username": username}); err != nil {
+		t.Fatal(err)
+	}
+	if err := es.Write("Account", account2, map[string]interface{}{"username": username}); errors.Cause(err) != storagecommon.ErrDuplicateIndexValue {
+		t.Errorf("write should fail with duplicate unique index value: %v", err)
+	}
+	if eids, err := indexer.FindByAttr("Account", "username", username); err != nil || len(eids) != 1 || eids[0] != account1 {
+		t.Errorf("entity with long index value should be found: %v, %v", eids, err)
+	}
+}
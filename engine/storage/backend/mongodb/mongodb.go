@@ -6,6 +6,9 @@ import (
 
 	"io"
 
+	"strings"
+
+	"github.com/pkg/errors"
 	"github.com/sagacao/goworld/engine/common"
 	"github.com/sagacao/goworld/engine/gwlog"
 	"github.com/sagacao/goworld/engine/storage/storage_common"
@@ -47,9 +50,105 @@ func (es *mongoDBEntityStorge) Write(typeName string, entityID common.EntityID,
 	_, err := col.UpsertId(entityID, bson.M{
 		"data": data,
 	})
+	return es.checkDup(err)
+}
+
+// Update sets and deletes fields of entity data in mongodb
+//
+// Keys which contain "." or start with "$" can not be used in field paths, so the entire data is written instead
+func (es *mongoDBEntityStorge) Update(typeName string, entityID common.EntityID, updates map[string]interface{}, deletes []string) error {
+	for k := range updates {
+		if !isFieldPathKey(k) {
+			return es.rewrite(typeName, entityID, updates, deletes)
+		}
+	}
+	for _, k := range deletes {
+		if !isFieldPathKey(k) {
+			return es.rewrite(typeName, entityID, updates, deletes)
+		}
+	}
+
+	update := bson.M{}
+	if len(updates) > 0 {
+		setFields := bson.M{}
+		for k, v := range updates {
+			setFields["data."+k] = v
+		}
+		update["$set"] = setFields
+	}
+	if len(deletes) > 0 {
+		unsetFields := bson.M{}
+		for _, k := range deletes {
+			unsetFields["data."+k] = ""
+		}
+		update["$unset"] = unsetFields
+	}
+	if len(update) == 0 {
+		return nil
+	}
+
+	col := es.getCollection(typeName)
+	_, err := col.UpsertId(entityID, update)
+	return es.checkDup(err)
+}
+
+func isFieldPathKey(k string) bool {
+	return k != "" && !strings.Contains(k, ".") && !strings.HasPrefix(k, "$")
+}
+
+// rewrite applies updates and deletes to the entity data, and writes the entire data
+func (es *mongoDBEntityStorge) rewrite(typeName string, entityID common.EntityID, updates map[string]interface{}, deletes []string) error {
+	data := map[string]interface{}{}
+	if old, err := es.Read(typeName, entityID); err == nil {
+		data = old.(map[string]interface{})
+	} else if err != mgo.ErrNotFound {
+		return err
+	}
+
+	for k, v := range updates {
+		data[k] = v
+	}
+	for _, k := range deletes {
+		delete(data, k)
+	}
+	return es.Write(typeName, entityID, data)
+}
+
+// checkDup converts duplicate key errors of unique indexes to ErrDuplicateIndexValue, so that the write is not retried
+func (es *mongoDBEntityStorge) checkDup(err error) error {
+	if err != nil && mgo.IsDup(err) {
+		return errors.Wrap(storagecommon.ErrDuplicateIndexValue, err.Error())
+	}
 	return err
 }
 
+// DefineIndex ensures the index of the attribute in entity data
+func (es *mongoDBEntityStorge) DefineIndex(typeName string, attr string, unique bool) error {
+	col := es.getCollection(typeName)
+	return col.EnsureIndex(mgo.Index{
+		Key:        []string{"data." + attr},
+		Unique:     unique,
+		Sparse:     true, // entities without the attribute are not indexed
+		Background: true,
+	})
+}
+
+// FindByAttr returns IDs of entities of which the attribute equals to value
+func (es *mongoDBEntityStorge) FindByAttr(typeName string, attr string, value interface{}) ([]common.EntityID, error) {
+	col := es.getCollection(typeName)
+	var docs []bson.M
+	err := col.Find(bson.M{"data." + attr: value}).Select(bson.M{"_id": 1}).All(&docs)
+	if err != nil {
+		return nil, err
+	}
+
+	entityIDs := make([]common.EntityID, len(docs))
+	for i, doc := range docs {
+		entityIDs[i] = common.EntityID(doc["_id"].(string))
+	}
+	return entityIDs, nil
+}
+
 func (es *mongoDBEntityStorge) Read(typeName string, entityID common.EntityID) (interface{}, error) {
 	col := es.getCollection(typeName)
 	q := col.FindId(entityID)
@@ -127,6 +226,15 @@ func (es *mongoDBEntityStorge) Exists(typeName string, entityID common.EntityID)
 	}
 }
 
+func (es *mongoDBEntityStorge) Delete(typeName string, entityID common.EntityID) error {
+	col := es.getCollection(typeName)
+	err := col.RemoveId(entityID)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
 func (es *mongoDBEntityStorge) Close() {
 	es.db.Session.Close()
 }
@@ -5,6 +5,8 @@ import (
 
 	"github.com/sagacao/goworld/engine/common"
 	"github.com/sagacao/goworld/engine/gwlog"
+	"github.com/sagacao/goworld/engine/storage/storage_common"
+	"github.com/xiaonanln/typeconv"
 )
 
 func TestMongoDBEntityStorage(t *testing.T) {
@@ -64,3 +66,43 @@ func TestMongoDBEntityStorage(t *testing.T) {
 	}
 
 }
+
+func TestMongoDBEntityStorageUpdate(t *testing.T) {
+	es, err := OpenMongoDB("mongodb://localhost:27017/goworld", "goworld")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entityID := common.GenEntityID()
+	if err = es.Write("Avatar", entityID, map[string]interface{}{"a": 1, "b": "2", "c": true}); err != nil {
+		t.Fatal(err)
+	}
+
+	updater := es.(storagecommon.EntityStorageUpdater)
+	if err = updater.Update("Avatar", entityID, map[string]interface{}{"a": 2, "d": 1.11}, []string{"c"}); err != nil {
+		t.Fatal(err)
+	}
+
+	verifyData, err := es.Read("Avatar", entityID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := verifyData.(map[string]interface{})
+	if typeconv.Int(data["a"]) != 2 || data["b"] != "2" || data["d"] != 1.11 {
+		t.Errorf("read wrong data: %v", data)
+	}
+	if _, ok := data["c"]; ok {
+		t.Errorf("c should be deleted: %v", data)
+	}
+
+	// keys which can not be used in field paths
+	if err = updater.Update("Avatar", entityID, map[string]interface{}{"e.f": 1, "$g": 2}, []string{"b"}); err != nil {
+		t.Fatal(err)
+	}
+	if verifyData, err = es.Read("Avatar", entityID); err != nil {
+		t.Fatal(err)
+	}
+	data = verifyData.(map[string]interface{})
+	if typeconv.Int(data["e.f"]) != 1 || typeconv.Int(data["$g"]) != 2 || typeconv.Int(data["a"]) != 2 || data["b"] != nil {
+		t.Errorf("read wrong data: %v", data)
+	}
+}
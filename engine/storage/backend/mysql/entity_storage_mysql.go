@@ -1,15 +1,28 @@
 package entitystoragemysql
 
 import (
+	"crypto/sha1"
 	"database/sql"
+	"encoding/hex"
 
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/pkg/errors"
 	"github.com/sagacao/goworld/engine/common"
 	"github.com/sagacao/goworld/engine/netutil"
 	"github.com/sagacao/goworld/engine/storage/storage_common"
 
 	"fmt"
+)
 
-	_ "github.com/go-sql-driver/mysql"
+const (
+	// _ER_DUP_ENTRY is the mysql error number of duplicate keys
+	_ER_DUP_ENTRY = 1062
+	// _MAX_INDEX_VALUE_LENGTH is the max length of index values, which are stored in `idx_<attr>` columns
+	_MAX_INDEX_VALUE_LENGTH = 255
+	// _BUILT_INDEXES_TABLE records indexes which are filled for existing rows
+	_BUILT_INDEXES_TABLE = "_built_indexes"
 )
 
 var (
@@ -19,6 +32,7 @@ var (
 type mysqlEntityStorage struct {
 	db                 *sql.DB
 	visitedEntityTypes common.StringSet
+	indexes            storagecommon.Indexes
 }
 
 // OpenMySQL opens redis as entity storage
@@ -36,6 +50,7 @@ func OpenMySQL(url string) (storagecommon.EntityStorage, error) {
 	return &mysqlEntityStorage{
 		db:                 db,
 		visitedEntityTypes: common.StringSet{},
+		indexes:            storagecommon.Indexes{},
 	}, nil
 }
 
@@ -94,11 +109,214 @@ func (es *mysqlEntityStorage) Write(typeName string, entityID common.EntityID, d
 		return err
 	}
 
+	if len(es.indexes[typeName]) > 0 {
+		// ON DUPLICATE KEY UPDATE can not be used since it also updates rows with duplicate unique index values
+		tx, err := es.db.Begin()
+		if err != nil {
+			return err
+		}
+		var dummy int
+		err = tx.QueryRow("SELECT 1 FROM `"+typeName+"` WHERE `id` = ? FOR UPDATE", string(entityID)).Scan(&dummy)
+		if err == nil || err == sql.ErrNoRows {
+			err = es.writeRow(tx, typeName, entityID, b, data.(map[string]interface{}), err == nil)
+		}
+		if err != nil {
+			tx.Rollback()
+			return es.checkDup(err)
+		}
+		return tx.Commit()
+	}
+
 	_, err = es.db.Exec(fmt.Sprintf("INSERT INTO `%s`(`id`, `data`) VALUES(?, ?) ON DUPLICATE KEY UPDATE `data` = ?", typeName), string(entityID), b, b)
 	//gwlog.Infof("INSERT ...: %v", err)
 	return err
 }
 
+// writeRow writes the packed data and index values of the entity in transaction
+func (es *mysqlEntityStorage) writeRow(tx *sql.Tx, typeName string, entityID common.EntityID, b []byte, data map[string]interface{}, exists bool) error {
+	columns := []string{"`data`"}
+	args := []interface{}{b}
+	indexValues := es.indexes.Values(typeName, data)
+	for attr := range es.indexes[typeName] {
+		columns = append(columns, indexColumn(attr))
+		if v, ok := indexValues[attr]; ok {
+			args = append(args, indexColumnValue(v))
+		} else {
+			args = append(args, nil)
+		}
+	}
+
+	var err error
+	if exists {
+		_, err = tx.Exec(fmt.Sprintf("UPDATE `%s` SET %s = ? WHERE `id` = ?", typeName, strings.Join(columns, " = ?, ")), append(args, string(entityID))...)
+	} else {
+		_, err = tx.Exec(fmt.Sprintf("INSERT INTO `%s`(`id`, %s) VALUES(?%s)", typeName, strings.Join(columns, ", "), strings.Repeat(", ?", len(columns))), append([]interface{}{string(entityID)}, args...)...)
+	}
+	return err
+}
+
+func indexColumn(attr string) string {
+	return escapeId("idx_" + attr)
+}
+
+// indexColumnValue returns the value of the index in `idx_<attr>` columns, index values which are too long are hashed
+func indexColumnValue(v string) string {
+	if len(v) <= _MAX_INDEX_VALUE_LENGTH {
+		return v
+	}
+	// index values start with type prefixes other than 'h', so hashed values never equal to short values
+	sum := sha1.Sum([]byte(v))
+	return "h" + hex.EncodeToString(sum[:])
+}
+
+// checkDup converts duplicate key errors of unique indexes to ErrDuplicateIndexValue, so that the write is not retried
+func (es *mysqlEntityStorage) checkDup(err error) error {
+	if myerr, ok := err.(*mysql.MySQLError); ok && myerr.Number == _ER_DUP_ENTRY {
+		return errors.Wrap(storagecommon.ErrDuplicateIndexValue, err.Error())
+	}
+	return err
+}
+
+// DefineIndex defines the index of the attribute as the indexed `idx_<attr>` column, which is filled for existing rows if
+// not built
+func (es *mysqlEntityStorage) DefineIndex(typeName string, attr string, unique bool) error {
+	if err := es.createTableForEntityTypeIfNotExists(typeName); err != nil {
+		return err
+	}
+	es.indexes.Define(typeName, attr, unique)
+
+	_, err := es.db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS `%s`(`type` VARCHAR(64) NOT NULL, `attr` VARCHAR(64) NOT NULL, PRIMARY KEY(`type`, `attr`))", _BUILT_INDEXES_TABLE))
+	if err != nil {
+		return err
+	}
+	var n int
+	err = es.db.QueryRow("SELECT COUNT(*) FROM `"+_BUILT_INDEXES_TABLE+"` WHERE `type` = ? AND `attr` = ?", typeName, attr).Scan(&n)
+	if err != nil || n > 0 {
+		return err
+	}
+
+	// the column might be added by a previous startup which failed to fill it
+	err = es.db.QueryRow("SELECT COUNT(*) FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?", typeName, "idx_"+attr).Scan(&n)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		indexType := "INDEX"
+		if unique {
+			indexType = "UNIQUE INDEX"
+		}
+		_, err = es.db.Exec(fmt.Sprintf("ALTER TABLE `%s` ADD COLUMN %s VARCHAR(%d) NULL, ADD %s %s(%s)", typeName, indexColumn(attr), _MAX_INDEX_VALUE_LENGTH, indexType, indexColumn(attr), indexColumn(attr)))
+		if err != nil {
+			return err
+		}
+	}
+
+	rows, err := es.db.Query(fmt.Sprintf("SELECT `id`, `data` FROM `%s`", typeName))
+	if err != nil {
+		return err
+	}
+	values := map[string]string{}
+	for rows.Next() {
+		var id string
+		var b []byte
+		var data map[string]interface{}
+		if err = rows.Scan(&id, &b); err == nil {
+			err = dataPacker.UnpackMsg(b, &data)
+		}
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		if v, ok := storagecommon.IndexValue(data[attr]); ok {
+			values[id] = indexColumnValue(v)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for id, v := range values {
+		if _, err = es.db.Exec(fmt.Sprintf("UPDATE `%s` SET %s = ? WHERE `id` = ?", typeName, indexColumn(attr)), v, id); err != nil {
+			return es.checkDup(err)
+		}
+	}
+	_, err = es.db.Exec("INSERT IGNORE INTO `"+_BUILT_INDEXES_TABLE+"`(`type`, `attr`) VALUES(?, ?)", typeName, attr)
+	return err
+}
+
+// FindByAttr returns IDs of entities of which the attribute equals to value
+func (es *mysqlEntityStorage) FindByAttr(typeName string, attr string, value interface{}) ([]common.EntityID, error) {
+	if _, ok := es.indexes[typeName][attr]; !ok {
+		return nil, errors.Errorf("%s.%s is not indexed", typeName, attr)
+	}
+	v, ok := storagecommon.IndexValue(value)
+	if !ok {
+		return nil, errors.Errorf("%s.%s: value of type %T can not be indexed", typeName, attr, value)
+	}
+
+	rows, err := es.db.Query(fmt.Sprintf("SELECT `id` FROM `%s` WHERE %s = ?", typeName, indexColumn(attr)), indexColumnValue(v))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	eids := []common.EntityID{}
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		eids = append(eids, common.EntityID(id))
+	}
+	return eids, rows.Err()
+}
+
+// Update sets and deletes fields of entity data in mysql
+//
+// Entity data is stored as a packed blob, so the row is locked, modified and written back in one transaction
+func (es *mysqlEntityStorage) Update(typeName string, entityID common.EntityID, updates map[string]interface{}, deletes []string) error {
+	if err := es.createTableForEntityTypeIfNotExists(typeName); err != nil {
+		return err
+	}
+
+	tx, err := es.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	data := map[string]interface{}{}
+	var b []byte
+	err = tx.QueryRow("SELECT `data` FROM `"+typeName+"` WHERE `id` = ? FOR UPDATE", string(entityID)).Scan(&b)
+	exists := err == nil
+	if err == nil {
+		err = dataPacker.UnpackMsg(b, &data)
+	} else if err == sql.ErrNoRows {
+		err = nil
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for k, v := range updates {
+		data[k] = v
+	}
+	for _, k := range deletes {
+		delete(data, k)
+	}
+
+	if b, err = packData(data); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err = es.writeRow(tx, typeName, entityID, b, data, exists); err != nil {
+		tx.Rollback()
+		return es.checkDup(err)
+	}
+	return tx.Commit()
+}
+
 func (es *mysqlEntityStorage) Read(typeName string, entityID common.EntityID) (interface{}, error) {
 	if err := es.createTableForEntityTypeIfNotExists(typeName); err != nil {
 		return nil, err
@@ -138,6 +356,15 @@ func (es *mysqlEntityStorage) Exists(typeName string, entityID common.EntityID)
 	return true, nil
 }
 
+func (es *mysqlEntityStorage) Delete(typeName string, entityID common.EntityID) error {
+	if err := es.createTableForEntityTypeIfNotExists(typeName); err != nil {
+		return err
+	}
+
+	_, err := es.db.Exec("DELETE FROM `"+typeName+"` WHERE `id` = ?", string(entityID))
+	return err
+}
+
 func (es *mysqlEntityStorage) Close() {
 	es.db.Close()
 }
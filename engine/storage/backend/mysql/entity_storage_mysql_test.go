@@ -7,6 +7,7 @@ import (
 
 	"github.com/sagacao/goworld/engine/common"
 	"github.com/sagacao/goworld/engine/gwlog"
+	"github.com/sagacao/goworld/engine/storage/storage_common"
 	"github.com/xiaonanln/typeconv"
 )
 
@@ -87,3 +88,48 @@ func TestMySQLEntityStorage(t *testing.T) {
 	}
 
 }
+
+func TestMySQLEntityStorageUpdate(t *testing.T) {
+	pwd := "testmysql"
+	if os.Getenv("TRAVIS") != "" {
+		pwd = ""
+	}
+	es, err := OpenMySQL("root:" + pwd + "@tcp(127.0.0.1:3306)/goworld")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entityID := common.GenEntityID()
+	if err = es.Write("Avatar", entityID, map[string]interface{}{"a": 1, "b": "2", "c": true}); err != nil {
+		t.Fatal(err)
+	}
+
+	updater := es.(storagecommon.EntityStorageUpdater)
+	if err = updater.Update("Avatar", entityID, map[string]interface{}{"a": 2, "d": 1.11}, []string{"c"}); err != nil {
+		t.Fatal(err)
+	}
+
+	verifyData, err := es.Read("Avatar", entityID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := verifyData.(map[string]interface{})
+	if typeconv.Int(data["a"]) != 2 || data["b"] != "2" || data["d"] != 1.11 {
+		t.Errorf("read wrong data: %v", data)
+	}
+	if _, ok := data["c"]; ok {
+		t.Errorf("c should be deleted: %v", data)
+	}
+}
+
+func TestIndexColumnValue(t *testing.T) {
+	short, _ := storagecommon.IndexValue("alice")
+	if v := indexColumnValue(short); v != short {
+		t.Errorf("short index values should not be hashed: %s", v)
+	}
+	long1, _ := storagecommon.IndexValue(string(make([]byte, _MAX_INDEX_VALUE_LENGTH)))
+	long2, _ := storagecommon.IndexValue(string(make([]byte, _MAX_INDEX_VALUE_LENGTH+1)))
+	v1, v2 := indexColumnValue(long1), indexColumnValue(long2)
+	if len(v1) > _MAX_INDEX_VALUE_LENGTH || len(v2) > _MAX_INDEX_VALUE_LENGTH || v1 == v2 {
+		t.Errorf("long index values should be hashed into different values: %s, %s", v1, v2)
+	}
+}
@@ -10,12 +10,20 @@ import (
 	"github.com/sagacao/goworld/engine/storage/storage_common"
 )
 
+const (
+	// _HASH_MARKER_FIELD is always set in entity hash so that entities with empty data still exist
+	_HASH_MARKER_FIELD = "$"
+	// _INDEX_KEY_PREFIX is the prefix of keys of indexes, which should not match keys of entities
+	_INDEX_KEY_PREFIX = "$index$"
+)
+
 var (
 	dataPacker = netutil.MessagePackMsgPacker{}
 )
 
 type redisEntityStorage struct {
-	c redis.Conn
+	c       redis.Conn
+	indexes storagecommon.Indexes
 }
 
 // OpenRedis opens redis as entity storage
@@ -32,7 +40,8 @@ func OpenRedis(url string, dbindex int) (storagecommon.EntityStorage, error) {
 	}
 
 	es := &redisEntityStorage{
-		c: c,
+		c:       c,
+		indexes: storagecommon.Indexes{},
 	}
 
 	return es, nil
@@ -82,25 +91,260 @@ func isZeroCursor(c interface{}) bool {
 	return string(c.([]byte)) == "0"
 }
 
+// Write writes entity data as a redis hash, each key of data is packed in one field
 func (es *redisEntityStorage) Write(typeName string, entityID common.EntityID, data interface{}) error {
-	b, err := packData(data)
+	key := entityKey(typeName, entityID)
+	args := redis.Args{key, _HASH_MARKER_FIELD, ""}
+	for k, v := range data.(map[string]interface{}) {
+		b, err := packData(v)
+		if err != nil {
+			return err
+		}
+		args = append(args, k, b)
+	}
+
+	var oldIndexValues, newIndexValues map[string]string
+	if len(es.indexes[typeName]) > 0 {
+		var err error
+		if oldIndexValues, err = es.readIndexValues(typeName, entityID); err != nil {
+			return err
+		}
+		newIndexValues = es.indexes.Values(typeName, data.(map[string]interface{}))
+		if err = es.checkUniqueIndexes(typeName, entityID, oldIndexValues, newIndexValues); err != nil {
+			return err
+		}
+	}
+
+	es.c.Send("MULTI")
+	es.c.Send("DEL", key)
+	es.c.Send("HMSET", args...)
+	es.sendIndexChanges(typeName, entityID, oldIndexValues, newIndexValues)
+	return es.exec()
+}
+
+// Update sets and deletes fields of entity data in redis hash
+func (es *redisEntityStorage) Update(typeName string, entityID common.EntityID, updates map[string]interface{}, deletes []string) error {
+	key := entityKey(typeName, entityID)
+	isHash, err := es.isHash(key)
 	if err != nil {
 		return err
 	}
 
-	_, err = es.c.Do("SET", entityKey(typeName, entityID), b)
+	if !isHash {
+		// data is saved in legacy format, rewrite in hash format
+		data, err := es.Read(typeName, entityID)
+		if err == redis.ErrNil {
+			data, err = map[string]interface{}{}, nil
+		}
+		if err != nil {
+			return err
+		}
+
+		m := data.(map[string]interface{})
+		for k, v := range updates {
+			m[k] = v
+		}
+		for _, k := range deletes {
+			delete(m, k)
+		}
+		return es.Write(typeName, entityID, m)
+	}
+
+	var oldIndexValues, newIndexValues map[string]string
+	if len(es.indexes[typeName]) > 0 {
+		if oldIndexValues, err = es.readIndexValues(typeName, entityID); err != nil {
+			return err
+		}
+		newIndexValues = es.indexes.Updated(typeName, oldIndexValues, updates, deletes)
+		if err = es.checkUniqueIndexes(typeName, entityID, oldIndexValues, newIndexValues); err != nil {
+			return err
+		}
+	}
+
+	es.c.Send("MULTI")
+	if len(updates) > 0 {
+		args := redis.Args{key}
+		for k, v := range updates {
+			b, err := packData(v)
+			if err != nil {
+				es.c.Do("DISCARD")
+				return err
+			}
+			args = append(args, k, b)
+		}
+		es.c.Send("HMSET", args...)
+	}
+	if len(deletes) > 0 {
+		es.c.Send("HDEL", redis.Args{key}.AddFlat(deletes)...)
+	}
+	es.sendIndexChanges(typeName, entityID, oldIndexValues, newIndexValues)
+	return es.exec()
+}
+
+// exec executes the transaction, which fails if watched index keys are changed
+func (es *redisEntityStorage) exec() error {
+	reply, err := es.c.Do("EXEC")
+	if err == nil && reply == nil {
+		err = errors.New("index changed by others")
+	}
 	return err
 }
 
+func indexKey(typeName string, attr string, value string) string {
+	return _INDEX_KEY_PREFIX + typeName + "$" + attr + "$" + value
+}
+
+// indexBuiltKey is set after the index is built from existing entities
+func indexBuiltKey(typeName string, attr string) string {
+	return _INDEX_KEY_PREFIX + typeName + "$" + attr
+}
+
+func (es *redisEntityStorage) readIndexValues(typeName string, entityID common.EntityID) (map[string]string, error) {
+	data, err := es.Read(typeName, entityID)
+	if err == redis.ErrNil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return es.indexes.Values(typeName, data.(map[string]interface{})), nil
+}
+
+// checkUniqueIndexes checks that new values of unique indexes are not used by other entities, keys of which are watched
+// until the transaction is executed
+func (es *redisEntityStorage) checkUniqueIndexes(typeName string, entityID common.EntityID, old, new map[string]string) error {
+	for attr, unique := range es.indexes[typeName] {
+		v, ok := new[attr]
+		if !unique || !ok || old[attr] == v {
+			continue
+		}
+
+		key := indexKey(typeName, attr, v)
+		if _, err := es.c.Do("WATCH", key); err != nil {
+			return err
+		}
+		eids, err := redis.Strings(es.c.Do("SMEMBERS", key))
+		if err == nil {
+			for _, eid := range eids {
+				if eid != string(entityID) {
+					err = errors.Wrapf(storagecommon.ErrDuplicateIndexValue, "%s.%s", typeName, attr)
+					break
+				}
+			}
+		}
+		if err != nil {
+			es.c.Do("UNWATCH")
+			return err
+		}
+	}
+	return nil
+}
+
+func (es *redisEntityStorage) sendIndexChanges(typeName string, entityID common.EntityID, old, new map[string]string) {
+	for attr := range es.indexes[typeName] {
+		oldVal, hasOld := old[attr]
+		newVal, hasNew := new[attr]
+		if hasOld == hasNew && oldVal == newVal {
+			continue
+		}
+		if hasOld {
+			es.c.Send("SREM", indexKey(typeName, attr, oldVal), string(entityID))
+		}
+		if hasNew {
+			es.c.Send("SADD", indexKey(typeName, attr, newVal), string(entityID))
+		}
+	}
+}
+
+// DefineIndex defines the index of the attribute as sets of entity IDs, which is built from existing entities if not built
+func (es *redisEntityStorage) DefineIndex(typeName string, attr string, unique bool) error {
+	es.indexes.Define(typeName, attr, unique)
+	built, err := redis.Bool(es.c.Do("EXISTS", indexBuiltKey(typeName, attr)))
+	if err != nil || built {
+		return err
+	}
+
+	eids, err := es.List(typeName)
+	if err != nil {
+		return err
+	}
+	for _, eid := range eids {
+		data, err := es.Read(typeName, eid)
+		if err != nil {
+			return err
+		}
+		if v, ok := storagecommon.IndexValue(data.(map[string]interface{})[attr]); ok {
+			if _, err := es.c.Do("SADD", indexKey(typeName, attr, v), string(eid)); err != nil {
+				return err
+			}
+		}
+	}
+	_, err = es.c.Do("SET", indexBuiltKey(typeName, attr), 1)
+	return err
+}
+
+// FindByAttr returns IDs of entities of which the attribute equals to value
+func (es *redisEntityStorage) FindByAttr(typeName string, attr string, value interface{}) ([]common.EntityID, error) {
+	if _, ok := es.indexes[typeName][attr]; !ok {
+		return nil, errors.Errorf("%s.%s is not indexed", typeName, attr)
+	}
+	v, ok := storagecommon.IndexValue(value)
+	if !ok {
+		return nil, errors.Errorf("%s.%s: value of type %T can not be indexed", typeName, attr, value)
+	}
+
+	members, err := redis.Strings(es.c.Do("SMEMBERS", indexKey(typeName, attr, v)))
+	if err != nil {
+		return nil, err
+	}
+	eids := make([]common.EntityID, len(members))
+	for i, eid := range members {
+		eids[i] = common.EntityID(eid)
+	}
+	return eids, nil
+}
+
+func (es *redisEntityStorage) isHash(key string) (bool, error) {
+	keyType, err := redis.String(es.c.Do("TYPE", key))
+	return keyType == "hash", err
+}
+
 func (es *redisEntityStorage) Read(typeName string, entityID common.EntityID) (interface{}, error) {
-	b, err := redis.Bytes(es.c.Do("GET", entityKey(typeName, entityID)))
+	key := entityKey(typeName, entityID)
+	isHash, err := es.isHash(key)
 	if err != nil {
 		return nil, err
 	}
-	var data map[string]interface{}
-	if err = dataPacker.UnpackMsg(b, &data); err != nil {
+
+	if !isHash {
+		// entity data saved in legacy format
+		b, err := redis.Bytes(es.c.Do("GET", key))
+		if err != nil {
+			return nil, err
+		}
+		var data map[string]interface{}
+		if err = dataPacker.UnpackMsg(b, &data); err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+
+	fields, err := redis.StringMap(es.c.Do("HGETALL", key))
+	if err != nil {
 		return nil, err
 	}
+
+	data := make(map[string]interface{}, len(fields))
+	for k, b := range fields {
+		if k == _HASH_MARKER_FIELD {
+			continue
+		}
+
+		var v interface{}
+		if err = dataPacker.UnpackMsg([]byte(b), &v); err != nil {
+			return nil, err
+		}
+		data[k] = v
+	}
 	return data, nil
 }
 
@@ -110,6 +354,24 @@ func (es *redisEntityStorage) Exists(typeName string, entityID common.EntityID)
 	return exists, err
 }
 
+// Delete deletes the entity and removes it from indexes
+func (es *redisEntityStorage) Delete(typeName string, entityID common.EntityID) error {
+	key := entityKey(typeName, entityID)
+	if len(es.indexes[typeName]) == 0 {
+		_, err := es.c.Do("DEL", key)
+		return err
+	}
+
+	oldIndexValues, err := es.readIndexValues(typeName, entityID)
+	if err != nil {
+		return err
+	}
+	es.c.Send("MULTI")
+	es.c.Send("DEL", key)
+	es.sendIndexChanges(typeName, entityID, oldIndexValues, nil)
+	return es.exec()
+}
+
 func (es *redisEntityStorage) Close() {
 	es.c.Close()
 }
@@ -5,6 +5,7 @@ import (
 
 	"github.com/sagacao/goworld/engine/common"
 	"github.com/sagacao/goworld/engine/gwlog"
+	"github.com/sagacao/goworld/engine/storage/storage_common"
 	"github.com/xiaonanln/typeconv"
 )
 
@@ -65,3 +66,31 @@ func TestRedisEntityStorage(t *testing.T) {
 	}
 
 }
+
+func TestRedisEntityStorageUpdate(t *testing.T) {
+	es, err := OpenRedis("redis://localhost:6379", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entityID := common.GenEntityID()
+	if err = es.Write("Avatar", entityID, map[string]interface{}{"a": 1, "b": "2", "c": true}); err != nil {
+		t.Fatal(err)
+	}
+
+	updater := es.(storagecommon.EntityStorageUpdater)
+	if err = updater.Update("Avatar", entityID, map[string]interface{}{"a": 2, "d": 1.11}, []string{"c"}); err != nil {
+		t.Fatal(err)
+	}
+
+	verifyData, err := es.Read("Avatar", entityID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := verifyData.(map[string]interface{})
+	if typeconv.Int(data["a"]) != 2 || data["b"] != "2" || data["d"] != 1.11 {
+		t.Errorf("read wrong data: %v", data)
+	}
+	if _, ok := data["c"]; ok {
+		t.Errorf("c should be deleted: %v", data)
+	}
+}
@@ -12,12 +12,20 @@ import (
 	"github.com/sagacao/goworld/engine/storage/storage_common"
 )
 
+const (
+	// _INDEX_KEY_PREFIX is the prefix of keys of indexes, which should not match keys of entities
+	_INDEX_KEY_PREFIX = "$index$"
+	// _UNIQUE_KEY_PREFIX is the prefix of keys of values of unique indexes, which are set to IDs of entities claiming them
+	_UNIQUE_KEY_PREFIX = "$unique$"
+)
+
 var (
 	dataPacker = netutil.MessagePackMsgPacker{}
 )
 
 type redisClusterEntityStorage struct {
-	c *redis.Cluster
+	c       *redis.Cluster
+	indexes storagecommon.Indexes
 }
 
 // OpenRedis opens redis as entity storage
@@ -36,7 +44,8 @@ func OpenRedisCluster(startNodes []string) (storagecommon.EntityStorage, error)
 	}
 
 	es := &redisClusterEntityStorage{
-		c: c,
+		c:       c,
+		indexes: storagecommon.Indexes{},
 	}
 
 	return es, nil
@@ -86,16 +95,233 @@ func isZeroCursor(c interface{}) bool {
 	return string(c.([]byte)) == "0"
 }
 
+// Write writes entity data and maintains indexes
+//
+// Index keys are in different slots from the entity key, so indexes are updated after data is written. New values of
+// unique indexes are claimed by SET NX before writing, so the same value can not be written by different entities
+// concurrently.
 func (es *redisClusterEntityStorage) Write(typeName string, entityID common.EntityID, data interface{}) error {
 	b, err := packData(data)
 	if err != nil {
 		return err
 	}
 
-	_, err = es.c.Do("SET", entityKey(typeName, entityID), b)
+	var oldIndexValues, newIndexValues map[string]string
+	if len(es.indexes[typeName]) > 0 {
+		if oldIndexValues, err = es.readIndexValues(typeName, entityID); err != nil {
+			return err
+		}
+		newIndexValues = es.indexes.Values(typeName, data.(map[string]interface{}))
+		if err = es.claimUniqueIndexes(typeName, entityID, oldIndexValues, newIndexValues); err != nil {
+			return err
+		}
+	}
+
+	// claimed values are kept if fail, since data might be written, and they are claimed again when retrying
+	if _, err = es.c.Do("SET", entityKey(typeName, entityID), b); err != nil {
+		return err
+	}
+	if err = es.releaseUniqueIndexes(typeName, entityID, oldIndexValues, newIndexValues); err != nil {
+		return err
+	}
+	return es.updateIndexes(typeName, entityID, oldIndexValues, newIndexValues)
+}
+
+func indexKey(typeName string, attr string, value string) string {
+	return _INDEX_KEY_PREFIX + typeName + "$" + attr + "$" + value
+}
+
+// indexBuiltKey is set after the index is built from existing entities
+func indexBuiltKey(typeName string, attr string) string {
+	return _INDEX_KEY_PREFIX + typeName + "$" + attr
+}
+
+func (es *redisClusterEntityStorage) readIndexValues(typeName string, entityID common.EntityID) (map[string]string, error) {
+	data, err := es.Read(typeName, entityID)
+	if err == redis.ErrNil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return es.indexes.Values(typeName, data.(map[string]interface{})), nil
+}
+
+// uniqueKey is set to the ID of the entity which claims the value of the unique index
+func uniqueKey(typeName string, attr string, value string) string {
+	return _UNIQUE_KEY_PREFIX + typeName + "$" + attr + "$" + value
+}
+
+// uniqueBuiltKey is set after values of the unique index are claimed by existing entities
+func uniqueBuiltKey(typeName string, attr string) string {
+	return _UNIQUE_KEY_PREFIX + typeName + "$" + attr
+}
+
+// claimUniqueIndexes claims new values of unique indexes for the entity, values which are claimed are released if fail
+func (es *redisClusterEntityStorage) claimUniqueIndexes(typeName string, entityID common.EntityID, old, new map[string]string) error {
+	var claimed []string
+	for attr, unique := range es.indexes[typeName] {
+		v, ok := new[attr]
+		if !unique || !ok || old[attr] == v {
+			continue
+		}
+
+		key := uniqueKey(typeName, attr, v)
+		ok, err := es.claim(key, entityID)
+		if err == nil && !ok {
+			err = errors.Wrapf(storagecommon.ErrDuplicateIndexValue, "%s.%s", typeName, attr)
+		}
+		if err != nil {
+			for _, key := range claimed {
+				es.release(key, entityID)
+			}
+			return err
+		}
+		claimed = append(claimed, key)
+	}
+	return nil
+}
+
+// releaseUniqueIndexes releases old values of unique indexes which are not used by the entity any more
+func (es *redisClusterEntityStorage) releaseUniqueIndexes(typeName string, entityID common.EntityID, old, new map[string]string) error {
+	for attr, unique := range es.indexes[typeName] {
+		v, ok := old[attr]
+		if !unique || !ok {
+			continue
+		}
+		if newVal, hasNew := new[attr]; hasNew && newVal == v {
+			continue
+		}
+		if err := es.release(uniqueKey(typeName, attr, v), entityID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// claim sets the key to the entity ID if not set, returns false if the key is claimed by another entity
+func (es *redisClusterEntityStorage) claim(key string, entityID common.EntityID) (bool, error) {
+	for {
+		r, err := es.c.Do("SET", key, string(entityID), "NX")
+		if err != nil || r != nil {
+			return err == nil, err
+		}
+
+		owner, err := redis.String(es.c.Do("GET", key))
+		if err == redis.ErrNil {
+			continue // released after SET NX, try again
+		} else if err != nil {
+			return false, err
+		}
+		return owner == string(entityID), nil
+	}
+}
+
+// release deletes the key if it is claimed by the entity
+//
+// Keys are only claimed and released by writes of the claiming entities, which are never concurrent, so the key is not
+// claimed by others between GET and DEL.
+func (es *redisClusterEntityStorage) release(key string, entityID common.EntityID) error {
+	owner, err := redis.String(es.c.Do("GET", key))
+	if err == redis.ErrNil || (err == nil && owner != string(entityID)) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	_, err = es.c.Do("DEL", key)
 	return err
 }
 
+func (es *redisClusterEntityStorage) updateIndexes(typeName string, entityID common.EntityID, old, new map[string]string) error {
+	for attr := range es.indexes[typeName] {
+		oldVal, hasOld := old[attr]
+		newVal, hasNew := new[attr]
+		if hasOld == hasNew && oldVal == newVal {
+			continue
+		}
+		if hasOld {
+			if _, err := es.c.Do("SREM", indexKey(typeName, attr, oldVal), string(entityID)); err != nil {
+				return err
+			}
+		}
+		if hasNew {
+			if _, err := es.c.Do("SADD", indexKey(typeName, attr, newVal), string(entityID)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// DefineIndex defines the index of the attribute as sets of entity IDs, which is built from existing entities if not built
+//
+// Values of unique indexes are also claimed by existing entities, which is built separately since indexes defined by
+// older versions do not claim values.
+func (es *redisClusterEntityStorage) DefineIndex(typeName string, attr string, unique bool) error {
+	es.indexes.Define(typeName, attr, unique)
+	err := es.buildIndex(indexBuiltKey(typeName, attr), typeName, attr, func(eid common.EntityID, v string) error {
+		_, err := es.c.Do("SADD", indexKey(typeName, attr, v), string(eid))
+		return err
+	})
+	if err != nil || !unique {
+		return err
+	}
+
+	return es.buildIndex(uniqueBuiltKey(typeName, attr), typeName, attr, func(eid common.EntityID, v string) error {
+		ok, err := es.claim(uniqueKey(typeName, attr, v), eid)
+		if err == nil && !ok {
+			err = errors.Wrapf(storagecommon.ErrDuplicateIndexValue, "%s.%s", typeName, attr)
+		}
+		return err
+	})
+}
+
+// buildIndex calls build with index values of existing entities if the built key is not set, which is set after built
+func (es *redisClusterEntityStorage) buildIndex(builtKey string, typeName string, attr string, build func(eid common.EntityID, v string) error) error {
+	built, err := redis.Bool(es.c.Do("EXISTS", builtKey))
+	if err != nil || built {
+		return err
+	}
+
+	eids, err := es.List(typeName)
+	if err != nil {
+		return err
+	}
+	for _, eid := range eids {
+		data, err := es.Read(typeName, eid)
+		if err != nil {
+			return err
+		}
+		if v, ok := storagecommon.IndexValue(data.(map[string]interface{})[attr]); ok {
+			if err := build(eid, v); err != nil {
+				return err
+			}
+		}
+	}
+	_, err = es.c.Do("SET", builtKey, 1)
+	return err
+}
+
+// FindByAttr returns IDs of entities of which the attribute equals to value
+func (es *redisClusterEntityStorage) FindByAttr(typeName string, attr string, value interface{}) ([]common.EntityID, error) {
+	if _, ok := es.indexes[typeName][attr]; !ok {
+		return nil, errors.Errorf("%s.%s is not indexed", typeName, attr)
+	}
+	v, ok := storagecommon.IndexValue(value)
+	if !ok {
+		return nil, errors.Errorf("%s.%s: value of type %T can not be indexed", typeName, attr, value)
+	}
+
+	members, err := redis.Strings(es.c.Do("SMEMBERS", indexKey(typeName, attr, v)))
+	if err != nil {
+		return nil, err
+	}
+	eids := make([]common.EntityID, len(members))
+	for i, eid := range members {
+		eids[i] = common.EntityID(eid)
+	}
+	return eids, nil
+}
+
 func (es *redisClusterEntityStorage) Read(typeName string, entityID common.EntityID) (interface{}, error) {
 	b, err := redis.Bytes(es.c.Do("GET", entityKey(typeName, entityID)))
 	if err != nil {
@@ -114,6 +340,25 @@ func (es *redisClusterEntityStorage) Exists(typeName string, entityID common.Ent
 	return exists, err
 }
 
+// Delete deletes the entity and removes it from indexes
+func (es *redisClusterEntityStorage) Delete(typeName string, entityID common.EntityID) error {
+	var oldIndexValues map[string]string
+	if len(es.indexes[typeName]) > 0 {
+		var err error
+		if oldIndexValues, err = es.readIndexValues(typeName, entityID); err != nil {
+			return err
+		}
+	}
+
+	if _, err := es.c.Do("DEL", entityKey(typeName, entityID)); err != nil {
+		return err
+	}
+	if err := es.releaseUniqueIndexes(typeName, entityID, oldIndexValues, nil); err != nil {
+		return err
+	}
+	return es.updateIndexes(typeName, entityID, oldIndexValues, nil)
+}
+
 func (es *redisClusterEntityStorage) Close() {
 	es.c.Close()
 }
@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/sagacao/goworld/engine/common"
+)
+
+type entityKey struct {
+	TypeName string
+	EntityID common.EntityID
+}
+
+type cacheItem struct {
+	key  entityKey
+	data map[string]interface{}
+}
+
+// dataCache is a LRU cache of entity data which is saved but not written yet, so that loading these entities does not
+// wait for the writes and hit the backend
+//
+// Data is removed once written, since it might be changed by other processes afterwards. Entities being saved are owned
+// by this process, so cached data is always the latest.
+//
+// Data is copied when put into or got from the cache, since callers may modify the data.
+type dataCache struct {
+	sync.Mutex
+	size  int
+	items map[entityKey]*list.Element
+	lru   *list.List // most recently used items are at front
+}
+
+func newDataCache(size int) *dataCache {
+	return &dataCache{
+		size:  size,
+		items: map[entityKey]*list.Element{},
+		lru:   list.New(),
+	}
+}
+
+func (c *dataCache) put(key entityKey, data interface{}) {
+	m, ok := data.(map[string]interface{})
+	if !ok || c.size <= 0 {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	m = deepCopy(m).(map[string]interface{})
+	if elem, ok := c.items[key]; ok {
+		elem.Value.(*cacheItem).data = m
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.items[key] = c.lru.PushFront(&cacheItem{key: key, data: m})
+	for c.lru.Len() > c.size {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+// update applies updates and deletes to cached data if the entity is cached
+func (c *dataCache) update(key entityKey, updates map[string]interface{}, deletes []string) {
+	c.Lock()
+	defer c.Unlock()
+	elem, ok := c.items[key]
+	if !ok {
+		return
+	}
+
+	m := elem.Value.(*cacheItem).data
+	for k, v := range updates {
+		m[k] = deepCopy(v)
+	}
+	for _, k := range deletes {
+		delete(m, k)
+	}
+	c.lru.MoveToFront(elem)
+}
+
+// get returns a copy of cached data
+func (c *dataCache) get(key entityKey) (map[string]interface{}, bool) {
+	c.Lock()
+	defer c.Unlock()
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return deepCopy(elem.Value.(*cacheItem).data).(map[string]interface{}), true
+}
+
+func (c *dataCache) contains(key entityKey) bool {
+	c.Lock()
+	defer c.Unlock()
+	_, ok := c.items[key]
+	return ok
+}
+
+// remove removes cached data of the entity
+func (c *dataCache) remove(key entityKey) {
+	c.Lock()
+	defer c.Unlock()
+	if elem, ok := c.items[key]; ok {
+		c.removeElement(elem)
+	}
+}
+
+func (c *dataCache) removeElement(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.items, elem.Value.(*cacheItem).key)
+}
+
+// deepCopy copies maps and lists in entity data
+func deepCopy(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(val))
+		for k, elem := range val {
+			m[k] = deepCopy(elem)
+		}
+		return m
+	case map[interface{}]interface{}:
+		m := make(map[interface{}]interface{}, len(val))
+		for k, elem := range val {
+			m[k] = deepCopy(elem)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(val))
+		for i, elem := range val {
+			l[i] = deepCopy(elem)
+		}
+		return l
+	default:
+		return v
+	}
+}
@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/sagacao/goworld/engine/gwlog"
+	"github.com/sagacao/goworld/engine/opmon"
+	"github.com/xiaonanln/typeconv"
+)
+
+const (
+	// _DELETED_TYPE_NAME is the entity type of soft deleted entities, which are purged after the retention period
+	_DELETED_TYPE_NAME = "_deleted"
+	// _MAX_PURGE_INTERVAL is the max interval of purging soft deleted entities
+	_MAX_PURGE_INTERVAL = time.Hour
+)
+
+var (
+	softDeleteRetention time.Duration
+	purgeStop           chan struct{}
+)
+
+// deleteEntity deletes the entity from the backend
+//
+// If soft delete is enabled, entity data is moved to the _deleted entity type with the type name and the delete time.
+func (w *storageWorker) deleteEntity(key entityKey) error {
+	if softDeleteRetention > 0 {
+		exists, err := w.engine.Exists(key.TypeName, key.EntityID)
+		if err != nil {
+			return err
+		}
+		if exists {
+			data, err := w.engine.Read(key.TypeName, key.EntityID)
+			if err != nil {
+				return err
+			}
+			err = w.engine.Write(_DELETED_TYPE_NAME, key.EntityID, map[string]interface{}{
+				"type":      key.TypeName,
+				"data":      data,
+				"deletedAt": time.Now().Unix(),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return w.engine.Delete(key.TypeName, key.EntityID)
+}
+
+// purgeRoutine purges soft deleted entities periodically until storage is shutdown
+func purgeRoutine() {
+	w := &storageWorker{}
+	defer func() {
+		w.closeEngine()
+		workersWaitGroup.Done()
+	}()
+
+	interval := softDeleteRetention
+	if interval > _MAX_PURGE_INTERVAL {
+		interval = _MAX_PURGE_INTERVAL
+	}
+	for {
+		if err := w.purgeDeleted(); err != nil {
+			gwlog.Errorf("storage: purge deleted entities failed: %s", err)
+			if w.engine != nil {
+				w.checkEOF(err)
+			}
+		}
+
+		select {
+		case <-purgeStop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// purgeDeleted deletes soft deleted entities which are deleted longer than the retention period
+func (w *storageWorker) purgeDeleted() error {
+	if err := w.assureEngineReady(); err != nil {
+		return err
+	}
+
+	monop := opmon.StartOperation("storage.purge")
+	defer monop.Finish(time.Second * 10)
+
+	eids, err := w.engine.List(_DELETED_TYPE_NAME)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	purged := 0
+	for _, eid := range eids {
+		data, err := w.engine.Read(_DELETED_TYPE_NAME, eid)
+		if err != nil {
+			return err
+		}
+		m, _ := data.(map[string]interface{})
+		if m != nil && m["deletedAt"] != nil && now.Sub(time.Unix(typeconv.Int(m["deletedAt"]), 0)) < softDeleteRetention {
+			continue
+		}
+
+		if err = w.engine.Delete(_DELETED_TYPE_NAME, eid); err != nil {
+			return err
+		}
+		purged++
+	}
+	if purged > 0 {
+		gwlog.Infof("storage: purged %d deleted entities", purged)
+	}
+	return nil
+}
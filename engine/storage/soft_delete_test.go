@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sagacao/goworld/engine/common"
+	"github.com/sagacao/goworld/engine/storage/backend/bolt"
+)
+
+func TestSoftDelete(t *testing.T) {
+	dir, err := os.MkdirTemp("", "goworld_storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, err := entitystoragebolt.OpenBolt(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { softDeleteRetention = 0 }()
+	softDeleteRetention = time.Hour
+
+	w := &storageWorker{engine: engine}
+	avatar := entityKey{"Avatar", common.GenEntityID()}
+	if err := engine.Write(avatar.TypeName, avatar.EntityID, map[string]interface{}{"name": "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.deleteEntity(avatar); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := engine.Exists(avatar.TypeName, avatar.EntityID); exists || err != nil {
+		t.Fatalf("entity should be deleted: %v", err)
+	}
+	data, err := engine.Read(_DELETED_TYPE_NAME, avatar.EntityID)
+	if m, _ := data.(map[string]interface{}); err != nil || m["type"] != "Avatar" || m["data"].(map[string]interface{})["name"] != "alice" {
+		t.Fatalf("deleted entity should be kept: %v, %v", data, err)
+	}
+
+	if err := w.purgeDeleted(); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := engine.Exists(_DELETED_TYPE_NAME, avatar.EntityID); !exists {
+		t.Fatalf("deleted entity should be kept in retention period")
+	}
+	softDeleteRetention = time.Nanosecond
+	if err := w.purgeDeleted(); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := engine.Exists(_DELETED_TYPE_NAME, avatar.EntityID); exists {
+		t.Fatalf("deleted entity should be purged after retention period")
+	}
+}
@@ -5,13 +5,18 @@ import (
 
 	"strconv"
 
+	"sync"
+
+	"github.com/pkg/errors"
 	"github.com/xiaonanln/go-xnsyncutil/xnsyncutil"
 	"github.com/sagacao/goworld/engine/common"
 	"github.com/sagacao/goworld/engine/config"
 	"github.com/sagacao/goworld/engine/consts"
 	"github.com/sagacao/goworld/engine/gwlog"
+	"github.com/sagacao/goworld/engine/metrics"
 	"github.com/sagacao/goworld/engine/opmon"
 	"github.com/sagacao/goworld/engine/post"
+	"github.com/sagacao/goworld/engine/storage/backend/bolt"
 	"github.com/sagacao/goworld/engine/storage/backend/filesystem"
 	"github.com/sagacao/goworld/engine/storage/backend/mongodb"
 	"github.com/sagacao/goworld/engine/storage/backend/mysql"
@@ -21,18 +26,23 @@ import (
 )
 
 var (
-	storageEngine            storagecommon.EntityStorage
-	operationQueue           = xnsyncutil.NewSyncQueue()
-	storageRoutineTerminated = xnsyncutil.NewOneTimeCond()
+	// readQueue is the queue of load, exists and list requests shared by read workers
+	readQueue        = xnsyncutil.NewSyncQueue()
+	writeWorkers     = []*writeWorker{newWriteWorker(nil)} // writes before Initialize are queued in the first worker
+	workersWaitGroup sync.WaitGroup
+	cache            = newDataCache(0)
+	updateSupported  bool
+	indexesLock      sync.Mutex
+	indexes          = storagecommon.Indexes{}
+
+	// openStorageEngine opens a connection to the storage backend, each worker opens its own connection
+	openStorageEngine = openConfiguredStorageEngine
+
+	operationQueueLengthMetric = metrics.NewGaugeFunc("goworld_storage_operation_queue_length", "Number of storage operations waiting in queue", func() float64 {
+		return float64(operationQueueLen())
+	})
 )
 
-type saveRequest struct {
-	TypeName string
-	EntityID common.EntityID
-	Data     interface{}
-	Callback SaveCallbackFunc
-}
-
 type loadRequest struct {
 	TypeName string
 	EntityID common.EntityID
@@ -50,8 +60,18 @@ type listEntityIDsRequest struct {
 	Callback ListCallbackFunc
 }
 
-// SaveCallbackFunc is the callback type of storage Save
-type SaveCallbackFunc func()
+type findByAttrRequest struct {
+	TypeName string
+	Attr     string
+	Value    interface{}
+	Callback ListCallbackFunc
+}
+
+// SaveCallbackFunc is the callback type of storage Save, Update and Delete
+//
+// err is nil if the data is written. If values of unique indexes conflict with other entities, other data is written
+// with stored values of the unique indexes, and err is caused by storagecommon.ErrDuplicateIndexValue.
+type SaveCallbackFunc func(err error)
 
 // LoadCallbackFunc is the callback type of storage Load
 type LoadCallbackFunc func(data interface{}, err error)
@@ -63,77 +83,302 @@ type ExistsCallbackFunc func(exists bool, err error)
 type ListCallbackFunc func([]common.EntityID, error)
 
 // Save saves entity data to storage
+//
+// Data is written to the backend in background, and saves of the same entity which are not written yet are coalesced.
+// The callback is called after the data is written or failed to write.
 func Save(typeName string, entityID common.EntityID, data interface{}, callback SaveCallbackFunc) {
-	operationQueue.Push(saveRequest{
-		TypeName: typeName,
-		EntityID: entityID,
-		Data:     data,
-		Callback: callback,
-	})
+	key := entityKey{typeName, entityID}
+	cache.put(key, data)
+	writeWorkerOf(entityID).save(key, data, callback)
 	checkOperationQueueLen()
 }
 
+// Update updates part of entity data in storage
+//
+// Values of keys in updates are set and keys in deletes are deleted. Should only be used if IsUpdateSupported returns true
+func Update(typeName string, entityID common.EntityID, updates map[string]interface{}, deletes []string, callback SaveCallbackFunc) {
+	key := entityKey{typeName, entityID}
+	cache.update(key, updates, deletes)
+	writeWorkerOf(entityID).update(key, updates, deletes, callback)
+	checkOperationQueueLen()
+}
+
+// Delete deletes entity data from storage
+//
+// Pending saves of the entity are discarded. If soft delete is enabled, data is kept for the retention period before purged.
+func Delete(typeName string, entityID common.EntityID, callback SaveCallbackFunc) {
+	key := entityKey{typeName, entityID}
+	cache.remove(key)
+	writeWorkerOf(entityID).delete(key, callback)
+	checkOperationQueueLen()
+}
+
+// IsUpdateSupported returns if the storage backend supports partial updates
+func IsUpdateSupported() bool {
+	return updateSupported
+}
+
 // Load loads entity data from storage
+//
+// Data which is saved but not written yet is loaded from cache if enabled, otherwise entities which are not written yet
+// are loaded after they are written.
 func Load(typeName string, entityID common.EntityID, callback LoadCallbackFunc) {
-	operationQueue.Push(loadRequest{
+	key := entityKey{typeName, entityID}
+	if data, ok := cache.get(key); ok {
+		if callback != nil {
+			post.Post(func() {
+				callback(data, nil)
+			})
+		}
+		return
+	}
+
+	pushReadRequest(key, loadRequest{
 		TypeName: typeName,
 		EntityID: entityID,
 		Callback: callback,
 	})
-	checkOperationQueueLen()
 }
 
 // Exists checks if entity of specified ID exists in storage
 func Exists(typeName string, entityID common.EntityID, callback ExistsCallbackFunc) {
-	operationQueue.Push(existsRequest{
+	key := entityKey{typeName, entityID}
+	if cache.contains(key) {
+		if callback != nil {
+			post.Post(func() {
+				callback(true, nil)
+			})
+		}
+		return
+	}
+
+	pushReadRequest(key, existsRequest{
 		TypeName: typeName,
 		EntityID: entityID,
 		Callback: callback,
 	})
-	checkOperationQueueLen()
 }
 
 // ListEntityIDs returns all entity IDs in storage
 //
 // Return values can be large for common entity types
 func ListEntityIDs(typeName string, callback ListCallbackFunc) {
-	operationQueue.Push(listEntityIDsRequest{
+	// entities which are not written yet are also listed, and entities which are not deleted yet are not
+	pendingIDs := map[common.EntityID]bool{}
+	for _, w := range writeWorkers {
+		for eid, exists := range w.pendingEntityIDs(typeName) {
+			pendingIDs[eid] = exists
+		}
+	}
+
+	readQueue.Push(listEntityIDsRequest{
 		TypeName: typeName,
-		Callback: callback,
+		Callback: func(eids []common.EntityID, err error) {
+			if err == nil && len(pendingIDs) > 0 {
+				var existing []common.EntityID
+				for _, eid := range eids {
+					if exists, ok := pendingIDs[eid]; !ok || exists {
+						existing = append(existing, eid)
+					}
+				}
+				for eid, exists := range pendingIDs {
+					if exists {
+						existing = append(existing, eid)
+					}
+				}
+				eids = mergeEntityIDs(nil, existing)
+			}
+			if callback != nil {
+				callback(eids, err)
+			}
+		},
+	})
+	checkOperationQueueLen()
+}
+
+// DefineIndex defines the index of the attribute of entity type, should be called before storage is initialized
+func DefineIndex(typeName string, attr string, unique bool) {
+	indexesLock.Lock()
+	indexes.Define(typeName, attr, unique)
+	indexesLock.Unlock()
+}
+
+// defineIndexes defines all indexes in the storage engine
+func defineIndexes(engine storagecommon.EntityStorage) error {
+	indexesLock.Lock()
+	defer indexesLock.Unlock()
+	if len(indexes) == 0 {
+		return nil
+	}
+
+	indexer, ok := engine.(storagecommon.EntityStorageIndexer)
+	if !ok {
+		return errors.Errorf("storage %T does not support indexes", engine)
+	}
+	for typeName, attrs := range indexes {
+		for attr, unique := range attrs {
+			if err := indexer.DefineIndex(typeName, attr, unique); err != nil {
+				return errors.Wrapf(err, "define index %s.%s failed", typeName, attr)
+			}
+		}
+	}
+	return nil
+}
+
+// FindByAttr returns IDs of entities in storage of which the attribute equals to value
+//
+// The attribute should be indexed by DefineIndex. Entities which are not written yet are also considered.
+func FindByAttr(typeName string, attr string, value interface{}, callback ListCallbackFunc) {
+	indexValue, indexable := storagecommon.IndexValue(value)
+	pendingValues := map[common.EntityID]string{}
+	if indexable {
+		for _, w := range writeWorkers {
+			for eid, v := range w.pendingIndexValues(typeName, attr) {
+				pendingValues[eid] = v
+			}
+		}
+	}
+
+	readQueue.Push(findByAttrRequest{
+		TypeName: typeName,
+		Attr:     attr,
+		Value:    value,
+		Callback: func(eids []common.EntityID, err error) {
+			if err == nil && len(pendingValues) > 0 {
+				var matched []common.EntityID
+				for _, eid := range eids {
+					if v, ok := pendingValues[eid]; !ok || v == indexValue {
+						matched = append(matched, eid)
+					}
+				}
+				for eid, v := range pendingValues {
+					if v == indexValue {
+						matched = append(matched, eid)
+					}
+				}
+				eids = mergeEntityIDs(nil, matched)
+			}
+			if callback != nil {
+				callback(eids, err)
+			}
+		},
 	})
 	checkOperationQueueLen()
 }
 
+func mergeEntityIDs(eids []common.EntityID, others []common.EntityID) []common.EntityID {
+	set := common.EntityIDSet{}
+	for _, eid := range eids {
+		set.Add(eid)
+	}
+	for _, eid := range others {
+		if !set.Contains(eid) {
+			set.Add(eid)
+			eids = append(eids, eid)
+		}
+	}
+	return eids
+}
+
+// pushReadRequest pushes the read request to read workers, or defers it until the pending write of the entity is finished
+func pushReadRequest(key entityKey, req interface{}) {
+	if !writeWorkerOf(key.EntityID).deferRead(key, req) {
+		readQueue.Push(req)
+	}
+	checkOperationQueueLen()
+}
+
+func writeWorkerOf(entityID common.EntityID) *writeWorker {
+	if len(writeWorkers) == 1 {
+		return writeWorkers[0]
+	}
+
+	var h uint32
+	for i := 0; i < len(entityID); i++ {
+		h = h*31 + uint32(entityID[i])
+	}
+	return writeWorkers[h%uint32(len(writeWorkers))]
+}
+
+func operationQueueLen() int {
+	n := readQueue.Len()
+	for _, w := range writeWorkers {
+		n += w.queueLen()
+	}
+	return n
+}
+
 var recentWarnedQueueLen = 0
 
 func checkOperationQueueLen() {
-	qlen := operationQueue.Len()
+	qlen := operationQueueLen()
 	if qlen > 100 && qlen%100 == 0 && recentWarnedQueueLen != qlen {
 		gwlog.Warnf("Storage operation queue length = %d", qlen)
 		recentWarnedQueueLen = qlen
 	}
 }
 
-// Shutdown storage module
+// Shutdown storage module after all pending writes are written
 func Shutdown() {
-	operationQueue.Close()
-	storageRoutineTerminated.Wait()
+	readQueue.Close()
+	if purgeStop != nil {
+		close(purgeStop)
+	}
+	for _, w := range writeWorkers {
+		w.close()
+	}
+	workersWaitGroup.Wait()
 }
 
 // Initialize is called by engine to initialize storage module
 func Initialize() {
-	err := assureStorageEngineReady()
+	engine, err := openStorageEngine()
 	if err != nil {
 		gwlog.Fatalf("Storage engine is not ready: %s", err)
 	}
-	go storageRoutine()
-}
+	_, updateSupported = engine.(storagecommon.EntityStorageUpdater)
+	if err := defineIndexes(engine); err != nil {
+		gwlog.Fatalf("Storage engine is not ready: %s", err)
+	}
 
-func assureStorageEngineReady() (err error) {
-	if storageEngine != nil {
-		return
+	cfg := config.GetStorage()
+	cache = newDataCache(cfg.CacheSize)
+	readWorkers, writeWorkerNum := cfg.ReadWorkers, cfg.WriteWorkers
+	if readWorkers <= 0 {
+		readWorkers = 1
+	}
+	if writeWorkerNum <= 0 {
+		writeWorkerNum = 1
+	}
+	gwlog.Infof("storage: %d read workers, %d write workers, cache size %d", readWorkers, writeWorkerNum, cfg.CacheSize)
+
+	workersWaitGroup.Add(readWorkers + writeWorkerNum)
+	for i := 0; i < readWorkers; i++ {
+		w := &storageWorker{}
+		if i == 0 {
+			w.engine = engine // reuse the connection for checking the storage
+		}
+		go w.readRoutine()
+	}
+	for len(writeWorkers) < writeWorkerNum {
+		writeWorkers = append(writeWorkers, newWriteWorker(nil))
+	}
+	// writes before Initialize are queued in the first worker, move them so that writes of an entity stay in order
+	writeWorkers[0].rehash()
+	for _, w := range writeWorkers {
+		go w.routine()
 	}
 
+	softDeleteRetention = cfg.SoftDeleteRetention
+	if softDeleteRetention > 0 {
+		gwlog.Infof("storage: deleted entities are purged after %s", softDeleteRetention)
+		purgeStop = make(chan struct{})
+		workersWaitGroup.Add(1)
+		go purgeRoutine()
+	}
+}
+
+func openConfiguredStorageEngine() (storageEngine storagecommon.EntityStorage, err error) {
 	cfg := config.GetStorage()
 	if cfg.Type == "filesystem" {
 		storageEngine, err = entitystoragefilesystem.OpenDirectory(cfg.Directory)
@@ -143,7 +388,7 @@ func assureStorageEngineReady() (err error) {
 		var dbindex int = -1
 		if cfg.DB != "" {
 			if dbindex, err = strconv.Atoi(cfg.DB); err != nil {
-				return err
+				return nil, err
 			}
 		}
 		storageEngine, err = entitystorageredis.OpenRedis(cfg.Url, dbindex)
@@ -155,6 +400,8 @@ func assureStorageEngineReady() (err error) {
 		} else {
 			gwlog.Panicf("unknown sql driver: %s", cfg.Driver)
 		}
+	} else if cfg.Type == "bolt" {
+		storageEngine, err = entitystoragebolt.OpenBolt(cfg.Url)
 	} else {
 		gwlog.Panicf("unknown storage type: %s", cfg.Type)
 	}
@@ -162,79 +409,77 @@ func assureStorageEngineReady() (err error) {
 	return
 }
 
-func storageRoutine() {
+// storageWorker owns a connection to the storage backend, which is reopened if broken
+type storageWorker struct {
+	engine storagecommon.EntityStorage
+}
+
+func (w *storageWorker) assureEngineReady() (err error) {
+	if w.engine != nil {
+		return
+	}
+	engine, err := openStorageEngine()
+	if err != nil {
+		return
+	}
+	if err = defineIndexes(engine); err != nil {
+		engine.Close()
+		return
+	}
+	w.engine = engine
+	return
+}
+
+// checkEOF closes the connection if err is EOF, so that it is reopened later
+func (w *storageWorker) checkEOF(err error) {
+	if err != nil && w.engine.IsEOF(err) {
+		w.closeEngine()
+	}
+}
+
+func (w *storageWorker) closeEngine() {
+	if w.engine != nil {
+		w.engine.Close()
+		w.engine = nil
+	}
+}
+
+func (w *storageWorker) readRoutine() {
 	defer func() {
 		err := recover()
 		if err != nil {
-			gwlog.TraceError("storage routine paniced: %s, restarting ...", err)
-			go storageRoutine() // restart the storage routine
+			gwlog.TraceError("storage read routine paniced: %s, restarting ...", err)
+			go w.readRoutine() // restart the storage routine
 		} else {
 			// normal quit
-			storageEngine.Close()
-			storageRoutineTerminated.Signal()
+			w.closeEngine()
+			workersWaitGroup.Done()
 		}
 	}()
 
 	for {
-		err := assureStorageEngineReady()
+		err := w.assureEngineReady()
 		if err != nil {
 			gwlog.Errorf("Storage engine is not ready: %s", err)
 			time.Sleep(time.Second)
 			continue
 		}
 
-		op := operationQueue.Pop()
+		op := readQueue.Pop()
 		if op == nil { // entity storage closed
 			break
 		}
 
 		var monop *opmon.Operation
-		if saveReq, ok := op.(saveRequest); ok {
-			// handle save request
-			monop = opmon.StartOperation("storage.save")
-			for {
-				if consts.DEBUG_SAVE_LOAD {
-					gwlog.Debugf("storage: SAVING %s %s ...", saveReq.TypeName, saveReq.EntityID)
-				}
-				err := assureStorageEngineReady()
-				if err != nil {
-					gwlog.Errorf("Storage engine is not ready: %s", err)
-					time.Sleep(time.Second) // wait for 1 second to retry
-					continue
-				}
-
-				if storageEngine == nil {
-					gwlog.Fatalf("storage engine is nil")
-				}
-
-				err = storageEngine.Write(saveReq.TypeName, saveReq.EntityID, saveReq.Data)
-				if err != nil {
-					// save failed ?
-					gwlog.Errorf("storage: save failed: %s", err)
-
-					if err != nil && storageEngine.IsEOF(err) {
-						storageEngine.Close()
-						storageEngine = nil
-					}
-
-					continue // always retry if fail
-				} else {
-					monop.Finish(time.Millisecond * 100)
-					if saveReq.Callback != nil {
-						post.Post(func() {
-							saveReq.Callback()
-						})
-					}
-					break
-				}
-			}
-		} else if loadReq, ok := op.(loadRequest); ok {
+		if loadReq, ok := op.(loadRequest); ok {
 			// handle load request
-			gwlog.Debugf("storage: LOADING %s %s ...", loadReq.TypeName, loadReq.EntityID)
+			if consts.DEBUG_SAVE_LOAD {
+				gwlog.Debugf("storage: LOADING %s %s ...", loadReq.TypeName, loadReq.EntityID)
+			}
 			monop = opmon.StartOperation("storage.load")
-			data, err := storageEngine.Read(loadReq.TypeName, loadReq.EntityID)
+			data, err := w.engine.Read(loadReq.TypeName, loadReq.EntityID)
 			if err != nil {
-				// save failed ?
+				// load failed ?
 				gwlog.TraceError("storage: load %s %s failed: %s", loadReq.TypeName, loadReq.EntityID, err)
 				data = nil
 			}
@@ -245,27 +490,20 @@ func storageRoutine() {
 					loadReq.Callback(data, err)
 				})
 			}
-
-			if err != nil && storageEngine.IsEOF(err) {
-				storageEngine.Close()
-				storageEngine = nil
-			}
+			w.checkEOF(err)
 		} else if existsReq, ok := op.(existsRequest); ok {
 			monop = opmon.StartOperation("storage.exists")
-			exists, err := storageEngine.Exists(existsReq.TypeName, existsReq.EntityID)
+			exists, err := w.engine.Exists(existsReq.TypeName, existsReq.EntityID)
 			monop.Finish(time.Millisecond * 100)
 			if existsReq.Callback != nil {
 				post.Post(func() {
 					existsReq.Callback(exists, err)
 				})
 			}
-			if err != nil && storageEngine.IsEOF(err) {
-				storageEngine.Close()
-				storageEngine = nil
-			}
+			w.checkEOF(err)
 		} else if listReq, ok := op.(listEntityIDsRequest); ok {
 			monop = opmon.StartOperation("storage.list")
-			eids, err := storageEngine.List(listReq.TypeName)
+			eids, err := w.engine.List(listReq.TypeName)
 			if err != nil {
 				gwlog.TraceError("ListEntityIDs %s failed: %s", listReq.TypeName, err)
 			}
@@ -275,10 +513,27 @@ func storageRoutine() {
 					listReq.Callback(eids, err)
 				})
 			}
-			if err != nil && storageEngine.IsEOF(err) {
-				storageEngine.Close()
-				storageEngine = nil
+			w.checkEOF(err)
+		} else if findReq, ok := op.(findByAttrRequest); ok {
+			monop = opmon.StartOperation("storage.find")
+			var eids []common.EntityID
+			var err error
+			indexer, ok := w.engine.(storagecommon.EntityStorageIndexer)
+			if ok {
+				eids, err = indexer.FindByAttr(findReq.TypeName, findReq.Attr, findReq.Value)
+			} else {
+				err = errors.Errorf("storage %T does not support indexes", w.engine)
+			}
+			if err != nil {
+				gwlog.TraceError("FindByAttr %s.%s failed: %s", findReq.TypeName, findReq.Attr, err)
+			}
+			monop.Finish(time.Millisecond * 100)
+			if findReq.Callback != nil {
+				post.Post(func() {
+					findReq.Callback(eids, err)
+				})
 			}
+			w.checkEOF(err)
 		} else {
 			gwlog.Panicf("storage: unknown operation: %v", op)
 		}
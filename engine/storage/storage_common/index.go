@@ -0,0 +1,110 @@
+package storagecommon
+
+import (
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// ErrDuplicateIndexValue is returned by writes which violate unique indexes
+var ErrDuplicateIndexValue = errors.New("duplicate value of unique index")
+
+// Indexes are attributes of entity types which are indexed, values are true for unique indexes
+//
+// Backends without native indexes use it to maintain indexes on writes.
+type Indexes map[string]map[string]bool
+
+// Define defines the index of the attribute of the entity type
+func (indexes Indexes) Define(typeName string, attr string, unique bool) {
+	attrs := indexes[typeName]
+	if attrs == nil {
+		attrs = map[string]bool{}
+		indexes[typeName] = attrs
+	}
+	attrs[attr] = unique
+}
+
+// Values returns index values of indexed attributes in entity data, attributes which are absent or not indexable are omitted
+func (indexes Indexes) Values(typeName string, data map[string]interface{}) map[string]string {
+	attrs := indexes[typeName]
+	if len(attrs) == 0 {
+		return nil
+	}
+
+	values := map[string]string{}
+	for attr := range attrs {
+		if v, ok := IndexValue(data[attr]); ok {
+			values[attr] = v
+		}
+	}
+	return values
+}
+
+// Updated returns index values after updates and deletes are applied to entity data with index values of old
+func (indexes Indexes) Updated(typeName string, old map[string]string, updates map[string]interface{}, deletes []string) map[string]string {
+	attrs := indexes[typeName]
+	values := make(map[string]string, len(old))
+	for attr, v := range old {
+		values[attr] = v
+	}
+	for _, attr := range deletes {
+		delete(values, attr)
+	}
+	for attr, val := range updates {
+		if _, ok := attrs[attr]; !ok {
+			continue
+		}
+		if v, ok := IndexValue(val); ok {
+			values[attr] = v
+		} else {
+			delete(values, attr)
+		}
+	}
+	return values
+}
+
+// IndexValue returns the string form of the attribute value in indexes
+//
+// Only strings, bools and numbers can be indexed. Numbers of different types are equal if their values are equal, since
+// packers may decode numbers in other types.
+func IndexValue(v interface{}) (string, bool) {
+	switch val := v.(type) {
+	case string:
+		return "s" + val, true
+	case bool:
+		return "b" + strconv.FormatBool(val), true
+	case int:
+		return "n" + strconv.FormatInt(int64(val), 10), true
+	case int8:
+		return "n" + strconv.FormatInt(int64(val), 10), true
+	case int16:
+		return "n" + strconv.FormatInt(int64(val), 10), true
+	case int32:
+		return "n" + strconv.FormatInt(int64(val), 10), true
+	case int64:
+		return "n" + strconv.FormatInt(val, 10), true
+	case uint:
+		return "n" + strconv.FormatUint(uint64(val), 10), true
+	case uint8:
+		return "n" + strconv.FormatUint(uint64(val), 10), true
+	case uint16:
+		return "n" + strconv.FormatUint(uint64(val), 10), true
+	case uint32:
+		return "n" + strconv.FormatUint(uint64(val), 10), true
+	case uint64:
+		return "n" + strconv.FormatUint(val, 10), true
+	case float32:
+		return floatIndexValue(float64(val)), true
+	case float64:
+		return floatIndexValue(val), true
+	default:
+		return "", false
+	}
+}
+
+func floatIndexValue(f float64) string {
+	if f == float64(int64(f)) {
+		return "n" + strconv.FormatInt(int64(f), 10)
+	}
+	return "n" + strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -8,6 +8,23 @@ type EntityStorage interface {
 	Write(typeName string, entityID common.EntityID, data interface{}) error
 	Read(typeName string, entityID common.EntityID) (interface{}, error)
 	Exists(typeName string, entityID common.EntityID) (bool, error)
+	Delete(typeName string, entityID common.EntityID) error // deleting entities which do not exist should not fail
 	Close()
 	IsEOF(err error) bool
 }
+
+// EntityStorageUpdater is the optional interface of entity storage backends which support partial updates
+//
+// Update sets values of keys in updates and deletes keys in deletes, leaving other keys of entity data unchanged
+type EntityStorageUpdater interface {
+	Update(typeName string, entityID common.EntityID, updates map[string]interface{}, deletes []string) error
+}
+
+// EntityStorageIndexer is the optional interface of entity storage backends which support finding entities by attributes
+//
+// Indexes are maintained when entity data is written or updated. Writes which violate unique indexes fail with
+// ErrDuplicateIndexValue and are not retried.
+type EntityStorageIndexer interface {
+	DefineIndex(typeName string, attr string, unique bool) error
+	FindByAttr(typeName string, attr string, value interface{}) ([]common.EntityID, error)
+}
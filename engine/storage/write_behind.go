@@ -0,0 +1,444 @@
+package storage
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sagacao/goworld/engine/common"
+	"github.com/sagacao/goworld/engine/consts"
+	"github.com/sagacao/goworld/engine/gwlog"
+	"github.com/sagacao/goworld/engine/opmon"
+	"github.com/sagacao/goworld/engine/post"
+	"github.com/sagacao/goworld/engine/storage/storage_common"
+)
+
+// pendingWrite is the coalesced write of an entity which is waiting to be written to the backend
+type pendingWrite struct {
+	key       entityKey
+	data      map[string]interface{} // full entity data, nil if only updates are pending
+	updates   map[string]interface{}
+	deletes   common.StringSet
+	deleted   bool // entity is deleted, data and updates are nil
+	callbacks []SaveCallbackFunc
+	reads     []interface{} // read requests of the entity which should be handled after the write
+}
+
+// writeWorker writes entity data to the backend in background
+//
+// Entities are assigned to write workers by entity IDs, so writes of an entity are always in order. Saves and updates
+// of an entity which are not written yet are coalesced into one write.
+type writeWorker struct {
+	storageWorker
+	lock     sync.Mutex
+	cond     *sync.Cond
+	pending  map[entityKey]*pendingWrite
+	order    []entityKey // keys of pending writes in FIFO order
+	inflight *pendingWrite
+	closed   bool
+}
+
+func newWriteWorker(engine storagecommon.EntityStorage) *writeWorker {
+	w := &writeWorker{
+		storageWorker: storageWorker{engine: engine},
+		pending:       map[entityKey]*pendingWrite{},
+	}
+	w.cond = sync.NewCond(&w.lock)
+	return w
+}
+
+// getPendingWrite returns the pending write of the entity, which is created if not exists. Should be called with lock held
+func (w *writeWorker) getPendingWrite(key entityKey) *pendingWrite {
+	pw := w.pending[key]
+	if pw == nil {
+		pw = &pendingWrite{key: key}
+		w.pending[key] = pw
+		w.order = append(w.order, key)
+		w.cond.Signal()
+	}
+	return pw
+}
+
+func (w *writeWorker) save(key entityKey, data interface{}, callback SaveCallbackFunc) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	pw := w.getPendingWrite(key)
+	m, ok := data.(map[string]interface{})
+	if !ok {
+		gwlog.Panicf("storage: save %s %s: data should be map, but got %T", key.TypeName, key.EntityID, data)
+	}
+	// full data replaces all pending changes, and is copied since updates are applied to it
+	pw.data = make(map[string]interface{}, len(m))
+	for k, v := range m {
+		pw.data[k] = v
+	}
+	pw.updates, pw.deletes, pw.deleted = nil, nil, false
+	if callback != nil {
+		pw.callbacks = append(pw.callbacks, callback)
+	}
+}
+
+func (w *writeWorker) update(key entityKey, updates map[string]interface{}, deletes []string, callback SaveCallbackFunc) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	pw := w.getPendingWrite(key)
+	pw.applyUpdates(updates, deletes)
+	if callback != nil {
+		pw.callbacks = append(pw.callbacks, callback)
+	}
+}
+
+// applyUpdates coalesces the updates into the pending write
+func (pw *pendingWrite) applyUpdates(updates map[string]interface{}, deletes []string) {
+	if pw.deleted {
+		// entity is created again after deleted
+		pw.data, pw.deleted = map[string]interface{}{}, false
+	}
+	if pw.data != nil {
+		// apply changes to pending full data
+		for k, v := range updates {
+			pw.data[k] = v
+		}
+		for _, k := range deletes {
+			delete(pw.data, k)
+		}
+	} else {
+		if pw.updates == nil {
+			pw.updates, pw.deletes = map[string]interface{}{}, common.StringSet{}
+		}
+		for k, v := range updates {
+			pw.updates[k] = v
+			pw.deletes.Remove(k)
+		}
+		for _, k := range deletes {
+			delete(pw.updates, k)
+			pw.deletes.Add(k)
+		}
+	}
+}
+
+// delete deletes the entity, all pending changes are discarded
+func (w *writeWorker) delete(key entityKey, callback SaveCallbackFunc) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	pw := w.getPendingWrite(key)
+	pw.data, pw.updates, pw.deletes, pw.deleted = nil, nil, nil, true
+	if callback != nil {
+		pw.callbacks = append(pw.callbacks, callback)
+	}
+}
+
+// deferRead defers the read request until the pending or inflight write of the entity is finished, returns false if
+// the entity has nothing to write
+func (w *writeWorker) deferRead(key entityKey, req interface{}) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if pw := w.pending[key]; pw != nil {
+		pw.reads = append(pw.reads, req)
+		return true
+	}
+	if w.inflight != nil && w.inflight.key == key {
+		w.inflight.reads = append(w.inflight.reads, req)
+		return true
+	}
+	return false
+}
+
+// pendingEntityIDs returns IDs of entities of the type which are not written yet, values are false if entities are deleted
+func (w *writeWorker) pendingEntityIDs(typeName string) map[common.EntityID]bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	eids := map[common.EntityID]bool{}
+	if w.inflight != nil && w.inflight.key.TypeName == typeName {
+		eids[w.inflight.key.EntityID] = !w.inflight.deleted
+	}
+	for key, pw := range w.pending {
+		if key.TypeName == typeName {
+			eids[key.EntityID] = !pw.deleted
+		}
+	}
+	return eids
+}
+
+// pendingIndexValues returns index values of the attribute of entities of the type which are not written yet, values are
+// empty if the attribute is removed. Entities of which the attribute is not changed are omitted.
+func (w *writeWorker) pendingIndexValues(typeName string, attr string) map[common.EntityID]string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	values := map[common.EntityID]string{}
+	pendingValue := func(pw *pendingWrite) {
+		if pw.key.TypeName != typeName {
+			return
+		}
+		var val interface{}
+		if pw.deleted {
+			val = nil
+		} else if pw.data != nil {
+			val = pw.data[attr]
+		} else if v, ok := pw.updates[attr]; ok {
+			val = v
+		} else if !pw.deletes.Contains(attr) {
+			return
+		}
+		values[pw.key.EntityID], _ = storagecommon.IndexValue(val)
+	}
+
+	if w.inflight != nil {
+		pendingValue(w.inflight)
+	}
+	for _, pw := range w.pending {
+		pendingValue(pw)
+	}
+	return values
+}
+
+func (w *writeWorker) queueLen() int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return len(w.order)
+}
+
+// close stops the worker after all pending writes are written
+func (w *writeWorker) close() {
+	w.lock.Lock()
+	w.closed = true
+	w.cond.Broadcast()
+	w.lock.Unlock()
+}
+
+// next waits for the next pending write, returns nil if the worker is closed and all writes are finished
+func (w *writeWorker) next() *pendingWrite {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	for len(w.order) == 0 && !w.closed {
+		w.cond.Wait()
+	}
+	if len(w.order) == 0 {
+		return nil
+	}
+
+	key := w.order[0]
+	w.order = w.order[1:]
+	pw := w.pending[key]
+	delete(w.pending, key)
+	w.inflight = pw
+	return pw
+}
+
+// requeue puts the inflight write back to the front of the queue, newer changes of the entity are coalesced into it
+func (w *writeWorker) requeue(pw *pendingWrite) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.inflight = nil
+	if newer := w.pending[pw.key]; newer != nil {
+		if newer.data != nil || newer.deleted {
+			pw.data, pw.updates, pw.deletes, pw.deleted = newer.data, nil, nil, newer.deleted
+		} else if newer.updates != nil {
+			pw.applyUpdates(newer.updates, newer.deletes.ToList())
+		}
+		pw.callbacks = append(pw.callbacks, newer.callbacks...)
+		pw.reads = append(pw.reads, newer.reads...)
+		for i, key := range w.order {
+			if key == pw.key {
+				w.order = append(w.order[:i], w.order[i+1:]...)
+				break
+			}
+		}
+	}
+	w.pending[pw.key] = pw
+	w.order = append([]entityKey{pw.key}, w.order...)
+	w.cond.Signal()
+}
+
+// rehash moves pending writes to the workers which the entities are assigned to, should be called before workers start
+func (w *writeWorker) rehash() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	order := w.order
+	w.order = nil
+	for _, key := range order {
+		target := writeWorkerOf(key.EntityID)
+		if target == w {
+			w.order = append(w.order, key)
+			continue
+		}
+
+		target.lock.Lock()
+		target.pending[key] = w.pending[key]
+		target.order = append(target.order, key)
+		target.lock.Unlock()
+		delete(w.pending, key)
+	}
+}
+
+func (w *writeWorker) routine() {
+	var pw *pendingWrite
+	defer func() {
+		err := recover()
+		if err != nil {
+			gwlog.TraceError("storage write routine paniced: %s, restarting ...", err)
+			if pw != nil {
+				// retry the write, deferred reads are handled after it
+				w.requeue(pw)
+			}
+			go w.routine() // restart the storage routine
+		} else {
+			// normal quit
+			w.closeEngine()
+			workersWaitGroup.Done()
+		}
+	}()
+
+	for {
+		pw = w.next()
+		if pw == nil { // all writes are finished
+			break
+		}
+
+		w.write(pw)
+		reads := w.finish(pw)
+		pw = nil
+		for _, req := range reads {
+			readQueue.Push(req)
+		}
+	}
+}
+
+// finish finishes the inflight write and returns deferred reads of the entity
+//
+// Cached data is removed if the entity has no newer pending write, since other processes may write the entity later,
+// for example after it is migrated to another game.
+func (w *writeWorker) finish(pw *pendingWrite) []interface{} {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.inflight = nil
+	if w.pending[pw.key] == nil {
+		cache.remove(pw.key)
+	}
+	return pw.reads
+}
+
+// write writes the pending write to backend, always retry if fail
+//
+// If values of unique indexes conflict with other entities, the write is retried with stored values of the unique
+// indexes, and the error is passed to callbacks.
+func (w *writeWorker) write(pw *pendingWrite) {
+	var monop *opmon.Operation
+	if pw.deleted {
+		monop = opmon.StartOperation("storage.delete")
+	} else if pw.data != nil {
+		monop = opmon.StartOperation("storage.save")
+	} else {
+		monop = opmon.StartOperation("storage.update")
+	}
+
+	var failure error
+	for {
+		if consts.DEBUG_SAVE_LOAD {
+			gwlog.Debugf("storage: SAVING %s %s ...", pw.key.TypeName, pw.key.EntityID)
+		}
+		err := w.assureEngineReady()
+		if err != nil {
+			gwlog.Errorf("Storage engine is not ready: %s", err)
+			time.Sleep(time.Second) // wait for 1 second to retry
+			continue
+		}
+
+		if pw.deleted {
+			err = w.deleteEntity(pw.key)
+		} else if pw.data != nil {
+			err = w.engine.Write(pw.key.TypeName, pw.key.EntityID, pw.data)
+		} else {
+			err = w.engine.(storagecommon.EntityStorageUpdater).Update(pw.key.TypeName, pw.key.EntityID, pw.updates, pw.deletes.ToList())
+		}
+		if errors.Cause(err) == storagecommon.ErrDuplicateIndexValue {
+			// retrying the same write does not help, and cached data is not saved
+			gwlog.Errorf("storage: save %s %s failed: %s", pw.key.TypeName, pw.key.EntityID, err)
+			cache.remove(pw.key)
+			if failure != nil {
+				// stored values of unique indexes should never conflict
+				failure = errors.Errorf("storage: %s %s is not saved: %s", pw.key.TypeName, pw.key.EntityID, err)
+				break
+			}
+
+			// write other changes with stored values of unique indexes
+			dupErr := err
+			if err = w.revertUniqueIndexes(pw); err != nil {
+				gwlog.Errorf("storage: revert unique indexes of %s %s failed: %s", pw.key.TypeName, pw.key.EntityID, err)
+				w.checkEOF(err)
+				continue
+			}
+			failure = dupErr
+			continue
+		} else if err != nil {
+			gwlog.Errorf("storage: save %s %s failed: %s", pw.key.TypeName, pw.key.EntityID, err)
+			w.checkEOF(err)
+			continue // always retry if fail
+		}
+		break
+	}
+
+	monop.Finish(time.Millisecond * 100)
+	if len(pw.callbacks) > 0 {
+		callbacks := pw.callbacks
+		post.Post(func() {
+			for _, callback := range callbacks {
+				callback(failure)
+			}
+		})
+	}
+}
+
+// revertUniqueIndexes reverts values of unique indexes in the pending write to the stored values
+func (w *writeWorker) revertUniqueIndexes(pw *pendingWrite) error {
+	var uniqueAttrs []string
+	indexesLock.Lock()
+	for attr, unique := range indexes[pw.key.TypeName] {
+		if unique {
+			uniqueAttrs = append(uniqueAttrs, attr)
+		}
+	}
+	indexesLock.Unlock()
+
+	var stored map[string]interface{}
+	if pw.data != nil {
+		exists, err := w.engine.Exists(pw.key.TypeName, pw.key.EntityID)
+		if err != nil {
+			return err
+		}
+		if exists {
+			data, err := w.engine.Read(pw.key.TypeName, pw.key.EntityID)
+			if err != nil {
+				return err
+			}
+			stored, _ = data.(map[string]interface{})
+		}
+	}
+
+	// pending index values are read from the inflight write
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for _, attr := range uniqueAttrs {
+		if pw.data != nil {
+			if val, ok := stored[attr]; ok {
+				pw.data[attr] = val
+			} else {
+				delete(pw.data, attr)
+			}
+		} else {
+			delete(pw.updates, attr)
+			pw.deletes.Remove(attr)
+		}
+	}
+	return nil
+}
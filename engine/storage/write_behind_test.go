@@ -0,0 +1,323 @@
+package storage
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/sagacao/goworld/engine/common"
+	"github.com/sagacao/goworld/engine/post"
+	"github.com/sagacao/goworld/engine/storage/storage_common"
+)
+
+type testWrite struct {
+	key     entityKey
+	data    map[string]interface{}
+	updates map[string]interface{}
+	deletes []string
+}
+
+type testEntityStorage struct {
+	sync.Mutex
+	writes    []testWrite
+	stored    map[string]interface{} // data returned by Read
+	takenName string                 // writes of the name are rejected as duplicate index values
+}
+
+func (s *testEntityStorage) List(typeName string) ([]common.EntityID, error) {
+	return nil, nil
+}
+
+func (s *testEntityStorage) Write(typeName string, entityID common.EntityID, data interface{}) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.takenName != "" && data.(map[string]interface{})["name"] == s.takenName {
+		return errors.Wrapf(storagecommon.ErrDuplicateIndexValue, "name %s", s.takenName)
+	}
+	s.writes = append(s.writes, testWrite{key: entityKey{typeName, entityID}, data: data.(map[string]interface{})})
+	return nil
+}
+
+func (s *testEntityStorage) Update(typeName string, entityID common.EntityID, updates map[string]interface{}, deletes []string) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.takenName != "" && updates["name"] == s.takenName {
+		return errors.Wrapf(storagecommon.ErrDuplicateIndexValue, "name %s", s.takenName)
+	}
+	s.writes = append(s.writes, testWrite{key: entityKey{typeName, entityID}, updates: updates, deletes: deletes})
+	return nil
+}
+
+func (s *testEntityStorage) Read(typeName string, entityID common.EntityID) (interface{}, error) {
+	return s.stored, nil
+}
+
+func (s *testEntityStorage) Exists(typeName string, entityID common.EntityID) (bool, error) {
+	return s.stored != nil, nil
+}
+
+func (s *testEntityStorage) Delete(typeName string, entityID common.EntityID) error {
+	s.Lock()
+	defer s.Unlock()
+	s.writes = append(s.writes, testWrite{key: entityKey{typeName, entityID}})
+	return nil
+}
+
+func (s *testEntityStorage) Close() {
+}
+
+func (s *testEntityStorage) IsEOF(err error) bool {
+	return false
+}
+
+func TestWriteWorkerCoalesce(t *testing.T) {
+	engine := &testEntityStorage{}
+	w := newWriteWorker(engine)
+	avatar := entityKey{"Avatar", common.GenEntityID()}
+	monster := entityKey{"Monster", common.GenEntityID()}
+
+	callbacks := 0
+	callback := func(err error) {
+		if err == nil {
+			callbacks++
+		}
+	}
+	w.save(avatar, map[string]interface{}{"hp": 100, "mp": 50}, callback)
+	w.update(monster, map[string]interface{}{"hp": 10, "mp": 5}, nil, callback)
+	w.update(avatar, map[string]interface{}{"hp": 90}, []string{"mp"}, callback)
+	w.update(monster, map[string]interface{}{"mp": 10}, []string{"hp"}, callback)
+	if !w.deferRead(avatar, loadRequest{TypeName: avatar.TypeName, EntityID: avatar.EntityID}) {
+		t.Fatalf("read of pending entity should be deferred")
+	}
+	if w.deferRead(entityKey{"Avatar", common.GenEntityID()}, nil) {
+		t.Fatalf("read of entity without pending writes should not be deferred")
+	}
+	if eids := w.pendingEntityIDs("Avatar"); len(eids) != 1 || !eids[avatar.EntityID] {
+		t.Fatalf("wrong pending entity IDs: %v", eids)
+	}
+	if w.queueLen() != 2 {
+		t.Fatalf("writes should be coalesced into 2, but got %d", w.queueLen())
+	}
+
+	for pw := w.next(); pw != nil; pw = w.next() {
+		w.write(pw)
+		w.inflight = nil
+		if pw.key == avatar && len(pw.reads) != 1 {
+			t.Fatalf("deferred read should be handled after the write")
+		}
+		if len(w.order) == 0 {
+			w.close()
+		}
+	}
+
+	if len(engine.writes) != 2 {
+		t.Fatalf("should write 2 times, but got %d", len(engine.writes))
+	}
+	if data := engine.writes[0].data; len(data) != 1 || data["hp"] != 90 {
+		t.Errorf("wrong data written: %v", data)
+	}
+	if updates, deletes := engine.writes[1].updates, engine.writes[1].deletes; len(updates) != 1 || updates["mp"] != 10 || len(deletes) != 1 || deletes[0] != "hp" {
+		t.Errorf("wrong updates written: %v, %v", updates, deletes)
+	}
+
+	post.Tick()
+	if callbacks != 4 {
+		t.Errorf("all 4 callbacks should be called, but got %d", callbacks)
+	}
+}
+
+func TestDataCache(t *testing.T) {
+	c := newDataCache(2)
+	k1, k2, k3 := entityKey{"Avatar", "1"}, entityKey{"Avatar", "2"}, entityKey{"Avatar", "3"}
+	data := map[string]interface{}{"hp": 100, "bag": map[string]interface{}{"sword": 1}}
+	c.put(k1, data)
+	data["bag"].(map[string]interface{})["shield"] = 1
+
+	cached, ok := c.get(k1)
+	if !ok || len(cached["bag"].(map[string]interface{})) != 1 {
+		t.Fatalf("data should be copied into cache: %v", cached)
+	}
+	cached["hp"] = 0
+	c.update(k1, map[string]interface{}{"mp": 50}, []string{"bag"})
+	if cached, _ = c.get(k1); len(cached) != 2 || cached["hp"] != 100 || cached["mp"] != 50 {
+		t.Fatalf("wrong cached data: %v", cached)
+	}
+
+	c.put(k2, map[string]interface{}{})
+	c.get(k1)
+	c.put(k3, map[string]interface{}{})
+	if !c.contains(k1) || c.contains(k2) || !c.contains(k3) {
+		t.Fatalf("least recently used data should be removed")
+	}
+}
+
+func TestWriteWorkerPendingIndexValues(t *testing.T) {
+	w := newWriteWorker(&testEntityStorage{})
+	alice, bob, carol := entityKey{"Account", "alice"}, entityKey{"Account", "bob"}, entityKey{"Account", "carol"}
+	w.save(alice, map[string]interface{}{"username": "alice"}, nil)
+	w.update(bob, map[string]interface{}{"username": "bob"}, nil, nil)
+	w.update(carol, map[string]interface{}{"level": 2}, []string{"username"}, nil)
+	w.update(entityKey{"Account", "dave"}, map[string]interface{}{"level": 3}, nil, nil)
+	w.save(entityKey{"Avatar", "eve"}, map[string]interface{}{"username": "eve"}, nil)
+
+	values := w.pendingIndexValues("Account", "username")
+	aliceValue, _ := storagecommon.IndexValue("alice")
+	bobValue, _ := storagecommon.IndexValue("bob")
+	if len(values) != 3 || values[alice.EntityID] != aliceValue || values[bob.EntityID] != bobValue || values[carol.EntityID] != "" {
+		t.Fatalf("wrong pending index values: %v", values)
+	}
+}
+
+func TestWriteWorkerDelete(t *testing.T) {
+	engine := &testEntityStorage{}
+	w := newWriteWorker(engine)
+	avatar := entityKey{"Avatar", common.GenEntityID()}
+	monster := entityKey{"Monster", common.GenEntityID()}
+
+	w.save(avatar, map[string]interface{}{"hp": 100}, nil)
+	w.delete(avatar, nil)
+	w.delete(monster, nil)
+	w.update(monster, map[string]interface{}{"hp": 10}, nil, nil)
+	if eids := w.pendingEntityIDs("Avatar"); len(eids) != 1 || eids[avatar.EntityID] {
+		t.Fatalf("deleted entity should be pending as not existing: %v", eids)
+	}
+	if eids := w.pendingEntityIDs("Monster"); len(eids) != 1 || !eids[monster.EntityID] {
+		t.Fatalf("entity updated after deleted should be pending as existing: %v", eids)
+	}
+
+	w.close()
+	for pw := w.next(); pw != nil; pw = w.next() {
+		w.write(pw)
+		w.inflight = nil
+	}
+	if len(engine.writes) != 2 {
+		t.Fatalf("should write 2 times, but got %d", len(engine.writes))
+	}
+	if write := engine.writes[0]; write.key != avatar || write.data != nil || write.updates != nil {
+		t.Errorf("avatar should be deleted: %+v", write)
+	}
+	if data := engine.writes[1].data; len(data) != 1 || data["hp"] != 10 {
+		t.Errorf("monster should be created again: %v", data)
+	}
+}
+
+func TestWriteWorkerRequeue(t *testing.T) {
+	w := newWriteWorker(&testEntityStorage{})
+	avatar := entityKey{"Avatar", common.GenEntityID()}
+	w.save(avatar, map[string]interface{}{"hp": 100, "mp": 50}, nil)
+	pw := w.next()
+	w.update(avatar, map[string]interface{}{"hp": 90}, []string{"mp"}, nil)
+	w.update(entityKey{"Avatar", common.GenEntityID()}, map[string]interface{}{"hp": 10}, nil, nil)
+	w.deferRead(avatar, loadRequest{TypeName: avatar.TypeName, EntityID: avatar.EntityID})
+
+	// the write routine paniced when writing the avatar
+	w.requeue(pw)
+	if w.inflight != nil || w.queueLen() != 2 || w.order[0] != avatar {
+		t.Fatalf("inflight write should be requeued at the front: inflight=%v, order=%v", w.inflight, w.order)
+	}
+	if pw = w.pending[avatar]; len(pw.data) != 1 || pw.data["hp"] != 90 || len(pw.reads) != 1 {
+		t.Fatalf("newer changes should be coalesced into the requeued write: %+v", pw)
+	}
+}
+
+func TestWriteWorkerRehash(t *testing.T) {
+	oldWriteWorkers := writeWorkers
+	defer func() {
+		writeWorkers = oldWriteWorkers
+	}()
+
+	w := newWriteWorker(&testEntityStorage{})
+	writeWorkers = []*writeWorker{w}
+	var keys []entityKey
+	for i := 0; i < 10; i++ {
+		key := entityKey{"Avatar", common.GenEntityID()}
+		w.save(key, map[string]interface{}{"hp": i}, nil)
+		keys = append(keys, key)
+	}
+
+	writeWorkers = append(writeWorkers, newWriteWorker(nil), newWriteWorker(nil))
+	w.rehash()
+	total := 0
+	for _, ww := range writeWorkers {
+		total += ww.queueLen()
+	}
+	if total != len(keys) {
+		t.Fatalf("all pending writes should be kept, but got %d", total)
+	}
+	for _, key := range keys {
+		if writeWorkerOf(key.EntityID).pending[key] == nil {
+			t.Errorf("pending write of %s should be moved to its worker", key.EntityID)
+		}
+	}
+}
+
+func TestWriteWorkerDuplicateIndexValue(t *testing.T) {
+	oldIndexes := indexes
+	defer func() {
+		indexes = oldIndexes
+	}()
+	indexes = storagecommon.Indexes{}
+	indexes.Define("Account", "name", true)
+
+	engine := &testEntityStorage{stored: map[string]interface{}{"name": "alice", "level": 1}, takenName: "bob"}
+	w := newWriteWorker(engine)
+	alice := entityKey{"Account", common.GenEntityID()}
+	var errs []error
+	callback := func(err error) { errs = append(errs, err) }
+	w.save(alice, map[string]interface{}{"name": "bob", "level": 2}, callback)
+	w.update(entityKey{"Account", common.GenEntityID()}, map[string]interface{}{"name": "bob", "level": 3}, nil, callback)
+	w.close()
+	for pw := w.next(); pw != nil; pw = w.next() {
+		w.write(pw)
+		w.inflight = nil
+	}
+
+	if len(engine.writes) != 2 {
+		t.Fatalf("should write 2 times, but got %d", len(engine.writes))
+	}
+	if data := engine.writes[0].data; len(data) != 2 || data["name"] != "alice" || data["level"] != 2 {
+		t.Errorf("name should be reverted to the stored value: %v", data)
+	}
+	if updates := engine.writes[1].updates; len(updates) != 1 || updates["level"] != 3 {
+		t.Errorf("name should be dropped from updates: %v", updates)
+	}
+	post.Tick()
+	if len(errs) != 2 || errors.Cause(errs[0]) != storagecommon.ErrDuplicateIndexValue || errors.Cause(errs[1]) != storagecommon.ErrDuplicateIndexValue {
+		t.Errorf("duplicate index value errors should be passed to callbacks: %v", errs)
+	}
+}
+
+func TestWriteWorkerCacheRemovedAfterWritten(t *testing.T) {
+	oldCache := cache
+	defer func() {
+		cache = oldCache
+	}()
+	cache = newDataCache(10)
+
+	engine := &testEntityStorage{}
+	w := newWriteWorker(engine)
+	avatar := entityKey{"Avatar", common.GenEntityID()}
+	save := func(hp int) {
+		data := map[string]interface{}{"hp": hp}
+		cache.put(avatar, data)
+		w.save(avatar, data, nil)
+	}
+
+	save(100)
+	pw := w.next()
+	save(90)
+	w.write(pw)
+	w.finish(pw)
+	if data, ok := cache.get(avatar); !ok || data["hp"] != 90 {
+		t.Fatalf("data of pending write should be cached: %v", data)
+	}
+
+	pw = w.next()
+	w.write(pw)
+	w.finish(pw)
+	// the avatar is migrated to another game, which writes the entity behind the cache
+	engine.stored = map[string]interface{}{"hp": 80}
+	if cache.contains(avatar) {
+		t.Fatalf("cached data should be removed after written")
+	}
+}
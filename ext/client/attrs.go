@@ -0,0 +1,95 @@
+package client
+
+import (
+	"github.com/pkg/errors"
+	"github.com/sagacao/goworld/engine/proto"
+	"github.com/xiaonanln/typeconv"
+)
+
+// applyAttrChange applies the attribute change sent by server to attrs
+func applyAttrChange(attrs map[string]interface{}, change proto.AttrChange) error {
+	// path is from the changed attribute to the top level attribute
+	var parent interface{}
+	var parentKey interface{}
+	var attr interface{} = attrs
+	for i := len(change.Path) - 1; i >= 0; i-- {
+		val, err := getAttrItem(attr, change.Path[i])
+		if err != nil {
+			return err
+		}
+		parent, parentKey, attr = attr, change.Path[i], val
+	}
+
+	switch change.MsgType {
+	case proto.MT_NOTIFY_MAP_ATTR_CHANGE_ON_CLIENT, proto.MT_NOTIFY_MAP_ATTR_DEL_ON_CLIENT, proto.MT_NOTIFY_MAP_ATTR_CLEAR_ON_CLIENT:
+		ma, ok := attr.(map[string]interface{})
+		if !ok {
+			return errors.Errorf("attribute at %v is not a map, but %T", change.Path, attr)
+		}
+		switch change.MsgType {
+		case proto.MT_NOTIFY_MAP_ATTR_CHANGE_ON_CLIENT:
+			ma[change.Key] = change.Val
+		case proto.MT_NOTIFY_MAP_ATTR_DEL_ON_CLIENT:
+			delete(ma, change.Key)
+		default:
+			for key := range ma {
+				delete(ma, key)
+			}
+		}
+	default:
+		la, ok := attr.([]interface{})
+		if !ok {
+			return errors.Errorf("attribute at %v is not a list, but %T", change.Path, attr)
+		}
+		switch change.MsgType {
+		case proto.MT_NOTIFY_LIST_ATTR_CHANGE_ON_CLIENT:
+			if int(change.Index) >= len(la) {
+				return errors.Errorf("list index %d out of range at %v", change.Index, change.Path)
+			}
+			la[change.Index] = change.Val
+		case proto.MT_NOTIFY_LIST_ATTR_POP_ON_CLIENT:
+			if len(la) == 0 {
+				return errors.Errorf("pop empty list at %v", change.Path)
+			}
+			la = la[:len(la)-1]
+		case proto.MT_NOTIFY_LIST_ATTR_APPEND_ON_CLIENT:
+			la = append(la, change.Val)
+		default:
+			return errors.Errorf("invalid attribute change message type: %d", change.MsgType)
+		}
+		// the list might be reallocated, so set it to the parent again
+		return setAttrItem(parent, parentKey, la)
+	}
+	return nil
+}
+
+func getAttrItem(attr interface{}, key interface{}) (interface{}, error) {
+	switch a := attr.(type) {
+	case map[string]interface{}:
+		val, ok := a[typeconv.String(key)]
+		if !ok {
+			return nil, errors.Errorf("key %v not found", key)
+		}
+		return val, nil
+	case []interface{}:
+		index := int(typeconv.Int(key))
+		if index < 0 || index >= len(a) {
+			return nil, errors.Errorf("list index %d out of range", index)
+		}
+		return a[index], nil
+	default:
+		return nil, errors.Errorf("attribute of type %T has no item %v", attr, key)
+	}
+}
+
+func setAttrItem(attr interface{}, key interface{}, val interface{}) error {
+	switch a := attr.(type) {
+	case map[string]interface{}:
+		a[typeconv.String(key)] = val
+	case []interface{}:
+		a[typeconv.Int(key)] = val
+	default:
+		return errors.Errorf("attribute of type %T has no item %v", attr, key)
+	}
+	return nil
+}
@@ -0,0 +1,493 @@
+// Package client is the Go client SDK for connecting to GoWorld gates
+//
+// Client connects to the gate over TCP, KCP or WebSocket, maintains client entities created by the server and
+// dispatches server calls to methods of registered client entity types. All packets and posted functions are handled
+// in the main routine of the client, so entity callbacks never run concurrently for the same client.
+package client
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sagacao/goworld/engine/common"
+	"github.com/sagacao/goworld/engine/consts"
+	"github.com/sagacao/goworld/engine/gwioutil"
+	"github.com/sagacao/goworld/engine/gwlog"
+	"github.com/sagacao/goworld/engine/gwutils"
+	"github.com/sagacao/goworld/engine/netutil"
+	"github.com/sagacao/goworld/engine/proto"
+	"github.com/xtaci/kcp-go"
+	"golang.org/x/net/websocket"
+)
+
+// Transport is the transport protocol used to connect to gate
+type Transport int
+
+const (
+	// TransportTCP connects to the listen_addr of gate over TCP
+	TransportTCP Transport = iota
+	// TransportKCP connects to the listen_addr of gate over KCP
+	TransportKCP
+	// TransportWebSocket connects to the http_addr of gate over WebSocket
+	TransportWebSocket
+)
+
+const (
+	// DefaultHeartbeatInterval is the default interval of sending heartbeats to gate
+	DefaultHeartbeatInterval = time.Second * 5
+
+	_PACKET_QUEUE_SIZE = 1000
+	_POST_QUEUE_SIZE   = 1000
+	_RESUME_TIMEOUT    = time.Second * 10
+)
+
+// Config is the configuration of client connection
+type Config struct {
+	Addr              string        // address of gate: listen_addr for TCP & KCP, http_addr for WebSocket
+	Transport         Transport     // transport protocol
+	Compress          bool          // should be the same as compress_connection of gate
+	CompressFormat    string        // should be the same as compress_format of gate
+	TLS               bool          // should be the same as encrypt_connection of gate
+	TLSConfig         *tls.Config   // TLS config for encrypted connection, ServerName is taken from Addr if not set
+	HeartbeatInterval time.Duration // interval of sending heartbeats, DefaultHeartbeatInterval is used if 0
+	// skip verifying the certificate of gate, which should only be used for testing with self-signed certificates
+	InsecureSkipVerify bool
+	// keep entities after disconnected so that the session can be resumed by Resume, entities are destroyed if false
+	KeepEntitiesOnDisconnect bool
+}
+
+// Client is a client connection to gate
+type Client struct {
+	config       Config
+	conn         *proto.GoWorldConnection
+	clientid     common.ClientID
+	resumeToken  string
+	entities     map[common.EntityID]*Entity
+	player       *Entity
+	packetQueue  chan proto.Message
+	postQueue    chan func()
+	disconnected chan struct{}
+
+	// the disconnected client whose session is being resumed by this client
+	resumeFrom   *Client
+	resumeQueue  []proto.Message // messages received before the resume result
+	resumeResult chan bool
+}
+
+// Dial connects to gate and starts the client
+func Dial(config Config) (*Client, error) {
+	netconn, err := dial(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return newClient(netconn, config, nil), nil
+}
+
+// Resume connects to gate and resumes the session of the disconnected client old
+//
+// The gate can be different from the one that old client was connected to, but the session should be resumed within
+// client_resume_grace_period of games. If the session is resumed, entities of old client are moved to the new client and
+// messages missed during disconnection are replayed. Otherwise, entities of old client are destroyed and the new client
+// continues as a newly connected client. Config.KeepEntitiesOnDisconnect should be set for old client, so that entities
+// are kept after disconnected.
+func Resume(old *Client, config Config) (c *Client, resumed bool, err error) {
+	netconn, err := dial(config)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return resume(old, netconn, config)
+}
+
+func resume(old *Client, netconn net.Conn, config Config) (*Client, bool, error) {
+	select {
+	case <-old.disconnected:
+	default:
+		netconn.Close()
+		return nil, false, errors.Errorf("%s is not disconnected", old)
+	}
+
+	if old.resumeToken == "" || old.player == nil {
+		netconn.Close()
+		return nil, false, errors.Errorf("%s can not be resumed without resume token or player", old)
+	}
+
+	c := newClient(netconn, config, old)
+	select {
+	case resumed := <-c.resumeResult:
+		return c, resumed, nil
+	case <-c.disconnected:
+		return nil, false, errors.Errorf("%s disconnected while resuming", c)
+	case <-time.After(_RESUME_TIMEOUT):
+		c.Close()
+		return nil, false, errors.Errorf("%s resume timeout", c)
+	}
+}
+
+func dial(config Config) (netconn net.Conn, err error) {
+	netconn, err = dialTransport(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.TLS && config.Transport != TransportWebSocket {
+		netconn = tls.Client(netconn, tlsConfig(config))
+	}
+	return netconn, nil
+}
+
+// tlsConfig returns the TLS config of the encrypted connection, the certificate of gate is verified unless
+// InsecureSkipVerify is set
+func tlsConfig(config Config) *tls.Config {
+	var tlsConfig *tls.Config
+	if config.TLSConfig != nil {
+		tlsConfig = config.TLSConfig.Clone()
+	} else {
+		tlsConfig = &tls.Config{}
+	}
+	if config.InsecureSkipVerify {
+		tlsConfig.InsecureSkipVerify = true
+	}
+	if tlsConfig.ServerName == "" {
+		host, _, err := net.SplitHostPort(config.Addr)
+		if err != nil {
+			host = config.Addr
+		}
+		tlsConfig.ServerName = host
+	}
+	return tlsConfig
+}
+
+func dialTransport(config Config) (net.Conn, error) {
+	switch config.Transport {
+	case TransportTCP:
+		conn, err := net.Dial("tcp", config.Addr)
+		if err != nil {
+			return nil, errors.Wrap(err, "dial TCP failed")
+		}
+		tcpConn := conn.(*net.TCPConn)
+		tcpConn.SetNoDelay(consts.CLIENT_PROXY_SET_TCP_NO_DELAY)
+		return conn, nil
+	case TransportKCP:
+		conn, err := kcp.DialWithOptions(config.Addr, nil, 10, 3)
+		if err != nil {
+			return nil, errors.Wrap(err, "dial KCP failed")
+		}
+		// use the same options as gate
+		conn.SetNoDelay(consts.KCP_NO_DELAY, consts.KCP_INTERNAL_UPDATE_TIMER_INTERVAL, consts.KCP_ENABLE_FAST_RESEND, consts.KCP_DISABLE_CONGESTION_CONTROL)
+		conn.SetStreamMode(consts.KCP_SET_STREAM_MODE)
+		conn.SetWriteDelay(consts.KCP_SET_WRITE_DELAY)
+		conn.SetACKNoDelay(consts.KCP_SET_ACK_NO_DELAY)
+		return conn, nil
+	case TransportWebSocket:
+		scheme, originScheme := "ws", "http"
+		if config.TLS {
+			scheme, originScheme = "wss", "https"
+		}
+		wsConfig, err := websocket.NewConfig(fmt.Sprintf("%s://%s/ws", scheme, config.Addr), fmt.Sprintf("%s://%s/", originScheme, config.Addr))
+		if err != nil {
+			return nil, errors.Wrap(err, "websocket config failed")
+		}
+		if config.TLS {
+			wsConfig.TlsConfig = tlsConfig(config)
+		}
+		conn, err := websocket.DialConfig(wsConfig)
+		if err != nil {
+			return nil, errors.Wrap(err, "dial WebSocket failed")
+		}
+		conn.PayloadType = websocket.BinaryFrame
+		return conn, nil
+	default:
+		return nil, errors.Errorf("unknown transport: %d", config.Transport)
+	}
+}
+
+func newClient(netconn net.Conn, config Config, resumeFrom *Client) *Client {
+	if config.HeartbeatInterval <= 0 {
+		config.HeartbeatInterval = DefaultHeartbeatInterval
+	}
+
+	conn := netutil.NetConnection{netconn}
+	c := &Client{
+		config:       config,
+		conn:         proto.NewGoWorldConnection(netutil.NewBufferedConnection(conn), config.Compress, config.CompressFormat),
+		entities:     map[common.EntityID]*Entity{},
+		packetQueue:  make(chan proto.Message, _PACKET_QUEUE_SIZE),
+		postQueue:    make(chan func(), _POST_QUEUE_SIZE),
+		disconnected: make(chan struct{}),
+	}
+	c.conn.SetAutoFlush(consts.CLIENT_PROXY_WRITE_FLUSH_INTERVAL)
+	if resumeFrom != nil {
+		c.resumeFrom = resumeFrom
+		c.resumeResult = make(chan bool, 1)
+		c.conn.SendResumeClientFromClient(resumeFrom.player.ID, resumeFrom.resumeToken)
+	}
+	go c.recvRoutine()
+	go c.mainRoutine()
+	return c
+}
+
+func (c *Client) String() string {
+	return fmt.Sprintf("Client<%s@%s>", c.clientid, c.conn.RemoteAddr())
+}
+
+// ClientID returns the client ID which is set by gate, or empty if not set
+func (c *Client) ClientID() common.ClientID {
+	return c.clientid
+}
+
+// ResumeToken returns the token for resuming the session, or empty if not set by gate
+func (c *Client) ResumeToken() string {
+	return c.resumeToken
+}
+
+// Player returns the player entity of the client, or nil if not created
+//
+// Should be called in the main routine of client (i.e. in entity callbacks or posted functions)
+func (c *Client) Player() *Entity {
+	return c.player
+}
+
+// GetEntity returns the client entity of the ID, or nil if not found
+//
+// Should be called in the main routine of client (i.e. in entity callbacks or posted functions)
+func (c *Client) GetEntity(id common.EntityID) *Entity {
+	return c.entities[id]
+}
+
+// Post posts the function to be called in the main routine of client
+//
+// The function is dropped if the client is disconnected
+func (c *Client) Post(f func()) {
+	select {
+	case c.postQueue <- f:
+	case <-c.disconnected:
+	}
+}
+
+// Disconnected returns a channel which is closed when the client is disconnected
+func (c *Client) Disconnected() <-chan struct{} {
+	return c.disconnected
+}
+
+// Close closes the connection to gate
+func (c *Client) Close() {
+	c.conn.Close()
+}
+
+func (c *Client) recvRoutine() {
+	defer close(c.packetQueue)
+
+	for {
+		var msgtype proto.MsgType
+		pkt, err := c.conn.Recv(&msgtype)
+		if pkt != nil {
+			c.packetQueue <- proto.Message{msgtype, pkt}
+		} else if err != nil && !gwioutil.IsTimeoutError(err) {
+			if !netutil.IsConnectionError(err) && !c.conn.IsClosed() {
+				gwlog.Errorf("%s: recv failed: %s", c, err)
+			}
+			break
+		}
+	}
+}
+
+func (c *Client) mainRoutine() {
+	heartbeatTicker := time.NewTicker(c.config.HeartbeatInterval)
+	defer heartbeatTicker.Stop()
+
+	for {
+		select {
+		case msg, ok := <-c.packetQueue:
+			if !ok {
+				c.onDisconnected()
+				return
+			}
+			if c.resumeFrom != nil && msg.MsgType != proto.MT_SET_CLIENT_CLIENTID && msg.MsgType != proto.MT_NOTIFY_CLIENT_RESUMED_ON_CLIENT {
+				// messages before the resume result are from the boot entity of this connection, which are dropped if resumed
+				c.resumeQueue = append(c.resumeQueue, msg)
+				break
+			}
+			c.handleMessage(msg)
+		case f := <-c.postQueue:
+			gwutils.RunPanicless(f)
+		case <-heartbeatTicker.C:
+			c.conn.SetHeartbeatFromClient()
+		}
+	}
+}
+
+func (c *Client) handleMessage(msg proto.Message) {
+	if err := gwutils.CatchPanic(func() {
+		c.handlePacket(msg.MsgType, msg.Packet)
+	}); err != nil {
+		gwlog.TraceError("%s: handle packet %d failed: %v", c, msg.MsgType, err)
+	}
+	msg.Packet.Release()
+}
+
+func (c *Client) onDisconnected() {
+	c.conn.Close()
+	for _, msg := range c.resumeQueue {
+		msg.Packet.Release()
+	}
+	c.resumeQueue = nil
+
+	if !c.config.KeepEntitiesOnDisconnect {
+		for _, e := range c.entities {
+			c.destroyEntity(e)
+		}
+	}
+	gwlog.Infof("%s disconnected", c)
+	close(c.disconnected)
+}
+
+func (c *Client) onResumed(ownerID common.EntityID, resumed bool) {
+	old := c.resumeFrom
+	if old == nil {
+		gwlog.Warnf("%s: resume result of %s is received, but not resuming", c, ownerID)
+		return
+	}
+
+	c.resumeFrom = nil
+	queue := c.resumeQueue
+	c.resumeQueue = nil
+
+	if resumed {
+		gwlog.Infof("%s: session of %s is resumed", c, old)
+		c.entities, old.entities = old.entities, map[common.EntityID]*Entity{}
+		c.player, old.player = old.player, nil
+		for _, e := range c.entities {
+			e.client = c
+		}
+		for _, msg := range queue {
+			msg.Packet.Release()
+		}
+	} else {
+		gwlog.Warnf("%s: session of %s can not be resumed", c, old)
+		for _, e := range old.entities {
+			old.destroyEntity(e)
+		}
+		for _, msg := range queue {
+			c.handleMessage(msg)
+		}
+	}
+	c.resumeResult <- resumed
+}
+
+func (c *Client) handlePacket(msgtype proto.MsgType, pkt *netutil.Packet) {
+	if msgtype >= proto.MT_REDIRECT_TO_GATEPROXY_MSG_TYPE_START && msgtype <= proto.MT_REDIRECT_TO_GATEPROXY_MSG_TYPE_STOP {
+		// messages redirected by gate starts with gateid and clientid
+		_ = pkt.ReadUint16()
+		_ = pkt.ReadClientID()
+	}
+
+	switch msgtype {
+	case proto.MT_SET_CLIENT_CLIENTID:
+		c.clientid = pkt.ReadClientID()
+		c.resumeToken = pkt.ReadVarStr()
+	case proto.MT_NOTIFY_CLIENT_RESUMED_ON_CLIENT:
+		ownerID := pkt.ReadEntityID()
+		resumed := pkt.ReadBool()
+		c.onResumed(ownerID, resumed)
+	case proto.MT_CREATE_ENTITY_ON_CLIENT:
+		c.handleCreateEntity(pkt)
+	case proto.MT_DESTROY_ENTITY_ON_CLIENT:
+		_ = pkt.ReadVarStr() // typeName
+		eid := pkt.ReadEntityID()
+		if e := c.entities[eid]; e != nil {
+			c.destroyEntity(e)
+		}
+	case proto.MT_NOTIFY_MAP_ATTR_CHANGE_ON_CLIENT, proto.MT_NOTIFY_MAP_ATTR_DEL_ON_CLIENT, proto.MT_NOTIFY_MAP_ATTR_CLEAR_ON_CLIENT,
+		proto.MT_NOTIFY_LIST_ATTR_CHANGE_ON_CLIENT, proto.MT_NOTIFY_LIST_ATTR_POP_ON_CLIENT, proto.MT_NOTIFY_LIST_ATTR_APPEND_ON_CLIENT:
+		c.applyAttrChange(proto.ReadAttrChangeOfType(msgtype, pkt))
+	case proto.MT_NOTIFY_ATTR_CHANGES_ON_CLIENT:
+		for pkt.HasUnreadPayload() {
+			c.applyAttrChange(proto.ReadAttrChange(pkt))
+		}
+	case proto.MT_CALL_ENTITY_METHOD_ON_CLIENT:
+		eid := pkt.ReadEntityID()
+		method := pkt.ReadVarStr()
+		args := pkt.ReadArgs()
+		if e := c.entities[eid]; e != nil {
+			e.onCallFromServer(method, args)
+		} else {
+			gwlog.Warnf("%s: call %s.%s, but entity is not found", c, eid, method)
+		}
+	case proto.MT_CALL_FILTERED_CLIENTS:
+		// filtered calls are called on the player entity
+		_ = pkt.ReadOneByte() // op
+		_ = pkt.ReadVarStr()  // key
+		_ = pkt.ReadVarStr()  // val
+		method := pkt.ReadVarStr()
+		args := pkt.ReadArgs()
+		if c.player != nil {
+			c.player.onCallFromServer(method, args)
+		}
+	case proto.MT_SYNC_POSITION_YAW_ON_CLIENTS:
+		for pkt.HasUnreadPayload() {
+			eid := pkt.ReadEntityID()
+			x, y, z, yaw := pkt.ReadFloat32(), pkt.ReadFloat32(), pkt.ReadFloat32(), pkt.ReadFloat32()
+			if e := c.entities[eid]; e != nil {
+				e.onPositionYawSynced(Vector3{x, y, z}, yaw)
+			}
+		}
+	case proto.MT_UDP_SYNC_CONN_NOTIFY_CLIENTID_ACK:
+	default:
+		gwlog.Warnf("%s: unknown message type: %d", c, msgtype)
+	}
+}
+
+func (c *Client) handleCreateEntity(pkt *netutil.Packet) {
+	isPlayer := pkt.ReadBool()
+	eid := pkt.ReadEntityID()
+	typeName := pkt.ReadVarStr()
+	x, y, z, yaw := pkt.ReadFloat32(), pkt.ReadFloat32(), pkt.ReadFloat32(), pkt.ReadFloat32()
+	var clientData map[string]interface{}
+	pkt.ReadData(&clientData)
+
+	if old := c.entities[eid]; old != nil {
+		// entity is created again (e.g. after migration), replace the old one
+		c.destroyEntity(old)
+	}
+
+	e := createEntity(c, typeName, eid, isPlayer, clientData, Vector3{x, y, z}, yaw)
+	if e == nil {
+		return
+	}
+
+	c.entities[eid] = e
+	if isPlayer {
+		c.player = e
+	}
+	gwutils.RunPanicless(e.I.OnCreated)
+}
+
+func (c *Client) destroyEntity(e *Entity) {
+	delete(c.entities, e.ID)
+	if c.player == e {
+		c.player = nil
+	}
+	e.destroyed = true
+	gwutils.RunPanicless(e.I.OnDestroy)
+}
+
+func (c *Client) applyAttrChange(change proto.AttrChange) {
+	e := c.entities[change.EntityID]
+	if e == nil {
+		gwlog.Warnf("%s: attribute of %s is changed, but entity is not found", c, change.EntityID)
+		return
+	}
+
+	if err := applyAttrChange(e.Attrs, change); err != nil {
+		gwlog.Errorf("%s: apply attribute change to %s failed: %s", c, e, err)
+		return
+	}
+	gwutils.RunPanicless(func() {
+		e.I.OnAttrChanged(change)
+	})
+}
@@ -0,0 +1,259 @@
+package client
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sagacao/goworld/engine/common"
+	"github.com/sagacao/goworld/engine/netutil"
+	"github.com/sagacao/goworld/engine/proto"
+)
+
+type testAvatar struct {
+	Entity
+	greetings chan string
+}
+
+func (a *testAvatar) OnCreated() {
+	a.greetings = make(chan string, 1)
+}
+
+func (a *testAvatar) Greet(name string, times int) {
+	for i := 0; i < times; i++ {
+		a.greetings <- name
+	}
+}
+
+func init() {
+	RegisterEntity("testAvatar", &testAvatar{})
+}
+
+// call calls the function in the main routine of client and waits for it
+func call(c *Client, f func()) {
+	done := make(chan struct{})
+	c.Post(func() {
+		f()
+		close(done)
+	})
+	<-done
+}
+
+// waitFor waits until the condition is true in the main routine of client
+func waitFor(t *testing.T, c *Client, cond func() bool) {
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		var ok bool
+		call(c, func() {
+			ok = cond()
+		})
+		if ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("wait for condition timeout")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestClient(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	c := newClient(clientConn, Config{}, nil)
+	defer c.Close()
+
+	gate := proto.NewGoWorldConnection(netutil.NewBufferedConnection(netutil.NetConnection{serverConn}), false, "")
+	gate.SetAutoFlush(time.Millisecond)
+	defer gate.Close()
+
+	eid := common.GenEntityID()
+	clientid := common.GenClientID()
+	gate.SendCreateEntityOnClient(1, clientid, "testAvatar", eid, true, map[string]interface{}{
+		"name":  "foo",
+		"items": []interface{}{"sword"},
+	}, 1, 2, 3, 0)
+	gate.SendCallEntityMethodOnClient(1, clientid, eid, "Greet", []interface{}{"bar", 1})
+
+	var avatar *testAvatar
+	waitFor(t, c, func() bool {
+		if player := c.Player(); player != nil {
+			avatar = player.I.(*testAvatar)
+		}
+		return avatar != nil
+	})
+	select {
+	case name := <-avatar.greetings:
+		if name != "bar" {
+			t.Fatalf("wrong greeting: %s", name)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("method is not called")
+	}
+
+	gate.SendNotifyMapAttrChangeOnClient(1, clientid, eid, nil, "name", "bar")
+	gate.SendNotifyListAttrAppendOnClient(1, clientid, eid, []interface{}{"items"}, "shield")
+	waitFor(t, c, func() bool {
+		items := avatar.Attrs["items"].([]interface{})
+		return len(items) == 2 && items[1] == "shield"
+	})
+	call(c, func() {
+		if avatar.Attrs["name"] != "bar" {
+			t.Errorf("name should be bar, but is %v", avatar.Attrs["name"])
+		}
+		if avatar.Position != (Vector3{1, 2, 3}) {
+			t.Errorf("wrong position: %v", avatar.Position)
+		}
+	})
+
+	gate.Close()
+	select {
+	case <-c.Disconnected():
+	case <-time.After(time.Second * 5):
+		t.Fatalf("client should be disconnected")
+	}
+	if !avatar.IsDestroyed() {
+		t.Fatalf("entities should be destroyed after disconnected")
+	}
+}
+
+func TestApplyAttrChange(t *testing.T) {
+	attrs := map[string]interface{}{
+		"bag": map[string]interface{}{
+			"slots": []interface{}{
+				map[string]interface{}{"count": 1},
+			},
+		},
+	}
+
+	// path is from the changed attribute to the top level attribute
+	changes := []proto.AttrChange{
+		{MsgType: proto.MT_NOTIFY_MAP_ATTR_CHANGE_ON_CLIENT, Path: []interface{}{0, "slots", "bag"}, Key: "count", Val: 2},
+		{MsgType: proto.MT_NOTIFY_LIST_ATTR_APPEND_ON_CLIENT, Path: []interface{}{"slots", "bag"}, Val: "new"},
+		{MsgType: proto.MT_NOTIFY_LIST_ATTR_POP_ON_CLIENT, Path: []interface{}{"slots", "bag"}},
+		{MsgType: proto.MT_NOTIFY_MAP_ATTR_DEL_ON_CLIENT, Path: nil, Key: "missing"},
+	}
+	for _, change := range changes {
+		if err := applyAttrChange(attrs, change); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	slots := attrs["bag"].(map[string]interface{})["slots"].([]interface{})
+	if len(slots) != 1 || slots[0].(map[string]interface{})["count"] != 2 {
+		t.Fatalf("wrong slots: %v", slots)
+	}
+
+	if err := applyAttrChange(attrs, proto.AttrChange{MsgType: proto.MT_NOTIFY_LIST_ATTR_POP_ON_CLIENT, Path: []interface{}{"bag"}}); err == nil {
+		t.Fatalf("pop on map attribute should fail")
+	}
+}
+
+// recvFromClient receives the next message sent by client to the fake gate
+func recvFromClient(t *testing.T, gate *proto.GoWorldConnection) (proto.MsgType, *netutil.Packet) {
+	for {
+		var msgtype proto.MsgType
+		pkt, err := gate.Recv(&msgtype)
+		if pkt != nil {
+			return msgtype, pkt
+		} else if err != nil {
+			t.Fatalf("recv from client failed: %s", err)
+		}
+	}
+}
+
+func TestResume(t *testing.T) {
+	config := Config{KeepEntitiesOnDisconnect: true}
+	serverConn, clientConn := net.Pipe()
+	old := newClient(clientConn, config, nil)
+
+	gate := proto.NewGoWorldConnection(netutil.NewBufferedConnection(netutil.NetConnection{serverConn}), false, "")
+	gate.SetAutoFlush(time.Millisecond)
+
+	eid := common.GenEntityID()
+	clientid := common.GenClientID()
+	gate.SendSetClientClientID(clientid, "token1")
+	gate.SendCreateEntityOnClient(1, clientid, "testAvatar", eid, true, map[string]interface{}{"name": "foo"}, 0, 0, 0, 0)
+	waitFor(t, old, func() bool {
+		return old.Player() != nil && old.ResumeToken() == "token1"
+	})
+	avatar := old.Player().I.(*testAvatar)
+
+	gate.Close()
+	<-old.Disconnected()
+	if avatar.IsDestroyed() {
+		t.Fatalf("entities should be kept after disconnected")
+	}
+
+	serverConn, clientConn = net.Pipe()
+	gate = proto.NewGoWorldConnection(netutil.NewBufferedConnection(netutil.NetConnection{serverConn}), false, "")
+	gate.SetAutoFlush(time.Millisecond)
+	defer gate.Close()
+
+	type resumeResult struct {
+		c       *Client
+		resumed bool
+		err     error
+	}
+	resultChan := make(chan resumeResult, 1)
+	go func() {
+		c, resumed, err := resume(old, clientConn, config)
+		resultChan <- resumeResult{c, resumed, err}
+	}()
+
+	msgtype, pkt := recvFromClient(t, gate)
+	if msgtype != proto.MT_RESUME_CLIENT_FROM_CLIENT || pkt.ReadEntityID() != eid || pkt.ReadVarStr() != "token1" {
+		t.Fatalf("client should send resume message with owner entity and token")
+	}
+
+	// boot entity of the new connection is created before the session is resumed
+	newClientid := common.GenClientID()
+	gate.SendSetClientClientID(newClientid, "token2")
+	gate.SendCreateEntityOnClient(1, newClientid, "testAvatar", common.GenEntityID(), true, nil, 0, 0, 0, 0)
+	gate.SendNotifyClientResumedOnClient(1, newClientid, eid, true)
+	// replayed messages
+	gate.SendCallEntityMethodOnClient(1, newClientid, eid, "Greet", []interface{}{"bar", 1})
+
+	var result resumeResult
+	select {
+	case result = <-resultChan:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("resume timeout")
+	}
+	if result.err != nil || !result.resumed {
+		t.Fatalf("session should be resumed: %v", result.err)
+	}
+	c := result.c
+	defer c.Close()
+
+	select {
+	case name := <-avatar.greetings:
+		if name != "bar" {
+			t.Fatalf("wrong greeting: %s", name)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("replayed method is not called")
+	}
+	call(c, func() {
+		if c.Player() != &avatar.Entity || len(c.entities) != 1 {
+			t.Errorf("entities of old client should be moved to the new client, but player is %v", c.Player())
+		}
+		if avatar.GetClient() != c || c.ResumeToken() != "token2" {
+			t.Errorf("entities should be rebound to the new client with the new token")
+		}
+	})
+}
+
+func TestTLSConfig(t *testing.T) {
+	c := tlsConfig(Config{Addr: "gate.example.com:14001"})
+	if c.InsecureSkipVerify || c.ServerName != "gate.example.com" {
+		t.Fatalf("certificate should be verified against the host of Addr: %+v", c)
+	}
+	custom := &tls.Config{ServerName: "gate"}
+	if c = tlsConfig(Config{Addr: "127.0.0.1:14001", TLSConfig: custom, InsecureSkipVerify: true}); !c.InsecureSkipVerify || c.ServerName != "gate" {
+		t.Fatalf("InsecureSkipVerify should be applied to a copy of TLSConfig: %+v", c)
+	}
+	if custom.InsecureSkipVerify {
+		t.Fatalf("TLSConfig should not be modified")
+	}
+}
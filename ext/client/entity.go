@@ -0,0 +1,171 @@
+package client
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/sagacao/goworld/engine/common"
+	"github.com/sagacao/goworld/engine/gwlog"
+	"github.com/sagacao/goworld/engine/netutil"
+	"github.com/sagacao/goworld/engine/proto"
+)
+
+// Vector3 is the position of client entity
+type Vector3 struct {
+	X float32
+	Y float32
+	Z float32
+}
+
+// IEntity declares functions that is defined in Entity
+type IEntity interface {
+	OnCreated()                            // Called when entity is created on client
+	OnDestroy()                            // Called when entity is destroyed on client
+	OnAttrChanged(change proto.AttrChange) // Called after attribute change is applied to Attrs
+	OnPositionYawSynced()                  // Called after position and yaw are synced from server
+}
+
+// Entity is the client side entity which should be embedded in client entity types
+//
+// Methods of client entity types can be called by server entities (e.g. CallClient), arguments are unpacked to
+// parameter types of methods.
+type Entity struct {
+	ID       common.EntityID
+	TypeName string
+	IsPlayer bool
+	I        IEntity
+	V        reflect.Value
+	Attrs    map[string]interface{} // client attributes of entity
+	Position Vector3
+	Yaw      float32
+
+	client    *Client
+	destroyed bool
+}
+
+var registeredEntityTypes = map[string]reflect.Type{}
+
+// RegisterEntity registers the client entity type, which should embed Entity
+//
+// Entities of unregistered types are not created on client.
+func RegisterEntity(typeName string, entity IEntity) {
+	entityPtrType := reflect.TypeOf(entity)
+	if entityPtrType.Kind() != reflect.Ptr || entityPtrType.Elem().Kind() != reflect.Struct {
+		gwlog.Panicf("RegisterEntity %s: %T is not a pointer to struct", typeName, entity)
+	}
+
+	entityType := entityPtrType.Elem()
+	if field, ok := entityType.FieldByName("Entity"); !ok || !field.Anonymous || field.Type != reflect.TypeOf(Entity{}) {
+		gwlog.Panicf("RegisterEntity %s: %s should embed client.Entity", typeName, entityType)
+	}
+
+	if _, ok := registeredEntityTypes[typeName]; ok {
+		gwlog.Panicf("RegisterEntity %s: already registered", typeName)
+	}
+
+	registeredEntityTypes[typeName] = entityType
+}
+
+func createEntity(client *Client, typeName string, id common.EntityID, isPlayer bool, attrs map[string]interface{}, pos Vector3, yaw float32) *Entity {
+	entityType := registeredEntityTypes[typeName]
+	if entityType == nil {
+		gwlog.Warnf("%s: entity type %s is not registered, entity %s is not created", client, typeName, id)
+		return nil
+	}
+
+	if attrs == nil {
+		attrs = map[string]interface{}{}
+	}
+
+	entityInstance := reflect.New(entityType)
+	e := reflect.Indirect(entityInstance).FieldByName("Entity").Addr().Interface().(*Entity)
+	e.ID = id
+	e.TypeName = typeName
+	e.IsPlayer = isPlayer
+	e.I = entityInstance.Interface().(IEntity)
+	e.V = entityInstance
+	e.Attrs = attrs
+	e.Position = pos
+	e.Yaw = yaw
+	e.client = client
+	return e
+}
+
+func (e *Entity) String() string {
+	return fmt.Sprintf("%s<%s>", e.TypeName, e.ID)
+}
+
+// GetClient returns the client of entity
+func (e *Entity) GetClient() *Client {
+	return e.client
+}
+
+// IsDestroyed returns if the entity is destroyed
+func (e *Entity) IsDestroyed() bool {
+	return e.destroyed
+}
+
+// CallServer calls the method of entity on server
+//
+// The method should be exposed to client on server (e.g. named with suffix _Client)
+func (e *Entity) CallServer(method string, args ...interface{}) {
+	e.client.conn.SendCallEntityMethodFromClient(e.ID, method, args)
+}
+
+// SyncPositionYaw sets position and yaw of the entity and syncs them to server
+//
+// Position and yaw are only accepted by server for the player entity or entities with client syncing enabled
+func (e *Entity) SyncPositionYaw(pos Vector3, yaw float32) {
+	e.Position = pos
+	e.Yaw = yaw
+	e.client.conn.SendSyncPositionYawFromClient(e.ID, pos.X, pos.Y, pos.Z, yaw)
+}
+
+func (e *Entity) onPositionYawSynced(pos Vector3, yaw float32) {
+	e.Position = pos
+	e.Yaw = yaw
+	e.I.OnPositionYawSynced()
+}
+
+func (e *Entity) onCallFromServer(methodName string, args [][]byte) {
+	method := e.V.MethodByName(methodName)
+	if !method.IsValid() {
+		gwlog.Errorf("%s: method %s is not found", e, methodName)
+		return
+	}
+
+	methodType := method.Type()
+	if methodType.NumIn() != len(args) {
+		gwlog.Errorf("%s.%s: %d arguments expected, but %d received", e, methodName, methodType.NumIn(), len(args))
+		return
+	}
+
+	in := make([]reflect.Value, len(args))
+	for i, arg := range args {
+		argVal := reflect.New(methodType.In(i))
+		if err := netutil.MSG_PACKER.UnpackMsg(arg, argVal.Interface()); err != nil {
+			gwlog.Errorf("%s.%s: unpack argument %d failed: %s", e, methodName, i, err)
+			return
+		}
+		in[i] = argVal.Elem()
+	}
+	method.Call(in)
+}
+
+// OnCreated is called when entity is created on client
+func (e *Entity) OnCreated() {
+}
+
+// OnDestroy is called when entity is destroyed on client
+func (e *Entity) OnDestroy() {
+}
+
+// OnAttrChanged is called after attribute change is applied to Attrs
+//
+// change.Path is the path from the changed attribute to the top level attribute, as it is sent by server
+func (e *Entity) OnAttrChanged(change proto.AttrChange) {
+}
+
+// OnPositionYawSynced is called after position and yaw are synced from server
+func (e *Entity) OnPositionYawSynced() {
+}
@@ -0,0 +1,269 @@
+package instance
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sagacao/goworld"
+	"github.com/sagacao/goworld/engine/common"
+	"github.com/sagacao/goworld/engine/entity"
+	"github.com/sagacao/goworld/engine/gwlog"
+)
+
+const (
+	// ServiceName is the name of the instance service
+	ServiceName = "InstanceService"
+
+	_AGENT_TYPE_NAME     = "InstanceAgent"
+	_REQUEST_TIMEOUT     = time.Second * 30 // callbacks of requests are called with ErrRequestTimeout if not replied in time
+	_RESERVATION_TIMEOUT = time.Second * 30 // allocated entities should enter the instance in time, or their rooms are released
+	_DEFAULT_IDLE_TTL    = time.Minute
+	_CHECK_IDLE_INTERVAL = time.Second
+)
+
+// ErrRequestTimeout is passed to the callback of RequestInstance if the instance service does not reply in time
+var ErrRequestTimeout = errors.New("instance request timeout")
+
+// KindConfig is the config of instances of a space kind
+type KindConfig struct {
+	Capacity int           // max number of entities allocated into each instance, 0 for unlimited
+	IdleTTL  time.Duration // empty instances are destroyed after IdleTTL, default to 1 minute
+	GameID   uint16        // the game to create instances on, 0 for any game
+}
+
+var kindConfigs = map[int]KindConfig{}
+
+// SetKindConfig sets the config of instances of the space kind, only kinds with config can be requested
+//
+// SetKindConfig should be called on all games before goworld.Run
+func SetKindConfig(kind int, cfg KindConfig) {
+	if kind == 0 {
+		gwlog.Panicf("instance: nil space can not be used as instances")
+	}
+	kindConfigs[kind] = cfg
+}
+
+// RegisterService registers the instance service and the agent entity type which receives replies of requests
+func RegisterService() {
+	goworld.RegisterService(ServiceName, &InstanceService{})
+	goworld.RegisterEntity(_AGENT_TYPE_NAME, &InstanceAgent{})
+}
+
+// RequestInstance allocates entities into an instance of the space kind and makes them enter the instance
+//
+// Partially filled instances are reused if they have enough room, otherwise a new instance is created by
+// goworld.CreateSpaceOnGame. callback is called on this game with the ID of the instance space when entities are
+// entering the instance, or with an error if the request fails.
+func RequestInstance(kind int, entityIDs []common.EntityID, callback func(spaceID common.EntityID, err error)) {
+	agent := getAgent()
+	agent.lastRequestID += 1
+	reqid := agent.lastRequestID
+	agent.callbacks[reqid] = callback
+	agent.AddCallback(_REQUEST_TIMEOUT, "OnRequestTimeout", reqid)
+
+	members := make([]interface{}, len(entityIDs))
+	for i, eid := range entityIDs {
+		members[i] = eid
+	}
+	goworld.CallService(ServiceName, "RequestInstance", agent.ID, reqid, kind, members)
+}
+
+// InstanceService is the service entity which maintains instances of all kinds
+//
+// The service should not be sharded, since all instances are maintained in one place.
+type InstanceService struct {
+	entity.Entity
+	pool *instancePool
+}
+
+// DescribeEntityType describes InstanceService
+func (s *InstanceService) DescribeEntityType(desc *entity.EntityTypeDesc) {
+}
+
+// OnInit initializes InstanceService fields
+func (s *InstanceService) OnInit() {
+	s.pool = newInstancePool(kindConfigs)
+}
+
+// OnCreated is called when InstanceService is created
+func (s *InstanceService) OnCreated() {
+	gwlog.Infof("Registering InstanceService ...")
+	s.AddTimer(_CHECK_IDLE_INTERVAL, "CheckIdleInstances")
+}
+
+// RequestInstance is called by RequestInstance to allocate members into an instance of the kind
+func (s *InstanceService) RequestInstance(agentID common.EntityID, reqid int64, kind int, members []interface{}) {
+	req := &instanceRequest{AgentID: agentID, RequestID: reqid, Members: make([]common.EntityID, 0, len(members))}
+	for _, m := range members {
+		switch eid := m.(type) {
+		case common.EntityID:
+			req.Members = append(req.Members, eid)
+		case string:
+			req.Members = append(req.Members, common.EntityID(eid))
+		default:
+			gwlog.Panicf("%s.RequestInstance: invalid entity ID %v", s, m)
+		}
+	}
+
+	now := time.Now()
+	inst, err := s.pool.allocate(kind, req, now)
+	if err != nil {
+		s.reply(req, "", err)
+		return
+	}
+
+	if inst == nil {
+		spaceID := goworld.CreateSpaceOnGame(kindConfigs[kind].GameID, kind)
+		gwlog.Infof("%s: creating instance %s of kind %d for %v", s, spaceID, kind, req.Members)
+		inst = s.pool.add(kind, spaceID, req, now)
+	}
+
+	if inst.Ready {
+		s.dispatch(inst.SpaceID, req)
+	} else {
+		inst.pending = append(inst.pending, req)
+	}
+}
+
+// dispatch makes members of the request enter the instance and replies to the requester
+func (s *InstanceService) dispatch(spaceID common.EntityID, req *instanceRequest) {
+	for _, eid := range req.Members {
+		// position is omitted, so members enter the instance at the origin
+		s.Call(eid, "EnterSpace", spaceID)
+	}
+	s.reply(req, spaceID, nil)
+}
+
+func (s *InstanceService) reply(req *instanceRequest, spaceID common.EntityID, err error) {
+	errmsg := ""
+	if err != nil {
+		errmsg = err.Error()
+		gwlog.Warnf("%s: request %d of %s failed: %s", s, req.RequestID, req.AgentID, errmsg)
+	}
+	s.Call(req.AgentID, "OnInstanceAllocated", req.RequestID, spaceID, errmsg)
+}
+
+// OnInstanceReady is called by the instance space when it is created
+func (s *InstanceService) OnInstanceReady(spaceID common.EntityID, kind int, count int) {
+	for _, req := range s.pool.setReady(kind, spaceID, count, time.Now()) {
+		s.dispatch(spaceID, req)
+	}
+}
+
+// OnInstanceEntityCount is called by the instance space when an entity enters or leaves the space
+func (s *InstanceService) OnInstanceEntityCount(spaceID common.EntityID, count int, entered common.EntityID) {
+	s.pool.setCount(spaceID, count, entered)
+}
+
+// OnInstanceDestroyed is called by the instance space when it is destroyed
+func (s *InstanceService) OnInstanceDestroyed(spaceID common.EntityID) {
+	for _, req := range s.pool.remove(spaceID) {
+		s.reply(req, "", errors.Errorf("instance %s is destroyed", spaceID))
+	}
+}
+
+// CheckIdleInstances destroys instances which are idle for too long
+func (s *InstanceService) CheckIdleInstances() {
+	for _, spaceID := range s.pool.collectIdle(time.Now()) {
+		gwlog.Infof("%s: destroying idle instance %s", s, spaceID)
+		s.Call(spaceID, "Destroy")
+	}
+}
+
+// InstanceAgent receives replies of requests from the instance service for this game
+type InstanceAgent struct {
+	entity.Entity
+	lastRequestID int64
+	callbacks     map[int64]func(spaceID common.EntityID, err error)
+}
+
+var agent *InstanceAgent
+
+func getAgent() *InstanceAgent {
+	if agent == nil || agent.IsDestroyed() {
+		agent = goworld.CreateEntityLocally(_AGENT_TYPE_NAME).I.(*InstanceAgent)
+	}
+	return agent
+}
+
+// DescribeEntityType describes InstanceAgent
+func (a *InstanceAgent) DescribeEntityType(desc *entity.EntityTypeDesc) {
+}
+
+// OnInit initializes InstanceAgent fields
+func (a *InstanceAgent) OnInit() {
+	a.callbacks = map[int64]func(spaceID common.EntityID, err error){}
+}
+
+// OnRestored is called when the agent is restored after the game is reloaded, callbacks of pending requests are lost
+func (a *InstanceAgent) OnRestored() {
+	agent = a
+}
+
+// OnInstanceAllocated is called by the instance service when the request is handled
+func (a *InstanceAgent) OnInstanceAllocated(reqid int64, spaceID common.EntityID, errmsg string) {
+	var err error
+	if errmsg != "" {
+		err = errors.New(errmsg)
+	}
+	a.invokeCallback(reqid, spaceID, err)
+}
+
+// OnRequestTimeout is called when the request is not replied in time
+func (a *InstanceAgent) OnRequestTimeout(reqid int64) {
+	a.invokeCallback(reqid, "", ErrRequestTimeout)
+}
+
+func (a *InstanceAgent) invokeCallback(reqid int64, spaceID common.EntityID, err error) {
+	callback, ok := a.callbacks[reqid]
+	if !ok {
+		return // already replied or timeout
+	}
+	delete(a.callbacks, reqid)
+	callback(spaceID, err)
+}
+
+// Space reports states of instance spaces to the instance service
+//
+// Custom space type should embed Space instead of goworld.Space to use instances. If OnSpaceCreated,
+// OnSpaceDestroy, OnEntityEnterSpace or OnEntityLeaveSpace is overridden, the method of Space should also be called.
+type Space struct {
+	entity.Space
+}
+
+func (space *Space) isInstance() bool {
+	_, ok := kindConfigs[space.Kind]
+	return ok
+}
+
+// OnSpaceCreated reports the instance space is ready
+func (space *Space) OnSpaceCreated() {
+	space.Space.OnSpaceCreated()
+	if space.isInstance() {
+		goworld.CallService(ServiceName, "OnInstanceReady", space.ID, space.Kind, space.GetEntityCount())
+	}
+}
+
+// OnSpaceDestroy reports the instance space is destroyed
+func (space *Space) OnSpaceDestroy() {
+	space.Space.OnSpaceDestroy()
+	if space.isInstance() {
+		goworld.CallService(ServiceName, "OnInstanceDestroyed", space.ID)
+	}
+}
+
+// OnEntityEnterSpace reports the number of entities in the instance space
+func (space *Space) OnEntityEnterSpace(e *entity.Entity) {
+	space.Space.OnEntityEnterSpace(e)
+	if space.isInstance() {
+		goworld.CallService(ServiceName, "OnInstanceEntityCount", space.ID, space.GetEntityCount(), e.ID)
+	}
+}
+
+// OnEntityLeaveSpace reports the number of entities in the instance space
+func (space *Space) OnEntityLeaveSpace(e *entity.Entity) {
+	space.Space.OnEntityLeaveSpace(e)
+	if space.isInstance() {
+		goworld.CallService(ServiceName, "OnInstanceEntityCount", space.ID, space.GetEntityCount(), common.EntityID(""))
+	}
+}
@@ -0,0 +1,168 @@
+package instance
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sagacao/goworld/engine/common"
+)
+
+// instanceInfo is the state of an instance space maintained by the instance service
+type instanceInfo struct {
+	Kind      int
+	SpaceID   common.EntityID
+	Ready     bool                          // the space is created and reported to the service
+	Count     int                           // number of entities in the space, reported by the space
+	reserved  map[common.EntityID]time.Time // entities allocated into the instance but not entered yet, with deadlines
+	pending   []*instanceRequest            // requests waiting for the space to be ready
+	idleSince time.Time                     // the time since which the instance is empty, zero if not idle
+}
+
+// load returns the number of entities in or allocated into the instance
+func (inst *instanceInfo) load() int {
+	return inst.Count + len(inst.reserved)
+}
+
+// instanceRequest is a request of allocating entities into an instance
+type instanceRequest struct {
+	AgentID   common.EntityID
+	RequestID int64
+	Members   []common.EntityID
+}
+
+// instancePool maintains instances of all kinds and allocates entities into instances
+type instancePool struct {
+	kinds     map[int]KindConfig
+	instances map[common.EntityID]*instanceInfo
+}
+
+func newInstancePool(kinds map[int]KindConfig) *instancePool {
+	return &instancePool{
+		kinds:     kinds,
+		instances: map[common.EntityID]*instanceInfo{},
+	}
+}
+
+// allocate chooses an instance of kind which has enough room for the request, returns nil if a new instance should be created
+//
+// Partially filled instances are preferred, so that entities gather in fewer instances.
+func (pool *instancePool) allocate(kind int, req *instanceRequest, now time.Time) (*instanceInfo, error) {
+	cfg, ok := pool.kinds[kind]
+	if !ok {
+		return nil, errors.Errorf("instance kind %d is not configured", kind)
+	}
+	if cfg.Capacity > 0 && len(req.Members) > cfg.Capacity {
+		return nil, errors.Errorf("%d entities exceed the capacity %d of instance kind %d", len(req.Members), cfg.Capacity, kind)
+	}
+
+	var chosen *instanceInfo
+	for _, inst := range pool.instances {
+		if inst.Kind != kind {
+			continue
+		}
+		inst.expireReservations(now)
+		if cfg.Capacity > 0 && inst.load()+len(req.Members) > cfg.Capacity {
+			continue
+		}
+		if chosen == nil || inst.load() > chosen.load() || (inst.load() == chosen.load() && inst.SpaceID < chosen.SpaceID) {
+			chosen = inst
+		}
+	}
+
+	if chosen != nil {
+		chosen.reserve(req.Members, now)
+	}
+	return chosen, nil
+}
+
+// add adds the instance which is being created for the request
+func (pool *instancePool) add(kind int, spaceID common.EntityID, req *instanceRequest, now time.Time) *instanceInfo {
+	inst := &instanceInfo{
+		Kind:     kind,
+		SpaceID:  spaceID,
+		reserved: map[common.EntityID]time.Time{},
+	}
+	inst.reserve(req.Members, now)
+	pool.instances[spaceID] = inst
+	return inst
+}
+
+func (inst *instanceInfo) reserve(members []common.EntityID, now time.Time) {
+	for _, eid := range members {
+		inst.reserved[eid] = now.Add(_RESERVATION_TIMEOUT)
+	}
+	inst.idleSince = time.Time{}
+}
+
+func (inst *instanceInfo) expireReservations(now time.Time) {
+	for eid, deadline := range inst.reserved {
+		if now.After(deadline) {
+			delete(inst.reserved, eid)
+		}
+	}
+}
+
+// setReady marks the instance as ready, returns pending requests which should be dispatched now
+func (pool *instancePool) setReady(kind int, spaceID common.EntityID, count int, now time.Time) []*instanceRequest {
+	inst := pool.instances[spaceID]
+	if inst == nil {
+		// the instance is not created by the pool (e.g. the service is restarted), but it can still be used
+		inst = &instanceInfo{Kind: kind, SpaceID: spaceID, reserved: map[common.EntityID]time.Time{}}
+		pool.instances[spaceID] = inst
+	}
+	inst.Ready = true
+	inst.Count = count
+	pending := inst.pending
+	inst.pending = nil
+	return pending
+}
+
+// setCount updates the number of entities in the instance, the entered entity is not reserved any more
+func (pool *instancePool) setCount(spaceID common.EntityID, count int, entered common.EntityID) {
+	inst := pool.instances[spaceID]
+	if inst == nil {
+		return
+	}
+	inst.Count = count
+	if !entered.IsNil() {
+		delete(inst.reserved, entered)
+	}
+}
+
+// remove removes the instance, returns pending requests which can not be dispatched any more
+func (pool *instancePool) remove(spaceID common.EntityID) []*instanceRequest {
+	inst := pool.instances[spaceID]
+	if inst == nil {
+		return nil
+	}
+	delete(pool.instances, spaceID)
+	return inst.pending
+}
+
+// collectIdle removes instances which are idle for longer than the idle TTL of their kinds, returns their space IDs
+func (pool *instancePool) collectIdle(now time.Time) []common.EntityID {
+	var idle []common.EntityID
+	for spaceID, inst := range pool.instances {
+		if !inst.Ready {
+			continue
+		}
+		inst.expireReservations(now)
+		if inst.load() > 0 {
+			inst.idleSince = time.Time{}
+			continue
+		}
+		if inst.idleSince.IsZero() {
+			inst.idleSince = now
+		}
+
+		ttl := pool.kinds[inst.Kind].IdleTTL
+		if ttl <= 0 {
+			ttl = _DEFAULT_IDLE_TTL
+		}
+		if now.Sub(inst.idleSince) >= ttl {
+			delete(pool.instances, spaceID)
+			idle = append(idle, spaceID)
+		}
+	}
+	return idle
+}
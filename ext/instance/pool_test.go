@@ -0,0 +1,68 @@
+package instance
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sagacao/goworld/engine/common"
+)
+
+func makeRequest(n int) *instanceRequest {
+	req := &instanceRequest{AgentID: common.GenEntityID()}
+	for i := 0; i < n; i++ {
+		req.Members = append(req.Members, common.GenEntityID())
+	}
+	return req
+}
+
+func TestInstancePool(t *testing.T) {
+	pool := newInstancePool(map[int]KindConfig{1: {Capacity: 4, IdleTTL: time.Minute}})
+	now := time.Now()
+
+	if _, err := pool.allocate(2, makeRequest(1), now); err == nil {
+		t.Fatalf("kind 2 is not configured")
+	}
+	if _, err := pool.allocate(1, makeRequest(5), now); err == nil {
+		t.Fatalf("request should not exceed capacity")
+	}
+
+	// create a new instance for the first request, and pending until the space is ready
+	req1 := makeRequest(3)
+	if inst, err := pool.allocate(1, req1, now); inst != nil || err != nil {
+		t.Fatalf("a new instance should be created, but got %v, %v", inst, err)
+	}
+	space1 := common.GenEntityID()
+	inst1 := pool.add(1, space1, req1, now)
+	inst1.pending = append(inst1.pending, req1)
+	if pending := pool.setReady(1, space1, 0, now); len(pending) != 1 || pending[0] != req1 || !inst1.Ready {
+		t.Fatalf("pending requests should be dispatched when the instance is ready")
+	}
+
+	// the partially filled instance is reused
+	req2 := makeRequest(1)
+	if inst, _ := pool.allocate(1, req2, now); inst != inst1 || inst1.load() != 4 {
+		t.Fatalf("partially filled instance should be reused")
+	}
+	if inst, _ := pool.allocate(1, makeRequest(1), now); inst != nil {
+		t.Fatalf("full instance should not be reused")
+	}
+
+	// entered entities are not reserved any more
+	pool.setCount(space1, 1, req1.Members[0])
+	if inst1.load() != 4 || len(inst1.reserved) != 3 {
+		t.Fatalf("wrong load after entity entered: %d", inst1.load())
+	}
+
+	// reservations expire, and empty instances are destroyed after idle TTL
+	now = now.Add(_RESERVATION_TIMEOUT + time.Second)
+	pool.setCount(space1, 0, "")
+	if idle := pool.collectIdle(now); len(idle) != 0 {
+		t.Fatalf("instance should not be destroyed before idle TTL")
+	}
+	if idle := pool.collectIdle(now.Add(time.Minute)); len(idle) != 1 || idle[0] != space1 {
+		t.Fatalf("idle instance should be destroyed, but got %v", idle)
+	}
+	if len(pool.instances) != 0 {
+		t.Fatalf("idle instance should be removed")
+	}
+}
@@ -23,6 +23,9 @@ type Entity = entity.Entity
 // Space is the type of spaces
 type Space = entity.Space
 
+// SpacePartition is the config of partitioned spaces
+type SpacePartition = entity.SpacePartition
+
 // EntityID is a global unique ID for entities and spaces.
 // EntityID is unique in the whole game server, and also unique across multiple games.
 type EntityID = common.EntityID
@@ -45,8 +48,10 @@ func RegisterEntity(typeName string, entityPtr entity.IEntity) *entity.EntityTyp
 
 // RegisterService registeres an service type
 // After registeration, the service entity will be created automatically on some game
-func RegisterService(typeName string, entityPtr entity.IEntity) {
-	service.RegisterService(typeName, entityPtr)
+//
+// Returns the service description object which can be used to set the number of shards of the service
+func RegisterService(typeName string, entityPtr entity.IEntity) *service.ServiceDesc {
+	return service.RegisterService(typeName, entityPtr)
 }
 
 // CreateSpaceAnywhere creates a space with specified kind in any game server
@@ -68,6 +73,27 @@ func CreateSpaceOnGame(gameid uint16, kind int) EntityID {
 	return entity.CreateSpaceSomewhere(gameid, kind)
 }
 
+// SetSpacePartition sets the partition config of the space kind, spaces of the kind can be created by CreatePartitionedSpace
+//
+// SetSpacePartition should be called on all games before Run
+func SetSpacePartition(kind int, partition SpacePartition) {
+	entity.SetSpacePartition(kind, partition)
+}
+
+// CreatePartitionedSpace creates a space of the kind which is split into cells on multiple games
+//
+// returns the world ID of the partitioned space
+func CreatePartitionedSpace(kind int) EntityID {
+	return entity.CreatePartitionedSpace(kind)
+}
+
+// GetPartitionCellID returns the ID of the cell space containing the position in the partitioned space
+//
+// Entities enter the partitioned space by `e.EnterSpace(GetPartitionCellID(kind, worldID, pos), pos)`
+func GetPartitionCellID(kind int, worldID EntityID, pos Vector3) EntityID {
+	return entity.GetPartitionCellID(kind, worldID, pos)
+}
+
 // CreateEntityLocally creates a entity on the local server
 //
 // returns EntityID
@@ -108,6 +134,20 @@ func ListEntityIDs(typeName string, callback storage.ListCallbackFunc) {
 	storage.ListEntityIDs(typeName, callback)
 }
 
+// FindEntityIDsByAttr finds IDs of saved entities of which the attribute equals to value
+//
+// The attribute should be indexed by EntityTypeDesc.DefineIndex. returns result in callback
+func FindEntityIDsByAttr(typeName string, attr string, value interface{}, callback storage.ListCallbackFunc) {
+	storage.FindByAttr(typeName, attr, value, callback)
+}
+
+// DeleteEntityData deletes data of the entity from entity storage
+//
+// The entity should not be loaded, otherwise data is saved again. Use Entity.DestroyAndDelete to delete loaded entities
+func DeleteEntityData(typeName string, entityID EntityID, callback storage.SaveCallbackFunc) {
+	storage.Delete(typeName, entityID, callback)
+}
+
 // Exists checks if entityID exists in entity storage
 //
 // returns result in callback
@@ -160,16 +200,31 @@ func Call(id EntityID, method string, args ...interface{}) {
 	entity.Call(id, method, args)
 }
 
-// CallService calls a service entity
+// CallService calls a service entity, shards of the service are called in round-robin
 func CallService(serviceName string, method string, args ...interface{}) {
 	service.CallService(serviceName, method, args)
 }
 
-// GetServiceEntityID returns the entityid of the service
-func GetServiceEntityID(serviceName string) common.EntityID {
+// CallServiceShardKey calls the shard of the service chosen by consistent hash of shardKey
+func CallServiceShardKey(serviceName string, shardKey string, method string, args ...interface{}) {
+	service.CallServiceShardKey(serviceName, shardKey, method, args)
+}
+
+// CallServiceShardIndex calls the specified shard of the service
+func CallServiceShardIndex(serviceName string, shard int, method string, args ...interface{}) {
+	service.CallServiceShardIndex(serviceName, shard, method, args)
+}
+
+// GetServiceEntityID returns entity IDs of all shards of the service
+func GetServiceEntityID(serviceName string) []common.EntityID {
 	return service.GetServiceEntityID(serviceName)
 }
 
+// GetServiceShardCount returns the number of shards of the service
+func GetServiceShardCount(serviceName string) int {
+	return service.GetServiceShardCount(serviceName)
+}
+
 // CallNilSpaces calls methods of all nil spaces on all games
 func CallNilSpaces(method string, args ...interface{}) {
 	entity.CallNilSpaces(method, args, game.GetGameID())
@@ -214,6 +269,31 @@ func GetOrPutKVDB(key string, val string, callback kvdb.KVDBGetOrPutCallback) {
 	kvdb.GetOrPut(key, val, callback)
 }
 
+// DeleteKVDB deletes key from KVDB
+func DeleteKVDB(key string, callback kvdb.KVDBPutCallback) {
+	kvdb.Delete(key, callback)
+}
+
+// CompareAndSwapKVDB sets value of key to newVal atomically if the current value is oldVal ("" means key not exists)
+func CompareAndSwapKVDB(key string, oldVal string, newVal string, callback kvdb.KVDBCompareAndSwapCallback) {
+	kvdb.CompareAndSwap(key, oldVal, newVal, callback)
+}
+
+// PutIfAbsentKVDB puts key-value to KVDB atomically if key not exists, the key expires after ttl if ttl > 0
+func PutIfAbsentKVDB(key string, val string, ttl time.Duration, callback kvdb.KVDBGetOrPutCallback) {
+	kvdb.PutIfAbsent(key, val, ttl, callback)
+}
+
+// IncrKVDB increases the integer value of key by delta atomically
+func IncrKVDB(key string, delta int64, callback kvdb.KVDBIncrCallback) {
+	kvdb.Incr(key, delta, callback)
+}
+
+// ExpireKVDB sets TTL of key in KVDB, ttl <= 0 removes the TTL
+func ExpireKVDB(key string, ttl time.Duration, callback kvdb.KVDBPutCallback) {
+	kvdb.Expire(key, ttl, callback)
+}
+
 // GetOnlineGames returns all online game IDs
 func GetOnlineGames() common.Uint16Set {
 	return game.GetOnlineGames()
@@ -246,3 +326,19 @@ func Post(callback post.PostCallback) {
 func RegisterCrontab(minute, hour, day, month, dayofweek int, cb func()) {
 	crontab.Register(minute, hour, day, month, dayofweek, cb)
 }
+
+// RegisterCrontabSpec registers a callback which will be executed when the time matches the cron spec on this game
+//
+// spec is a standard cron string like "*/5 9-18 * * 1-5", and the time zone can be specified like "CRON_TZ=UTC 0 4 * * *"
+func RegisterCrontabSpec(spec string, cb func()) error {
+	_, err := crontab.RegisterSpec(spec, cb)
+	return err
+}
+
+// RegisterCrontabSingleton registers a job which runs on only one game of the cluster each time the cron spec matches
+//
+// All games should register the job with the same name and spec, e.g. for daily resets
+func RegisterCrontabSingleton(name string, spec string, cb func()) error {
+	_, err := crontab.RegisterSingleton(name, spec, cb)
+	return err
+}